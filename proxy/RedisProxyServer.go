@@ -1,24 +1,71 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"github.com/Mansfield6/tikv-proxy-demo/proxy/config"
 	"github.com/Mansfield6/tikv-proxy-demo/proxy/handler"
 	"github.com/Mansfield6/tikv-proxy-demo/proxy/redis"
 	"github.com/ngaut/log"
 	"github.com/pingcap/tidb/store/tikv"
-	"strings"
+	"github.com/prometheus/client_golang/prometheus"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 )
 
 var (
-	serverPort = flag.Int("port", 6379, "listen port,default: 6379")
-	pdAddr     = flag.String("pd", "localhost:2379", "pd address,default:localhost:2379")
-	logPath    = flag.String("lp", "", "log file path, if empty, default:stdout")
-	logLevel   = flag.String("ll", "info", "log level:INFO|WARN|ERROR default:INFO")
+	configFile = flag.String("config", "", "config file in the format of redis.conf, the flags given take precedence over it")
+
+	_ = flag.Int("port", config.Port.Get(), "listen port,default: 6379")
+	_ = flag.String("pd", config.PDAddr.Get(), "pd address,default:localhost:2379")
+	_ = flag.String("lp", config.LogFile.Get(), "log file path, if empty, default:stdout")
+	_ = flag.String("ll", config.LogLevel.Get(), "log level:INFO|WARN|ERROR default:INFO")
+
+	_ = flag.String("metrics-addr", config.MetricsAddr.Get(), "address of the http endpoint serving the prometheus metrics at /metrics, empty disables it")
+
+	_ = flag.Int("tls-port", config.TLSPort.Get(), "tls listen port, 0 disables tls; with -port 0 only tls is served")
+	_ = flag.String("tls-cert", config.TLSCertFile.Get(), "tls certificate file of the server, PEM")
+	_ = flag.String("tls-key", config.TLSKeyFile.Get(), "tls private key file of the server, PEM")
+	_ = flag.String("tls-ca", config.TLSCAFile.Get(), "tls CA bundle client certificates are verified with, PEM")
+	_ = flag.Bool("tls-auth-clients", config.TLSAuthClients.Get(), "require clients to present a certificate signed by -tls-ca")
+	_ = flag.String("tls-min-version", config.TLSMinVersion.Get(), "lowest tls version accepted: 1.0|1.1|1.2|1.3")
 )
 
+// flagParams maps the flags to the params of the config they set.
+var flagParams = map[string]*config.Param{
+	"port":             config.Port.Param,
+	"pd":               config.PDAddr.Param,
+	"lp":               config.LogFile.Param,
+	"ll":               config.LogLevel.Param,
+	"metrics-addr":     config.MetricsAddr.Param,
+	"tls-port":         config.TLSPort.Param,
+	"tls-cert":         config.TLSCertFile.Param,
+	"tls-key":          config.TLSKeyFile.Param,
+	"tls-ca":           config.TLSCAFile.Param,
+	"tls-auth-clients": config.TLSAuthClients.Param,
+	"tls-min-version":  config.TLSMinVersion.Param,
+}
+
+// loadConfig loads the config file and the flags given on top of it.
+func loadConfig() error {
+	overrides := make(map[string]string)
+	flag.Visit(func(f *flag.Flag) {
+		if p := flagParams[f.Name]; p != nil {
+			overrides[p.Name] = f.Value.String()
+		}
+	})
+	return config.Load(*configFile, overrides)
+}
+
 func main() {
 	flag.Parse()
+	if err := loadConfig(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
 
 	defer func() {
 		if msg := recover(); msg != nil {
@@ -28,48 +75,105 @@ func main() {
 
 	initlog()
 
-	log.Info("serverPort:", *serverPort)
-	log.Info("pdAddr:", *pdAddr)
-	log.Info("logpath:", *logPath)
-	log.Info("logpaht:", *logLevel)
+	log.Info("config:", config.Path())
+	log.Info("serverPort:", config.Port.Get())
+	log.Info("pdAddr:", config.PDAddr.Get())
+	log.Info("logpath:", config.LogFile.Get())
+	log.Info("logpaht:", config.LogLevel.Get())
 
 	driver := tikv.Driver{}
-	store, err := driver.Open(fmt.Sprintf("tikv://%s?cluster=1", *pdAddr))
+	store, err := driver.Open(fmt.Sprintf("tikv://%s?cluster=1", config.PDAddr.Get()))
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	myhandler := &handler.TxTikvHandler{store}
+	myhandler := handler.NewTxTikvHandler(store)
 
-	srv, err := redis.NewServer(redis.DefaultConfig().Port(*serverPort).Handler(myhandler))
+	serverConfig := redis.DefaultConfig().Port(config.Port.Get()).Handler(myhandler).ACLStore(handler.NewACLStore(store)).
+		PubSubLog(handler.NewPubSubLog(store))
+	if config.TLSPort.Get() != 0 {
+		serverConfig.TLSPort(config.TLSPort.Get()).TLSCert(config.TLSCertFile.Get(), config.TLSKeyFile.Get()).
+			TLSCA(config.TLSCAFile.Get()).TLSAuthClients(config.TLSAuthClients.Get()).
+			TLSMinVersion(config.TLSMinVersion.Get())
+	}
+	srv, err := redis.NewServer(serverConfig)
 	if err != nil {
 		panic(err)
 	}
+	go reloadOnSignal(srv)
+	if addr := config.MetricsAddr.Get(); addr != "" {
+		go serveMetrics(addr)
+	}
 
-	if err := srv.ListenAndServe(); err != nil {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		shutdownOnSignal(srv)
+	}()
+	if err := srv.ListenAndServe(); err != redis.ErrServerClosed {
 		panic(err)
 	}
+	<-done
+	if err := store.Close(); err != nil {
+		log.Errorf("close store failed - %s", err)
+	}
+	log.Info("server stopped")
+}
+
+// shutdownOnSignal shuts the server down on SIGTERM or SIGINT, the commands
+// being served get config.ShutdownTimeout to finish.
+func shutdownOnSignal(srv *redis.Server) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-c
+	log.Infof("got signal %s, shutting down", sig)
+	ctx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout.Get())
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Errorf("shutdown failed - %s", err)
+	}
+}
+
+// reloadOnSignal reloads the config file and the tls certificates on SIGHUP.
+func reloadOnSignal(srv *redis.Server) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	for range c {
+		if err := config.Reload(); err != nil {
+			log.Errorf("reload config failed - %s", err)
+		} else if config.Path() != "" {
+			log.Info("config reloaded")
+		}
+		if config.TLSPort.Get() == 0 {
+			continue
+		}
+		if err := srv.ReloadTLS(); err != nil {
+			log.Errorf("reload tls certificates failed - %s", err)
+			continue
+		}
+		log.Info("tls certificates reloaded")
+	}
+}
+
+// serveMetrics serves the prometheus metrics over http.
+func serveMetrics(addr string) {
+	log.Info("metrics", addr)
+	http.Handle("/metrics", prometheus.Handler())
+	if err := http.ListenAndServe(addr, nil); err != nil {
+		log.Errorf("serve metrics failed - %s", err)
+	}
 }
 
 func initlog() {
-	if len(*logPath) > 0 {
+	if logPath := config.LogFile.Get(); len(logPath) > 0 {
 		log.SetHighlighting(false)
-		err := log.SetOutputByName(*logPath)
+		err := log.SetOutputByName(logPath)
 		if err != nil {
 			log.Fatalf("set log name failed - %s", err)
 		}
 	}
 
-	switch strings.ToUpper(*logLevel) {
-	case "INFO":
-		log.SetLevel(log.LOG_LEVEL_INFO)
-	case "ERROR":
-		log.SetLevel(log.LOG_LEVEL_ERROR)
-	case "WARN":
-		log.SetLevel(log.LOG_LEVEL_WARN)
-	default:
-		log.SetLevel(log.LOG_LEVEL_INFO)
-	}
+	config.SetLogLevel()
 
 	log.SetRotateByDay()
 }
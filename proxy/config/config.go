@@ -0,0 +1,517 @@
+// Package config owns the settings of the proxy. They are read from a config
+// file in the format of redis.conf, a directive and its value on every line,
+// and the mutable ones can be changed at runtime by CONFIG SET or by reloading
+// the file.
+package config
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Mansfield6/tikv-proxy-demo/proxy/util"
+	"github.com/juju/errors"
+	"github.com/ngaut/log"
+)
+
+// value is the value of a param, parse checks a string without changing
+// the value so that several params can be checked before any is set.
+type value interface {
+	String() string
+	parse(s string) (interface{}, error)
+	store(v interface{})
+}
+
+// Param is a setting, a mutable one can be changed while the proxy runs.
+type Param struct {
+	Name    string
+	Mutable bool
+	def     string
+	value   value
+	// apply is called once the value is changed.
+	apply func()
+}
+
+// String gets the value of p as it is written in the config file.
+func (p *Param) String() string {
+	return p.value.String()
+}
+
+var params = make(map[string]*Param)
+
+func register(name string, mutable bool, v value) *Param {
+	p := &Param{Name: name, Mutable: mutable, def: v.String(), value: v}
+	params[name] = p
+	return p
+}
+
+// Int is an integer param within [min, max].
+type Int struct {
+	*Param
+	v        int64
+	min, max int64
+}
+
+func newInt(name string, mutable bool, def int64, min int64, max int64) *Int {
+	i := &Int{v: def, min: min, max: max}
+	i.Param = register(name, mutable, i)
+	return i
+}
+
+// Get gets the value of i.
+func (i *Int) Get() int {
+	return int(atomic.LoadInt64(&i.v))
+}
+
+func (i *Int) String() string {
+	return strconv.FormatInt(atomic.LoadInt64(&i.v), 10)
+}
+
+func (i *Int) parse(s string) (interface{}, error) {
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return nil, errors.New("argument couldn't be parsed into an integer")
+	}
+	if n < i.min || n > i.max {
+		return nil, errors.Errorf("argument must be between %d and %d inclusive", i.min, i.max)
+	}
+	return n, nil
+}
+
+func (i *Int) store(v interface{}) {
+	atomic.StoreInt64(&i.v, v.(int64))
+}
+
+// Duration is a param of a positive duration, written the way Go formats
+// durations, as in 10ms or 1s.
+type Duration struct {
+	*Param
+	v int64
+}
+
+func newDuration(name string, mutable bool, def time.Duration) *Duration {
+	d := &Duration{v: int64(def)}
+	d.Param = register(name, mutable, d)
+	return d
+}
+
+// Get gets the value of d.
+func (d *Duration) Get() time.Duration {
+	return time.Duration(atomic.LoadInt64(&d.v))
+}
+
+func (d *Duration) String() string {
+	return d.Get().String()
+}
+
+func (d *Duration) parse(s string) (interface{}, error) {
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return nil, errors.New("argument couldn't be parsed into a duration")
+	}
+	if v <= 0 {
+		return nil, errors.New("argument must be positive")
+	}
+	return v, nil
+}
+
+func (d *Duration) store(v interface{}) {
+	atomic.StoreInt64(&d.v, int64(v.(time.Duration)))
+}
+
+// Bool is a param of yes or no.
+type Bool struct {
+	*Param
+	v int32
+}
+
+func newBool(name string, mutable bool, def bool) *Bool {
+	b := &Bool{}
+	b.store(def)
+	b.Param = register(name, mutable, b)
+	return b
+}
+
+// Get gets the value of b.
+func (b *Bool) Get() bool {
+	return atomic.LoadInt32(&b.v) != 0
+}
+
+func (b *Bool) String() string {
+	if b.Get() {
+		return "yes"
+	}
+	return "no"
+}
+
+func (b *Bool) parse(s string) (interface{}, error) {
+	switch strings.ToLower(s) {
+	case "yes", "true":
+		return true, nil
+	case "no", "false":
+		return false, nil
+	}
+	return nil, errors.New("argument must be 'yes' or 'no'")
+}
+
+func (b *Bool) store(v interface{}) {
+	var n int32
+	if v.(bool) {
+		n = 1
+	}
+	atomic.StoreInt32(&b.v, n)
+}
+
+// String is a param of a string, one of choices if there are any.
+type String struct {
+	*Param
+	mu      sync.RWMutex
+	v       string
+	choices []string
+}
+
+func newString(name string, mutable bool, def string, choices ...string) *String {
+	s := &String{v: def, choices: choices}
+	s.Param = register(name, mutable, s)
+	return s
+}
+
+// Get gets the value of s.
+func (s *String) Get() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.v
+}
+
+func (s *String) String() string {
+	return s.Get()
+}
+
+func (s *String) parse(v string) (interface{}, error) {
+	if len(s.choices) == 0 {
+		return v, nil
+	}
+	for _, c := range s.choices {
+		if strings.EqualFold(c, v) {
+			return c, nil
+		}
+	}
+	return nil, errors.Errorf("argument must be one of %s", strings.Join(s.choices, ", "))
+}
+
+func (s *String) store(v interface{}) {
+	s.mu.Lock()
+	s.v = v.(string)
+	s.mu.Unlock()
+}
+
+var (
+	// mu serializes the changes of the params and of the config file.
+	mu sync.Mutex
+	// path is the config file, none if empty.
+	path string
+	// overrides are the values given on the command line, they take
+	// precedence over the config file.
+	overrides map[string]string
+)
+
+// Load sets the params from the config file at file, if it is not empty, and
+// then from overrides. The file is read again by Reload and written by
+// Rewrite.
+func Load(file string, over map[string]string) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	var values map[string]string
+	if file != "" {
+		var err error
+		if values, err = readFile(file); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	for name := range over {
+		if params[name] == nil {
+			return errors.Errorf("unknown config '%s'", name)
+		}
+	}
+	path, overrides = file, over
+	return errors.Trace(setAll(merge(values), false))
+}
+
+// Reload reads the config file again and sets the mutable params from it.
+// The immutable params that changed are left as they are until a restart.
+func Reload() error {
+	mu.Lock()
+	defer mu.Unlock()
+	if path == "" {
+		return nil
+	}
+	values, err := readFile(path)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(setAll(merge(values), true))
+}
+
+// merge gets the value of every param, from overrides, values or the
+// default.
+func merge(values map[string]string) map[string]string {
+	all := make(map[string]string, len(params))
+	for name, p := range params {
+		all[name] = p.def
+		if v, ok := values[name]; ok {
+			all[name] = v
+		}
+		if v, ok := overrides[name]; ok {
+			all[name] = v
+		}
+	}
+	return all
+}
+
+func setAll(values map[string]string, reload bool) error {
+	parsed := make(map[*Param]interface{})
+	for name, s := range values {
+		p := params[name]
+		v, err := p.value.parse(s)
+		if err != nil {
+			return errors.Errorf("invalid config '%s' - %s", name, err)
+		}
+		if formatValue(v) == p.String() {
+			continue
+		}
+		if reload && !p.Mutable {
+			log.Warnf("config '%s' changed to '%s', it takes effect after a restart", name, s)
+			continue
+		}
+		parsed[p] = v
+	}
+	apply(parsed)
+	return nil
+}
+
+func formatValue(v interface{}) string {
+	switch v := v.(type) {
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case time.Duration:
+		return v.String()
+	case bool:
+		if v {
+			return "yes"
+		}
+		return "no"
+	}
+	return fmt.Sprint(v)
+}
+
+func apply(parsed map[*Param]interface{}) {
+	for p, v := range parsed {
+		p.value.store(v)
+		log.Infof("config '%s' set to '%s'", p.Name, p.String())
+	}
+	for p := range parsed {
+		if p.apply != nil {
+			p.apply()
+		}
+	}
+}
+
+// Get gets the names and values of the params matching one of patterns,
+// sorted by name.
+func Get(patterns []string) [][2]string {
+	var res [][2]string
+	for name, p := range params {
+		for _, pattern := range patterns {
+			if util.GlobMatch([]byte(strings.ToLower(pattern)), []byte(name)) {
+				res = append(res, [2]string{name, p.String()})
+				break
+			}
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i][0] < res[j][0] })
+	return res
+}
+
+// SetError is the error of Set, it tells the param that could not be set.
+type SetError struct {
+	Name string
+	Err  error
+}
+
+func (e *SetError) Error() string {
+	return e.Err.Error()
+}
+
+var (
+	// ErrUnknown is the error of Set for a name that is not a param.
+	ErrUnknown = errors.New("unknown option")
+	// ErrImmutable is the error of Set for a param that is not mutable.
+	ErrImmutable = errors.New("can't set immutable config")
+	// ErrNoFile is the error of Rewrite without a config file.
+	ErrNoFile = errors.New("The server is running without a config file")
+)
+
+// Set sets the params of pairs of names and values, either all of them or
+// none.
+func Set(pairs [][2]string) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	parsed := make(map[*Param]interface{})
+	for _, pair := range pairs {
+		name := strings.ToLower(pair[0])
+		p := params[name]
+		if p == nil {
+			return &SetError{Name: pair[0], Err: ErrUnknown}
+		}
+		if _, ok := parsed[p]; ok {
+			return &SetError{Name: pair[0], Err: errors.New("duplicate parameter")}
+		}
+		if !p.Mutable {
+			return &SetError{Name: pair[0], Err: ErrImmutable}
+		}
+		v, err := p.value.parse(pair[1])
+		if err != nil {
+			return &SetError{Name: pair[0], Err: err}
+		}
+		parsed[p] = v
+	}
+	apply(parsed)
+	return nil
+}
+
+// Path gets the config file, empty if there is none.
+func Path() string {
+	mu.Lock()
+	defer mu.Unlock()
+	return path
+}
+
+// readFile reads the directives of a config file. A value may be quoted the
+// way Go quotes strings, the last of the directives of a param wins.
+func readFile(file string) (map[string]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer f.Close()
+
+	values := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		name, v, ok, err := parseLine(scanner.Text())
+		if err != nil {
+			return nil, errors.Errorf("%s:%d: %s", file, n, err)
+		}
+		if !ok {
+			continue
+		}
+		if params[name] == nil {
+			return nil, errors.Errorf("%s:%d: unknown directive '%s'", file, n, name)
+		}
+		values[name] = v
+	}
+	return values, errors.Trace(scanner.Err())
+}
+
+// parseLine parses a line of a config file, ok is false for a blank line or
+// a comment.
+func parseLine(line string) (name string, v string, ok bool, err error) {
+	line = strings.TrimSpace(line)
+	if line == "" || line[0] == '#' {
+		return "", "", false, nil
+	}
+	i := strings.IndexAny(line, " \t")
+	if i < 0 {
+		return "", "", false, errors.Errorf("missing the value of '%s'", line)
+	}
+	name, v = strings.ToLower(line[:i]), strings.TrimSpace(line[i+1:])
+	if strings.HasPrefix(v, `"`) {
+		if v, err = strconv.Unquote(v); err != nil {
+			return "", "", false, errors.Errorf("invalid quoted value of '%s'", name)
+		}
+	}
+	return name, v, true, nil
+}
+
+func formatLine(p *Param) string {
+	v := p.String()
+	if v == "" || strings.ContainsAny(v, " \t\"#") {
+		v = strconv.Quote(v)
+	}
+	return p.Name + " " + v
+}
+
+// Rewrite writes the current values to the config file. The lines of the
+// params are updated in place, the params missing from the file are added at
+// its end unless they have their default values, and the comments are kept.
+func Rewrite() error {
+	mu.Lock()
+	defer mu.Unlock()
+	if path == "" {
+		return ErrNoFile
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Trace(err)
+	}
+
+	var lines []string
+	written := make(map[string]bool)
+	if len(data) > 0 {
+		for _, line := range strings.Split(strings.TrimRight(string(data), "\n"), "\n") {
+			name, _, ok, _ := parseLine(line)
+			if !ok || params[name] == nil {
+				lines = append(lines, line)
+				continue
+			}
+			if !written[name] {
+				lines = append(lines, formatLine(params[name]))
+				written[name] = true
+			}
+		}
+	}
+	var added []string
+	for name, p := range params {
+		if !written[name] && p.String() != p.def {
+			added = append(added, formatLine(p))
+		}
+	}
+	sort.Strings(added)
+	lines = append(lines, added...)
+
+	// The file is replaced at once, a crash leaves either version of it.
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".rewrite-")
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if fi, serr := os.Stat(path); serr == nil {
+		err = tmp.Chmod(fi.Mode())
+	}
+	if err == nil {
+		_, err = fmt.Fprintln(tmp, strings.Join(lines, "\n"))
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return errors.Trace(err)
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/pingcap/check"
+)
+
+func TestConfig(t *testing.T) {
+	TestingT(t)
+}
+
+var _ = Suite(&testConfigSuite{})
+
+type testConfigSuite struct {
+	dir string
+}
+
+func (s *testConfigSuite) SetUpTest(c *C) {
+	dir, err := ioutil.TempDir("", "config")
+	c.Assert(err, IsNil)
+	s.dir = dir
+}
+
+func (s *testConfigSuite) TearDownTest(c *C) {
+	// Loading nothing puts every param back to its default.
+	c.Assert(Load("", nil), IsNil)
+	os.RemoveAll(s.dir)
+}
+
+// writeFile writes a config file and gets its path.
+func (s *testConfigSuite) writeFile(c *C, content string) string {
+	file := filepath.Join(s.dir, "proxy.conf")
+	c.Assert(ioutil.WriteFile(file, []byte(content), 0644), IsNil)
+	return file
+}
+
+func (s *testConfigSuite) TestParseLine(c *C) {
+	tbl := []struct {
+		line  string
+		name  string
+		value string
+		ok    bool
+		err   bool
+	}{
+		{"", "", "", false, false},
+		{"   ", "", "", false, false},
+		{"# port 6380", "", "", false, false},
+		{"  # indented comment", "", "", false, false},
+		{"port 6380", "port", "6380", true, false},
+		{"PORT\t 6380  ", "port", "6380", true, false},
+		{"logfile a b.log", "logfile", "a b.log", true, false},
+		{`logfile "a \"b\".log"`, "logfile", `a "b".log`, true, false},
+		{`logfile ""`, "logfile", "", true, false},
+		{`logfile "unterminated`, "", "", false, true},
+		{"port", "", "", false, true},
+	}
+	for _, t := range tbl {
+		name, value, ok, err := parseLine(t.line)
+		c.Assert(err != nil, Equals, t.err, Commentf("%q", t.line))
+		c.Assert(ok, Equals, t.ok, Commentf("%q", t.line))
+		c.Assert(name, Equals, t.name, Commentf("%q", t.line))
+		c.Assert(value, Equals, t.value, Commentf("%q", t.line))
+	}
+}
+
+func (s *testConfigSuite) TestLoad(c *C) {
+	file := s.writeFile(c, "# the proxy\nport 7000\nmax-retry-count 7\ntimeout 3\ntimeout 4\n")
+
+	// The command line wins over the file, the last directive of the file
+	// over the earlier ones.
+	c.Assert(Load(file, map[string]string{"max-retry-count": "9"}), IsNil)
+	c.Assert(Port.Get(), Equals, 7000)
+	c.Assert(MaxRetryCount.Get(), Equals, 9)
+	c.Assert(Timeout.Get(), Equals, 4)
+	c.Assert(MaxClients.Get(), Equals, 10000)
+	c.Assert(Path(), Equals, file)
+
+	c.Assert(Load(file, map[string]string{"nosuch": "1"}), NotNil)
+	c.Assert(Load(s.writeFile(c, "nosuch 1\n"), nil), NotNil)
+	c.Assert(Load(filepath.Join(s.dir, "missing.conf"), nil), NotNil)
+	// A bad value sets none of the params.
+	c.Assert(Load(s.writeFile(c, "timeout 5\nmaxclients 0\n"), nil), NotNil)
+	c.Assert(Timeout.Get(), Equals, 4)
+}
+
+func (s *testConfigSuite) TestSet(c *C) {
+	c.Assert(Set([][2]string{{"timeout", "5"}, {"MAXCLIENTS", "20"}}), IsNil)
+	c.Assert(Timeout.Get(), Equals, 5)
+	c.Assert(MaxClients.Get(), Equals, 20)
+
+	tbl := []struct {
+		pairs [][2]string
+		name  string
+		err   error
+	}{
+		{[][2]string{{"timeout", "6"}, {"nosuch", "1"}}, "nosuch", ErrUnknown},
+		{[][2]string{{"timeout", "6"}, {"port", "7000"}}, "port", ErrImmutable},
+		{[][2]string{{"timeout", "6"}, {"Timeout", "7"}}, "Timeout", nil},
+		{[][2]string{{"timeout", "6"}, {"maxclients", "0"}}, "maxclients", nil},
+		{[][2]string{{"timeout", "6"}, {"timeout", "x"}}, "timeout", nil},
+		{[][2]string{{"timeout", "6"}, {"loglevel", "debug"}}, "loglevel", nil},
+		{[][2]string{{"timeout", "6"}, {"block-poll-interval", "0s"}}, "block-poll-interval", nil},
+	}
+	for _, t := range tbl {
+		err := Set(t.pairs)
+		e, ok := err.(*SetError)
+		c.Assert(ok, IsTrue, Commentf("%v: %v", t.pairs, err))
+		c.Assert(e.Name, Equals, t.name)
+		if t.err != nil {
+			c.Assert(e.Err, Equals, t.err)
+		}
+		// Either all the params are set or none.
+		c.Assert(Timeout.Get(), Equals, 5, Commentf("%v", t.pairs))
+	}
+	c.Assert(MaxClients.Get(), Equals, 20)
+}
+
+func (s *testConfigSuite) TestReload(c *C) {
+	file := s.writeFile(c, "port 7000\ntimeout 5\nseek-threshold 20\n")
+	c.Assert(Load(file, map[string]string{"maxclients": "30"}), IsNil)
+	c.Assert(Set([][2]string{{"scan-max-count", "50"}}), IsNil)
+
+	// The removed mutable params go back to their defaults, the immutable
+	// ones wait for a restart.
+	s.writeFile(c, "port 7001\nseek-threshold 21\n")
+	c.Assert(Reload(), IsNil)
+	c.Assert(Port.Get(), Equals, 7000)
+	c.Assert(Timeout.Get(), Equals, 0)
+	c.Assert(SeekThreshold.Get(), Equals, 21)
+	c.Assert(ScanMaxCount.Get(), Equals, 10000)
+	c.Assert(MaxClients.Get(), Equals, 30)
+
+	// A broken file changes nothing.
+	s.writeFile(c, "seek-threshold 22\ntimeout x\n")
+	c.Assert(Reload(), NotNil)
+	c.Assert(SeekThreshold.Get(), Equals, 21)
+}
+
+func (s *testConfigSuite) TestRewrite(c *C) {
+	c.Assert(Rewrite(), Equals, ErrNoFile)
+
+	file := s.writeFile(c, "# the proxy\ntimeout 5\n\n# clients\nmaxclients 10\nmaxclients 11\nlogfile \"a b.log\"\n")
+	c.Assert(Load(file, nil), IsNil)
+	c.Assert(Set([][2]string{{"timeout", "7"}, {"seek-threshold", "20"}, {"scan-max-count", "10000"}}), IsNil)
+	c.Assert(Rewrite(), IsNil)
+
+	// The lines are updated in place, a param set twice keeps one line and
+	// the params not at their defaults are added.
+	data, err := ioutil.ReadFile(file)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "# the proxy\ntimeout 7\n\n# clients\nmaxclients 11\nlogfile \"a b.log\"\nseek-threshold 20\n")
+
+	// The file reads back the same.
+	c.Assert(Load(file, nil), IsNil)
+	c.Assert(Timeout.Get(), Equals, 7)
+	c.Assert(LogFile.Get(), Equals, "a b.log")
+}
@@ -0,0 +1,87 @@
+package config
+
+import (
+	"math"
+	"strings"
+	"time"
+
+	"github.com/ngaut/log"
+)
+
+// The settings of the server, they take effect after a restart.
+var (
+	Port        = newInt("port", false, 6379, 0, 65535)
+	PDAddr      = newString("pd", false, "localhost:2379")
+	LogFile     = newString("logfile", false, "")
+	MetricsAddr = newString("metrics-addr", false, ":9380")
+
+	TLSPort        = newInt("tls-port", false, 0, 0, 65535)
+	TLSCertFile    = newString("tls-cert-file", false, "")
+	TLSKeyFile     = newString("tls-key-file", false, "")
+	TLSCAFile      = newString("tls-ca-cert-file", false, "")
+	TLSAuthClients = newBool("tls-auth-clients", false, true)
+	TLSMinVersion  = newString("tls-min-version", false, "1.2", "1.0", "1.1", "1.2", "1.3")
+)
+
+// The settings that can be changed while the server runs.
+var (
+	LogLevel = newString("loglevel", true, "info", "info", "warn", "error")
+
+	// MaxRetryCount is the number of times a transaction is run before its
+	// retryable error is given up on.
+	MaxRetryCount = newInt("max-retry-count", true, 5, 1, 100)
+	MaxKeySize    = newInt("max-key-size", true, 1024, 1, math.MaxInt32)
+	MaxValueSize  = newInt("max-value-size", true, 1024*1024*1024, 1, math.MaxInt32)
+	// SeekThreshold is the number of elements above which a structure seeks
+	// to its elements instead of getting them one by one.
+	SeekThreshold = newInt("seek-threshold", true, 10, 1, math.MaxInt32)
+
+	// ExpireReapInterval is the interval between two rounds of the expire
+	// reaper, ExpireReapBatch the raw keys it deletes in one transaction.
+	ExpireReapInterval = newDuration("expire-reap-interval", true, time.Second)
+	ExpireReapBatch    = newInt("expire-reap-batch", true, 100, 1, math.MaxInt32)
+	// ScanDefaultCount is the number of keys SCAN visits without COUNT,
+	// ScanMaxCount caps its COUNT so that a call stays one small transaction.
+	ScanDefaultCount = newInt("scan-default-count", true, 10, 1, math.MaxInt32)
+	ScanMaxCount     = newInt("scan-max-count", true, 10000, 1, math.MaxInt32)
+	// FlushBatch is the number of keys deleted in one transaction of FLUSHDB
+	// and FLUSHALL.
+	FlushBatch = newInt("flush-batch", true, 1000, 1, math.MaxInt32)
+	// PubSubLogTTL is how long a message is kept in the pub/sub log for the
+	// proxies reading it, the expire reaper drops the older ones.
+	// PubSubPollInterval is how often a proxy reads the log.
+	PubSubLogTTL       = newDuration("pubsub-log-ttl", true, time.Minute)
+	PubSubPollInterval = newDuration("pubsub-poll-interval", true, 10*time.Millisecond)
+	// BlockPollInterval is the interval between two checks of the lists
+	// clients are blocked on, a check is one BatchGet on the latest snapshot.
+	BlockPollInterval = newDuration("block-poll-interval", true, 10*time.Millisecond)
+	// MaxClients is the number of client connections above which new ones
+	// are refused, Timeout the seconds after which an idle client is closed,
+	// 0 to never close it.
+	MaxClients = newInt("maxclients", true, 10000, 1, math.MaxInt32)
+	Timeout    = newInt("timeout", true, 0, 0, math.MaxInt32)
+	// ProtoMaxBulkLen caps the length of an argument of a request,
+	// ProtoMaxMultibulkLen the number of its arguments.
+	ProtoMaxBulkLen      = newInt("proto-max-bulk-len", true, 512*1024*1024, 1, math.MaxInt32)
+	ProtoMaxMultibulkLen = newInt("proto-max-multibulk-len", true, 1024*1024, 1, math.MaxInt32)
+
+	// ShutdownTimeout is how long a shutdown waits for the commands being
+	// served before it closes their connections.
+	ShutdownTimeout = newDuration("shutdown-timeout", true, 10*time.Second)
+)
+
+func init() {
+	LogLevel.apply = SetLogLevel
+}
+
+// SetLogLevel sets the level of the log to LogLevel.
+func SetLogLevel() {
+	switch strings.ToLower(LogLevel.Get()) {
+	case "error":
+		log.SetLevel(log.LOG_LEVEL_ERROR)
+	case "warn":
+		log.SetLevel(log.LOG_LEVEL_WARN)
+	default:
+		log.SetLevel(log.LOG_LEVEL_INFO)
+	}
+}
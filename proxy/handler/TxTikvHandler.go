@@ -1,9 +1,78 @@
 package handler
 
 import (
+	"sync"
+
+	"github.com/Mansfield6/tikv-proxy-demo/proxy/structure"
+	"github.com/Mansfield6/tikv-proxy-demo/proxy/uuid"
 	"github.com/pingcap/tidb/kv"
 )
 
 type TxTikvHandler struct {
 	Store kv.Storage
+	// dbMap, blocked and loops are shared by all the sessions.
+	dbMap   *structure.DBMap
+	blocked *blockedClients
+	loops   *loops
+	// id tells the proxy from the others in the reaper lease and the
+	// queues of the blocked clients.
+	id []byte
+
+	// The fields below are the state of a client session, the server runs
+	// every connection on its own copy of the handler.
+
+	// db is the logical database chosen by SELECT.
+	db int
+	// watched maps the keys given to WATCH to their versions.
+	watched map[watchedKey][]byte
+	// txn is the transaction of the EXEC running on the connection, all the
+	// commands queued by MULTI share it.
+	txn kv.Transaction
+	// execErr aborts the running EXEC.
+	execErr error
+	// execPushed is set when a list got elements in the running EXEC, the
+	// blocked clients are signalled once it commits.
+	execPushed bool
+}
+
+// NewTxTikvHandler creates a handler on store and starts its background
+// expire reaper and the watch of the lists clients are blocked on.
+func NewTxTikvHandler(store kv.Storage) *TxTikvHandler {
+	id := uuid.NewV4().Bytes()
+	h := &TxTikvHandler{Store: store, dbMap: structure.NewDBMap(), blocked: newBlockedClients(id), loops: newLoops(), id: id}
+	h.loops.run(h.reapExpired)
+	h.loops.run(h.watchBlocked)
+	return h
+}
+
+// Close stops the background work of the handler and waits for the
+// transactions it runs to finish, the store is not used by it afterwards.
+// The server calls it on shutdown once the connections are closed.
+func (h *TxTikvHandler) Close() error {
+	h.loops.close()
+	return nil
+}
+
+// loops are the background goroutines of a handler.
+type loops struct {
+	stop chan struct{}
+	once sync.Once
+	wg   sync.WaitGroup
+}
+
+func newLoops() *loops {
+	return &loops{stop: make(chan struct{})}
+}
+
+func (l *loops) run(loop func(stop <-chan struct{})) {
+	l.wg.Add(1)
+	go func() {
+		defer l.wg.Done()
+		loop(l.stop)
+	}()
+}
+
+func (l *loops) close() {
+	l.once.Do(func() { close(l.stop) })
+	l.wg.Wait()
 }
@@ -0,0 +1,61 @@
+package handler
+
+import (
+	"github.com/Mansfield6/tikv-proxy-demo/proxy/structure"
+	"github.com/juju/errors"
+	"github.com/pingcap/tidb/kv"
+)
+
+// ACLStore keeps the ACL users of the server in the store, so every proxy on
+// the same cluster shares them. It implements redis.ACLStore.
+type ACLStore struct {
+	store kv.Storage
+}
+
+func NewACLStore(store kv.Storage) *ACLStore {
+	return &ACLStore{store: store}
+}
+
+func (s *ACLStore) LoadUsers() (map[string]string, error) {
+	res, err := callStore(s.store, "acl load", func(txn kv.Transaction) (interface{}, error) {
+		return structure.LoadACLUsers(txn)
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return res.(map[string]string), nil
+}
+
+func (s *ACLStore) UpdateUser(name string, fn func(rules string) (string, error)) error {
+	_, err := callStore(s.store, "acl setuser", func(txn kv.Transaction) (interface{}, error) {
+		rules, err := structure.GetACLUser(txn, name)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		if rules, err = fn(rules); err != nil {
+			return nil, err
+		}
+		return nil, structure.SetACLUser(txn, name, rules)
+	})
+	return err
+}
+
+func (s *ACLStore) DeleteUsers(names []string) (int, error) {
+	res, err := callStore(s.store, "acl deluser", func(txn kv.Transaction) (interface{}, error) {
+		n := 0
+		for _, name := range names {
+			ok, err := structure.DeleteACLUser(txn, name)
+			if err != nil {
+				return 0, errors.Trace(err)
+			}
+			if ok {
+				n++
+			}
+		}
+		return n, nil
+	})
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	return res.(int), nil
+}
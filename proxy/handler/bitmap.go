@@ -0,0 +1,312 @@
+package handler
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/Mansfield6/tikv-proxy-demo/proxy/structure"
+	"github.com/juju/errors"
+	"github.com/ngaut/log"
+)
+
+var (
+	errBitOffset    = errors.New("bit offset is not an integer or out of range")
+	errBitValue     = errors.New("bit is not an integer or out of range")
+	errBitPosBit    = errors.New("The bit argument must be 1 or 0.")
+	errBitFieldType = errors.New("Invalid bitfield type. Use something like i16 u8. Note that u64 is not supported but i64 is.")
+	errBitFieldOF   = errors.New("Invalid OVERFLOW type specified")
+	errBitFieldRO   = errors.New("BITFIELD_RO only supports the GET subcommand")
+	errBitOpNot     = errors.New("BITOP NOT must be called with a single source key.")
+)
+
+func (h *TxTikvHandler) SETBIT(key []byte, offset []byte, value []byte) (int, error) {
+	off, err := parseBitOffset(offset, false, 1)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	if len(value) != 1 || (value[0] != '0' && value[0] != '1') {
+		return 0, errBitValue
+	}
+
+	context := newRequestContext("setbit")
+	log.Infof("%s setbit %s %s %s", context.id, key, offset, value)
+	res, err := h.callTx(context, func(tx *structure.TxStructure) (interface{}, error) {
+		return tx.SetBit(key, off, value[0] == '1')
+	})
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	return res.(int), nil
+}
+
+func (h *TxTikvHandler) GETBIT(key []byte, offset []byte) (int, error) {
+	off, err := parseBitOffset(offset, false, 1)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	context := newRequestContext("getbit")
+	log.Infof("%s getbit %s %s", context.id, key, offset)
+	res, err := h.callTx(context, func(tx *structure.TxStructure) (interface{}, error) {
+		return tx.GetBit(key, off)
+	})
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	return res.(int), nil
+}
+
+func (h *TxTikvHandler) BITCOUNT(args [][]byte) (int, error) {
+	if len(args) == 0 {
+		return 0, errArguments("len(args) = %d, expect >= 1", len(args))
+	}
+	if len(args) == 2 || len(args) > 4 {
+		return 0, ErrSyntax
+	}
+
+	start, end := int64(0), int64(-1)
+	bitUnit := false
+	if len(args) >= 3 {
+		var err error
+		if start, err = parseInt(args[1]); err != nil {
+			return 0, errors.Trace(err)
+		}
+		if end, err = parseInt(args[2]); err != nil {
+			return 0, errors.Trace(err)
+		}
+	}
+	if len(args) == 4 {
+		var err error
+		if bitUnit, err = parseBitUnit(args[3]); err != nil {
+			return 0, errors.Trace(err)
+		}
+	}
+
+	context := newRequestContext("bitcount")
+	log.Infof("%s bitcount %s", context.id, args)
+	res, err := h.callTx(context, func(tx *structure.TxStructure) (interface{}, error) {
+		return tx.BitCount(args[0], start, end, bitUnit)
+	})
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	return int(res.(int64)), nil
+}
+
+func (h *TxTikvHandler) BITPOS(args [][]byte) (int, error) {
+	if len(args) < 2 || len(args) > 5 {
+		return 0, errArguments("len(args) = %d, expect >= 2 && <= 5", len(args))
+	}
+
+	bit, err := parseInt(args[1])
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	if bit != 0 && bit != 1 {
+		return 0, errBitPosBit
+	}
+
+	start, end := int64(0), int64(-1)
+	bitUnit := false
+	if len(args) >= 3 {
+		if start, err = parseInt(args[2]); err != nil {
+			return 0, errors.Trace(err)
+		}
+	}
+	if len(args) >= 4 {
+		if end, err = parseInt(args[3]); err != nil {
+			return 0, errors.Trace(err)
+		}
+	}
+	if len(args) == 5 {
+		if bitUnit, err = parseBitUnit(args[4]); err != nil {
+			return 0, errors.Trace(err)
+		}
+	}
+
+	context := newRequestContext("bitpos")
+	log.Infof("%s bitpos %s", context.id, args)
+	res, err := h.callTx(context, func(tx *structure.TxStructure) (interface{}, error) {
+		return tx.BitPos(args[0], int(bit), start, end, len(args) >= 4, bitUnit)
+	})
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	return int(res.(int64)), nil
+}
+
+func (h *TxTikvHandler) BITOP(args [][]byte) (int, error) {
+	if len(args) < 3 {
+		return 0, errArguments("len(args) = %d, expect >= 3", len(args))
+	}
+
+	var op int
+	switch strings.ToUpper(string(args[0])) {
+	case "AND":
+		op = structure.BitAnd
+	case "OR":
+		op = structure.BitOr
+	case "XOR":
+		op = structure.BitXor
+	case "NOT":
+		op = structure.BitNot
+		if len(args) != 3 {
+			return 0, errBitOpNot
+		}
+	default:
+		return 0, ErrSyntax
+	}
+
+	context := newRequestContext("bitop")
+	log.Infof("%s bitop %s", context.id, args)
+	res, err := h.callTx(context, func(tx *structure.TxStructure) (interface{}, error) {
+		return tx.BitOp(op, args[1], args[2:])
+	})
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	return int(res.(int64)), nil
+}
+
+func (h *TxTikvHandler) BITFIELD(args [][]byte) ([]interface{}, error) {
+	return h.bitField("bitfield", args, false)
+}
+
+func (h *TxTikvHandler) BITFIELD_RO(args [][]byte) ([]interface{}, error) {
+	return h.bitField("bitfield_ro", args, true)
+}
+
+func (h *TxTikvHandler) bitField(cmd string, args [][]byte, readOnly bool) ([]interface{}, error) {
+	if len(args) < 1 {
+		return nil, errArguments("len(args) = %d, expect >= 1", len(args))
+	}
+
+	ops, err := parseBitFieldOps(args[1:])
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if readOnly {
+		for _, op := range ops {
+			if op.Op != structure.BitFieldGet {
+				return nil, errBitFieldRO
+			}
+		}
+	}
+
+	context := newRequestContext(cmd)
+	log.Infof("%s %s %s", context.id, cmd, args)
+	res, err := h.callTx(context, func(tx *structure.TxStructure) (interface{}, error) {
+		return tx.BitField(args[0], ops)
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	values := res.([]*int64)
+	replies := make([]interface{}, len(values))
+	for i, v := range values {
+		if v != nil {
+			replies[i] = int(*v)
+		}
+	}
+	return replies, nil
+}
+
+// parseBitFieldOps parses the subcommands of BITFIELD, an OVERFLOW applies
+// to the SET and INCRBY subcommands that follow it.
+func parseBitFieldOps(args [][]byte) ([]*structure.BitFieldOp, error) {
+	var ops []*structure.BitFieldOp
+	overflow := structure.BitFieldWrap
+	for i := 0; i < len(args); i++ {
+		sub := strings.ToUpper(string(args[i]))
+		if sub == "OVERFLOW" {
+			if i+1 >= len(args) {
+				return nil, ErrSyntax
+			}
+			i++
+			switch strings.ToUpper(string(args[i])) {
+			case "WRAP":
+				overflow = structure.BitFieldWrap
+			case "SAT":
+				overflow = structure.BitFieldSat
+			case "FAIL":
+				overflow = structure.BitFieldFail
+			default:
+				return nil, errBitFieldOF
+			}
+			continue
+		}
+
+		op := &structure.BitFieldOp{Overflow: overflow}
+		argc := 2
+		switch sub {
+		case "GET":
+			op.Op = structure.BitFieldGet
+		case "SET":
+			op.Op = structure.BitFieldSet
+			argc = 3
+		case "INCRBY":
+			op.Op = structure.BitFieldIncrBy
+			argc = 3
+		default:
+			return nil, ErrSyntax
+		}
+		if i+argc >= len(args) {
+			return nil, ErrSyntax
+		}
+
+		var err error
+		if op.Signed, op.Bits, err = parseBitFieldType(args[i+1]); err != nil {
+			return nil, errors.Trace(err)
+		}
+		if op.Offset, err = parseBitOffset(args[i+2], true, op.Bits); err != nil {
+			return nil, errors.Trace(err)
+		}
+		if argc == 3 {
+			if op.Value, err = parseInt(args[i+3]); err != nil {
+				return nil, errors.Trace(err)
+			}
+		}
+		i += argc
+		ops = append(ops, op)
+	}
+	return ops, nil
+}
+
+// parseBitFieldType parses a bitfield type like i16 or u8.
+func parseBitFieldType(arg []byte) (bool, uint, error) {
+	if len(arg) < 2 || (arg[0] != 'i' && arg[0] != 'I' && arg[0] != 'u' && arg[0] != 'U') {
+		return false, 0, errBitFieldType
+	}
+	signed := arg[0] == 'i' || arg[0] == 'I'
+	n, err := strconv.Atoi(string(arg[1:]))
+	if err != nil || n < 1 || (signed && n > 64) || (!signed && n > 63) {
+		return false, 0, errBitFieldType
+	}
+	return signed, uint(n), nil
+}
+
+// parseBitOffset parses a bit offset, with hash allowed an offset like #2
+// is multiplied by the width of the field.
+func parseBitOffset(arg []byte, hash bool, width uint) (int64, error) {
+	mul := int64(1)
+	if hash && len(arg) > 0 && arg[0] == '#' {
+		mul = int64(width)
+		arg = arg[1:]
+	}
+	n, err := strconv.ParseInt(string(arg), 10, 64)
+	if err != nil || n < 0 || n > (structure.MaxStringLength*8-1)/mul {
+		return 0, errBitOffset
+	}
+	return n * mul, nil
+}
+
+func parseBitUnit(arg []byte) (bool, error) {
+	switch strings.ToUpper(string(arg)) {
+	case "BYTE":
+		return false, nil
+	case "BIT":
+		return true, nil
+	}
+	return false, ErrSyntax
+}
@@ -0,0 +1,441 @@
+package handler
+
+import (
+	"encoding/binary"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Mansfield6/tikv-proxy-demo/proxy/config"
+	"github.com/Mansfield6/tikv-proxy-demo/proxy/structure"
+	"github.com/juju/errors"
+	"github.com/ngaut/log"
+	"github.com/pingcap/tidb/kv"
+)
+
+var (
+	errTimeoutNotFloat = errors.New("timeout is not a float or out of range")
+	errTimeoutNegative = errors.New("timeout is negative")
+)
+
+// A blocked client waits in the queue of every key it is blocked on. The
+// queues are kept in the store and shared by all the proxies. Only the
+// client at the head of a queue pops from its key, so clients are served in
+// the order they came on every proxy. A proxy renews the leases of the
+// entries of its clients, and entries left by a proxy that went away run out.
+const (
+	waiterLease = 10 * time.Second
+	waiterRenew = time.Second
+)
+
+// blockKey is a list clients are blocked on, in a logical database.
+type blockKey struct {
+	db  int
+	key string
+}
+
+// blockedClient is a client parked by BLPOP, BRPOP or BLMOVE.
+type blockedClient struct {
+	id   []byte
+	db   int
+	keys [][]byte
+	// seq is the seq of the entries of the client in the queues, 0 until
+	// it is queued.
+	seq uint64
+	// wake is signalled when the client is at the head of the queue of a
+	// key that got elements.
+	wake chan struct{}
+}
+
+func (c *blockedClient) signal() {
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+// blockedClients are the clients of a proxy that are queued.
+type blockedClients struct {
+	mu      sync.Mutex
+	proxyID []byte
+	next    uint64
+	clients map[string]*blockedClient
+	// poke makes watchBlocked check the lists at once.
+	poke chan struct{}
+}
+
+func newBlockedClients(proxyID []byte) *blockedClients {
+	return &blockedClients{
+		proxyID: proxyID,
+		clients: make(map[string]*blockedClient),
+		poke:    make(chan struct{}, 1),
+	}
+}
+
+// newClient creates a client with an id no other client on any proxy has.
+func (b *blockedClients) newClient(db int, keys [][]byte) *blockedClient {
+	b.mu.Lock()
+	b.next++
+	n := b.next
+	b.mu.Unlock()
+	id := make([]byte, 0, structure.WaiterIDLen)
+	id = append(id, b.proxyID...)
+	id = append(id, make([]byte, 8)...)
+	binary.BigEndian.PutUint64(id[len(b.proxyID):], n)
+	return &blockedClient{id: id, db: db, keys: keys, wake: make(chan struct{}, 1)}
+}
+
+func (b *blockedClients) add(c *blockedClient) {
+	b.mu.Lock()
+	b.clients[string(c.id)] = c
+	b.mu.Unlock()
+}
+
+func (b *blockedClients) remove(c *blockedClient) {
+	b.mu.Lock()
+	delete(b.clients, string(c.id))
+	b.mu.Unlock()
+}
+
+func (b *blockedClients) get(id []byte) *blockedClient {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.clients[string(id)]
+}
+
+func (b *blockedClients) list() []*blockedClient {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	clients := make([]*blockedClient, 0, len(b.clients))
+	for _, c := range b.clients {
+		clients = append(clients, c)
+	}
+	return clients
+}
+
+// signal tells watchBlocked that a list got elements on this proxy, the head
+// of its queue may be a client of another proxy.
+func (b *blockedClients) signal() {
+	if b == nil {
+		return
+	}
+	select {
+	case b.poke <- struct{}{}:
+	default:
+	}
+}
+
+// signalList signals that a list got elements. Inside EXEC the signal waits
+// for the commit, the elements are not there before.
+func (h *TxTikvHandler) signalList() {
+	if h.txn != nil {
+		h.execPushed = true
+		return
+	}
+	h.blocked.signal()
+}
+
+// watchBlocked wakes the clients at the head of the queues of the lists that
+// got elements, on this proxy or another one, and renews the leases of the
+// queued clients, until stop is closed.
+func (h *TxTikvHandler) watchBlocked(stop <-chan struct{}) {
+	renewed := time.Now()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-h.blocked.poke:
+		case <-time.After(config.BlockPollInterval.Get()):
+		}
+		clients := h.blocked.list()
+		if len(clients) == 0 {
+			continue
+		}
+		if time.Since(renewed) >= waiterRenew {
+			renewed = time.Now()
+			if err := h.renewWaiters(clients); err != nil {
+				log.Errorf("renew the leases of blocked clients failed - %s", errors.ErrorStack(err))
+			}
+		}
+		if err := h.wakeHeads(clients); err != nil {
+			log.Errorf("check the lists of blocked clients failed - %s", errors.ErrorStack(err))
+		}
+	}
+}
+
+// wakeHeads reads the metas of the lists clients are blocked on with one
+// BatchGet, and wakes the clients of this proxy at the head of the queues of
+// the lists that have elements. It reads from the latest snapshot, which
+// needs no timestamp.
+func (h *TxTikvHandler) wakeHeads(clients []*blockedClient) error {
+	snap, err := h.Store.GetSnapshot(kv.MaxVersion)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	txs := make(map[int]*structure.TxStructure)
+	seen := make(map[blockKey]bool)
+	var keys []blockKey
+	var metaKeys []kv.Key
+	for _, c := range clients {
+		tx, ok := txs[c.db]
+		if !ok {
+			if tx, err = h.dbMap.Reader(snap, c.db); err != nil {
+				return errors.Trace(err)
+			}
+			txs[c.db] = tx
+		}
+		for _, key := range c.keys {
+			bk := blockKey{db: c.db, key: string(key)}
+			if !seen[bk] {
+				seen[bk] = true
+				keys = append(keys, bk)
+				metaKeys = append(metaKeys, tx.EncodeMetaKey(key))
+			}
+		}
+	}
+	metas, err := snap.BatchGet(metaKeys)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	now := nowms()
+	for i, bk := range keys {
+		if !structure.IsListMeta(metas[string(metaKeys[i])]) {
+			continue
+		}
+		head, err := txs[bk.db].WaiterHead([]byte(bk.key), now)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if c := h.blocked.get(head); c != nil {
+			c.signal()
+		}
+	}
+	return nil
+}
+
+// renewWaiters renews the leases of the entries of clients in one
+// transaction.
+func (h *TxTikvHandler) renewWaiters(clients []*blockedClient) error {
+	until := nowms() + int64(waiterLease/time.Millisecond)
+	_, err := callStore(h.Store, "renew-waiters", func(txn kv.Transaction) (interface{}, error) {
+		for _, c := range clients {
+			tx, err := h.dbMap.Structure(txn, c.db)
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+			if err = tx.RenewWaiter(c.keys, c.seq, c.id, until); err != nil {
+				return nil, errors.Trace(err)
+			}
+		}
+		return nil, nil
+	})
+	return errors.Trace(err)
+}
+
+// parseTimeout parses the timeout of a blocking command in seconds, 0
+// waits forever.
+func parseTimeout(arg []byte) (time.Duration, error) {
+	f, err := strconv.ParseFloat(string(arg), 64)
+	if err != nil || math.IsNaN(f) || math.IsInf(f, 0) || f*float64(time.Second) > math.MaxInt64 {
+		return 0, errTimeoutNotFloat
+	}
+	if f < 0 {
+		return 0, errTimeoutNegative
+	}
+	d := time.Duration(f * float64(time.Second))
+	if d == 0 && f > 0 {
+		d = time.Millisecond
+	}
+	return d, nil
+}
+
+// blockingPop runs pop on keys in one transaction until it gives a value,
+// the client stays blocked in between for at most timeout. The client is
+// queued on keys when nothing was popped, and pops only once it is at the
+// head of a queue. The value is nil once the timeout passes or the client
+// disconnects. Inside EXEC pop is only tried once, as redis does.
+func (h *TxTikvHandler) blockingPop(context *RequestContext, closed <-chan struct{}, keys [][]byte, timeout time.Duration,
+	pop func(tx *structure.TxStructure, key []byte) (interface{}, error)) (interface{}, error) {
+	if h.txn != nil {
+		return h.callTx(context, func(tx *structure.TxStructure) (interface{}, error) {
+			for _, key := range keys {
+				res, err := pop(tx, key)
+				if err != nil || res != nil {
+					return res, err
+				}
+			}
+			return nil, nil
+		})
+	}
+
+	c := h.blocked.newClient(h.db, keys)
+	defer h.dequeue(context, c)
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	for {
+		res, err := h.tryPop(context, c, pop)
+		if err != nil || res != nil {
+			return res, err
+		}
+		select {
+		case <-c.wake:
+		case <-expired:
+			return nil, nil
+		case <-closed:
+			log.Infof("%s client disconnected while blocked", context.id)
+			return nil, nil
+		}
+	}
+}
+
+// tryPop runs pop on the keys of c whose queue c is at the head of, until
+// one gives a value. A client that pops leaves its queues, one that is not
+// queued yet and pops nothing is queued, in the same transaction.
+func (h *TxTikvHandler) tryPop(context *RequestContext, c *blockedClient,
+	pop func(tx *structure.TxStructure, key []byte) (interface{}, error)) (interface{}, error) {
+	var seq uint64
+	res, err := h.callTx(context, func(tx *structure.TxStructure) (interface{}, error) {
+		now := nowms()
+		for _, key := range c.keys {
+			head, err := tx.IsWaiterHead(key, c.id, now)
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+			if !head {
+				continue
+			}
+			res, err := pop(tx, key)
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+			if res != nil {
+				if c.seq != 0 {
+					err = tx.DequeueWaiter(c.keys, c.seq, c.id)
+				}
+				return res, errors.Trace(err)
+			}
+		}
+		if c.seq == 0 {
+			var err error
+			seq, err = tx.EnqueueWaiter(c.keys, c.id, now+int64(waiterLease/time.Millisecond))
+			return nil, errors.Trace(err)
+		}
+		return nil, nil
+	})
+	if err != nil || res != nil {
+		if res != nil {
+			c.seq = 0
+		}
+		return res, errors.Trace(err)
+	}
+	if c.seq == 0 {
+		c.seq = seq
+		h.blocked.add(c)
+	}
+	return nil, nil
+}
+
+// dequeue takes c out of its queues once it stops waiting, the lease of its
+// entries runs out if that fails.
+func (h *TxTikvHandler) dequeue(context *RequestContext, c *blockedClient) {
+	h.blocked.remove(c)
+	if c.seq == 0 {
+		return
+	}
+	_, err := callStore(h.Store, "dequeue-waiter", func(txn kv.Transaction) (interface{}, error) {
+		tx, err := h.dbMap.Structure(txn, c.db)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		return nil, tx.DequeueWaiter(c.keys, c.seq, c.id)
+	})
+	if err != nil {
+		log.Warningf("%s dequeue blocked client failed - %s", context.id, err)
+	}
+	// The client may have been the head of a list that has elements, the
+	// next client gets its turn.
+	h.blocked.signal()
+}
+
+func (h *TxTikvHandler) BLPOP(closed <-chan struct{}, args [][]byte) (interface{}, error) {
+	return h.blockingListPop("blpop", closed, args, true)
+}
+
+func (h *TxTikvHandler) BRPOP(closed <-chan struct{}, args [][]byte) (interface{}, error) {
+	return h.blockingListPop("brpop", closed, args, false)
+}
+
+func (h *TxTikvHandler) blockingListPop(cmd string, closed <-chan struct{}, args [][]byte, left bool) (interface{}, error) {
+	if len(args) < 2 {
+		return nil, errArguments("len(args) = %d, expect >= 2", len(args))
+	}
+	timeout, err := parseTimeout(args[len(args)-1])
+	if err != nil {
+		return nil, err
+	}
+	keys := args[:len(args)-1]
+
+	context := newRequestContext(cmd)
+	log.Infof("%s %s %s", context.id, cmd, args)
+	res, err := h.blockingPop(context, closed, keys, timeout, func(tx *structure.TxStructure, key []byte) (interface{}, error) {
+		var v []byte
+		var err error
+		if left {
+			v, err = tx.LPop(key)
+		} else {
+			v, err = tx.RPop(key)
+		}
+		if err != nil || v == nil {
+			return nil, errors.Trace(err)
+		}
+		return [][]byte{key, v}, nil
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if res == nil {
+		return []interface{}(nil), nil
+	}
+	return res, nil
+}
+
+func (h *TxTikvHandler) BLMOVE(closed <-chan struct{}, src []byte, dst []byte, from []byte, to []byte, timeout []byte) (interface{}, error) {
+	srcLeft, err := parseListEnd(from)
+	if err != nil {
+		return nil, err
+	}
+	dstLeft, err := parseListEnd(to)
+	if err != nil {
+		return nil, err
+	}
+	d, err := parseTimeout(timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	context := newRequestContext("blmove")
+	log.Infof("%s blmove %s %s %s %s %s", context.id, src, dst, from, to, timeout)
+	res, err := h.blockingPop(context, closed, [][]byte{src}, d, func(tx *structure.TxStructure, key []byte) (interface{}, error) {
+		v, err := tx.LMove(key, dst, srcLeft, dstLeft)
+		if err != nil || v == nil {
+			return nil, errors.Trace(err)
+		}
+		return v, nil
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if res == nil {
+		return nil, nil
+	}
+	h.signalList()
+	return res, nil
+}
@@ -0,0 +1,99 @@
+package handler
+
+import (
+	"math"
+
+	"github.com/Mansfield6/tikv-proxy-demo/proxy/structure"
+	"github.com/juju/errors"
+	"github.com/ngaut/log"
+)
+
+func (h *TxTikvHandler) INCR(key []byte) (int, error) {
+	return h.incrBy("incr", key, 1)
+}
+
+func (h *TxTikvHandler) DECR(key []byte) (int, error) {
+	return h.incrBy("decr", key, -1)
+}
+
+func (h *TxTikvHandler) INCRBY(key []byte, increment []byte) (int, error) {
+	step, err := parseInt(increment)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	return h.incrBy("incrby", key, step)
+}
+
+func (h *TxTikvHandler) DECRBY(key []byte, decrement []byte) (int, error) {
+	step, err := parseInt(decrement)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	if step == math.MinInt64 {
+		return 0, errors.New("decrement would overflow")
+	}
+	return h.incrBy("decrby", key, -step)
+}
+
+func (h *TxTikvHandler) incrBy(cmd string, key []byte, step int64) (int, error) {
+	context := newRequestContext(cmd)
+	log.Infof("%s %s %s %d", context.id, cmd, key, step)
+	res, err := h.callTx(context, func(tx *structure.TxStructure) (interface{}, error) {
+		return tx.Inc(key, step)
+	})
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	return int(res.(int64)), nil
+}
+
+func (h *TxTikvHandler) INCRBYFLOAT(key []byte, increment []byte) ([]byte, error) {
+	step, err := parseFloat(increment)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	context := newRequestContext("incrbyfloat")
+	log.Infof("%s incrbyfloat %s %s", context.id, key, increment)
+	res, err := h.callTx(context, func(tx *structure.TxStructure) (interface{}, error) {
+		return tx.IncByFloat(key, step)
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return res.([]byte), nil
+}
+
+func (h *TxTikvHandler) HINCRBY(key []byte, field []byte, increment []byte) (int, error) {
+	step, err := parseInt(increment)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	context := newRequestContext("hincrby")
+	log.Infof("%s hincrby %s %s %s", context.id, key, field, increment)
+	res, err := h.callTx(context, func(tx *structure.TxStructure) (interface{}, error) {
+		return tx.MergedHInc(key, field, step)
+	})
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	return int(res.(int64)), nil
+}
+
+func (h *TxTikvHandler) HINCRBYFLOAT(key []byte, field []byte, increment []byte) ([]byte, error) {
+	step, err := parseFloat(increment)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	context := newRequestContext("hincrbyfloat")
+	log.Infof("%s hincrbyfloat %s %s %s", context.id, key, field, increment)
+	res, err := h.callTx(context, func(tx *structure.TxStructure) (interface{}, error) {
+		return tx.MergedHIncByFloat(key, field, step)
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return res.([]byte), nil
+}
@@ -0,0 +1,154 @@
+package handler
+
+import (
+	"strings"
+
+	"github.com/Mansfield6/tikv-proxy-demo/proxy/config"
+	"github.com/Mansfield6/tikv-proxy-demo/proxy/redis"
+	"github.com/Mansfield6/tikv-proxy-demo/proxy/structure"
+	"github.com/juju/errors"
+	"github.com/ngaut/log"
+)
+
+// parseDB parses a database index argument.
+func parseDB(arg []byte) (int, error) {
+	n, err := parseInt(arg)
+	if err != nil {
+		return 0, err
+	}
+	if n < 0 || n >= int64(structure.Databases) {
+		return 0, structure.ErrDBIndex
+	}
+	return int(n), nil
+}
+
+func (h *TxTikvHandler) SELECT(index []byte) (*redis.StatusReply, error) {
+	db, err := parseDB(index)
+	if err != nil {
+		return nil, err
+	}
+	h.db = db
+	return redis.StatusOK, nil
+}
+
+func (h *TxTikvHandler) DBSIZE() (int, error) {
+	context := newRequestContext("dbsize")
+	log.Infof("%s dbsize %d", context.id, h.db)
+	res, err := h.callTx(context, func(tx *structure.TxStructure) (interface{}, error) {
+		return tx.DBSize()
+	})
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	return int(res.(int64)), nil
+}
+
+func (h *TxTikvHandler) FLUSHDB(args [][]byte) (*redis.StatusReply, error) {
+	if err := checkFlushArgs(args); err != nil {
+		return nil, err
+	}
+	context := newRequestContext("flushdb")
+	log.Infof("%s flushdb %d", context.id, h.db)
+	if err := h.flush(context, h.db); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return redis.StatusOK, nil
+}
+
+func (h *TxTikvHandler) FLUSHALL(args [][]byte) (*redis.StatusReply, error) {
+	if err := checkFlushArgs(args); err != nil {
+		return nil, err
+	}
+	context := newRequestContext("flushall")
+	log.Infof("%s flushall", context.id)
+	for db := 0; db < structure.Databases; db++ {
+		if err := h.flush(context, db); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+	return redis.StatusOK, nil
+}
+
+// checkFlushArgs accepts the ASYNC and SYNC options, the keys are deleted
+// before the reply either way.
+func checkFlushArgs(args [][]byte) error {
+	if len(args) > 1 {
+		return errArguments("len(args) = %d, expect <= 1", len(args))
+	}
+	for _, arg := range args {
+		switch strings.ToUpper(string(arg)) {
+		case "ASYNC", "SYNC":
+		default:
+			return ErrSyntax
+		}
+	}
+	return nil
+}
+
+// flush deletes the keys of db by config.FlushBatch keys in a transaction, so a
+// large database does not make one huge transaction. Inside EXEC all the
+// batches go to the transaction of the EXEC.
+func (h *TxTikvHandler) flush(context *RequestContext, db int) error {
+	batch := config.FlushBatch.Get()
+	for {
+		res, err := h.callTx(context, func(tx *structure.TxStructure) (interface{}, error) {
+			dt, err := tx.DB(db)
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+			return dt.FlushDB(batch)
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if res.(int) < batch {
+			return nil
+		}
+	}
+}
+
+func (h *TxTikvHandler) SWAPDB(a []byte, b []byte) (*redis.StatusReply, error) {
+	dbA, err := parseDB(a)
+	if err != nil {
+		return nil, err
+	}
+	dbB, err := parseDB(b)
+	if err != nil {
+		return nil, err
+	}
+
+	context := newRequestContext("swapdb")
+	log.Infof("%s swapdb %d %d", context.id, dbA, dbB)
+	_, err = h.callTx(context, func(tx *structure.TxStructure) (interface{}, error) {
+		return nil, tx.SwapDB(dbA, dbB)
+	})
+	h.dbMap.Invalidate()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return redis.StatusOK, nil
+}
+
+func (h *TxTikvHandler) MOVE(key []byte, index []byte) (int, error) {
+	db, err := parseDB(index)
+	if err != nil {
+		return 0, err
+	}
+
+	context := newRequestContext("move")
+	log.Infof("%s move %s %d", context.id, key, db)
+	res, err := h.callTx(context, func(tx *structure.TxStructure) (interface{}, error) {
+		dt, err := tx.DB(db)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		return tx.Move(key, dt)
+	})
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	if res.(bool) {
+		return 1, nil
+	}
+	return 0, nil
+}
@@ -1,18 +1,59 @@
 package handler
 
 import (
+	"strings"
+
+	"github.com/Mansfield6/tikv-proxy-demo/proxy/redis"
+	"github.com/Mansfield6/tikv-proxy-demo/proxy/structure"
 	"github.com/juju/errors"
 	"github.com/ngaut/log"
+	"github.com/pingcap/tidb/kv"
 )
 
 var (
-	ErrBegionTXN = errors.New("begin transaction error")
-	ErrKeySize   = errors.New("invalid key size")
-	ErrValueSize = errors.New("invalid value size")
+	ErrBegionTXN  = errors.New("begin transaction error")
+	ErrKeySize    = errors.New("invalid key size")
+	ErrValueSize  = errors.New("invalid value size")
+	ErrNotInteger = structure.ErrNotInteger
+	ErrNotFloat   = structure.ErrNotFloat
+	ErrSyntax     = errors.New("syntax error")
 )
 
+// errArguments logs why the arguments are invalid, the client gets the
+// wrong number of arguments error of the command.
 func errArguments(format string, v ...interface{}) error {
 	err := errors.Errorf(format, v...)
 	log.Warningf("call store function with invalid arguments - %s", err)
-	return errors.Trace(err)
+	return errors.Trace(redis.ErrWrongArgs)
+}
+
+// replyError maps the errors of the structure and of tikv to the error codes
+// redis clients know, other errors are replied as they are.
+func replyError(err error) error {
+	if err == nil {
+		return nil
+	}
+	switch {
+	case structure.IsWrongType(err):
+		return redis.ErrWrongType
+	case isServerBusy(err):
+		log.Warningf("storage busy: %s", err)
+		return redis.ErrBusy
+	case kv.IsRetryableError(err) || isBackoffExhausted(err):
+		log.Warningf("retryable error: %s", err)
+		return redis.ErrTryAgain
+	}
+	return err
+}
+
+// isServerBusy reports whether err comes from tikv reporting that it is too
+// busy, also when the client gave up backing off on it.
+func isServerBusy(err error) bool {
+	return strings.Contains(err.Error(), "server is busy")
+}
+
+// isBackoffExhausted reports whether err comes from the tikv client giving up
+// on a request after backing off, like on a region that is not ready.
+func isBackoffExhausted(err error) bool {
+	return strings.Contains(err.Error(), "backoffer.maxSleep")
 }
@@ -0,0 +1,31 @@
+package handler
+
+import (
+	"github.com/Mansfield6/tikv-proxy-demo/proxy/redis"
+	"github.com/Mansfield6/tikv-proxy-demo/proxy/structure"
+	"github.com/juju/errors"
+	. "github.com/pingcap/check"
+	"github.com/pingcap/tidb/kv"
+)
+
+func (s *testHandlerSuite) TestReplyError(c *C) {
+	other := errors.New("other")
+	tests := []struct {
+		err  error
+		want error
+	}{
+		{nil, nil},
+		{errors.Trace(structure.ErrSetType), redis.ErrWrongType},
+		{errors.New("server is busy, ctx: region 2"), redis.ErrBusy},
+		// The backoff gave up on a busy server.
+		{errors.New("backoffer.maxSleep 20000ms is exceeded, errors:\nserver is busy, ctx: region 2"), redis.ErrBusy},
+		// The backoff gave up on something else.
+		{errors.New("backoffer.maxSleep 20000ms is exceeded, errors:\nregion 2 is not leader"), redis.ErrTryAgain},
+		{errors.Annotate(errors.New("backoffer.maxSleep 5000ms is exceeded, errors:\nnot ready"), "[try again later]"), redis.ErrTryAgain},
+		{kv.ErrRetryable, redis.ErrTryAgain},
+		{other, other},
+	}
+	for _, tt := range tests {
+		c.Assert(replyError(tt.err), Equals, tt.want, Commentf("%v", tt.err))
+	}
+}
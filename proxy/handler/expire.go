@@ -0,0 +1,89 @@
+package handler
+
+import (
+	"time"
+
+	"github.com/Mansfield6/tikv-proxy-demo/proxy/config"
+	"github.com/Mansfield6/tikv-proxy-demo/proxy/structure"
+	"github.com/juju/errors"
+	"github.com/ngaut/log"
+	"github.com/pingcap/tidb/store/tikv/oracle"
+)
+
+// reapExpired periodically deletes keys whose ttl has passed, until stop is
+// closed. Each round deletes at most config.ExpireReapBatch raw keys in one
+// transaction and starts the next round at once while there is still work
+// left. Only the proxy holding the reaper lease reaps, the others check
+// every round whether it has run out. The reaper also drops the messages
+// of the Pub/Sub log older than config.PubSubLogTTL.
+func (h *TxTikvHandler) reapExpired(stop <-chan struct{}) {
+	for {
+		more, err := h.reapExpiredOnce(config.ExpireReapBatch.Get())
+		if err != nil {
+			log.Errorf("reap expired keys failed - %s", errors.ErrorStack(err))
+		}
+		wait := time.Duration(0)
+		if err != nil || !more {
+			wait = config.ExpireReapInterval.Get()
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// reaperLeaseTTL is how long the reaper lease lasts, in milliseconds. Another
+// proxy takes over that long after the holder stopped.
+func reaperLeaseTTL() int64 {
+	return int64(10 * config.ExpireReapInterval.Get() / time.Millisecond)
+}
+
+// pubsubLogFloor gets the timestamp the messages of the Pub/Sub log started
+// before are dropped at now.
+func pubsubLogFloor(now int64) uint64 {
+	return oracle.ComposeTS(now-int64(config.PubSubLogTTL.Get()/time.Millisecond), 0)
+}
+
+func (h *TxTikvHandler) reapExpiredOnce(batch int) (bool, error) {
+	context := newRequestContext("reap")
+	var reaped, trimmed int
+	var more bool
+	_, err := CallWithRetry(context, func() (interface{}, error) {
+		txn, err := h.Store.Begin()
+		if err != nil {
+			return nil, errors.Trace(ErrBegionTXN)
+		}
+
+		now := nowms()
+		held, ierr := structure.HoldReaperLease(txn, h.id, now, reaperLeaseTTL())
+		reaped, trimmed, more = 0, 0, false
+		if ierr == nil && held {
+			reaped, more, ierr = structure.ReapExpired(txn, now, batch)
+		}
+		if ierr == nil && held && reaped < batch {
+			var moreLog bool
+			trimmed, moreLog, ierr = structure.TrimPubSubLog(txn, pubsubLogFloor(now), batch-reaped)
+			more = more || moreLog
+		}
+		if ierr == nil {
+			ierr = commitTxn(txn)
+		}
+
+		if ierr != nil {
+			txn.Rollback()
+		}
+		return nil, ierr
+	})
+	if err != nil {
+		return false, errors.Trace(err)
+	}
+	if reaped > 0 {
+		log.Infof("%s reaped %d expired keys", context.id, reaped)
+	}
+	if trimmed > 0 {
+		log.Infof("%s dropped %d pub/sub messages", context.id, trimmed)
+	}
+	return more, nil
+}
@@ -0,0 +1,103 @@
+package handler
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/Mansfield6/tikv-proxy-demo/proxy/redis"
+	. "github.com/pingcap/check"
+	"github.com/pingcap/tidb/kv"
+	"github.com/pingcap/tidb/store/localstore"
+	"github.com/pingcap/tidb/store/localstore/goleveldb"
+)
+
+func TestHandler(t *testing.T) {
+	CustomVerboseFlag = true
+	TestingT(t)
+}
+
+var _ = Suite(&testHandlerSuite{})
+
+// testHandlerSuite runs the commands of a handler through a server on a
+// store in memory, the replies are checked as the clients read them.
+type testHandlerSuite struct {
+	store  kv.Storage
+	srv    *redis.Server
+	client net.Conn
+	r      *bufio.Reader
+}
+
+func (s *testHandlerSuite) SetUpTest(c *C) {
+	d := localstore.Driver{
+		Driver: goleveldb.MemoryDriver{},
+	}
+	store, err := d.Open("memory:")
+	c.Assert(err, IsNil)
+	s.store = store
+
+	s.srv, err = redis.NewServer(redis.DefaultConfig().Handler(NewTxTikvHandler(store)))
+	c.Assert(err, IsNil)
+	client, server := net.Pipe()
+	go s.srv.ServeClient(server)
+	client.SetDeadline(time.Now().Add(10 * time.Second))
+	s.client, s.r = client, bufio.NewReader(client)
+}
+
+func (s *testHandlerSuite) TearDownTest(c *C) {
+	s.client.Close()
+	// Shutdown closes the handler as well.
+	c.Assert(s.srv.Shutdown(context.Background()), IsNil)
+	c.Assert(s.store.Close(), IsNil)
+}
+
+// do sends a command and gets its reply as it was written.
+func (s *testHandlerSuite) do(c *C, args ...string) string {
+	cmd := fmt.Sprintf("*%d\r\n", len(args))
+	for _, arg := range args {
+		cmd += fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg)
+	}
+	_, err := s.client.Write([]byte(cmd))
+	c.Assert(err, IsNil)
+	reply, err := readReply(s.r)
+	c.Assert(err, IsNil)
+	return reply
+}
+
+// readReply reads one whole reply.
+func readReply(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil || len(line) < 3 {
+		return line, err
+	}
+	switch line[0] {
+	case '$':
+		n, err := strconv.Atoi(line[1 : len(line)-2])
+		if err != nil || n < 0 {
+			return line, err
+		}
+		b := make([]byte, n+2)
+		if _, err = io.ReadFull(r, b); err != nil {
+			return "", err
+		}
+		return line + string(b), nil
+	case '*':
+		n, err := strconv.Atoi(line[1 : len(line)-2])
+		if err != nil {
+			return line, err
+		}
+		for i := 0; i < n; i++ {
+			elem, err := readReply(r)
+			if err != nil {
+				return "", err
+			}
+			line += elem
+		}
+	}
+	return line, nil
+}
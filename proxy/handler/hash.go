@@ -1,6 +1,7 @@
 package handler
 
 import (
+	"github.com/Mansfield6/tikv-proxy-demo/proxy/redis"
 	"github.com/Mansfield6/tikv-proxy-demo/proxy/structure"
 	"github.com/juju/errors"
 	"github.com/ngaut/log"
@@ -17,30 +18,18 @@ func (h *TxTikvHandler) HSET(args [][]byte) (int, error) {
 
 	context := newRequestContext("hset")
 	log.Infof("%s hset %s", context.id, args)
-	res, err := CallWithRetry(context, func() (interface{}, error) {
-		txn, err := h.Store.Begin()
-		if err != nil {
-			return 0, errors.Trace(ErrBegionTXN)
-		}
-
-		tx := structure.NewStructure(txn, txn, []byte{0x00})
+	res, err := h.callTx(context, func(tx *structure.TxStructure) (interface{}, error) {
 		//res, ierr := tx.HSet(key, field, value)
-		res, ierr := tx.MergedHSet(key, field, value)
-
-		if ierr == nil {
-			ierr = txn.Commit()
-		}
-
-		if ierr != nil {
-			txn.Rollback()
-		}
-		return res, ierr
+		return tx.MergedHSet(key, field, value)
 	})
 
-	return res.(int), errors.Trace(err)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	return res.(int), nil
 }
 
-func (h *TxTikvHandler) HMSET(args [][]byte) ([]byte, error) {
+func (h *TxTikvHandler) HMSET(args [][]byte) (*redis.StatusReply, error) {
 	if len(args) == 1 || len(args)%2 != 1 {
 		return nil, errArguments("len(args) = %d, expect != 1 && mod 2 = 1", len(args))
 	}
@@ -56,27 +45,14 @@ func (h *TxTikvHandler) HMSET(args [][]byte) ([]byte, error) {
 
 	context := newRequestContext("hmset")
 	log.Infof("%s hmset %s %s", context.id, key, args)
-	res, err := CallWithRetry(context, func() (interface{}, error) {
-		txn, err := h.Store.Begin()
-		if err != nil {
-			return 0, errors.Trace(ErrBegionTXN)
-		}
-
-		tx := structure.NewStructure(txn, txn, []byte{0x00})
+	_, err := h.callTx(context, func(tx *structure.TxStructure) (interface{}, error) {
 		//res, ierr := tx.HMSet(key, eles)
-		res, ierr := tx.MergedHMSet(key, eles)
-
-		if ierr == nil {
-			ierr = txn.Commit()
-		}
-
-		if ierr != nil {
-			txn.Rollback()
-		}
-		return res, ierr
+		return tx.MergedHMSet(key, eles)
 	})
-
-	return res.([]byte), errors.Trace(err)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return redis.StatusOK, nil
 }
 
 func (h *TxTikvHandler) HGET(args [][]byte) ([]byte, error) {
@@ -89,51 +65,27 @@ func (h *TxTikvHandler) HGET(args [][]byte) ([]byte, error) {
 
 	context := newRequestContext("hget")
 	log.Infof("%s hget %s", context.id, args)
-	res, err := CallWithRetry(context, func() (interface{}, error) {
-		txn, err := h.Store.Begin()
-		if err != nil {
-			return nil, errors.Trace(ErrBegionTXN)
-		}
-
-		tx := structure.NewStructure(txn, txn, []byte{0x00})
+	res, err := h.callTx(context, func(tx *structure.TxStructure) (interface{}, error) {
 		//res, ierr := tx.HGet(key, field)
-		res, ierr := tx.MergedHGet(key, field)
-		if ierr == nil {
-			ierr = txn.Commit()
-		}
-
-		if ierr != nil {
-			txn.Rollback()
-		}
-		return res, ierr
+		return tx.MergedHGet(key, field)
 	})
-	return res.([]byte), err
-
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return res.([]byte), nil
 }
 
-func (h *TxTikvHandler) HGETALL(key []byte) ([][]byte, error) {
+func (h *TxTikvHandler) HGETALL(key []byte) (redis.Map, error) {
 	context := newRequestContext("hgetall")
 	log.Infof("%s hget %s", context.id, key)
-	res, err := CallWithRetry(context, func() (interface{}, error) {
-		txn, err := h.Store.Begin()
-		if err != nil {
-			return nil, errors.Trace(ErrBegionTXN)
-		}
-
-		tx := structure.NewStructure(txn, txn, []byte{0x00})
+	res, err := h.callTx(context, func(tx *structure.TxStructure) (interface{}, error) {
 		//res, ierr := tx.HGetAll(key)
-		res, ierr := tx.MergedHGetAll(key)
-		if ierr == nil {
-			ierr = txn.Commit()
-		}
-
-		if ierr != nil {
-			txn.Rollback()
-		}
-		return res, ierr
+		return tx.MergedHGetAll(key)
 	})
-	return res.([][]byte), err
-
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return redis.Map(bulkValues(res.([][]byte))), nil
 }
 
 func (h *TxTikvHandler) HDEL(key []byte, args [][]byte) (int, error) {
@@ -143,75 +95,38 @@ func (h *TxTikvHandler) HDEL(key []byte, args [][]byte) (int, error) {
 
 	context := newRequestContext("hdel")
 	log.Infof("%s hdel %s", context.id, args)
-	res, err := CallWithRetry(context, func() (interface{}, error) {
-		txn, err := h.Store.Begin()
-		if err != nil {
-			return 0, errors.Trace(ErrBegionTXN)
-		}
-
-		tx := structure.NewStructure(txn, txn, []byte{0x00})
+	res, err := h.callTx(context, func(tx *structure.TxStructure) (interface{}, error) {
 		//res, ierr := tx.HDel(key, args)
-		res, ierr := tx.MergedHDel(key, args)
-
-		if ierr == nil {
-			ierr = txn.Commit()
-		}
-
-		if ierr != nil {
-			txn.Rollback()
-		}
-		return res, ierr
+		return tx.MergedHDel(key, args)
 	})
-
-	return res.(int), err
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	return res.(int), nil
 }
 
 func (h *TxTikvHandler) HKEYS(key []byte) ([][]byte, error) {
 
 	context := newRequestContext("hkeys")
 	log.Infof("%s hkeys %s", context.id, key)
-	res, err := CallWithRetry(context, func() (interface{}, error) {
-		txn, err := h.Store.Begin()
-		if err != nil {
-			return nil, errors.Trace(ErrBegionTXN)
-		}
-
-		tx := structure.NewStructure(txn, txn, []byte{0x00})
+	res, err := h.callTx(context, func(tx *structure.TxStructure) (interface{}, error) {
 		//res, ierr := tx.HKeys(key)
-		res, ierr := tx.MergedHKeys(key)
-		if ierr == nil {
-			ierr = txn.Commit()
-		}
-
-		if ierr != nil {
-			txn.Rollback()
-		}
-		return res, ierr
+		return tx.MergedHKeys(key)
 	})
-	return res.([][]byte), err
-
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return res.([][]byte), nil
 }
 
 func (h *TxTikvHandler) HLEN(key []byte) (int, error) {
 	context := newRequestContext("hlen")
 	log.Infof("%s hlen %s", context.id, key)
-	res, err := CallWithRetry(context, func() (interface{}, error) {
-		txn, err := h.Store.Begin()
-		if err != nil {
-			return nil, errors.Trace(ErrBegionTXN)
-		}
-
-		tx := structure.NewStructure(txn, txn, []byte{0x00})
-		res, ierr := tx.HLen(key)
-
-		if ierr == nil {
-			ierr = txn.Commit()
-		}
-
-		if ierr != nil {
-			txn.Rollback()
-		}
-		return res, ierr
+	res, err := h.callTx(context, func(tx *structure.TxStructure) (interface{}, error) {
+		return tx.HLen(key)
 	})
-	return res.(int), err
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	return res.(int), nil
 }
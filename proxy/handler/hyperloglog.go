@@ -0,0 +1,56 @@
+package handler
+
+import (
+	"github.com/Mansfield6/tikv-proxy-demo/proxy/redis"
+	"github.com/Mansfield6/tikv-proxy-demo/proxy/structure"
+	"github.com/juju/errors"
+	"github.com/ngaut/log"
+)
+
+func (h *TxTikvHandler) PFADD(args [][]byte) (int, error) {
+	if len(args) < 1 {
+		return 0, errArguments("len(args) = %d, expect >= 1", len(args))
+	}
+
+	context := newRequestContext("pfadd")
+	log.Infof("%s pfadd %s", context.id, args)
+	res, err := h.callTx(context, func(tx *structure.TxStructure) (interface{}, error) {
+		return tx.PFAdd(args[0], args[1:])
+	})
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	return res.(int), nil
+}
+
+func (h *TxTikvHandler) PFCOUNT(keys [][]byte) (int, error) {
+	if len(keys) < 1 {
+		return 0, errArguments("len(args) = %d, expect >= 1", len(keys))
+	}
+
+	context := newRequestContext("pfcount")
+	log.Infof("%s pfcount %s", context.id, keys)
+	res, err := h.callTx(context, func(tx *structure.TxStructure) (interface{}, error) {
+		return tx.PFCount(keys)
+	})
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	return int(res.(int64)), nil
+}
+
+func (h *TxTikvHandler) PFMERGE(args [][]byte) (*redis.StatusReply, error) {
+	if len(args) < 1 {
+		return nil, errArguments("len(args) = %d, expect >= 1", len(args))
+	}
+
+	context := newRequestContext("pfmerge")
+	log.Infof("%s pfmerge %s", context.id, args)
+	_, err := h.callTx(context, func(tx *structure.TxStructure) (interface{}, error) {
+		return nil, tx.PFMerge(args[0], args[1:])
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return redis.StatusOK, nil
+}
@@ -0,0 +1,80 @@
+package handler
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/Mansfield6/tikv-proxy-demo/proxy/config"
+	"github.com/Mansfield6/tikv-proxy-demo/proxy/structure"
+	"github.com/juju/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// InfoSections adds the keyspace and the tikv sections to INFO.
+func (h *TxTikvHandler) InfoSections() []string {
+	return []string{"keyspace", "tikv"}
+}
+
+// InfoSection gets the fields of the keyspace or the tikv section.
+func (h *TxTikvHandler) InfoSection(name string) ([][2]string, error) {
+	switch name {
+	case "keyspace":
+		return h.keyspaceInfo()
+	case "tikv":
+		return h.tikvInfo(), nil
+	}
+	return nil, nil
+}
+
+// keyspaceInfo counts the keys of the databases that have some, expired
+// keys not reaped yet included, in the format of redis.
+func (h *TxTikvHandler) keyspaceInfo() ([][2]string, error) {
+	txn, err := h.Store.Begin()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer txn.Rollback()
+
+	var fields [][2]string
+	for db := 0; db < structure.Databases; db++ {
+		tx, err := structure.NewDBStructure(txn, db)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		n, err := tx.DBSize()
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		if n > 0 {
+			// expires and avg_ttl are always 0, the keys with a ttl are
+			// kept in an expire index shared by all the databases, which
+			// would have to be read whole to count them.
+			fields = append(fields, [2]string{fmt.Sprintf("db%d", db), fmt.Sprintf("keys=%d,expires=0,avg_ttl=0", n)})
+		}
+	}
+	return fields, nil
+}
+
+// tikvInfo shows the store and the counters of the retries and conflicts,
+// which come from the metrics and are not reset by CONFIG RESETSTAT.
+func (h *TxTikvHandler) tikvInfo() [][2]string {
+	return [][2]string{
+		{"pd_address", config.PDAddr.Get()},
+		{"store_uuid", h.Store.UUID()},
+		{"max_retry_count", strconv.Itoa(config.MaxRetryCount.Get())},
+		{"total_retries", counterValue(retryCounter)},
+		{"total_retryable_errors", counterValue(retryErrorCounter.WithLabelValues("retryable"))},
+		{"total_non_retryable_errors", counterValue(retryErrorCounter.WithLabelValues("non_retryable"))},
+		{"total_txn_conflicts", counterValue(txnConflictCounter)},
+	}
+}
+
+// counterValue reads the value of a counter of the metrics.
+func counterValue(c prometheus.Counter) string {
+	var m dto.Metric
+	if err := c.Write(&m); err != nil {
+		return "0"
+	}
+	return strconv.FormatInt(int64(m.GetCounter().GetValue()), 10)
+}
@@ -1,11 +1,20 @@
 package handler
 
 import (
+	"math"
+	"math/big"
+	"strings"
+
+	"github.com/Mansfield6/tikv-proxy-demo/proxy/config"
+	"github.com/Mansfield6/tikv-proxy-demo/proxy/redis"
 	"github.com/Mansfield6/tikv-proxy-demo/proxy/structure"
+	"github.com/Mansfield6/tikv-proxy-demo/proxy/util"
 	"github.com/juju/errors"
 	"github.com/ngaut/log"
 )
 
+var errInvalidCursor = errors.New("invalid cursor")
+
 func (h *TxTikvHandler) DEL(keys [][]byte) (int, error) {
 	if len(keys) == 0 {
 		return 0, errArguments("len(args) = %d, expect != 0", len(keys))
@@ -13,26 +22,322 @@ func (h *TxTikvHandler) DEL(keys [][]byte) (int, error) {
 
 	context := newRequestContext("del")
 	log.Infof("%s del %s", context.id, keys)
-	res, err := CallWithRetry(context, func() (interface{}, error) {
-		txn, err := h.Store.Begin()
+	res, err := h.callTx(context, func(tx *structure.TxStructure) (interface{}, error) {
+		return tx.DEL(keys)
+	})
+	return res.(int), err
+
+}
+
+func (h *TxTikvHandler) UNLINK(keys [][]byte) (int, error) {
+	if len(keys) == 0 {
+		return 0, errArguments("len(args) = %d, expect != 0", len(keys))
+	}
+
+	context := newRequestContext("unlink")
+	log.Infof("%s unlink %s", context.id, keys)
+	res, err := h.callTx(context, func(tx *structure.TxStructure) (interface{}, error) {
+		return tx.DEL(keys)
+	})
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	return res.(int), nil
+}
+
+func (h *TxTikvHandler) TYPE(key []byte) ([]byte, error) {
+	context := newRequestContext("type")
+	log.Infof("%s type %s", context.id, key)
+	res, err := h.callTx(context, func(tx *structure.TxStructure) (interface{}, error) {
+		return tx.Type(key)
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return []byte(res.(string)), nil
+}
+
+func (h *TxTikvHandler) EXISTS(keys [][]byte) (int, error) {
+	return h.exists("exists", keys)
+}
+
+// TOUCH only counts the keys, there is no access time to update.
+func (h *TxTikvHandler) TOUCH(keys [][]byte) (int, error) {
+	return h.exists("touch", keys)
+}
+
+func (h *TxTikvHandler) exists(cmd string, keys [][]byte) (int, error) {
+	if len(keys) == 0 {
+		return 0, errArguments("len(args) = %d, expect != 0", len(keys))
+	}
+
+	context := newRequestContext(cmd)
+	log.Infof("%s %s %s", context.id, cmd, keys)
+	res, err := h.callTx(context, func(tx *structure.TxStructure) (interface{}, error) {
+		return tx.Exists(keys)
+	})
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	return res.(int), nil
+}
+
+func (h *TxTikvHandler) RENAME(src []byte, dst []byte) (*redis.StatusReply, error) {
+	if _, err := h.rename("rename", src, dst, false); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return redis.StatusOK, nil
+}
+
+func (h *TxTikvHandler) RENAMENX(src []byte, dst []byte) (int, error) {
+	return h.rename("renamenx", src, dst, true)
+}
+
+func (h *TxTikvHandler) rename(cmd string, src []byte, dst []byte, nx bool) (int, error) {
+	context := newRequestContext(cmd)
+	log.Infof("%s %s %s %s", context.id, cmd, src, dst)
+	res, err := h.callTx(context, func(tx *structure.TxStructure) (interface{}, error) {
+		return tx.Rename(src, dst, nx)
+	})
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	if res.(bool) {
+		return 1, nil
+	}
+	return 0, nil
+}
+
+func (h *TxTikvHandler) COPY(args [][]byte) (int, error) {
+	if len(args) < 2 {
+		return 0, errArguments("len(args) = %d, expect >= 2", len(args))
+	}
+
+	replace := false
+	db := h.db
+	for i := 2; i < len(args); i++ {
+		switch strings.ToUpper(string(args[i])) {
+		case "REPLACE":
+			replace = true
+		case "DB":
+			if i+1 >= len(args) {
+				return 0, ErrSyntax
+			}
+			var err error
+			if db, err = parseDB(args[i+1]); err != nil {
+				return 0, err
+			}
+			i++
+		default:
+			return 0, ErrSyntax
+		}
+	}
+
+	context := newRequestContext("copy")
+	log.Infof("%s copy %s", context.id, args)
+	res, err := h.callTx(context, func(tx *structure.TxStructure) (interface{}, error) {
+		dt, err := tx.DB(db)
 		if err != nil {
-			return 0, errors.Trace(ErrBegionTXN)
+			return nil, errors.Trace(err)
 		}
+		return tx.CopyTo(args[0], dt, args[1], replace)
+	})
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	if res.(bool) {
+		return 1, nil
+	}
+	return 0, nil
+}
 
-		tx := structure.NewStructure(txn, txn, []byte{0x00})
-		res, ierr := tx.DEL(keys)
+func (h *TxTikvHandler) EXPIRE(args [][]byte) (int, error) {
+	return h.expireGeneric("expire", args, 1000, true)
+}
 
-		if ierr == nil {
-			ierr = txn.Commit()
+func (h *TxTikvHandler) PEXPIRE(args [][]byte) (int, error) {
+	return h.expireGeneric("pexpire", args, 1, true)
+}
+
+func (h *TxTikvHandler) EXPIREAT(args [][]byte) (int, error) {
+	return h.expireGeneric("expireat", args, 1000, false)
+}
+
+func (h *TxTikvHandler) PEXPIREAT(args [][]byte) (int, error) {
+	return h.expireGeneric("pexpireat", args, 1, false)
+}
+
+// expireGeneric sets the ttl of args[0]. The time argument is in units of
+// unit milliseconds, relative to now if relative is set. A time that does
+// not fit in a unix time in milliseconds is rejected as redis does, one in
+// the past deletes the key.
+func (h *TxTikvHandler) expireGeneric(cmd string, args [][]byte, unit int64, relative bool) (int, error) {
+	if len(args) != 2 {
+		return 0, errArguments("len(args) = %d, expect = 2", len(args))
+	}
+
+	key := args[0]
+	n, err := parseInt(args[1])
+	if err != nil {
+		return 0, err
+	}
+	if n > math.MaxInt64/unit || n < math.MinInt64/unit {
+		return 0, errors.Errorf("invalid expire time in '%s' command", cmd)
+	}
+	expireAt := n * unit
+	if relative {
+		now := nowms()
+		if expireAt > math.MaxInt64-now {
+			return 0, errors.Errorf("invalid expire time in '%s' command", cmd)
 		}
+		expireAt += now
+	}
+
+	context := newRequestContext(cmd)
+	log.Infof("%s %s %s", context.id, cmd, args)
+	res, err := h.callTx(context, func(tx *structure.TxStructure) (interface{}, error) {
+		return tx.ExpireAt(key, expireAt)
+	})
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	return res.(int), nil
+}
+
+func (h *TxTikvHandler) TTL(key []byte) (int, error) {
+	ttl, err := h.pttl("ttl", key)
+	if err != nil || ttl < 0 {
+		return int(ttl), err
+	}
+	return int((ttl + 500) / 1000), nil
+}
+
+func (h *TxTikvHandler) PTTL(key []byte) (int, error) {
+	ttl, err := h.pttl("pttl", key)
+	return int(ttl), err
+}
+
+func (h *TxTikvHandler) pttl(cmd string, key []byte) (int64, error) {
+	context := newRequestContext(cmd)
+	log.Infof("%s %s %s", context.id, cmd, key)
+	res, err := h.callTx(context, func(tx *structure.TxStructure) (interface{}, error) {
+		return tx.PTTL(key)
+	})
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	return res.(int64), nil
+}
+
+func (h *TxTikvHandler) PERSIST(key []byte) (int, error) {
+	context := newRequestContext("persist")
+	log.Infof("%s persist %s", context.id, key)
+	res, err := h.callTx(context, func(tx *structure.TxStructure) (interface{}, error) {
+		return tx.Persist(key)
+	})
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	return res.(int), nil
+}
+
+func (h *TxTikvHandler) KEYS(pattern []byte) ([][]byte, error) {
+	context := newRequestContext("keys")
+	log.Infof("%s keys %s", context.id, pattern)
+	res, err := h.callTx(context, func(tx *structure.TxStructure) (interface{}, error) {
+		return tx.Keys(func(key []byte, flag structure.TypeFlag) bool {
+			return util.GlobMatch(pattern, key)
+		})
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return res.([][]byte), nil
+}
 
-		if ierr != nil {
-			txn.Rollback()
-			log.Error(ierr)
+func (h *TxTikvHandler) SCAN(args [][]byte) ([]interface{}, error) {
+	if len(args) < 1 {
+		return nil, errArguments("len(args) = %d, expect >= 1", len(args))
+	}
+
+	cursor, err := decodeCursor(args[0])
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	var pattern []byte
+	var typeName string
+	count := int64(config.ScanDefaultCount.Get())
+	for i := 1; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			return nil, ErrSyntax
+		}
+		switch strings.ToUpper(string(args[i])) {
+		case "MATCH":
+			pattern = args[i+1]
+		case "COUNT":
+			if count, err = parseInt(args[i+1]); err != nil {
+				return nil, errors.Trace(err)
+			}
+			if count < 1 {
+				return nil, ErrSyntax
+			}
+		case "TYPE":
+			typeName = strings.ToLower(string(args[i+1]))
+		default:
+			return nil, ErrSyntax
 		}
-		return res, ierr
+	}
+	if max := int64(config.ScanMaxCount.Get()); count > max {
+		count = max
+	}
+
+	context := newRequestContext("scan")
+	log.Infof("%s scan %s", context.id, args)
+	var next []byte
+	res, err := h.callTx(context, func(tx *structure.TxStructure) (interface{}, error) {
+		keys, last, err := tx.Scan(cursor, int(count), func(key []byte, flag structure.TypeFlag) bool {
+			if typeName != "" && structure.TypeName(flag) != typeName {
+				return false
+			}
+			return pattern == nil || util.GlobMatch(pattern, key)
+		})
+		next = last
+		return keys, err
 	})
-	return res.(int), err
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	keys := res.([][]byte)
+	if keys == nil {
+		keys = [][]byte{}
+	}
+	return []interface{}{encodeCursor(next), keys}, nil
+}
 
+// encodeCursor turns the last key a scan visited into a cursor, "0" when the
+// scan is complete. The cursor is the key read as a big-endian number behind
+// a leading 1 byte, so clients that expect numeric cursors keep working.
+func encodeCursor(key []byte) []byte {
+	if key == nil {
+		return []byte("0")
+	}
+	n := new(big.Int).SetBytes(append([]byte{1}, key...))
+	return []byte(n.String())
 }
 
+func decodeCursor(arg []byte) ([]byte, error) {
+	if string(arg) == "0" {
+		return nil, nil
+	}
+	n, ok := new(big.Int).SetString(string(arg), 10)
+	if !ok || n.Sign() <= 0 {
+		return nil, errInvalidCursor
+	}
+	b := n.Bytes()
+	if b[0] != 1 {
+		return nil, errInvalidCursor
+	}
+	return b[1:], nil
+}
@@ -0,0 +1,16 @@
+package handler
+
+import (
+	. "github.com/pingcap/check"
+)
+
+func (s *testHandlerSuite) TestHyperLogLogType(c *C) {
+	c.Assert(s.do(c, "PFADD", "h", "a"), Equals, ":1\r\n")
+	c.Assert(s.do(c, "SET", "s", "a"), Equals, "+OK\r\n")
+
+	// TYPE, SCAN TYPE and the string commands agree on what a hyperloglog is.
+	c.Assert(s.do(c, "TYPE", "h"), Equals, "$11\r\nhyperloglog\r\n")
+	c.Assert(s.do(c, "SCAN", "0", "TYPE", "string"), Equals, "*2\r\n$1\r\n0\r\n*1\r\n$1\r\ns\r\n")
+	c.Assert(s.do(c, "SCAN", "0", "TYPE", "hyperloglog"), Equals, "*2\r\n$1\r\n0\r\n*1\r\n$1\r\nh\r\n")
+	c.Assert(s.do(c, "GET", "h"), Matches, "-WRONGTYPE .*\r\n")
+}
@@ -0,0 +1,242 @@
+package handler
+
+import (
+	"strings"
+
+	"github.com/Mansfield6/tikv-proxy-demo/proxy/redis"
+	"github.com/Mansfield6/tikv-proxy-demo/proxy/structure"
+	"github.com/juju/errors"
+	"github.com/ngaut/log"
+)
+
+func (h *TxTikvHandler) LPUSH(args [][]byte) (int, error) {
+	return h.listPush("lpush", args, true)
+}
+
+func (h *TxTikvHandler) RPUSH(args [][]byte) (int, error) {
+	return h.listPush("rpush", args, false)
+}
+
+func (h *TxTikvHandler) listPush(cmd string, args [][]byte, left bool) (int, error) {
+	if len(args) < 2 {
+		return 0, errArguments("len(args) = %d, expect >= 2", len(args))
+	}
+
+	context := newRequestContext(cmd)
+	log.Infof("%s %s %s", context.id, cmd, args)
+	res, err := h.callTx(context, func(tx *structure.TxStructure) (interface{}, error) {
+		var err error
+		if left {
+			err = tx.LPush(args[0], args[1:]...)
+		} else {
+			err = tx.RPush(args[0], args[1:]...)
+		}
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		return tx.LLen(args[0])
+	})
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	h.signalList()
+	return int(res.(int64)), nil
+}
+
+func (h *TxTikvHandler) LPOP(args [][]byte) (interface{}, error) {
+	return h.listPop("lpop", args, true)
+}
+
+func (h *TxTikvHandler) RPOP(args [][]byte) (interface{}, error) {
+	return h.listPop("rpop", args, false)
+}
+
+// listPop pops one element as a bulk reply, or up to count elements as an
+// array reply when a count is given.
+func (h *TxTikvHandler) listPop(cmd string, args [][]byte, left bool) (interface{}, error) {
+	if len(args) != 1 && len(args) != 2 {
+		return nil, errArguments("len(args) = %d, expect = 1 or 2", len(args))
+	}
+
+	count := int64(1)
+	if len(args) == 2 {
+		n, err := parseInt(args[1])
+		if err != nil || n < 0 {
+			return nil, errors.New("value is out of range, must be positive")
+		}
+		count = n
+	}
+
+	context := newRequestContext(cmd)
+	log.Infof("%s %s %s", context.id, cmd, args)
+	res, err := h.callTx(context, func(tx *structure.TxStructure) (interface{}, error) {
+		if count == 0 {
+			// Nothing is popped, but a missing key still replies nil.
+			n, err := tx.LLen(args[0])
+			if err != nil || n == 0 {
+				return [][]byte(nil), errors.Trace(err)
+			}
+			return [][]byte{}, nil
+		}
+
+		var values [][]byte
+		for i := int64(0); i < count; i++ {
+			var v []byte
+			var err error
+			if left {
+				v, err = tx.LPop(args[0])
+			} else {
+				v, err = tx.RPop(args[0])
+			}
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+			if v == nil {
+				break
+			}
+			values = append(values, v)
+		}
+		return values, nil
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	values := res.([][]byte)
+	if len(args) == 2 {
+		// With a count a missing key replies a nil array.
+		if values == nil {
+			return []interface{}(nil), nil
+		}
+		return values, nil
+	}
+	if len(values) == 0 {
+		return nil, nil
+	}
+	return values[0], nil
+}
+
+func (h *TxTikvHandler) LMOVE(src []byte, dst []byte, from []byte, to []byte) ([]byte, error) {
+	srcLeft, err := parseListEnd(from)
+	if err != nil {
+		return nil, err
+	}
+	dstLeft, err := parseListEnd(to)
+	if err != nil {
+		return nil, err
+	}
+
+	context := newRequestContext("lmove")
+	log.Infof("%s lmove %s %s %s %s", context.id, src, dst, from, to)
+	res, err := h.callTx(context, func(tx *structure.TxStructure) (interface{}, error) {
+		return tx.LMove(src, dst, srcLeft, dstLeft)
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	v := res.([]byte)
+	if v != nil {
+		h.signalList()
+	}
+	return v, nil
+}
+
+// parseListEnd parses the LEFT or RIGHT argument of LMOVE, it is true for
+// LEFT.
+func parseListEnd(arg []byte) (bool, error) {
+	switch strings.ToUpper(string(arg)) {
+	case "LEFT":
+		return true, nil
+	case "RIGHT":
+		return false, nil
+	}
+	return false, ErrSyntax
+}
+
+func (h *TxTikvHandler) LLEN(key []byte) (int, error) {
+	context := newRequestContext("llen")
+	log.Infof("%s llen %s", context.id, key)
+	res, err := h.callTx(context, func(tx *structure.TxStructure) (interface{}, error) {
+		return tx.LLen(key)
+	})
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	return int(res.(int64)), nil
+}
+
+func (h *TxTikvHandler) LINDEX(key []byte, index []byte) (interface{}, error) {
+	i, err := parseInt(index)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	context := newRequestContext("lindex")
+	log.Infof("%s lindex %s %s", context.id, key, index)
+	res, err := h.callTx(context, func(tx *structure.TxStructure) (interface{}, error) {
+		return tx.LIndex(key, i)
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return bulkOrNil(res.([]byte)), nil
+}
+
+func (h *TxTikvHandler) LSET(key []byte, index []byte, value []byte) (*redis.StatusReply, error) {
+	i, err := parseInt(index)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	context := newRequestContext("lset")
+	log.Infof("%s lset %s %s %s", context.id, key, index, value)
+	_, err = h.callTx(context, func(tx *structure.TxStructure) (interface{}, error) {
+		return nil, tx.LSet(key, i, value)
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return redis.StatusOK, nil
+}
+
+func (h *TxTikvHandler) LRANGE(key []byte, start []byte, stop []byte) ([][]byte, error) {
+	first, err := parseInt(start)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	last, err := parseInt(stop)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	context := newRequestContext("lrange")
+	log.Infof("%s lrange %s %s %s", context.id, key, start, stop)
+	res, err := h.callTx(context, func(tx *structure.TxStructure) (interface{}, error) {
+		return tx.LRange(key, first, last)
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return res.([][]byte), nil
+}
+
+func (h *TxTikvHandler) LTRIM(key []byte, start []byte, stop []byte) (*redis.StatusReply, error) {
+	first, err := parseInt(start)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	last, err := parseInt(stop)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	context := newRequestContext("ltrim")
+	log.Infof("%s ltrim %s %s %s", context.id, key, start, stop)
+	_, err = h.callTx(context, func(tx *structure.TxStructure) (interface{}, error) {
+		return nil, tx.LTrim(key, first, last)
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return redis.StatusOK, nil
+}
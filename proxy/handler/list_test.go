@@ -0,0 +1,35 @@
+package handler
+
+import (
+	. "github.com/pingcap/check"
+)
+
+func (s *testHandlerSuite) TestListPopCount(c *C) {
+	c.Assert(s.do(c, "RPUSH", "l", "a", "b"), Equals, ":2\r\n")
+
+	tbl := []struct {
+		args  []string
+		reply string
+	}{
+		// Without a count a missing key replies a nil bulk, with one a nil
+		// array.
+		{[]string{"LPOP", "missing"}, "$-1\r\n"},
+		{[]string{"LPOP", "missing", "1"}, "*-1\r\n"},
+		{[]string{"RPOP", "missing", "0"}, "*-1\r\n"},
+		{[]string{"LPOP", "l", "0"}, "*0\r\n"},
+		{[]string{"LPOP", "l", "1"}, "*1\r\n$1\r\na\r\n"},
+		{[]string{"RPOP", "l"}, "$1\r\nb\r\n"},
+		{[]string{"LPOP", "l", "1"}, "*-1\r\n"},
+	}
+	for _, t := range tbl {
+		c.Assert(s.do(c, t.args...), Equals, t.reply, Commentf("%v", t.args))
+	}
+}
+
+func (s *testHandlerSuite) TestLSetOutOfRange(c *C) {
+	c.Assert(s.do(c, "RPUSH", "l", "a"), Equals, ":1\r\n")
+	c.Assert(s.do(c, "LSET", "l", "1", "x"), Equals, "-ERR index out of range\r\n")
+	c.Assert(s.do(c, "LSET", "l", "-2", "x"), Equals, "-ERR index out of range\r\n")
+	c.Assert(s.do(c, "LSET", "missing", "0", "x"), Equals, "-ERR no such key\r\n")
+	c.Assert(s.do(c, "LSET", "l", "-1", "x"), Equals, "+OK\r\n")
+}
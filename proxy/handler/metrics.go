@@ -0,0 +1,48 @@
+package handler
+
+import (
+	"github.com/juju/errors"
+	"github.com/pingcap/tidb/kv"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	retryCounter = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "tikvproxy",
+			Subsystem: "handler",
+			Name:      "retry_total",
+			Help:      "Counter of the transactions retried by CallWithRetry.",
+		})
+
+	retryErrorCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "tikvproxy",
+			Subsystem: "handler",
+			Name:      "retry_error_total",
+			Help:      "Counter of the errors met by CallWithRetry.",
+		}, []string{"type"})
+
+	txnConflictCounter = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "tikvproxy",
+			Subsystem: "handler",
+			Name:      "txn_conflict_total",
+			Help:      "Counter of the transactions failed to commit on a conflict.",
+		})
+)
+
+func init() {
+	prometheus.MustRegister(retryCounter)
+	prometheus.MustRegister(retryErrorCounter)
+	prometheus.MustRegister(txnConflictCounter)
+}
+
+// commitTxn commits txn, counting the commits lost to a conflict.
+func commitTxn(txn kv.Transaction) error {
+	err := txn.Commit()
+	if err != nil && kv.IsRetryableError(err) {
+		txnConflictCounter.Inc()
+	}
+	return errors.Trace(err)
+}
@@ -0,0 +1,145 @@
+package handler
+
+import (
+	"bytes"
+
+	"github.com/Mansfield6/tikv-proxy-demo/proxy/redis"
+	"github.com/Mansfield6/tikv-proxy-demo/proxy/structure"
+	"github.com/juju/errors"
+	"github.com/ngaut/log"
+	"github.com/pingcap/tidb/kv"
+)
+
+func (h *TxTikvHandler) WATCH(keys [][]byte) (*redis.StatusReply, error) {
+	if len(keys) == 0 {
+		return nil, errArguments("len(args) = %d, expect != 0", len(keys))
+	}
+
+	context := newRequestContext("watch")
+	log.Infof("%s watch %s", context.id, keys)
+	res, err := h.callTx(context, func(tx *structure.TxStructure) (interface{}, error) {
+		versions := make([][]byte, len(keys))
+		for i, key := range keys {
+			v, err := tx.KeyVersion(key)
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+			versions[i] = v
+		}
+		return versions, nil
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if h.watched == nil {
+		h.watched = make(map[watchedKey][]byte)
+	}
+	for i, v := range res.([][]byte) {
+		// A key watched twice keeps its first version.
+		wk := watchedKey{db: h.db, key: string(keys[i])}
+		if _, ok := h.watched[wk]; !ok {
+			h.watched[wk] = v
+		}
+	}
+	return redis.StatusOK, nil
+}
+
+// watchedKey is a key given to WATCH in the database selected then.
+type watchedKey struct {
+	db  int
+	key string
+}
+
+func (h *TxTikvHandler) UNWATCH() (*redis.StatusReply, error) {
+	h.watched = nil
+	return redis.StatusOK, nil
+}
+
+// Exec runs the commands queued by MULTI through run in one transaction. It
+// returns false without running them if a watched key changed since WATCH.
+// Their meta keys stay locked until the commit, and every write to a key
+// writes its meta, so a change made meanwhile fails the commit and aborts
+// the EXEC as well. Exec is called by the server and is
+// not a command.
+func (h *TxTikvHandler) Exec(run func() error) (bool, error) {
+	watched := h.watched
+	h.watched = nil
+
+	context := newRequestContext("exec")
+	log.Infof("%s exec, %d watched keys", context.id, len(watched))
+	txn, err := h.Store.Begin()
+	if err != nil {
+		return false, errors.Trace(ErrBegionTXN)
+	}
+
+	for wk, version := range watched {
+		tx, err := structure.NewDBStructure(txn, wk.db)
+		var v []byte
+		if err == nil {
+			v, err = tx.KeyVersion([]byte(wk.key))
+		}
+		if err == nil && !bytes.Equal(v, version) {
+			log.Infof("%s exec aborted, watched key %s changed", context.id, wk.key)
+			txn.Rollback()
+			return false, nil
+		}
+		if err == nil {
+			err = txn.LockKeys(tx.EncodeMetaKey([]byte(wk.key)))
+		}
+		if err != nil {
+			txn.Rollback()
+			return false, errors.Trace(err)
+		}
+	}
+
+	h.txn = txn
+	err = run()
+	if err == nil {
+		err = h.execErr
+	}
+	pushed := h.execPushed
+	h.txn, h.execErr, h.execPushed = nil, nil, false
+
+	if err == nil {
+		err = commitTxn(txn)
+	}
+	if err == nil && pushed {
+		h.blocked.signal()
+	}
+	if err != nil {
+		txn.Rollback()
+		if len(watched) > 0 && kv.IsRetryableError(err) {
+			log.Infof("%s exec aborted by a conflict - %s", context.id, err)
+			return false, nil
+		}
+		return false, replyError(err)
+	}
+	return true, nil
+}
+
+// Discard forgets the watched keys, it is called by the server for DISCARD
+// and is not a command.
+func (h *TxTikvHandler) Discard() {
+	h.watched = nil
+}
+
+// callExecTx runs fn on the transaction of the running EXEC, in the database
+// selected at that point of the EXEC. An error that would make callTx retry
+// aborts the whole EXEC instead, since the commands before this one can not
+// be run again. The map of the databases is read from the transaction, so a
+// SWAPDB queued before the command applies to it.
+func (h *TxTikvHandler) callExecTx(fn func(tx *structure.TxStructure) (interface{}, error)) (interface{}, error) {
+	if h.execErr != nil {
+		return nil, h.execErr
+	}
+	tx, err := structure.NewDBStructure(h.txn, h.db)
+	var res interface{}
+	if err == nil {
+		res, err = fn(tx)
+	}
+	if err != nil && kv.IsRetryableError(err) {
+		h.execErr = err
+	}
+	return res, err
+}
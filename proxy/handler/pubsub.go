@@ -0,0 +1,135 @@
+package handler
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Mansfield6/tikv-proxy-demo/proxy/redis"
+	"github.com/Mansfield6/tikv-proxy-demo/proxy/structure"
+	"github.com/Mansfield6/tikv-proxy-demo/proxy/uuid"
+	"github.com/juju/errors"
+	"github.com/pingcap/tidb/kv"
+	"github.com/pingcap/tidb/store/tikv/oracle"
+)
+
+// pubsubCommitLag is how long after its start a publishing transaction may
+// still commit. The log is ordered by start timestamps, so a message can show
+// up behind messages already read, the log reads that far back again and
+// skips the messages it has seen. A message committed later would be missed,
+// so Publish does not commit a transaction that is more than half of it old,
+// the other half is left to the commit itself.
+const pubsubCommitLag = time.Second
+
+// PubSubLog keeps the Pub/Sub messages in the store, so a message published
+// on one proxy reaches the subscribers of every proxy on the same cluster.
+// It implements redis.PubSubLog, the messages are numbered in the order the
+// proxy reads them.
+type PubSubLog struct {
+	store kv.Storage
+	id    []byte
+
+	mu sync.Mutex
+	// seq is the number of the last message read.
+	seq uint64
+	// floor is the version the log has been read up to, 0 before the first
+	// read. seen holds the messages read that started less than
+	// pubsubCommitLag before floor.
+	floor   uint64
+	seen    map[pubsubID]bool
+	pending []redis.PubSubMessage
+}
+
+type pubsubID struct {
+	ts        uint64
+	publisher string
+}
+
+func NewPubSubLog(store kv.Storage) *PubSubLog {
+	return &PubSubLog{store: store, id: uuid.NewV4().Bytes(), seen: make(map[pubsubID]bool)}
+}
+
+func (l *PubSubLog) Publish(channel []byte, message []byte) error {
+	_, err := callStore(l.store, "publish", func(txn kv.Transaction) (interface{}, error) {
+		if err := structure.PublishMessage(txn, txn.StartTS(), l.id, channel, message); err != nil {
+			return nil, errors.Trace(err)
+		}
+		// A retry starts a new transaction, so the message gets a new place
+		// in the log the readers have not passed yet.
+		age := time.Duration(oracle.GetPhysical(time.Now())-oracle.ExtractPhysical(txn.StartTS())) * time.Millisecond
+		if age > pubsubCommitLag/2 {
+			return nil, errors.Annotatef(kv.ErrRetryable, "publish started %s ago", age)
+		}
+		return nil, nil
+	})
+	return errors.Trace(err)
+}
+
+func (l *PubSubLog) Last() (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	err := l.fill()
+	l.pending = nil
+	return l.seq, errors.Trace(err)
+}
+
+func (l *PubSubLog) Read(after uint64, limit int) ([]redis.PubSubMessage, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.pending) == 0 {
+		if err := l.fill(); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+	for len(l.pending) > 0 && l.pending[0].Seq <= after {
+		l.pending = l.pending[1:]
+	}
+	if limit > len(l.pending) {
+		limit = len(l.pending)
+	}
+	res := l.pending[:limit]
+	l.pending = l.pending[limit:]
+	return res, nil
+}
+
+// fill reads the messages published since the last read into pending.
+func (l *PubSubLog) fill() error {
+	ver, err := l.store.CurrentVersion()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	snap, err := l.store.GetSnapshot(ver)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if l.floor == 0 {
+		l.floor = ver.Ver
+	}
+	msgs, err := structure.ReadMessages(snap, lagBehind(l.floor), ver.Ver)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	for _, m := range msgs {
+		id := pubsubID{m.TS, string(m.Publisher)}
+		if l.seen[id] {
+			continue
+		}
+		l.seen[id] = true
+		l.seq++
+		l.pending = append(l.pending, redis.PubSubMessage{Seq: l.seq, Channel: m.Channel, Message: m.Message})
+	}
+	l.floor = ver.Ver
+	// The next read skips the messages started up to from.
+	from := lagBehind(l.floor)
+	for id := range l.seen {
+		if id.ts <= from {
+			delete(l.seen, id)
+		}
+	}
+	return nil
+}
+
+// lagBehind gets the timestamp pubsubCommitLag before ts.
+func lagBehind(ts uint64) uint64 {
+	return oracle.ComposeTS(oracle.ExtractPhysical(ts)-int64(pubsubCommitLag/time.Millisecond), 0)
+}
@@ -0,0 +1,53 @@
+package handler
+
+import (
+	"time"
+
+	. "github.com/pingcap/check"
+	"github.com/pingcap/tidb/kv"
+	"github.com/pingcap/tidb/store/tikv/oracle"
+)
+
+// lateStore starts its first late transactions as if they had begun a
+// commit lag ago.
+type lateStore struct {
+	kv.Storage
+	late int
+}
+
+func (s *lateStore) Begin() (kv.Transaction, error) {
+	txn, err := s.Storage.Begin()
+	if err != nil || s.late == 0 {
+		return txn, err
+	}
+	s.late--
+	return lateTxn{txn}, nil
+}
+
+type lateTxn struct {
+	kv.Transaction
+}
+
+func (txn lateTxn) StartTS() uint64 {
+	ts := txn.Transaction.StartTS()
+	return oracle.ComposeTS(oracle.ExtractPhysical(ts)-int64(pubsubCommitLag/time.Millisecond), 0)
+}
+
+func (s *testHandlerSuite) TestPublishLate(c *C) {
+	store := &lateStore{Storage: s.store}
+	l := NewPubSubLog(store)
+	last, err := l.Last()
+	c.Assert(err, IsNil)
+
+	// A late transaction is retried rather than committed behind the readers.
+	store.late = 1
+	c.Assert(l.Publish([]byte("ch"), []byte("m")), IsNil)
+	msgs, err := l.Read(last, 10)
+	c.Assert(err, IsNil)
+	c.Assert(msgs, HasLen, 1)
+	c.Assert(string(msgs[0].Message), Equals, "m")
+
+	store.late = 1000
+	err = l.Publish([]byte("ch"), []byte("m"))
+	c.Assert(kv.IsRetryableError(err), IsTrue)
+}
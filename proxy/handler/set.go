@@ -0,0 +1,188 @@
+package handler
+
+import (
+	"github.com/Mansfield6/tikv-proxy-demo/proxy/redis"
+	"github.com/Mansfield6/tikv-proxy-demo/proxy/structure"
+	"github.com/juju/errors"
+	"github.com/ngaut/log"
+)
+
+func (h *TxTikvHandler) SADD(args [][]byte) (int, error) {
+	if len(args) < 2 {
+		return 0, errArguments("len(args) = %d, expect >= 2", len(args))
+	}
+
+	context := newRequestContext("sadd")
+	log.Infof("%s sadd %s", context.id, args)
+	res, err := h.callTx(context, func(tx *structure.TxStructure) (interface{}, error) {
+		return tx.SAdd(args[0], args[1:])
+	})
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	return res.(int), nil
+}
+
+func (h *TxTikvHandler) SREM(args [][]byte) (int, error) {
+	if len(args) < 2 {
+		return 0, errArguments("len(args) = %d, expect >= 2", len(args))
+	}
+
+	context := newRequestContext("srem")
+	log.Infof("%s srem %s", context.id, args)
+	res, err := h.callTx(context, func(tx *structure.TxStructure) (interface{}, error) {
+		return tx.SRem(args[0], args[1:])
+	})
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	return res.(int), nil
+}
+
+func (h *TxTikvHandler) SMEMBERS(key []byte) (redis.Set, error) {
+	context := newRequestContext("smembers")
+	log.Infof("%s smembers %s", context.id, key)
+	res, err := h.callTx(context, func(tx *structure.TxStructure) (interface{}, error) {
+		return tx.SMembers(key)
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return redis.Set(bulkValues(res.([][]byte))), nil
+}
+
+func (h *TxTikvHandler) SISMEMBER(key []byte, member []byte) (int, error) {
+	context := newRequestContext("sismember")
+	log.Infof("%s sismember %s %s", context.id, key, member)
+	res, err := h.callTx(context, func(tx *structure.TxStructure) (interface{}, error) {
+		return tx.SIsMember(key, member)
+	})
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	if res.(bool) {
+		return 1, nil
+	}
+	return 0, nil
+}
+
+func (h *TxTikvHandler) SCARD(key []byte) (int, error) {
+	context := newRequestContext("scard")
+	log.Infof("%s scard %s", context.id, key)
+	res, err := h.callTx(context, func(tx *structure.TxStructure) (interface{}, error) {
+		return tx.SCard(key)
+	})
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	return int(res.(int64)), nil
+}
+
+func (h *TxTikvHandler) SPOP(args [][]byte) (interface{}, error) {
+	if len(args) != 1 && len(args) != 2 {
+		return nil, errArguments("len(args) = %d, expect = 1 or 2", len(args))
+	}
+
+	count := int64(1)
+	if len(args) == 2 {
+		n, err := parseInt(args[1])
+		if err != nil || n < 0 {
+			return nil, errors.New("value is out of range, must be positive")
+		}
+		count = n
+	}
+
+	context := newRequestContext("spop")
+	log.Infof("%s spop %s", context.id, args)
+	res, err := h.callTx(context, func(tx *structure.TxStructure) (interface{}, error) {
+		return tx.SPop(args[0], count)
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	members := res.([][]byte)
+	if len(args) == 2 {
+		return members, nil
+	}
+	if len(members) == 0 {
+		return nil, nil
+	}
+	return members[0], nil
+}
+
+func (h *TxTikvHandler) SINTER(keys [][]byte) ([][]byte, error) {
+	return h.setAlgebra("sinter", keys, func(tx *structure.TxStructure) ([][]byte, error) {
+		return tx.SInter(keys)
+	})
+}
+
+func (h *TxTikvHandler) SUNION(keys [][]byte) ([][]byte, error) {
+	return h.setAlgebra("sunion", keys, func(tx *structure.TxStructure) ([][]byte, error) {
+		return tx.SUnion(keys)
+	})
+}
+
+func (h *TxTikvHandler) SDIFF(keys [][]byte) ([][]byte, error) {
+	return h.setAlgebra("sdiff", keys, func(tx *structure.TxStructure) ([][]byte, error) {
+		return tx.SDiff(keys)
+	})
+}
+
+func (h *TxTikvHandler) SINTERSTORE(args [][]byte) (int, error) {
+	return h.setAlgebraStore("sinterstore", args, func(tx *structure.TxStructure, keys [][]byte) ([][]byte, error) {
+		return tx.SInter(keys)
+	})
+}
+
+func (h *TxTikvHandler) SUNIONSTORE(args [][]byte) (int, error) {
+	return h.setAlgebraStore("sunionstore", args, func(tx *structure.TxStructure, keys [][]byte) ([][]byte, error) {
+		return tx.SUnion(keys)
+	})
+}
+
+func (h *TxTikvHandler) SDIFFSTORE(args [][]byte) (int, error) {
+	return h.setAlgebraStore("sdiffstore", args, func(tx *structure.TxStructure, keys [][]byte) ([][]byte, error) {
+		return tx.SDiff(keys)
+	})
+}
+
+// setAlgebra reads all the sets in one transaction, so the result is taken
+// from a single snapshot.
+func (h *TxTikvHandler) setAlgebra(cmd string, keys [][]byte, fn func(tx *structure.TxStructure) ([][]byte, error)) ([][]byte, error) {
+	if len(keys) == 0 {
+		return nil, errArguments("len(args) = %d, expect != 0", len(keys))
+	}
+
+	context := newRequestContext(cmd)
+	log.Infof("%s %s %s", context.id, cmd, keys)
+	res, err := h.callTx(context, func(tx *structure.TxStructure) (interface{}, error) {
+		return fn(tx)
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return res.([][]byte), nil
+}
+
+// setAlgebraStore computes the result from args[1:] and stores it at args[0]
+// within the same transaction.
+func (h *TxTikvHandler) setAlgebraStore(cmd string, args [][]byte, fn func(tx *structure.TxStructure, keys [][]byte) ([][]byte, error)) (int, error) {
+	if len(args) < 2 {
+		return 0, errArguments("len(args) = %d, expect >= 2", len(args))
+	}
+
+	context := newRequestContext(cmd)
+	log.Infof("%s %s %s", context.id, cmd, args)
+	res, err := h.callTx(context, func(tx *structure.TxStructure) (interface{}, error) {
+		members, err := fn(tx, args[1:])
+		if err != nil {
+			return 0, errors.Trace(err)
+		}
+		return tx.SStore(args[0], members)
+	})
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	return res.(int), nil
+}
@@ -1,100 +1,346 @@
 package handler
 
 import (
+	"math"
+	"strings"
+
+	"github.com/Mansfield6/tikv-proxy-demo/proxy/redis"
 	"github.com/Mansfield6/tikv-proxy-demo/proxy/structure"
 	"github.com/juju/errors"
 	"github.com/ngaut/log"
+	"github.com/pingcap/tidb/terror"
 )
 
-func (h *TxTikvHandler) SET(args [][]byte) ([]byte, error) {
-	context := newRequestContext("set")
-	if len(args) != 2 {
-		return nil, errArguments("len(args) = %d, expect = 2", len(args))
+func (h *TxTikvHandler) SET(args [][]byte) (interface{}, error) {
+	if len(args) < 2 {
+		return nil, errArguments("len(args) = %d, expect >= 2", len(args))
 	}
 
 	key := args[0]
 	value := args[1]
 
-	log.Infof("%s set %s %s", context.id, key, value)
-	res, err := CallWithRetry(context, func() (interface{}, error) {
-		txn, err := h.Store.Begin()
-		if err != nil {
-			return nil, errors.Trace(ErrBegionTXN)
+	var expireAt int64
+	flags := 0
+	for i := 2; i < len(args); i++ {
+		switch opt := strings.ToUpper(string(args[i])); opt {
+		case "NX":
+			flags |= structure.SetIfNotExist
+		case "XX":
+			flags |= structure.SetIfExist
+		case "KEEPTTL":
+			flags |= structure.SetKeepTTL
+		case "GET":
+			flags |= structure.SetGetOld
+		case "EX", "PX", "EXAT", "PXAT":
+			if expireAt != 0 || i+1 >= len(args) {
+				return nil, ErrSyntax
+			}
+			i++
+			n, err := toExpireAt("set", opt, args[i])
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+			expireAt = n
+		default:
+			return nil, ErrSyntax
 		}
+	}
+	if flags&structure.SetIfNotExist != 0 && flags&structure.SetIfExist != 0 {
+		return nil, ErrSyntax
+	}
+	if flags&structure.SetKeepTTL != 0 && expireAt != 0 {
+		return nil, ErrSyntax
+	}
 
-		tx := structure.NewStructure(txn, txn, []byte{0x00})
-		res, ierr := tx.Set(key, value)
-		if ierr == nil {
-			ierr = txn.Commit()
-		}
+	context := newRequestContext("set")
+	log.Infof("%s set %s", context.id, args)
+	var old []byte
+	res, err := h.callTx(context, func(tx *structure.TxStructure) (interface{}, error) {
+		var ok bool
+		var err error
+		old, ok, err = tx.SetString(key, value, expireAt, flags)
+		return ok, err
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
 
-		if ierr != nil {
-			txn.Rollback()
-		}
-		return res, ierr
+	if flags&structure.SetGetOld != 0 {
+		return bulkOrNil(old), nil
+	}
+	if !res.(bool) {
+		return nil, nil
+	}
+	return redis.StatusOK, nil
+}
+
+func (h *TxTikvHandler) SETNX(key []byte, value []byte) (int, error) {
+	context := newRequestContext("setnx")
+	log.Infof("%s setnx %s %s", context.id, key, value)
+	res, err := h.callTx(context, func(tx *structure.TxStructure) (interface{}, error) {
+		_, ok, err := tx.SetString(key, value, 0, structure.SetIfNotExist)
+		return ok, err
 	})
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	if res.(bool) {
+		return 1, nil
+	}
+	return 0, nil
+}
 
-	return res.([]byte), err
+func (h *TxTikvHandler) SETEX(key []byte, seconds []byte, value []byte) (*redis.StatusReply, error) {
+	return h.setExpireString("setex", "EX", key, seconds, value)
+}
 
+func (h *TxTikvHandler) PSETEX(key []byte, milliseconds []byte, value []byte) (*redis.StatusReply, error) {
+	return h.setExpireString("psetex", "PX", key, milliseconds, value)
 }
 
-func (h *TxTikvHandler) GET(key []byte) ([]byte, error) {
-	//if kerr := checkKeySize(key); kerr != nil {
-	//	return nil, kerr
-	//}
-	context := newRequestContext("set")
-	log.Infof("%s get %s", context.id, key)
+func (h *TxTikvHandler) setExpireString(cmd string, unit string, key []byte, ttl []byte, value []byte) (*redis.StatusReply, error) {
+	expireAt, err := toExpireAt(cmd, unit, ttl)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
 
-	res, err := CallWithRetry(context, func() (interface{}, error) {
-		txn, err := h.Store.Begin()
-		if err != nil {
-			return nil, errors.Trace(ErrBegionTXN)
-		}
+	context := newRequestContext(cmd)
+	log.Infof("%s %s %s %s %s", context.id, cmd, key, ttl, value)
+	_, err = h.callTx(context, func(tx *structure.TxStructure) (interface{}, error) {
+		_, _, err := tx.SetString(key, value, expireAt, 0)
+		return nil, err
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return redis.StatusOK, nil
+}
 
-		tx := structure.NewStructure(txn, txn, []byte{0x00})
-		res, ierr := tx.Get(key)
+func (h *TxTikvHandler) GETSET(key []byte, value []byte) (interface{}, error) {
+	context := newRequestContext("getset")
+	log.Infof("%s getset %s %s", context.id, key, value)
+	res, err := h.callTx(context, func(tx *structure.TxStructure) (interface{}, error) {
+		old, _, err := tx.SetString(key, value, 0, structure.SetGetOld)
+		return old, err
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return bulkOrNil(res.([]byte)), nil
+}
 
-		if ierr == nil {
-			ierr = txn.Commit()
-		}
+func (h *TxTikvHandler) GETDEL(key []byte) (interface{}, error) {
+	context := newRequestContext("getdel")
+	log.Infof("%s getdel %s", context.id, key)
+	res, err := h.callTx(context, func(tx *structure.TxStructure) (interface{}, error) {
+		return tx.GetDel(key)
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return bulkOrNil(res.([]byte)), nil
+}
 
-		if ierr != nil {
-			txn.Rollback()
-			log.Error(ierr)
+func (h *TxTikvHandler) GETEX(args [][]byte) (interface{}, error) {
+	if len(args) < 1 {
+		return nil, errArguments("len(args) = %d, expect >= 1", len(args))
+	}
+
+	var expireAt int64
+	persist := false
+	switch len(args) {
+	case 1:
+	case 2:
+		if strings.ToUpper(string(args[1])) != "PERSIST" {
+			return nil, ErrSyntax
 		}
-		return res, ierr
+		persist = true
+	case 3:
+		switch opt := strings.ToUpper(string(args[1])); opt {
+		case "EX", "PX", "EXAT", "PXAT":
+			n, err := toExpireAt("getex", opt, args[2])
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+			expireAt = n
+		default:
+			return nil, ErrSyntax
+		}
+	default:
+		return nil, ErrSyntax
+	}
+
+	context := newRequestContext("getex")
+	log.Infof("%s getex %s", context.id, args)
+	res, err := h.callTx(context, func(tx *structure.TxStructure) (interface{}, error) {
+		return tx.GetEx(args[0], expireAt, persist)
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return bulkOrNil(res.([]byte)), nil
+}
+
+func (h *TxTikvHandler) MSETNX(args [][]byte) (int, error) {
+	if len(args) == 0 || len(args)%2 != 0 {
+		return 0, errArguments("len(args) = %d, expect != 0 && mod 2 = 0", len(args))
+	}
+
+	keys := make([][]byte, 0, len(args)/2)
+	values := make([][]byte, 0, len(args)/2)
+	for i := 0; i < len(args); i += 2 {
+		keys = append(keys, args[i])
+		values = append(values, args[i+1])
+	}
+
+	context := newRequestContext("msetnx")
+	log.Infof("%s msetnx %s", context.id, args)
+	res, err := h.callTx(context, func(tx *structure.TxStructure) (interface{}, error) {
+		return tx.MSetNX(keys, values)
+	})
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	if res.(bool) {
+		return 1, nil
+	}
+	return 0, nil
+}
+
+func (h *TxTikvHandler) APPEND(key []byte, value []byte) (int, error) {
+	context := newRequestContext("append")
+	log.Infof("%s append %s %s", context.id, key, value)
+	res, err := h.callTx(context, func(tx *structure.TxStructure) (interface{}, error) {
+		return tx.Append(key, value)
+	})
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	return int(res.(int64)), nil
+}
+
+func (h *TxTikvHandler) STRLEN(key []byte) (int, error) {
+	context := newRequestContext("strlen")
+	log.Infof("%s strlen %s", context.id, key)
+	res, err := h.callTx(context, func(tx *structure.TxStructure) (interface{}, error) {
+		return tx.StrLen(key)
+	})
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	return int(res.(int64)), nil
+}
+
+func (h *TxTikvHandler) GETRANGE(key []byte, start []byte, end []byte) ([]byte, error) {
+	first, err := parseInt(start)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	last, err := parseInt(end)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	context := newRequestContext("getrange")
+	log.Infof("%s getrange %s %s %s", context.id, key, start, end)
+	res, err := h.callTx(context, func(tx *structure.TxStructure) (interface{}, error) {
+		return tx.GetRange(key, first, last)
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return res.([]byte), nil
+}
+
+func (h *TxTikvHandler) SETRANGE(key []byte, offset []byte, value []byte) (int, error) {
+	n, err := parseInt(offset)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	if n < 0 {
+		return 0, errors.New("offset is out of range")
+	}
+
+	context := newRequestContext("setrange")
+	log.Infof("%s setrange %s %s %s", context.id, key, offset, value)
+	res, err := h.callTx(context, func(tx *structure.TxStructure) (interface{}, error) {
+		return tx.SetRange(key, n, value)
+	})
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	return int(res.(int64)), nil
+}
+
+// toExpireAt converts the argument of an EX, PX, EXAT or PXAT option to an
+// absolute unix time in milliseconds.
+func toExpireAt(cmd string, opt string, arg []byte) (int64, error) {
+	n, err := parseInt(arg)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	now := nowms()
+	invalid := n <= 0
+	switch opt {
+	case "EX":
+		invalid = invalid || n > (math.MaxInt64-now)/1000
+		n = now + n*1000
+	case "PX":
+		invalid = invalid || n > math.MaxInt64-now
+		n = now + n
+	case "EXAT":
+		invalid = invalid || n > math.MaxInt64/1000
+		n = n * 1000
+	}
+	if invalid {
+		return 0, errors.Errorf("invalid expire time in '%s' command", cmd)
+	}
+	return n, nil
+}
+
+// bulkOrNil replies a missing value as a nil bulk.
+func bulkOrNil(value []byte) interface{} {
+	if value == nil {
+		return nil
+	}
+	return value
+}
+
+func (h *TxTikvHandler) GET(key []byte) ([]byte, error) {
+	if kerr := checkKeySize(key); kerr != nil {
+		return nil, kerr
+	}
+	context := newRequestContext("get")
+	log.Infof("%s get %s", context.id, key)
+
+	res, err := h.callTx(context, func(tx *structure.TxStructure) (interface{}, error) {
+		return tx.Get(key)
 	})
 
 	return res.([]byte), err
 }
 
-func (h *TxTikvHandler) MSET(args [][]byte) ([]byte, error) {
+func (h *TxTikvHandler) MSET(args [][]byte) (*redis.StatusReply, error) {
 	if len(args) == 0 || len(args)%2 != 0 {
 		return nil, errArguments("len(args) = %d, expect != 0 && mod 2 = 0", len(args))
 	}
 
-	//for i := len(args)/2 - 1; i >= 0; i-- {
-	//	key, value := args[i*2], args[i*2+1]
-	//	if kerr := checkKeySize(key); kerr != nil {
-	//		return nil, kerr
-	//	}
-	//
-	//	if verr := checkValueSize(value); verr != nil {
-	//		return nil, verr
-	//	}
-	//
-	//}
+	for i := len(args)/2 - 1; i >= 0; i-- {
+		key, value := args[i*2], args[i*2+1]
+		if kerr := checkKeySize(key); kerr != nil {
+			return nil, kerr
+		}
+
+		if verr := checkValueSize(value); verr != nil {
+			return nil, verr
+		}
+	}
 
 	context := newRequestContext("mset")
 	log.Infof("%s mset %s", context.id, args)
 
-	res, err := CallWithRetry(context, func() (interface{}, error) {
-		txn, err := h.Store.Begin()
-		if err != nil {
-			return nil, errors.Trace(ErrBegionTXN)
-		}
-
-		tx := structure.NewStructure(txn, txn, []byte{0x00})
+	_, err := h.callTx(context, func(tx *structure.TxStructure) (interface{}, error) {
 		var ierr error
 		for i := len(args)/2 - 1; i >= 0; i-- {
 			key, value := args[i*2], args[i*2+1]
@@ -106,17 +352,12 @@ func (h *TxTikvHandler) MSET(args [][]byte) ([]byte, error) {
 			}
 
 		}
-
-		if ierr == nil {
-			ierr = txn.Commit()
-		}
-
-		if ierr != nil {
-			txn.Rollback()
-		}
-		return []byte("OK"), ierr
+		return nil, ierr
 	})
-	return res.([]byte), err
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return redis.StatusOK, nil
 }
 
 func (h *TxTikvHandler) MGET(args [][]byte) ([][]byte, error) {
@@ -136,31 +377,21 @@ func (h *TxTikvHandler) MGET(args [][]byte) ([][]byte, error) {
 
 	context := newRequestContext("mget")
 	log.Infof("%s mget %s", context.id, args)
-	_, err := CallWithRetry(context, func() (interface{}, error) {
-		txn, err := h.Store.Begin()
-		if err != nil {
-			return nil, errors.Trace(ErrBegionTXN)
-		}
-
-		tx := structure.NewStructure(txn, txn, []byte{0x00})
+	_, err := h.callTx(context, func(tx *structure.TxStructure) (interface{}, error) {
 		var ierr error
 
 		for i, key := range keys {
 			res, err := tx.Get(key)
+			if terror.ErrorEqual(err, structure.ErrSetType) {
+				// mget replies nil for keys that do not hold a string.
+				res, err = nil, nil
+			}
 			if err != nil {
 				ierr = err
 				break
 			}
 			values[i] = res
 		}
-
-		if ierr == nil {
-			ierr = txn.Commit()
-		}
-
-		if ierr != nil {
-			txn.Rollback()
-		}
 		return nil, ierr
 	})
 
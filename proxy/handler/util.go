@@ -1,30 +1,27 @@
 package handler
 
 import (
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/Mansfield6/tikv-proxy-demo/proxy/config"
+	"github.com/Mansfield6/tikv-proxy-demo/proxy/structure"
 	"github.com/Mansfield6/tikv-proxy-demo/proxy/uuid"
+	"github.com/juju/errors"
 	"github.com/ngaut/log"
 	"github.com/pingcap/tidb/kv"
-	"time"
-	"github.com/juju/errors"
-)
-
-const (
-	MaxRetryCount int = 5
-	//max key size
-	MaxKeySize int = 1024
-	//max value size
-	MaxValueSize int = 1024 * 1024 * 1024
 )
 
 func checkKeySize(key []byte) error {
-	if len(key) > MaxKeySize || len(key) == 0 {
+	if len(key) > config.MaxKeySize.Get() || len(key) == 0 {
 		return ErrKeySize
 	}
 	return nil
 }
 
 func checkValueSize(value []byte) error {
-	if len(value) > MaxValueSize {
+	if len(value) > config.MaxValueSize.Get() {
 		return ErrValueSize
 	}
 
@@ -56,14 +53,98 @@ func CallWithRetry(context *RequestContext, fn func() (interface{}, error)) (int
 			return res, err
 		}
 		log.Errorf("%s retry:%d error:%s", context.id, curCount,errors.ErrorStack(err) )
-		if curCount >= MaxRetryCount {
+		if !kv.IsRetryableError(err) {
+			retryErrorCounter.WithLabelValues("non_retryable").Inc()
+			return res, err
+		}
+		retryErrorCounter.WithLabelValues("retryable").Inc()
+		if curCount >= config.MaxRetryCount.Get() {
 			log.Errorf("%s Retry reached max count %d error: %s", context.id, curCount, err)
 			return res, err
 		}
+		retryCounter.Inc()
+	}
 
-		if !kv.IsRetryableError(err) {
-			return res, err
+}
+
+// callTx runs fn against a new transaction and commits it, the whole
+// transaction is retried by CallWithRetry on retryable errors. The database
+// comes from the map cached by the proxy. Inside EXEC fn runs on the
+// transaction of the EXEC instead. Errors are mapped to the error
+// replies of redis.
+func (h *TxTikvHandler) callTx(context *RequestContext, fn func(tx *structure.TxStructure) (interface{}, error)) (interface{}, error) {
+	if h.txn != nil {
+		res, err := h.callExecTx(fn)
+		return res, replyError(err)
+	}
+	res, err := CallWithRetry(context, func() (interface{}, error) {
+		txn, err := h.Store.Begin()
+		if err != nil {
+			return nil, errors.Trace(ErrBegionTXN)
+		}
+
+		tx, ierr := h.dbMap.Structure(txn, h.db)
+		var res interface{}
+		if ierr == nil {
+			res, ierr = fn(tx)
 		}
+		if ierr == nil {
+			ierr = commitTxn(txn)
+		}
+
+		if ierr != nil {
+			txn.Rollback()
+		}
+		return res, ierr
+	})
+	return res, replyError(err)
+}
+
+// callStore runs fn in a transaction of its own and commits it, retrying on
+// retryable errors. It is for the bookkeeping of the proxy that does not go
+// through a TxStructure.
+func callStore(store kv.Storage, cmd string, fn func(txn kv.Transaction) (interface{}, error)) (interface{}, error) {
+	context := newRequestContext(cmd)
+	return CallWithRetry(context, func() (interface{}, error) {
+		txn, err := store.Begin()
+		if err != nil {
+			return nil, errors.Trace(ErrBegionTXN)
+		}
+
+		res, ierr := fn(txn)
+		if ierr == nil {
+			ierr = commitTxn(txn)
+		}
+
+		if ierr != nil {
+			txn.Rollback()
+		}
+		return res, ierr
+	})
+}
+
+func parseInt(arg []byte) (int64, error) {
+	n, err := strconv.ParseInt(string(arg), 10, 64)
+	if err != nil {
+		return 0, ErrNotInteger
 	}
+	return n, nil
+}
 
+func parseFloat(arg []byte) (float64, error) {
+	f, err := strconv.ParseFloat(string(arg), 64)
+	if err != nil || math.IsNaN(f) {
+		return 0, ErrNotFloat
+	}
+	return f, nil
 }
+
+// bulkValues turns values into the elements of an aggregate reply.
+func bulkValues(values [][]byte) []interface{} {
+	elems := make([]interface{}, len(values))
+	for i, v := range values {
+		elems[i] = v
+	}
+	return elems
+}
+
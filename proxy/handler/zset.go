@@ -0,0 +1,366 @@
+package handler
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/Mansfield6/tikv-proxy-demo/proxy/redis"
+	"github.com/Mansfield6/tikv-proxy-demo/proxy/structure"
+	"github.com/Mansfield6/tikv-proxy-demo/proxy/util"
+	"github.com/juju/errors"
+	"github.com/ngaut/log"
+)
+
+var errZSetBound = errors.New("min or max is not a float")
+
+func (h *TxTikvHandler) ZADD(args [][]byte) (interface{}, error) {
+	if len(args) < 3 {
+		return nil, errArguments("len(args) = %d, expect >= 3", len(args))
+	}
+
+	key := args[0]
+	flags, incr := 0, false
+	i := 1
+options:
+	for ; i < len(args); i++ {
+		switch strings.ToUpper(string(args[i])) {
+		case "NX":
+			flags |= structure.ZAddNX
+		case "XX":
+			flags |= structure.ZAddXX
+		case "GT":
+			flags |= structure.ZAddGT
+		case "LT":
+			flags |= structure.ZAddLT
+		case "CH":
+			flags |= structure.ZAddCH
+		case "INCR":
+			incr = true
+		default:
+			break options
+		}
+	}
+
+	rest := args[i:]
+	if len(rest) == 0 || len(rest)%2 != 0 {
+		return nil, ErrSyntax
+	}
+	if flags&structure.ZAddNX != 0 && flags&(structure.ZAddXX|structure.ZAddGT|structure.ZAddLT) != 0 ||
+		flags&structure.ZAddGT != 0 && flags&structure.ZAddLT != 0 {
+		return nil, errors.New("GT, LT, and/or NX options at the same time are not compatible")
+	}
+	if incr && len(rest) != 2 {
+		return nil, errors.New("INCR option supports a single increment-element pair")
+	}
+
+	pairs := make([]*structure.ZSetPair, len(rest)/2)
+	for j := range pairs {
+		score, err := parseFloat(rest[j*2])
+		if err != nil {
+			return nil, err
+		}
+		pairs[j] = &structure.ZSetPair{Score: score, Member: rest[j*2+1]}
+	}
+
+	context := newRequestContext("zadd")
+	log.Infof("%s zadd %s", context.id, args)
+	res, err := h.callTx(context, func(tx *structure.TxStructure) (interface{}, error) {
+		if !incr {
+			return tx.ZAdd(key, flags, pairs)
+		}
+
+		p := pairs[0]
+		old, exists, err := tx.ZScore(key, p.Member)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		score := old + p.Score
+		if exists && (flags&structure.ZAddNX != 0 ||
+			flags&structure.ZAddGT != 0 && score <= old ||
+			flags&structure.ZAddLT != 0 && score >= old) ||
+			!exists && flags&structure.ZAddXX != 0 {
+			return nil, nil
+		}
+
+		score, err = tx.ZIncrBy(key, p.Member, p.Score)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		return redis.Double(score), nil
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return res, nil
+}
+
+func (h *TxTikvHandler) ZINCRBY(args [][]byte) (redis.Double, error) {
+	if len(args) != 3 {
+		return 0, errArguments("len(args) = %d, expect = 3", len(args))
+	}
+
+	key, member := args[0], args[2]
+	delta, err := parseFloat(args[1])
+	if err != nil {
+		return 0, err
+	}
+
+	context := newRequestContext("zincrby")
+	log.Infof("%s zincrby %s", context.id, args)
+	res, err := h.callTx(context, func(tx *structure.TxStructure) (interface{}, error) {
+		return tx.ZIncrBy(key, member, delta)
+	})
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	return redis.Double(res.(float64)), nil
+}
+
+func (h *TxTikvHandler) ZREM(args [][]byte) (int, error) {
+	if len(args) < 2 {
+		return 0, errArguments("len(args) = %d, expect >= 2", len(args))
+	}
+
+	context := newRequestContext("zrem")
+	log.Infof("%s zrem %s", context.id, args)
+	res, err := h.callTx(context, func(tx *structure.TxStructure) (interface{}, error) {
+		return tx.ZRem(args[0], args[1:])
+	})
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	return res.(int), nil
+}
+
+func (h *TxTikvHandler) ZSCORE(key []byte, member []byte) (interface{}, error) {
+	context := newRequestContext("zscore")
+	log.Infof("%s zscore %s %s", context.id, key, member)
+	res, err := h.callTx(context, func(tx *structure.TxStructure) (interface{}, error) {
+		score, exists, err := tx.ZScore(key, member)
+		if err != nil || !exists {
+			return nil, errors.Trace(err)
+		}
+		return redis.Double(score), nil
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return res, nil
+}
+
+func (h *TxTikvHandler) ZCARD(key []byte) (int, error) {
+	context := newRequestContext("zcard")
+	log.Infof("%s zcard %s", context.id, key)
+	res, err := h.callTx(context, func(tx *structure.TxStructure) (interface{}, error) {
+		return tx.ZCard(key)
+	})
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	return int(res.(int64)), nil
+}
+
+func (h *TxTikvHandler) ZRANK(key []byte, member []byte) (interface{}, error) {
+	return h.zrank("zrank", key, member, false)
+}
+
+func (h *TxTikvHandler) ZREVRANK(key []byte, member []byte) (interface{}, error) {
+	return h.zrank("zrevrank", key, member, true)
+}
+
+func (h *TxTikvHandler) zrank(cmd string, key []byte, member []byte, reverse bool) (interface{}, error) {
+	context := newRequestContext(cmd)
+	log.Infof("%s %s %s %s", context.id, cmd, key, member)
+	res, err := h.callTx(context, func(tx *structure.TxStructure) (interface{}, error) {
+		return tx.ZRank(key, member, reverse)
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if rank := res.(int64); rank >= 0 {
+		return int(rank), nil
+	}
+	return nil, nil
+}
+
+// zrangeSpec is a parsed ZRANGE family request.
+type zrangeSpec struct {
+	key        []byte
+	min, max   []byte
+	byScore    bool
+	reverse    bool
+	withScores bool
+	offset     int64
+	count      int64
+}
+
+func (h *TxTikvHandler) ZRANGE(args [][]byte) ([][]byte, error) {
+	if len(args) < 3 {
+		return nil, errArguments("len(args) = %d, expect >= 3", len(args))
+	}
+
+	spec := &zrangeSpec{key: args[0], min: args[1], max: args[2], count: -1}
+	limit := false
+	for i := 3; i < len(args); i++ {
+		switch strings.ToUpper(string(args[i])) {
+		case "BYSCORE":
+			spec.byScore = true
+		case "REV":
+			spec.reverse = true
+		case "WITHSCORES":
+			spec.withScores = true
+		case "LIMIT":
+			if i+2 >= len(args) {
+				return nil, ErrSyntax
+			}
+			if err := spec.parseLimit(args[i+1], args[i+2]); err != nil {
+				return nil, err
+			}
+			limit = true
+			i += 2
+		default:
+			return nil, ErrSyntax
+		}
+	}
+	if limit && !spec.byScore {
+		return nil, errors.New("syntax error, LIMIT is only supported in combination with BYSCORE")
+	}
+	if spec.byScore && spec.reverse {
+		// ZRANGE key max min BYSCORE REV
+		spec.min, spec.max = spec.max, spec.min
+	}
+	return h.zrange("zrange", spec)
+}
+
+func (h *TxTikvHandler) ZREVRANGE(args [][]byte) ([][]byte, error) {
+	if len(args) != 3 && len(args) != 4 {
+		return nil, errArguments("len(args) = %d, expect = 3 or 4", len(args))
+	}
+
+	spec := &zrangeSpec{key: args[0], min: args[1], max: args[2], reverse: true, count: -1}
+	if len(args) == 4 {
+		if !strings.EqualFold(string(args[3]), "WITHSCORES") {
+			return nil, ErrSyntax
+		}
+		spec.withScores = true
+	}
+	return h.zrange("zrevrange", spec)
+}
+
+func (h *TxTikvHandler) ZRANGEBYSCORE(args [][]byte) ([][]byte, error) {
+	if len(args) < 3 {
+		return nil, errArguments("len(args) = %d, expect >= 3", len(args))
+	}
+
+	spec := &zrangeSpec{key: args[0], min: args[1], max: args[2], byScore: true, count: -1}
+	if err := spec.parseScoreOptions(args[3:]); err != nil {
+		return nil, err
+	}
+	return h.zrange("zrangebyscore", spec)
+}
+
+func (h *TxTikvHandler) ZREVRANGEBYSCORE(args [][]byte) ([][]byte, error) {
+	if len(args) < 3 {
+		return nil, errArguments("len(args) = %d, expect >= 3", len(args))
+	}
+
+	spec := &zrangeSpec{key: args[0], min: args[2], max: args[1], byScore: true, reverse: true, count: -1}
+	if err := spec.parseScoreOptions(args[3:]); err != nil {
+		return nil, err
+	}
+	return h.zrange("zrevrangebyscore", spec)
+}
+
+func (spec *zrangeSpec) parseScoreOptions(args [][]byte) error {
+	for i := 0; i < len(args); i++ {
+		switch strings.ToUpper(string(args[i])) {
+		case "WITHSCORES":
+			spec.withScores = true
+		case "LIMIT":
+			if i+2 >= len(args) {
+				return ErrSyntax
+			}
+			if err := spec.parseLimit(args[i+1], args[i+2]); err != nil {
+				return err
+			}
+			i += 2
+		default:
+			return ErrSyntax
+		}
+	}
+	return nil
+}
+
+func (spec *zrangeSpec) parseLimit(offset []byte, count []byte) error {
+	var err error
+	if spec.offset, err = parseInt(offset); err != nil {
+		return err
+	}
+	if spec.count, err = parseInt(count); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (h *TxTikvHandler) zrange(cmd string, spec *zrangeSpec) ([][]byte, error) {
+	var (
+		start, stop int64
+		min, max    structure.ZScoreBound
+		err         error
+	)
+	if spec.byScore {
+		if min, err = parseScoreBound(spec.min); err != nil {
+			return nil, err
+		}
+		if max, err = parseScoreBound(spec.max); err != nil {
+			return nil, err
+		}
+		if spec.offset < 0 {
+			return [][]byte{}, nil
+		}
+	} else {
+		if start, err = parseInt(spec.min); err != nil {
+			return nil, err
+		}
+		if stop, err = parseInt(spec.max); err != nil {
+			return nil, err
+		}
+	}
+
+	context := newRequestContext(cmd)
+	log.Infof("%s %s %s %s %s", context.id, cmd, spec.key, spec.min, spec.max)
+	res, err := h.callTx(context, func(tx *structure.TxStructure) (interface{}, error) {
+		if spec.byScore {
+			return tx.ZRangeByScore(spec.key, min, max, spec.reverse, spec.offset, spec.count)
+		}
+		return tx.ZRange(spec.key, start, stop, spec.reverse)
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	pairs := res.([]structure.ZSetPair)
+	rets := make([][]byte, 0, len(pairs)*2)
+	for _, p := range pairs {
+		rets = append(rets, p.Member)
+		if spec.withScores {
+			rets = append(rets, util.FormatFloat(p.Score, false))
+		}
+	}
+	return rets, nil
+}
+
+func parseScoreBound(arg []byte) (structure.ZScoreBound, error) {
+	bound := structure.ZScoreBound{}
+	if bytes.HasPrefix(arg, []byte("(")) {
+		bound.Exclusive = true
+		arg = arg[1:]
+	}
+
+	score, err := parseFloat(arg)
+	if err != nil {
+		return bound, errZSetBound
+	}
+	bound.Score = score
+	return bound, nil
+}
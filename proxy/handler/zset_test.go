@@ -0,0 +1,16 @@
+package handler
+
+import (
+	. "github.com/pingcap/check"
+)
+
+func (s *testHandlerSuite) TestZSetLargeScore(c *C) {
+	c.Assert(s.do(c, "ZADD", "z", "1000000", "m"), Equals, ":1\r\n")
+	// Integral scores keep all their digits, the way redis formats them.
+	c.Assert(s.do(c, "ZSCORE", "z", "m"), Equals, "$7\r\n1000000\r\n")
+	c.Assert(s.do(c, "ZINCRBY", "z", "1699999000123", "m"), Equals, "$13\r\n1700000000123\r\n")
+	c.Assert(s.do(c, "ZRANGE", "z", "0", "-1", "WITHSCORES"), Equals, "*2\r\n$1\r\nm\r\n$13\r\n1700000000123\r\n")
+	c.Assert(s.do(c, "ZINCRBY", "z", "0.5", "m"), Equals, "$15\r\n1700000000123.5\r\n")
+	c.Assert(s.do(c, "ZADD", "z", "1e17", "n"), Equals, ":1\r\n")
+	c.Assert(s.do(c, "ZSCORE", "z", "n"), Equals, "$5\r\n1e+17\r\n")
+}
@@ -0,0 +1,586 @@
+package redis
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Mansfield6/tikv-proxy-demo/proxy/util"
+	"github.com/ngaut/log"
+)
+
+// ACLReloadInterval is how often a server reloads the ACL users from a shared
+// ACLStore to pick up the changes made through other servers.
+var ACLReloadInterval = time.Second
+
+// defaultUserRules are the rules of the default user until it is changed,
+// anyone may connect and run everything.
+const defaultUserRules = "on nopass ~* +@all"
+
+// ACLStore keeps the ACL users, servers sharing a store share their users.
+type ACLStore interface {
+	// LoadUsers gets the rules of every stored user by user name.
+	LoadUsers() (map[string]string, error)
+	// UpdateUser sets the rules of a user to the ones returned by fn, which
+	// gets the current rules, empty if the user is not stored. Both happen
+	// in one transaction.
+	UpdateUser(name string, fn func(rules string) (string, error)) error
+	// DeleteUsers deletes users, it returns how many of them were stored.
+	DeleteUsers(names []string) (int, error)
+}
+
+// memoryACLStore is the ACLStore of a server that is not given one, the
+// users are only known to that server.
+type memoryACLStore struct {
+	mu    sync.Mutex
+	users map[string]string
+}
+
+func newMemoryACLStore() *memoryACLStore {
+	return &memoryACLStore{users: make(map[string]string)}
+}
+
+func (m *memoryACLStore) LoadUsers() (map[string]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	users := make(map[string]string, len(m.users))
+	for name, rules := range m.users {
+		users[name] = rules
+	}
+	return users, nil
+}
+
+func (m *memoryACLStore) UpdateUser(name string, fn func(rules string) (string, error)) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	rules, err := fn(m.users[name])
+	if err != nil {
+		return err
+	}
+	m.users[name] = rules
+	return nil
+}
+
+func (m *memoryACLStore) DeleteUsers(names []string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := 0
+	for _, name := range names {
+		if _, ok := m.users[name]; ok {
+			delete(m.users, name)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// aclUser is a user with its passwords and permissions.
+type aclUser struct {
+	name    string
+	enabled bool
+	nopass  bool
+	// passwords are the sha256 hashes of the passwords in hex.
+	passwords []string
+	// commands are the rules on commands in the order they were given, the
+	// last one matching a command decides whether it may run. No rule
+	// matching denies it.
+	commands []string
+	allKeys  bool
+	keys     []string
+}
+
+// parseUser creates a user from the rules it was stored with.
+func parseUser(name string, rules string) (*aclUser, error) {
+	u := &aclUser{name: name}
+	for _, rule := range strings.Fields(rules) {
+		if err := u.apply(rule, nil); err != nil {
+			return nil, err
+		}
+	}
+	return u, nil
+}
+
+// apply applies one ACL SETUSER rule to u, isCommand validates the command
+// names of the rules if it is not nil.
+func (u *aclUser) apply(rule string, isCommand func(name string) bool) error {
+	switch strings.ToLower(rule) {
+	case "on":
+		u.enabled = true
+	case "off":
+		u.enabled = false
+	case "nopass":
+		u.nopass = true
+		u.passwords = nil
+	case "resetpass":
+		u.nopass = false
+		u.passwords = nil
+	case "allkeys":
+		u.allKeys = true
+		u.keys = nil
+	case "resetkeys":
+		u.allKeys = false
+		u.keys = nil
+	case "allcommands":
+		u.commands = []string{"+@all"}
+	case "nocommands":
+		u.commands = nil
+	case "reset":
+		*u = aclUser{name: u.name}
+	default:
+		return u.applyModifier(rule, isCommand)
+	}
+	return nil
+}
+
+func (u *aclUser) applyModifier(rule string, isCommand func(name string) bool) error {
+	if len(rule) < 2 {
+		return errSyntaxRule
+	}
+	arg := rule[1:]
+	switch rule[0] {
+	case '>':
+		u.addPassword(hashPassword(arg))
+	case '#':
+		if len(arg) != sha256.Size*2 || strings.ToLower(arg) != arg {
+			return errPasswordHash
+		}
+		if _, err := hex.DecodeString(arg); err != nil {
+			return errPasswordHash
+		}
+		u.addPassword(arg)
+	case '<':
+		if !u.removePassword(hashPassword(arg)) {
+			return errNoSuchPassword
+		}
+	case '!':
+		if !u.removePassword(arg) {
+			return errNoSuchPassword
+		}
+	case '~':
+		if arg == "*" {
+			u.allKeys = true
+			u.keys = nil
+			return nil
+		}
+		if u.allKeys {
+			return errPatternAfterAll
+		}
+		u.keys = append(u.keys, arg)
+	case '+', '-':
+		name := strings.ToLower(arg)
+		if name == "@all" {
+			u.commands = nil
+			if rule[0] == '+' {
+				u.commands = []string{"+@all"}
+			}
+			return nil
+		}
+		if strings.HasPrefix(name, "@") {
+			if !isCategory(name[1:]) {
+				return errUnknownCommand
+			}
+		} else if isCommand != nil && !isCommand(name) {
+			return errUnknownCommand
+		}
+		u.commands = append(u.commands, rule[:1]+name)
+	default:
+		return errSyntaxRule
+	}
+	return nil
+}
+
+var (
+	errSyntaxRule      = fmt.Errorf("Syntax error")
+	errPasswordHash    = fmt.Errorf("The password hash must be exactly 64 characters and contain only lowercase hexadecimal characters")
+	errNoSuchPassword  = fmt.Errorf("no such password")
+	errPatternAfterAll = fmt.Errorf("Adding a pattern after the * pattern (or the 'allkeys' flag) is not valid and does not have any effect. Try 'resetkeys' to start with an empty list of patterns")
+	errUnknownCommand  = fmt.Errorf("Unknown command or category name in ACL")
+)
+
+func hashPassword(password string) string {
+	sum := sha256.Sum256([]byte(password))
+	return hex.EncodeToString(sum[:])
+}
+
+func (u *aclUser) addPassword(hash string) {
+	u.nopass = false
+	for _, p := range u.passwords {
+		if p == hash {
+			return
+		}
+	}
+	u.passwords = append(u.passwords, hash)
+}
+
+func (u *aclUser) removePassword(hash string) bool {
+	for i, p := range u.passwords {
+		if p == hash {
+			u.passwords = append(u.passwords[:i:i], u.passwords[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (u *aclUser) checkPassword(password []byte) bool {
+	if u.nopass {
+		return true
+	}
+	hash := []byte(hashPassword(string(password)))
+	ok := false
+	for _, p := range u.passwords {
+		if subtle.ConstantTimeCompare(hash, []byte(p)) == 1 {
+			ok = true
+		}
+	}
+	return ok
+}
+
+func isCategory(name string) bool {
+	for _, c := range aclCategories {
+		if c == name {
+			return true
+		}
+	}
+	return false
+}
+
+// canRun reports whether u may run the command name, s is its spec if it
+// has one.
+func (u *aclUser) canRun(name string, s *commandSpec) bool {
+	allowed := false
+	for _, rule := range u.commands {
+		target := rule[1:]
+		var match bool
+		switch {
+		case target == "@all":
+			match = true
+		case strings.HasPrefix(target, "@"):
+			match = s != nil && s.inCategory(target[1:])
+		default:
+			match = target == name
+		}
+		if match {
+			allowed = rule[0] == '+'
+		}
+	}
+	return allowed
+}
+
+// canAccess reports whether every key matches one of the key patterns of u.
+func (u *aclUser) canAccess(keys [][]byte) bool {
+	if u.allKeys {
+		return true
+	}
+	for _, key := range keys {
+		ok := false
+		for _, pattern := range u.keys {
+			if util.GlobMatch([]byte(pattern), key) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// rules describes u with the rules that create it, the way ACL LIST does.
+func (u *aclUser) rules() string {
+	rules := []string{"off"}
+	if u.enabled {
+		rules[0] = "on"
+	}
+	if u.nopass {
+		rules = append(rules, "nopass")
+	}
+	for _, p := range u.passwords {
+		rules = append(rules, "#"+p)
+	}
+	if u.allKeys {
+		rules = append(rules, "~*")
+	}
+	for _, k := range u.keys {
+		rules = append(rules, "~"+k)
+	}
+	return strings.Join(append(rules, u.commandRules()), " ")
+}
+
+func (u *aclUser) commandRules() string {
+	if len(u.commands) > 0 && u.commands[0] == "+@all" {
+		return strings.Join(u.commands, " ")
+	}
+	return strings.Join(append([]string{"-@all"}, u.commands...), " ")
+}
+
+func (u *aclUser) flags() []interface{} {
+	flags := []interface{}{[]byte("off")}
+	if u.enabled {
+		flags[0] = []byte("on")
+	}
+	if u.allKeys {
+		flags = append(flags, []byte("allkeys"))
+	}
+	if len(u.commands) == 1 && u.commands[0] == "+@all" {
+		flags = append(flags, []byte("allcommands"))
+	}
+	if u.nopass {
+		flags = append(flags, []byte("nopass"))
+	}
+	return flags
+}
+
+// acl holds the users of a server, cached from its ACLStore.
+type acl struct {
+	store ACLStore
+
+	mu    sync.RWMutex
+	users map[string]*aclUser
+}
+
+func newACL(store ACLStore) *acl {
+	return &acl{store: store, users: make(map[string]*aclUser)}
+}
+
+// reload replaces the cached users with the stored ones.
+func (a *acl) reload() error {
+	stored, err := a.store.LoadUsers()
+	if err != nil {
+		return err
+	}
+	users := make(map[string]*aclUser, len(stored)+1)
+	for name, rules := range stored {
+		u, err := parseUser(name, rules)
+		if err != nil {
+			log.Warnf("skip acl user %s with invalid rules %q - %s", name, rules, err)
+			continue
+		}
+		users[name] = u
+	}
+	if _, ok := users["default"]; !ok {
+		users["default"], _ = parseUser("default", defaultUserRules)
+	}
+
+	a.mu.Lock()
+	a.users = users
+	a.mu.Unlock()
+	return nil
+}
+
+// reloadLoop keeps reloading the users so changes made through other
+// servers get seen, until quit is closed.
+func (a *acl) reloadLoop(quit <-chan struct{}) {
+	for {
+		select {
+		case <-quit:
+			return
+		case <-time.After(ACLReloadInterval):
+		}
+		if err := a.reload(); err != nil {
+			log.Errorf("reload acl users failed - %s", err)
+		}
+	}
+}
+
+func (a *acl) user(name string) *aclUser {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.users[name]
+}
+
+func (a *acl) userNames() []string {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	names := make([]string, 0, len(a.users))
+	for name := range a.users {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// setUser applies rules to a user, creating it if it does not exist.
+func (a *acl) setUser(name string, rules [][]byte, isCommand func(name string) bool) error {
+	var u *aclUser
+	err := a.store.UpdateUser(name, func(stored string) (string, error) {
+		if stored == "" && name == "default" {
+			stored = defaultUserRules
+		}
+		var err error
+		if u, err = parseUser(name, stored); err != nil {
+			return "", err
+		}
+		for _, rule := range rules {
+			if err = u.apply(string(rule), isCommand); err != nil {
+				return "", fmt.Errorf("Error in ACL SETUSER modifier '%s': %s", rule, err)
+			}
+		}
+		return u.rules(), nil
+	})
+	if err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	a.users[name] = u
+	a.mu.Unlock()
+	return nil
+}
+
+func (a *acl) deleteUsers(names []string) (int, error) {
+	n, err := a.store.DeleteUsers(names)
+	if err != nil {
+		return 0, err
+	}
+	a.mu.Lock()
+	for _, name := range names {
+		delete(a.users, name)
+	}
+	a.mu.Unlock()
+	return n, nil
+}
+
+func (srv *Server) isCommand(name string) bool {
+	if _, ok := srv.methods[name]; ok {
+		return true
+	}
+	_, ok := commandSpecs[name]
+	return ok
+}
+
+// checkACL checks that the user of the session may run r, it returns the
+// error to reply otherwise. A denied command inside MULTI fails the EXEC.
+func (srv *Server) checkACL(r *Request, name string) ReplyWriter {
+	s := r.session
+	if name == "auth" || name == "hello" {
+		return nil
+	}
+
+	var reply ReplyWriter
+	u := srv.acl.user(s.user)
+	if !s.authenticated || u == nil || !u.enabled {
+		// The user may have been deleted or disabled meanwhile.
+		s.authenticated = false
+		reply = ErrNoAuth
+	} else if spec := commandSpecs[name]; !u.canRun(name, spec) {
+		reply = NewErrorCode("NOPERM", "this user has no permissions to run the '"+name+"' command or its subcommand")
+	} else if spec != nil && !u.canAccess(spec.keys(r.Args)) {
+		reply = ErrNoPermKey
+	}
+
+	if reply != nil && s.multi && name != "exec" && name != "discard" {
+		s.dirty = true
+	}
+	return reply
+}
+
+// authCommand handles AUTH [username] password.
+func (srv *Server) authCommand(r *Request) ReplyWriter {
+	user, password := []byte("default"), []byte(nil)
+	switch len(r.Args) {
+	case 1:
+		password = r.Args[0]
+		if u := srv.acl.user("default"); u != nil && u.nopass {
+			return NewError("AUTH <password> called without any password configured for the default user. Are you sure your configuration is correct?")
+		}
+	case 2:
+		user, password = r.Args[0], r.Args[1]
+	case 0:
+		return wrongArgs(r)
+	default:
+		return ErrSyntax
+	}
+	if reply := srv.auth(r.session, user, password); reply != nil {
+		return reply
+	}
+	return StatusOK
+}
+
+// auth authenticates the session as user, the users are reloaded first so
+// that the ones created through other servers can log in.
+func (srv *Server) auth(s *session, user []byte, password []byte) ReplyWriter {
+	if err := srv.acl.reload(); err != nil {
+		log.Errorf("reload acl users failed - %s", err)
+	}
+	u := srv.acl.user(string(user))
+	if u == nil || !u.enabled || !u.checkPassword(password) {
+		return ErrWrongPass
+	}
+	s.user = u.name
+	s.authenticated = true
+	return nil
+}
+
+// aclCommand handles ACL SETUSER, GETUSER, DELUSER, LIST and WHOAMI.
+func (srv *Server) aclCommand(r *Request) ReplyWriter {
+	if len(r.Args) == 0 {
+		return wrongArgs(r)
+	}
+	sub := strings.ToLower(string(r.Args[0]))
+	args := r.Args[1:]
+	switch {
+	case sub == "setuser" && len(args) >= 1:
+		if err := srv.acl.setUser(string(args[0]), args[1:], srv.isCommand); err != nil {
+			return NewError(err.Error())
+		}
+		return StatusOK
+	case sub == "getuser" && len(args) == 1:
+		if err := srv.acl.reload(); err != nil {
+			return NewError(err.Error())
+		}
+		u := srv.acl.user(string(args[0]))
+		if u == nil {
+			return srv.createValueReply(r, nil)
+		}
+		passwords := make([]interface{}, len(u.passwords))
+		for i, p := range u.passwords {
+			passwords[i] = []byte(p)
+		}
+		keys := []interface{}{}
+		if u.allKeys {
+			keys = append(keys, []byte("*"))
+		}
+		for _, k := range u.keys {
+			keys = append(keys, []byte(k))
+		}
+		return srv.createValueReply(r, Map{
+			[]byte("flags"), u.flags(),
+			[]byte("passwords"), passwords,
+			[]byte("commands"), []byte(u.commandRules()),
+			[]byte("keys"), keys,
+		})
+	case sub == "deluser" && len(args) >= 1:
+		names := make([]string, len(args))
+		for i, arg := range args {
+			if names[i] = string(arg); names[i] == "default" {
+				return NewError("The 'default' user cannot be removed")
+			}
+		}
+		n, err := srv.acl.deleteUsers(names)
+		if err != nil {
+			return NewError(err.Error())
+		}
+		return srv.createValueReply(r, n)
+	case sub == "list" && len(args) == 0:
+		if err := srv.acl.reload(); err != nil {
+			return NewError(err.Error())
+		}
+		var list []interface{}
+		for _, name := range srv.acl.userNames() {
+			if u := srv.acl.user(name); u != nil {
+				list = append(list, []byte("user "+name+" "+u.rules()))
+			}
+		}
+		return srv.createValueReply(r, list)
+	case sub == "whoami" && len(args) == 0:
+		return srv.createValueReply(r, []byte(r.session.user))
+	}
+	return NewError("Unknown subcommand or wrong number of arguments for '" + string(r.Args[0]) + "'. Try ACL HELP.")
+}
@@ -0,0 +1,248 @@
+package redis
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestACLPassword(t *testing.T) {
+	// The sha256 of "foo".
+	const foo = "2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae"
+	if h := hashPassword("foo"); h != foo {
+		t.Fatalf("hashPassword(foo) = %s, want %s", h, foo)
+	}
+
+	tests := []struct {
+		rules    string
+		password string
+		ok       bool
+	}{
+		{"", "foo", false},
+		{"nopass", "anything", true},
+		{">foo", "foo", true},
+		{">foo", "bar", false},
+		{">foo >bar", "bar", true},
+		{"#" + foo, "foo", true},
+		{">foo <foo", "foo", false},
+		{">foo !" + foo, "foo", false},
+		{">foo resetpass", "foo", false},
+		// A password ends nopass.
+		{"nopass >foo", "bar", false},
+		{">foo nopass", "bar", true},
+	}
+	for _, tt := range tests {
+		u, err := parseUser("u", tt.rules)
+		if err != nil {
+			t.Fatalf("parseUser(%q): %s", tt.rules, err)
+		}
+		if ok := u.checkPassword([]byte(tt.password)); ok != tt.ok {
+			t.Errorf("%q: checkPassword(%s) = %v, want %v", tt.rules, tt.password, ok, tt.ok)
+		}
+	}
+}
+
+func TestACLRules(t *testing.T) {
+	const foo = "#2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae"
+	tests := []struct {
+		rules string
+		// want is the user as ACL LIST shows it, empty if the rules fail.
+		want string
+		err  error
+	}{
+		{"", "off -@all", nil},
+		{"on", "on -@all", nil},
+		{"on off", "off -@all", nil},
+		{"on nopass", "on nopass -@all", nil},
+		{">foo", "off " + foo + " -@all", nil},
+		{">foo >foo", "off " + foo + " -@all", nil},
+		{"<foo", "", errNoSuchPassword},
+		{"#FOO", "", errPasswordHash},
+		{"~a* ~b", "off ~a* ~b -@all", nil},
+		{"allkeys", "off ~* -@all", nil},
+		{"~a ~*", "off ~* -@all", nil},
+		{"allkeys ~a", "", errPatternAfterAll},
+		{"allkeys resetkeys ~a", "off ~a -@all", nil},
+		{"+@all", "off +@all", nil},
+		{"allcommands -get", "off +@all -get", nil},
+		{"+@read -GET +set", "off -@all +@read -get +set", nil},
+		{"+@all -@all", "off -@all", nil},
+		{"+@nosuch", "", errUnknownCommand},
+		{"+nosuch", "", errUnknownCommand},
+		{"on nopass ~* +@all reset", "off -@all", nil},
+		{"x", "", errSyntaxRule},
+		{"?a", "", errSyntaxRule},
+	}
+	isCommand := func(name string) bool {
+		_, ok := commandSpecs[name]
+		return ok
+	}
+	for _, tt := range tests {
+		u := &aclUser{name: "u"}
+		var err error
+		for _, rule := range strings.Fields(tt.rules) {
+			if err = u.apply(rule, isCommand); err != nil {
+				break
+			}
+		}
+		if err != tt.err {
+			t.Errorf("%q: got error %v, want %v", tt.rules, err, tt.err)
+			continue
+		}
+		if err == nil && u.rules() != tt.want {
+			t.Errorf("%q: got user %q, want %q", tt.rules, u.rules(), tt.want)
+		}
+	}
+}
+
+func TestACLCanRun(t *testing.T) {
+	tests := []struct {
+		rules string
+		name  string
+		ok    bool
+	}{
+		{"", "get", false},
+		{"+@all", "get", true},
+		{"+@all", "nosuch", true},
+		{"+@read", "get", true},
+		{"+@read", "set", false},
+		{"+@read", "nosuch", false},
+		{"+@all -get", "get", false},
+		// The last matching rule decides.
+		{"-get +@read", "get", true},
+		{"+@read -@string", "get", false},
+		{"+@read -@string +get", "get", true},
+	}
+	for _, tt := range tests {
+		u, err := parseUser("u", tt.rules)
+		if err != nil {
+			t.Fatalf("parseUser(%q): %s", tt.rules, err)
+		}
+		if ok := u.canRun(tt.name, commandSpecs[tt.name]); ok != tt.ok {
+			t.Errorf("%q: canRun(%s) = %v, want %v", tt.rules, tt.name, ok, tt.ok)
+		}
+	}
+}
+
+func TestACLCanAccess(t *testing.T) {
+	tests := []struct {
+		rules string
+		keys  []string
+		ok    bool
+	}{
+		{"", nil, true},
+		{"", []string{"a"}, false},
+		{"allkeys", []string{"a", "b"}, true},
+		{"~a*", []string{"a", "ab"}, true},
+		{"~a*", []string{"a", "b"}, false},
+		{"~a* ~b", []string{"a", "b"}, true},
+		{"~a?", []string{"a"}, false},
+	}
+	for _, tt := range tests {
+		u, err := parseUser("u", tt.rules)
+		if err != nil {
+			t.Fatalf("parseUser(%q): %s", tt.rules, err)
+		}
+		if ok := u.canAccess(bytesOf(tt.keys...)); ok != tt.ok {
+			t.Errorf("%q: canAccess(%v) = %v, want %v", tt.rules, tt.keys, ok, tt.ok)
+		}
+	}
+}
+
+func TestCommandKeys(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		keys []string
+	}{
+		{"get", []string{"a"}, []string{"a"}},
+		{"blpop", []string{"a", "b", "0"}, []string{"a", "b"}},
+		{"blpop", []string{"a", "0"}, []string{"a"}},
+		{"mset", []string{"a", "1", "b", "2"}, []string{"a", "b"}},
+		// A missing value does not make a key of it.
+		{"mset", []string{"a", "1", "b"}, []string{"a", "b"}},
+		{"bitop", []string{"and", "dest", "a", "b"}, []string{"dest", "a", "b"}},
+		{"ping", []string{"a"}, nil},
+	}
+	for _, tt := range tests {
+		keys := commandSpecs[tt.name].keys(bytesOf(tt.args...))
+		if want := bytesOf(tt.keys...); !reflect.DeepEqual(keys, want) {
+			t.Errorf("%s %v: got keys %q, want %q", tt.name, tt.args, keys, want)
+		}
+	}
+}
+
+func TestACLReplies(t *testing.T) {
+	srv, err := NewServer(DefaultConfig().Handler(&echoHandler{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin := dialServer(t, srv)
+	defer admin.Close()
+	alice := dialServer(t, srv)
+	defer alice.Close()
+
+	steps := []struct {
+		client net.Conn
+		cmd    []string
+		reply  string
+	}{
+		{admin, []string{"ACL", "SETUSER", "alice", "on", ">pw", "~a*", "+get", "+echo"}, "+OK\r\n"},
+		{alice, []string{"AUTH", "alice", "wrong"}, "-WRONGPASS invalid username-password pair or user is disabled.\r\n"},
+		{alice, []string{"AUTH", "alice", "pw"}, "+OK\r\n"},
+		{alice, []string{"GET", "a1"}, bulk("a1")},
+		{alice, []string{"GET", "b"}, "-NOPERM this user has no permissions to access one of the keys used as arguments\r\n"},
+		{alice, []string{"LEN", "a1"}, "-NOPERM this user has no permissions to run the 'len' command or its subcommand\r\n"},
+		// A disabled user is logged out.
+		{admin, []string{"ACL", "SETUSER", "alice", "off"}, "+OK\r\n"},
+		{alice, []string{"ECHO", "x"}, "-NOAUTH Authentication required.\r\n"},
+		{alice, []string{"AUTH", "alice", "pw"}, "-WRONGPASS invalid username-password pair or user is disabled.\r\n"},
+		{admin, []string{"ACL", "SETUSER", "alice", "on"}, "+OK\r\n"},
+		{alice, []string{"AUTH", "alice", "pw"}, "+OK\r\n"},
+		{alice, []string{"ECHO", "x"}, bulk("x")},
+		// So is a deleted one.
+		{admin, []string{"ACL", "DELUSER", "alice"}, ":1\r\n"},
+		{alice, []string{"ECHO", "x"}, "-NOAUTH Authentication required.\r\n"},
+		// Once the default user has a password, new clients log in first.
+		{admin, []string{"ACL", "SETUSER", "default", ">secret"}, "+OK\r\n"},
+		{alice, []string{"AUTH", "secret"}, "+OK\r\n"},
+		{alice, []string{"ACL", "WHOAMI"}, bulk("default")},
+	}
+	for _, step := range steps {
+		if _, err := step.client.Write([]byte(command(step.cmd...))); err != nil {
+			t.Fatal(err)
+		}
+		if got := readReplies(t, step.client, len(step.reply)); got != step.reply {
+			t.Fatalf("%v replied %q, want %q", step.cmd, got, step.reply)
+		}
+	}
+
+	newcomer := dialServer(t, srv)
+	defer newcomer.Close()
+	want := "-NOAUTH Authentication required.\r\n"
+	newcomer.Write([]byte(command("ECHO", "x")))
+	if got := readReplies(t, newcomer, len(want)); got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+// dialServer connects a client to srv.
+func dialServer(t *testing.T, srv *Server) net.Conn {
+	client, server := net.Pipe()
+	go srv.ServeClient(server)
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	return client
+}
+
+func bytesOf(s ...string) [][]byte {
+	if s == nil {
+		return nil
+	}
+	b := make([][]byte, len(s))
+	for i := range s {
+		b[i] = []byte(s[i])
+	}
+	return b
+}
@@ -45,11 +45,40 @@ func (srv *Server) createHandlerFn(autoHandler interface{}, f *reflect.Value) (H
 }
 
 func (srv *Server) handlerFn(autoHandler interface{}, f *reflect.Value, checkers []CheckerFn) (HandlerFn, error) {
+	// A handler without a slice or map argument takes a fixed number of
+	// arguments, one per checker.
+	maxArgs := len(checkers)
+	mtype := f.Type()
+	for i := 0; i < mtype.NumIn(); i++ {
+		if mtype.In(i) == closedType {
+			maxArgs--
+		}
+		switch mtype.In(i).Kind() {
+		case reflect.Slice, reflect.Map:
+			if mtype.In(i) != reflect.TypeOf([]byte{}) {
+				maxArgs = -1
+			}
+		}
+	}
+	if mtype.IsVariadic() {
+		maxArgs = -1
+	}
+
 	return func(request *Request) (ReplyWriter, error) {
 		input := []reflect.Value{reflect.ValueOf(autoHandler)}
+		// Run on the copy of the handler of the connection if there is one.
+		if s := request.session; s != nil && s.handler.IsValid() && s.handler.Type() == input[0].Type() {
+			input[0] = s.handler
+		}
 
+		if maxArgs >= 0 && len(request.Args) > maxArgs {
+			return wrongArgs(request), nil
+		}
 		for _, checker := range checkers {
 			value, reply := checker(request)
+			if reply == ErrNotEnoughArgs {
+				return wrongArgs(request), nil
+			}
 			if reply != nil {
 				return reply, nil
 			}
@@ -99,7 +128,7 @@ func (srv *Server) handlerFn(autoHandler interface{}, f *reflect.Value, checkers
 			// Last return value is an error, wrap it to redis error
 			err := ierr.(error)
 			// convert to redis error reply
-			return NewError(err.Error()), nil
+			return errorReply(request, err), nil
 		}
 		if len(result) > 1 {
 			ret = result[0].Interface()
@@ -117,9 +146,25 @@ func hashValueReply(v HashValue) (*MultiBulkReply, error) {
 	return MultiBulkFromMap(m), nil
 }
 
+// createValueReply creates the reply of a value in the protocol of the
+// client, it is for values createReply knows.
+func (srv *Server) createValueReply(r *Request, val interface{}) ReplyWriter {
+	reply, err := srv.createReply(r, val)
+	if err != nil {
+		return NewError(err.Error())
+	}
+	return reply
+}
+
 func (srv *Server) createReply(r *Request, val interface{}) (ReplyWriter, error) {
 	Debugf("CREATE REPLY: %T", val)
-	switch v := val.(type) {
+	proto := 2
+	if r.session != nil {
+		proto = r.session.proto
+	}
+	switch v := toProto(val, proto).(type) {
+	case nil:
+		return &BulkReply{value: nil}, nil
 	case []interface{}:
 		return &MultiBulkReply{values: v}, nil
 	case string:
@@ -130,7 +175,7 @@ func (srv *Server) createReply(r *Request, val interface{}) (ReplyWriter, error)
 		}
 		m := make([]interface{}, len(v), cap(v))
 		for i, elem := range v {
-			m[i] = elem
+			m[i] = toProto(elem, proto)
 		}
 		return &MultiBulkReply{values: m}, nil
 	case []byte:
@@ -143,6 +188,8 @@ func (srv *Server) createReply(r *Request, val interface{}) (ReplyWriter, error)
 		return MultiBulkFromMap(v), nil
 	case int:
 		return &IntegerReply{number: v}, nil
+	case Map, Set, Push, Double, bool, BigNumber, *Verbatim, null:
+		return &valueReply{value: v}, nil
 	case *StatusReply:
 		return v, nil
 	case *MonitorReply:
@@ -175,30 +222,44 @@ func createCheckers(autoHandler interface{}, f *reflect.Value) ([]CheckerFn, err
 		start = 1
 	}
 
+	// arg is the index of the request argument the parameter i takes.
+	arg := 0
 	for i := start; i < mtype.NumIn(); i += 1 {
 		switch mtype.In(i) {
+		case closedType:
+			checkers = append(checkers, closedChecker)
+			continue
 		case reflect.TypeOf(""):
-			checkers = append(checkers, stringChecker(i-start))
+			checkers = append(checkers, stringChecker(arg))
 		case reflect.TypeOf([]string{}):
-			checkers = append(checkers, stringSliceChecker(i-start))
+			checkers = append(checkers, stringSliceChecker(arg))
 		case reflect.TypeOf([]byte{}):
-			checkers = append(checkers, byteChecker(i-start))
+			checkers = append(checkers, byteChecker(arg))
 		case reflect.TypeOf([][]byte{}):
-			checkers = append(checkers, byteSliceChecker(i-start))
+			checkers = append(checkers, byteSliceChecker(arg))
 		case reflect.TypeOf(map[string][]byte{}):
 			if i != mtype.NumIn()-1 {
 				return nil, errors.New("Map should be the last argument")
 			}
-			checkers = append(checkers, mapChecker(i-start))
+			checkers = append(checkers, mapChecker(arg))
 		case reflect.TypeOf(1):
-			checkers = append(checkers, intChecker(i-start))
+			checkers = append(checkers, intChecker(arg))
 		default:
 			return nil, fmt.Errorf("Argument %d: wrong type %s (%s)", i, mtype.In(i), mtype.Name())
 		}
+		arg++
 	}
 	return checkers, nil
 }
 
+// closedType is the type of a handler parameter that takes no argument but
+// gets a channel closed once the client of a blocking command disconnects.
+var closedType = reflect.TypeOf((<-chan struct{})(nil))
+
+func closedChecker(request *Request) (reflect.Value, ReplyWriter) {
+	return reflect.ValueOf(request.closed), nil
+}
+
 func stringChecker(index int) CheckerFn {
 	return func(request *Request) (reflect.Value, ReplyWriter) {
 		v, err := request.GetString(index)
@@ -0,0 +1,317 @@
+package redis
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// clientInfo is what CLIENT LIST shows of a session. The goroutine of the
+// connection publishes it under the mutex of the server as its requests start
+// and end, so that the other connections can read it.
+type clientInfo struct {
+	name  string
+	user  string
+	db    int
+	proto int
+	// multi is the number of commands queued, -1 outside MULTI.
+	multi     int
+	sub, psub int
+	blocked   bool
+	// cmd is the command running or the last one run.
+	cmd  string
+	last time.Time
+}
+
+// subcommandCommands are shown with their subcommand in the cmd of a
+// client, as in client|list.
+var subcommandCommands = map[string]bool{
+	"client": true, "config": true, "acl": true, "pubsub": true,
+}
+
+func commandName(r *Request) string {
+	name := strings.ToLower(r.Name)
+	if subcommandCommands[name] && len(r.Args) > 0 {
+		return name + "|" + strings.ToLower(string(r.Args[0]))
+	}
+	return name
+}
+
+// publishInfo publishes the state of s with cmd running, or run last.
+func (srv *Server) publishInfo(s *session, cmd string, blocked bool) {
+	info := clientInfo{
+		name:    s.name,
+		user:    s.user,
+		db:      s.db,
+		proto:   s.proto,
+		multi:   -1,
+		blocked: blocked,
+		cmd:     cmd,
+		last:    time.Now(),
+	}
+	if s.multi {
+		info.multi = len(s.queued)
+	}
+	if s.sub != nil {
+		info.sub, info.psub = len(s.sub.channels), len(s.sub.patterns)
+	}
+	srv.mu.Lock()
+	s.info = info
+	srv.mu.Unlock()
+}
+
+// killed reports whether the client killed itself with CLIENT KILL.
+func (srv *Server) killed(s *session) bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return s.kill
+}
+
+// clientLine formats s as a line of CLIENT LIST, srv.mu must be held.
+func clientLine(s *session, now time.Time) string {
+	info := s.info
+	flags := ""
+	if info.blocked {
+		flags += "b"
+	}
+	if info.sub+info.psub > 0 {
+		flags += "P"
+	}
+	if info.multi >= 0 {
+		flags += "x"
+	}
+	if flags == "" {
+		flags = "N"
+	}
+	return fmt.Sprintf("id=%d addr=%s laddr=%s name=%s age=%d idle=%d flags=%s db=%d sub=%d psub=%d multi=%d cmd=%s user=%s resp=%d\n",
+		s.id, s.addr, s.laddr, info.name, int64(now.Sub(s.created)/time.Second), int64(now.Sub(info.last)/time.Second),
+		flags, info.db, info.sub, info.psub, info.multi, info.cmd, info.user, info.proto)
+}
+
+// clients gets the sessions of the server sorted by id, srv.mu must be held.
+func (srv *Server) clients() []*session {
+	sessions := make([]*session, 0, len(srv.sessions))
+	for s := range srv.sessions {
+		sessions = append(sessions, s)
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].id < sessions[j].id })
+	return sessions
+}
+
+// clientFilter selects the clients of CLIENT LIST and CLIENT KILL.
+type clientFilter struct {
+	ids    map[int64]bool
+	addr   string
+	laddr  string
+	user   string
+	typ    string
+	skipme bool
+}
+
+func (f *clientFilter) match(s *session, me *session) bool {
+	if f.ids != nil && !f.ids[s.id] {
+		return false
+	}
+	if f.addr != "" && s.addr != f.addr {
+		return false
+	}
+	if f.laddr != "" && s.laddr != f.laddr {
+		return false
+	}
+	if f.user != "" && s.info.user != f.user {
+		return false
+	}
+	pubsub := s.info.sub+s.info.psub > 0
+	switch f.typ {
+	case "normal":
+		if pubsub {
+			return false
+		}
+	case "pubsub":
+		if !pubsub {
+			return false
+		}
+	case "master", "replica", "slave":
+		// There are no replication links.
+		return false
+	}
+	return !f.skipme || s != me
+}
+
+func parseClientType(arg []byte) (string, ReplyWriter) {
+	typ := strings.ToLower(string(arg))
+	switch typ {
+	case "normal", "pubsub", "master", "replica", "slave":
+		return typ, nil
+	}
+	return "", NewError("Unknown client type '" + string(arg) + "'")
+}
+
+func parseClientID(arg []byte) (int64, ReplyWriter) {
+	id, err := strconv.ParseInt(string(arg), 10, 64)
+	if err != nil || id <= 0 {
+		return 0, NewError("client-id should be greater than 0")
+	}
+	return id, nil
+}
+
+// validClientName reports whether name has no spaces, newlines or special
+// characters, so that it fits in a line of CLIENT LIST.
+func validClientName(name []byte) bool {
+	for _, c := range name {
+		if c < '!' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// clientCommand handles the CLIENT subcommands on the connections of the
+// server.
+func (srv *Server) clientCommand(r *Request) ReplyWriter {
+	s := r.session
+	if len(r.Args) == 0 {
+		return wrongArgs(r)
+	}
+	sub := strings.ToLower(string(r.Args[0]))
+	args := r.Args[1:]
+	switch {
+	case sub == "id" && len(args) == 0:
+		return &IntegerReply{number: int(s.id)}
+	case sub == "getname" && len(args) == 0:
+		if s.name == "" {
+			return srv.createValueReply(r, nil)
+		}
+		return &BulkReply{value: []byte(s.name)}
+	case sub == "setname" && len(args) == 1:
+		if !validClientName(args[0]) {
+			return NewError("Client names cannot contain spaces, newlines or special characters.")
+		}
+		s.name = string(args[0])
+		return StatusOK
+	case sub == "info" && len(args) == 0:
+		srv.mu.Lock()
+		defer srv.mu.Unlock()
+		return &BulkReply{value: []byte(clientLine(s, time.Now()))}
+	case sub == "list":
+		return srv.clientList(r, args)
+	case sub == "kill" && len(args) >= 1:
+		return srv.clientKill(r, args)
+	}
+	return NewError("Unknown subcommand or wrong number of arguments for '" + string(r.Args[0]) + "'. Try CLIENT HELP.")
+}
+
+// clientList handles CLIENT LIST [TYPE type] [ID id [id ...]].
+func (srv *Server) clientList(r *Request, args [][]byte) ReplyWriter {
+	var f clientFilter
+	for i := 0; i < len(args); i++ {
+		switch opt := strings.ToLower(string(args[i])); {
+		case opt == "type" && i+1 < len(args):
+			typ, reply := parseClientType(args[i+1])
+			if reply != nil {
+				return reply
+			}
+			f.typ = typ
+			i++
+		case opt == "id" && i+1 < len(args):
+			f.ids = make(map[int64]bool)
+			for i++; i < len(args); i++ {
+				id, reply := parseClientID(args[i])
+				if reply != nil {
+					return reply
+				}
+				f.ids[id] = true
+			}
+		default:
+			return ErrSyntax
+		}
+	}
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	var buf bytes.Buffer
+	now := time.Now()
+	for _, s := range srv.clients() {
+		if f.match(s, r.session) {
+			buf.WriteString(clientLine(s, now))
+		}
+	}
+	return &BulkReply{value: []byte(buf.String())}
+}
+
+// clientKill handles CLIENT KILL addr, which replies OK, and CLIENT KILL
+// with filters, which replies the number of clients killed. The connection
+// of the client itself is closed after the reply.
+func (srv *Server) clientKill(r *Request, args [][]byte) ReplyWriter {
+	f := clientFilter{skipme: true}
+	if len(args) == 1 {
+		f.addr, f.skipme = string(args[0]), false
+	} else {
+		if len(args)%2 != 0 {
+			return ErrSyntax
+		}
+		for i := 0; i < len(args); i += 2 {
+			v := args[i+1]
+			switch strings.ToLower(string(args[i])) {
+			case "id":
+				id, reply := parseClientID(v)
+				if reply != nil {
+					return reply
+				}
+				f.ids = map[int64]bool{id: true}
+			case "addr":
+				f.addr = string(v)
+			case "laddr":
+				f.laddr = string(v)
+			case "user":
+				if srv.acl.user(string(v)) == nil {
+					return NewError("No such user '" + string(v) + "'")
+				}
+				f.user = string(v)
+			case "type":
+				typ, reply := parseClientType(v)
+				if reply != nil {
+					return reply
+				}
+				f.typ = typ
+			case "skipme":
+				switch strings.ToLower(string(v)) {
+				case "yes":
+					f.skipme = true
+				case "no":
+					f.skipme = false
+				default:
+					return ErrSyntax
+				}
+			default:
+				return ErrSyntax
+			}
+		}
+	}
+
+	srv.mu.Lock()
+	killed := 0
+	for _, s := range srv.clients() {
+		if !f.match(s, r.session) {
+			continue
+		}
+		if s == r.session {
+			s.kill = true
+		} else {
+			s.out.conn.Close()
+		}
+		killed++
+	}
+	srv.mu.Unlock()
+
+	if len(args) == 1 {
+		if killed == 0 {
+			return NewError("No such client")
+		}
+		return StatusOK
+	}
+	return &IntegerReply{number: killed}
+}
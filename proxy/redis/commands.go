@@ -0,0 +1,200 @@
+package redis
+
+import (
+	"strings"
+)
+
+// commandSpec describes a command the way the command table of redis does:
+// the ACL categories it belongs to and where its keys are.
+type commandSpec struct {
+	categories []string
+	// firstKey, lastKey and step give the positions of the keys, the command
+	// name being at 0. A negative lastKey counts from the end, a firstKey of
+	// 0 means the command takes no keys.
+	firstKey int
+	lastKey  int
+	step     int
+}
+
+func spec(categories string, firstKey int, lastKey int, step int) *commandSpec {
+	return &commandSpec{
+		categories: strings.Fields(categories),
+		firstKey:   firstKey,
+		lastKey:    lastKey,
+		step:       step,
+	}
+}
+
+// aclCategories are the categories ACL rules may name.
+var aclCategories = []string{
+	"keyspace", "read", "write", "set", "sortedset", "list", "hash", "string",
+	"bitmap", "hyperloglog", "pubsub", "admin", "fast", "slow", "blocking",
+	"dangerous", "connection", "transaction",
+}
+
+var commandSpecs = map[string]*commandSpec{
+	"get":         spec("read string fast", 1, 1, 1),
+	"set":         spec("write string slow", 1, 1, 1),
+	"setnx":       spec("write string fast", 1, 1, 1),
+	"setex":       spec("write string slow", 1, 1, 1),
+	"psetex":      spec("write string slow", 1, 1, 1),
+	"getset":      spec("write string fast", 1, 1, 1),
+	"getdel":      spec("write string fast", 1, 1, 1),
+	"getex":       spec("write string fast", 1, 1, 1),
+	"mget":        spec("read string fast", 1, -1, 1),
+	"mset":        spec("write string slow", 1, -1, 2),
+	"msetnx":      spec("write string slow", 1, -1, 2),
+	"append":      spec("write string fast", 1, 1, 1),
+	"strlen":      spec("read string fast", 1, 1, 1),
+	"getrange":    spec("read string slow", 1, 1, 1),
+	"setrange":    spec("write string slow", 1, 1, 1),
+	"incr":        spec("write string fast", 1, 1, 1),
+	"decr":        spec("write string fast", 1, 1, 1),
+	"incrby":      spec("write string fast", 1, 1, 1),
+	"decrby":      spec("write string fast", 1, 1, 1),
+	"incrbyfloat": spec("write string fast", 1, 1, 1),
+
+	"setbit":      spec("write bitmap slow", 1, 1, 1),
+	"getbit":      spec("read bitmap fast", 1, 1, 1),
+	"bitcount":    spec("read bitmap slow", 1, 1, 1),
+	"bitpos":      spec("read bitmap slow", 1, 1, 1),
+	"bitop":       spec("write bitmap slow", 2, -1, 1),
+	"bitfield":    spec("write bitmap slow", 1, 1, 1),
+	"bitfield_ro": spec("read bitmap fast", 1, 1, 1),
+
+	"hset":         spec("write hash fast", 1, 1, 1),
+	"hmset":        spec("write hash fast", 1, 1, 1),
+	"hget":         spec("read hash fast", 1, 1, 1),
+	"hgetall":      spec("read hash slow", 1, 1, 1),
+	"hdel":         spec("write hash fast", 1, 1, 1),
+	"hkeys":        spec("read hash slow", 1, 1, 1),
+	"hlen":         spec("read hash fast", 1, 1, 1),
+	"hincrby":      spec("write hash fast", 1, 1, 1),
+	"hincrbyfloat": spec("write hash fast", 1, 1, 1),
+
+	"pfadd":   spec("write hyperloglog fast", 1, 1, 1),
+	"pfcount": spec("read hyperloglog slow", 1, -1, 1),
+	"pfmerge": spec("write hyperloglog slow", 1, -1, 1),
+
+	"del":       spec("keyspace write slow", 1, -1, 1),
+	"unlink":    spec("keyspace write fast", 1, -1, 1),
+	"type":      spec("keyspace read fast", 1, 1, 1),
+	"exists":    spec("keyspace read fast", 1, -1, 1),
+	"touch":     spec("keyspace read fast", 1, -1, 1),
+	"rename":    spec("keyspace write slow", 1, 2, 1),
+	"renamenx":  spec("keyspace write fast", 1, 2, 1),
+	"copy":      spec("keyspace write slow", 1, 2, 1),
+	"expire":    spec("keyspace write fast", 1, 1, 1),
+	"pexpire":   spec("keyspace write fast", 1, 1, 1),
+	"expireat":  spec("keyspace write fast", 1, 1, 1),
+	"pexpireat": spec("keyspace write fast", 1, 1, 1),
+	"persist":   spec("keyspace write fast", 1, 1, 1),
+	"ttl":       spec("keyspace read fast", 1, 1, 1),
+	"pttl":      spec("keyspace read fast", 1, 1, 1),
+	"keys":      spec("keyspace read slow dangerous", 0, 0, 0),
+	"scan":      spec("keyspace read slow", 0, 0, 0),
+	"move":      spec("keyspace write fast", 1, 1, 1),
+	"dbsize":    spec("keyspace read fast", 0, 0, 0),
+	"flushdb":   spec("keyspace write slow dangerous", 0, 0, 0),
+	"flushall":  spec("keyspace write slow dangerous", 0, 0, 0),
+	"swapdb":    spec("keyspace write fast dangerous", 0, 0, 0),
+
+	"lpush":  spec("write list fast", 1, 1, 1),
+	"rpush":  spec("write list fast", 1, 1, 1),
+	"lpop":   spec("write list fast", 1, 1, 1),
+	"rpop":   spec("write list fast", 1, 1, 1),
+	"llen":   spec("read list fast", 1, 1, 1),
+	"lindex": spec("read list slow", 1, 1, 1),
+	"lset":   spec("write list slow", 1, 1, 1),
+	"lrange": spec("read list slow", 1, 1, 1),
+	"ltrim":  spec("write list slow", 1, 1, 1),
+
+	"sadd":        spec("write set fast", 1, 1, 1),
+	"srem":        spec("write set fast", 1, 1, 1),
+	"smembers":    spec("read set slow", 1, 1, 1),
+	"sismember":   spec("read set fast", 1, 1, 1),
+	"scard":       spec("read set fast", 1, 1, 1),
+	"spop":        spec("write set fast", 1, 1, 1),
+	"sinter":      spec("read set slow", 1, -1, 1),
+	"sunion":      spec("read set slow", 1, -1, 1),
+	"sdiff":       spec("read set slow", 1, -1, 1),
+	"sinterstore": spec("write set slow", 1, -1, 1),
+	"sunionstore": spec("write set slow", 1, -1, 1),
+	"sdiffstore":  spec("write set slow", 1, -1, 1),
+
+	"zadd":             spec("write sortedset fast", 1, 1, 1),
+	"zincrby":          spec("write sortedset fast", 1, 1, 1),
+	"zrem":             spec("write sortedset fast", 1, 1, 1),
+	"zscore":           spec("read sortedset fast", 1, 1, 1),
+	"zcard":            spec("read sortedset fast", 1, 1, 1),
+	"zrank":            spec("read sortedset fast", 1, 1, 1),
+	"zrevrank":         spec("read sortedset fast", 1, 1, 1),
+	"zrange":           spec("read sortedset slow", 1, 1, 1),
+	"zrevrange":        spec("read sortedset slow", 1, 1, 1),
+	"zrangebyscore":    spec("read sortedset slow", 1, 1, 1),
+	"zrevrangebyscore": spec("read sortedset slow", 1, 1, 1),
+
+	"multi":   spec("transaction fast", 0, 0, 0),
+	"exec":    spec("transaction slow", 0, 0, 0),
+	"discard": spec("transaction fast", 0, 0, 0),
+	"watch":   spec("transaction fast", 1, -1, 1),
+	"unwatch": spec("transaction fast", 0, 0, 0),
+
+	"lmove":  spec("write list slow", 1, 2, 1),
+	"blpop":  spec("write list slow blocking", 1, -2, 1),
+	"brpop":  spec("write list slow blocking", 1, -2, 1),
+	"blmove": spec("write list slow blocking", 1, 2, 1),
+
+	"subscribe":    spec("pubsub slow", 0, 0, 0),
+	"psubscribe":   spec("pubsub slow", 0, 0, 0),
+	"unsubscribe":  spec("pubsub slow", 0, 0, 0),
+	"punsubscribe": spec("pubsub slow", 0, 0, 0),
+	"publish":      spec("pubsub fast", 0, 0, 0),
+	"pubsub":       spec("pubsub slow", 0, 0, 0),
+
+	"auth":    spec("connection fast", 0, 0, 0),
+	"hello":   spec("connection fast", 0, 0, 0),
+	"ping":    spec("connection fast", 0, 0, 0),
+	"echo":    spec("connection fast", 0, 0, 0),
+	"select":  spec("connection fast", 0, 0, 0),
+	"acl":     spec("admin slow dangerous", 0, 0, 0),
+	"config":  spec("admin slow dangerous", 0, 0, 0),
+	"client":  spec("admin slow dangerous connection", 0, 0, 0),
+	"info":    spec("slow dangerous", 0, 0, 0),
+	"monitor": spec("admin slow dangerous", 0, 0, 0),
+}
+
+// keys gets the key arguments of a request for the command of s.
+func (s *commandSpec) keys(args [][]byte) [][]byte {
+	var keys [][]byte
+	for _, i := range s.keyPositions(len(args)) {
+		keys = append(keys, args[i])
+	}
+	return keys
+}
+
+// keyPositions gets the indexes of the keys in n arguments for the command
+// of s.
+func (s *commandSpec) keyPositions(n int) []int {
+	if s.firstKey == 0 {
+		return nil
+	}
+	last := s.lastKey
+	if last < 0 {
+		last += n + 1
+	}
+	var positions []int
+	for i := s.firstKey; i <= last && i <= n; i += s.step {
+		positions = append(positions, i-1)
+	}
+	return positions
+}
+
+func (s *commandSpec) inCategory(category string) bool {
+	for _, c := range s.categories {
+		if c == category {
+			return true
+		}
+	}
+	return false
+}
@@ -5,6 +5,10 @@ type Config struct {
 	host    string
 	port    int
 	handler interface{}
+	acl     ACLStore
+	pubsub  PubSubLog
+	tlsPort int
+	tls     tlsFiles
 }
 
 func DefaultConfig() *Config {
@@ -13,6 +17,7 @@ func DefaultConfig() *Config {
 		host:    "127.0.0.1",
 		port:    6389,
 		handler: NewDefaultHandler(),
+		tls:     tlsFiles{authClients: true, minVersion: "1.2"},
 	}
 }
 
@@ -35,3 +40,52 @@ func (c *Config) Handler(h interface{}) *Config {
 	c.handler = h
 	return c
 }
+
+// ACLStore sets where the ACL users are kept, servers on the same store share
+// their users. Without it the users only live in the server.
+func (c *Config) ACLStore(s ACLStore) *Config {
+	c.acl = s
+	return c
+}
+
+// PubSubLog sets the log Pub/Sub messages go through, servers on the same
+// log deliver the messages published on each other. Without it the handler
+// serves Pub/Sub itself, if it does.
+func (c *Config) PubSubLog(l PubSubLog) *Config {
+	c.pubsub = l
+	return c
+}
+
+// TLSPort sets the port to serve TLS on, TLS is off while it is 0. With a
+// port of 0 the server only serves TLS.
+func (c *Config) TLSPort(p int) *Config {
+	c.tlsPort = p
+	return c
+}
+
+// TLSCert sets the PEM files of the certificate of the server and its key.
+func (c *Config) TLSCert(certFile string, keyFile string) *Config {
+	c.tls.certFile = certFile
+	c.tls.keyFile = keyFile
+	return c
+}
+
+// TLSCA sets the PEM bundle of the CAs client certificates are verified with.
+func (c *Config) TLSCA(caFile string) *Config {
+	c.tls.caFile = caFile
+	return c
+}
+
+// TLSAuthClients sets whether clients must present a certificate, it is on by
+// default.
+func (c *Config) TLSAuthClients(required bool) *Config {
+	c.tls.authClients = required
+	return c
+}
+
+// TLSMinVersion sets the lowest TLS version accepted, one of "1.0", "1.1",
+// "1.2" and "1.3". It is "1.2" by default.
+func (c *Config) TLSMinVersion(v string) *Config {
+	c.tls.minVersion = v
+	return c
+}
@@ -0,0 +1,59 @@
+package redis
+
+import (
+	"strings"
+
+	"github.com/Mansfield6/tikv-proxy-demo/proxy/config"
+	"github.com/ngaut/log"
+)
+
+// configCommand handles CONFIG GET, SET, RESETSTAT and REWRITE on the
+// settings of the config package.
+func (srv *Server) configCommand(r *Request) ReplyWriter {
+	if len(r.Args) == 0 {
+		return wrongArgs(r)
+	}
+	sub := strings.ToLower(string(r.Args[0]))
+	args := r.Args[1:]
+	switch {
+	case sub == "get" && len(args) >= 1:
+		patterns := make([]string, len(args))
+		for i, arg := range args {
+			patterns[i] = string(arg)
+		}
+		values := Map{}
+		for _, kv := range config.Get(patterns) {
+			values = append(values, []byte(kv[0]), []byte(kv[1]))
+		}
+		return srv.createValueReply(r, values)
+	case sub == "set" && len(args) >= 2 && len(args)%2 == 0:
+		pairs := make([][2]string, 0, len(args)/2)
+		for i := 0; i < len(args); i += 2 {
+			pairs = append(pairs, [2]string{string(args[i]), string(args[i+1])})
+		}
+		if err := config.Set(pairs); err != nil {
+			if e, ok := err.(*config.SetError); ok {
+				if e.Err == config.ErrUnknown {
+					return NewError("Unknown option or number of arguments for CONFIG SET - '" + e.Name + "'")
+				}
+				return NewError("CONFIG SET failed (possibly related to argument '" + e.Name + "') - " + e.Err.Error())
+			}
+			return NewError(err.Error())
+		}
+		return StatusOK
+	case sub == "resetstat" && len(args) == 0:
+		srv.stats.reset()
+		return StatusOK
+	case sub == "rewrite" && len(args) == 0:
+		if err := config.Rewrite(); err != nil {
+			if err == config.ErrNoFile {
+				return NewError(err.Error())
+			}
+			log.Errorf("rewrite config file failed - %s", err)
+			return NewError("Rewriting config file: " + err.Error())
+		}
+		log.Infof("config file %s rewritten", config.Path())
+		return StatusOK
+	}
+	return NewError("Unknown subcommand or wrong number of arguments for '" + string(r.Args[0]) + "'. Try CONFIG HELP.")
+}
@@ -2,6 +2,7 @@ package redis
 
 import (
 	"errors"
+	"fmt"
 	"io"
 )
 
@@ -14,12 +15,37 @@ var (
 	ErrExpectPositivInteger = NewError("Expected positive integer")
 	ErrExpectMorePair       = NewError("Expected at least one key val pair")
 	ErrExpectEvenPair       = NewError("Got uneven number of key val pairs")
+	ErrNestedMulti          = NewError("MULTI calls can not be nested")
+	ErrExecWithoutMulti     = NewError("EXEC without MULTI")
+	ErrDiscardWithoutMulti  = NewError("DISCARD without MULTI")
+	ErrWatchInMulti         = NewError("WATCH inside MULTI is not allowed")
+	ErrExecAbort            = NewErrorCode("EXECABORT", "Transaction discarded because of previous errors.")
+	ErrProtoVersion         = NewError("Protocol version is not an integer or out of range")
+	ErrNoProto              = NewErrorCode("NOPROTO", "unsupported protocol version")
+	ErrWrongPass            = NewErrorCode("WRONGPASS", "invalid username-password pair or user is disabled.")
+	ErrWrongType            = NewErrorCode("WRONGTYPE", "Operation against a key holding the wrong kind of value")
+	ErrTryAgain             = NewErrorCode("TRYAGAIN", "The command conflicted with another one and was not run, try again later")
+	ErrBusy                 = NewErrorCode("BUSY", "The storage is busy and timed out, try again later")
+	ErrSyntax               = NewError("syntax error")
+	ErrNoAuth               = NewErrorCode("NOAUTH", "Authentication required.")
+	ErrHelloNoAuth          = NewErrorCode("NOAUTH", "HELLO must be called with the client already authenticated, otherwise the HELLO AUTH <user> <pass> option can be used to authenticate the client and select the RESP protocol version at the same time")
+	ErrNoPermKey            = NewErrorCode("NOPERM", "this user has no permissions to access one of the keys used as arguments")
+	ErrNoConnection         = NewError("Command needs a client connection")
+	ErrSubscribeInMulti     = NewError("Command not allowed inside a transaction")
 )
 
 var (
 	ErrParseTimeout = errors.New("timeout is not an integer or out of range")
+	// ErrWrongArgs returned by a handler is replied with the wrong number of
+	// arguments error of the command.
+	ErrWrongArgs = errors.New("wrong number of arguments")
 )
 
+// causer is implemented by the traced errors of github.com/juju/errors.
+type causer interface {
+	Cause() error
+}
+
 type ErrorReply struct {
 	code    string
 	message string
@@ -35,5 +61,39 @@ func (er *ErrorReply) Error() string {
 }
 
 func NewError(message string) *ErrorReply {
-	return &ErrorReply{code: "ERROR", message: message}
+	return &ErrorReply{code: "ERR", message: message}
+}
+
+// NewErrorCode creates an error reply with a code other than ERR, clients
+// tell errors apart by their codes.
+func NewErrorCode(code string, message string) *ErrorReply {
+	return &ErrorReply{code: code, message: message}
+}
+
+func wrongArgs(r *Request) *ErrorReply {
+	return NewError("wrong number of arguments for '" + r.Name + "' command")
+}
+
+func unknownCommand(r *Request) *ErrorReply {
+	args := ""
+	for _, arg := range r.Args {
+		args += "`" + string(arg) + "`, "
+	}
+	return NewError(fmt.Sprintf("unknown command `%s`, with args beginning with: %s", r.Name, args))
+}
+
+// errorReply turns an error returned by a handler into its reply, a handler
+// picks the code of the reply by returning an *ErrorReply.
+func errorReply(r *Request, err error) *ErrorReply {
+	cause := err
+	if c, ok := err.(causer); ok && c.Cause() != nil {
+		cause = c.Cause()
+	}
+	if cause == ErrWrongArgs {
+		return wrongArgs(r)
+	}
+	if reply, ok := cause.(*ErrorReply); ok {
+		return reply
+	}
+	return NewError(err.Error())
 }
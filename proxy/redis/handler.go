@@ -2,6 +2,7 @@ package redis
 
 import (
 	"reflect"
+	"strconv"
 	"strings"
 )
 
@@ -32,11 +33,33 @@ func (srv *Server) Apply(r *Request) (ReplyWriter, error) {
 		Debugf("The method map is uninitialized")
 		return ErrMethodNotSupported, nil
 	}
-	fn, exists := srv.methods[strings.ToLower(r.Name)]
+	if r.session != nil {
+		name := strings.ToLower(r.Name)
+		if reply := srv.checkACL(r, name); reply != nil {
+			return reply, nil
+		}
+		if reply, ok := srv.applySession(r, name); ok {
+			return reply, nil
+		}
+	}
+	return srv.call(r)
+}
+
+func (srv *Server) call(r *Request) (ReplyWriter, error) {
+	name := strings.ToLower(r.Name)
+	fn, exists := srv.methods[name]
 	if !exists {
-		return ErrMethodNotSupported, nil
+		return unknownCommand(r), nil
+	}
+	reply, err := fn(r)
+	// The handler keeps the database of the session, CLIENT LIST shows the
+	// one it switched to.
+	if name == "select" && err == nil && r.session != nil && len(r.Args) == 1 {
+		if _, failed := reply.(*ErrorReply); !failed {
+			r.session.db, _ = strconv.Atoi(string(r.Args[0]))
+		}
 	}
-	return fn(r)
+	return reply, err
 }
 
 func (srv *Server) ApplyString(r *Request) (string, error) {
@@ -0,0 +1,199 @@
+package redis
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/Mansfield6/tikv-proxy-demo/proxy/config"
+	"github.com/ngaut/log"
+)
+
+// InfoProvider is implemented by handlers that add sections of their own to
+// INFO, such as the keyspace of their store. Its methods are not registered
+// as commands.
+type InfoProvider interface {
+	// InfoSections names the sections of the handler in the order INFO
+	// shows them, after the ones of the server.
+	InfoSections() []string
+	// InfoSection gets the fields of a section.
+	InfoSection(name string) ([][2]string, error)
+}
+
+// serverSections are the sections of the server, the ones not in
+// defaultSections are only shown when asked for.
+var (
+	serverSections  = []string{"server", "clients", "stats", "commandstats"}
+	defaultSections = map[string]bool{"server": true, "clients": true, "stats": true}
+)
+
+// info handles INFO [section [section ...]]. Without a section, or with
+// default, it shows the default sections of the server and all the sections
+// of the handler; all and everything show every section.
+func (srv *Server) info(r *Request) ReplyWriter {
+	provider, _ := srv.handler.(InfoProvider)
+	var handlerSections []string
+	if provider != nil {
+		handlerSections = provider.InfoSections()
+	}
+
+	args := r.Args
+	if len(args) == 0 {
+		args = [][]byte{[]byte("default")}
+	}
+	wanted := make(map[string]bool)
+	for _, arg := range args {
+		switch name := strings.ToLower(string(arg)); name {
+		case "default":
+			for name := range defaultSections {
+				wanted[name] = true
+			}
+			for _, name := range handlerSections {
+				wanted[name] = true
+			}
+		case "all", "everything":
+			for _, name := range serverSections {
+				wanted[name] = true
+			}
+			for _, name := range handlerSections {
+				wanted[name] = true
+			}
+		default:
+			wanted[name] = true
+		}
+	}
+
+	var buf bytes.Buffer
+	write := func(name string, fields [][2]string) {
+		if buf.Len() > 0 {
+			buf.WriteString("\r\n")
+		}
+		fmt.Fprintf(&buf, "# %s\r\n", strings.ToUpper(name[:1])+name[1:])
+		for _, f := range fields {
+			fmt.Fprintf(&buf, "%s:%s\r\n", f[0], f[1])
+		}
+	}
+	for _, name := range serverSections {
+		if wanted[name] {
+			write(name, srv.infoSection(name))
+		}
+	}
+	for _, name := range handlerSections {
+		if !wanted[name] {
+			continue
+		}
+		fields, err := provider.InfoSection(name)
+		if err != nil {
+			log.Errorf("info %s failed - %s", name, err)
+			return NewError(err.Error())
+		}
+		write(name, fields)
+	}
+	return &BulkReply{value: []byte(buf.String())}
+}
+
+// infoSection gets the fields of a section of the server.
+func (srv *Server) infoSection(name string) [][2]string {
+	switch name {
+	case "server":
+		return srv.serverInfo()
+	case "clients":
+		return srv.clientsInfo()
+	case "stats":
+		return srv.statsInfo()
+	case "commandstats":
+		return srv.commandStatsInfo()
+	}
+	return nil
+}
+
+func (srv *Server) serverInfo() [][2]string {
+	now := time.Now()
+	uptime := int64(now.Sub(srv.started) / time.Second)
+	port := "0"
+	if srv.Proto != "unix" && srv.Addr != "" {
+		if _, p, err := net.SplitHostPort(srv.Addr); err == nil {
+			port = p
+		}
+	}
+	return [][2]string{
+		{"redis_version", ServerVersion},
+		{"redis_mode", "standalone"},
+		{"os", runtime.GOOS + " " + runtime.GOARCH},
+		{"arch_bits", strconv.Itoa(strconv.IntSize)},
+		{"go_version", runtime.Version()},
+		{"process_id", strconv.Itoa(os.Getpid())},
+		{"tcp_port", port},
+		{"server_time_usec", strconv.FormatInt(now.UnixNano()/int64(time.Microsecond), 10)},
+		{"uptime_in_seconds", strconv.FormatInt(uptime, 10)},
+		{"uptime_in_days", strconv.FormatInt(uptime/(24*3600), 10)},
+		{"config_file", config.Path()},
+	}
+}
+
+func (srv *Server) clientsInfo() [][2]string {
+	srv.mu.Lock()
+	connected := len(srv.sessions)
+	blocked, pubsub := 0, 0
+	for s := range srv.sessions {
+		if s.info.blocked {
+			blocked++
+		}
+		if s.info.sub+s.info.psub > 0 {
+			pubsub++
+		}
+	}
+	srv.mu.Unlock()
+	return [][2]string{
+		{"connected_clients", strconv.Itoa(connected)},
+		{"blocked_clients", strconv.Itoa(blocked)},
+		{"pubsub_clients", strconv.Itoa(pubsub)},
+		{"maxclients", strconv.Itoa(config.MaxClients.Get())},
+	}
+}
+
+func (srv *Server) statsInfo() [][2]string {
+	s := srv.stats
+	count := func(n *int64) string {
+		return strconv.FormatInt(atomic.LoadInt64(n), 10)
+	}
+	return [][2]string{
+		{"total_connections_received", count(&s.connections)},
+		{"total_commands_processed", count(&s.processed)},
+		{"instantaneous_ops_per_sec", strconv.FormatInt(s.opsPerSec(), 10)},
+		{"total_net_input_bytes", count(&s.readBytes)},
+		{"total_net_output_bytes", count(&s.writtenBytes)},
+		{"rejected_connections", count(&s.rejected)},
+	}
+}
+
+// commandStatsInfo shows the counters of every command called since the
+// start or the last CONFIG RESETSTAT, the names that are not commands are
+// left out.
+func (srv *Server) commandStatsInfo() [][2]string {
+	s := srv.stats
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	names := make([]string, 0, len(s.commands))
+	for name := range s.commands {
+		if name != "unknown" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	fields := make([][2]string, 0, len(names))
+	for _, name := range names {
+		c := s.commands[name]
+		fields = append(fields, [2]string{"cmdstat_" + name, fmt.Sprintf(
+			"calls=%d,usec=%d,usec_per_call=%.2f,rejected_calls=0,failed_calls=%d",
+			c.calls, c.usec, float64(c.usec)/float64(c.calls), c.failed)})
+	}
+	return fields
+}
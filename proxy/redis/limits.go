@@ -0,0 +1,80 @@
+package redis
+
+import (
+	"bufio"
+	"net"
+	"time"
+
+	"github.com/Mansfield6/tikv-proxy-demo/proxy/config"
+)
+
+// maxInlineSize caps the length of a line of a request, which is an inline
+// request or the header of a multibulk or a bulk, as redis does.
+const maxInlineSize = 64 * 1024
+
+// The errors of the limits, the protocol errors close the connection after
+// they are replied.
+var (
+	ErrInlineTooBig        = NewError("Protocol error: too big inline request")
+	ErrInvalidMultibulkLen = NewError("Protocol error: invalid multibulk length")
+	ErrInvalidBulkLen      = NewError("Protocol error: invalid bulk length")
+	ErrMaxClients          = NewError("max number of clients reached")
+	ErrKeyTooBig           = NewError("invalid key size")
+	ErrValueTooBig         = NewError("invalid value size")
+)
+
+// readLine reads a line of a request, ending with '\n', of at most
+// maxInlineSize bytes.
+func readLine(r *bufio.Reader) (string, error) {
+	var line []byte
+	for {
+		chunk, err := r.ReadSlice('\n')
+		line = append(line, chunk...)
+		if len(line) > maxInlineSize {
+			return "", ErrInlineTooBig
+		}
+		if err != bufio.ErrBufferFull {
+			return string(line), err
+		}
+	}
+}
+
+// checkArgs checks the sizes of the keys of a request, and of the values a
+// write command stores, against the limits of the config.
+func checkArgs(r *Request) ReplyWriter {
+	s := commandSpecs[r.Name]
+	if s == nil {
+		return nil
+	}
+	maxKey, maxValue := config.MaxKeySize.Get(), config.MaxValueSize.Get()
+	isKey := make(map[int]bool)
+	for _, i := range s.keyPositions(len(r.Args)) {
+		isKey[i] = true
+		if len(r.Args[i]) > maxKey {
+			return ErrKeyTooBig
+		}
+	}
+	if !s.inCategory("write") {
+		return nil
+	}
+	for i, arg := range r.Args {
+		if !isKey[i] && len(arg) > maxValue {
+			return ErrValueTooBig
+		}
+	}
+	return nil
+}
+
+// setIdleDeadline makes the next read of conn fail once the client is idle
+// for the timeout of the config. The clients with subscriptions never time
+// out, as with redis.
+func setIdleDeadline(conn net.Conn, s *session, deadline *bool) {
+	timeout := time.Duration(config.Timeout.Get()) * time.Second
+	if timeout > 0 && s.sub.count() == 0 {
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		*deadline = true
+	} else if *deadline {
+		conn.SetReadDeadline(time.Time{})
+		*deadline = false
+	}
+}
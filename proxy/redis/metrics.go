@@ -0,0 +1,112 @@
+package redis
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	commandCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "tikvproxy",
+			Subsystem: "server",
+			Name:      "command_total",
+			Help:      "Counter of commands received.",
+		}, []string{"command"})
+
+	commandErrorCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "tikvproxy",
+			Subsystem: "server",
+			Name:      "command_error_total",
+			Help:      "Counter of commands replied with an error.",
+		}, []string{"command"})
+
+	commandHistogram = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "tikvproxy",
+			Subsystem: "server",
+			Name:      "command_duration_seconds",
+			Help:      "Bucketed histogram of processing time of commands, the time blocked included.",
+			Buckets:   prometheus.ExponentialBuckets(0.0001, 2, 20),
+		}, []string{"command"})
+
+	connGauge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "tikvproxy",
+			Subsystem: "server",
+			Name:      "connections",
+			Help:      "Number of client connections open.",
+		})
+
+	readBytesCounter = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "tikvproxy",
+			Subsystem: "server",
+			Name:      "read_bytes_total",
+			Help:      "Counter of bytes read from the client connections.",
+		})
+
+	writtenBytesCounter = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "tikvproxy",
+			Subsystem: "server",
+			Name:      "written_bytes_total",
+			Help:      "Counter of bytes written to the client connections.",
+		})
+)
+
+func init() {
+	prometheus.MustRegister(commandCounter)
+	prometheus.MustRegister(commandErrorCounter)
+	prometheus.MustRegister(commandHistogram)
+	prometheus.MustRegister(connGauge)
+	prometheus.MustRegister(readBytesCounter)
+	prometheus.MustRegister(writtenBytesCounter)
+}
+
+// metricsName gets the command label of a request, the names that are not
+// commands share one label so clients can not make up new series.
+func (srv *Server) metricsName(name string) string {
+	if _, ok := commandSpecs[name]; ok {
+		return name
+	}
+	if _, ok := srv.methods[name]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// observeCommand records a command in the metrics and the stats of the
+// server.
+func (srv *Server) observeCommand(name string, d time.Duration, failed bool) {
+	commandHistogram.WithLabelValues(name).Observe(d.Seconds())
+	commandCounter.WithLabelValues(name).Inc()
+	if failed {
+		commandErrorCounter.WithLabelValues(name).Inc()
+	}
+	srv.stats.command(name, d, failed)
+}
+
+// meteredConn counts the bytes read and written on a client connection.
+type meteredConn struct {
+	net.Conn
+	stats *stats
+}
+
+func (c meteredConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	readBytesCounter.Add(float64(n))
+	atomic.AddInt64(&c.stats.readBytes, int64(n))
+	return n, err
+}
+
+func (c meteredConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	writtenBytesCounter.Add(float64(n))
+	atomic.AddInt64(&c.stats.writtenBytes, int64(n))
+	return n, err
+}
@@ -0,0 +1,147 @@
+package redis
+
+import (
+	"reflect"
+	"strings"
+)
+
+// Transactional is implemented by handlers that can run the commands queued
+// between MULTI and EXEC in a single transaction. Such a handler must be a
+// pointer to a struct, every connection works on its own copy of the struct
+// so the handler can keep the state of the session in it. The methods of
+// Transactional are not registered as commands.
+type Transactional interface {
+	// Exec runs the queued commands through run in one transaction. It
+	// returns false if the transaction was aborted because a watched key
+	// changed.
+	Exec(run func() error) (bool, error)
+	// Discard forgets the watched keys.
+	Discard()
+}
+
+func (s *session) reset() {
+	s.multi = false
+	s.queued = nil
+	s.dirty = false
+}
+
+// hooks are the interfaces a handler implements for the server, not for the
+// clients.
+var hooks = []reflect.Type{
+	reflect.TypeOf((*Transactional)(nil)).Elem(),
+	reflect.TypeOf((*Closer)(nil)).Elem(),
+	reflect.TypeOf((*InfoProvider)(nil)).Elem(),
+}
+
+// isHook reports whether name is a method of one of the hooks, which a
+// handler implementing them must not expose as a command.
+func isHook(handler interface{}, name string) bool {
+	t := reflect.TypeOf(handler)
+	for _, hook := range hooks {
+		if !t.Implements(hook) {
+			continue
+		}
+		if _, ok := hook.MethodByName(name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// applyMulti handles the commands of MULTI and queues the commands sent
+// after it. It returns false if r is to be run as usual.
+func (srv *Server) applyMulti(r *Request, name string) (ReplyWriter, bool) {
+	s := r.session
+	switch name {
+	case "multi":
+		if s.multi {
+			return ErrNestedMulti, true
+		}
+		s.multi = true
+		return &StatusReply{code: "OK"}, true
+	case "exec":
+		if !s.multi {
+			return ErrExecWithoutMulti, true
+		}
+		return srv.exec(r), true
+	case "discard":
+		if !s.multi {
+			return ErrDiscardWithoutMulti, true
+		}
+		s.reset()
+		if t, ok := s.transactional(); ok {
+			t.Discard()
+		}
+		return &StatusReply{code: "OK"}, true
+	}
+
+	if !s.multi {
+		return nil, false
+	}
+	if name == "watch" {
+		return ErrWatchInMulti, true
+	}
+	if srv.pubsub != nil && subscriptionCommands[name] {
+		s.dirty = true
+		return ErrSubscribeInMulti, true
+	}
+	if _, exists := srv.methods[name]; !exists && !serverCommands[name] {
+		s.dirty = true
+		return unknownCommand(r), true
+	}
+	s.queued = append(s.queued, r)
+	return &StatusReply{code: "QUEUED"}, true
+}
+
+func (s *session) transactional() (Transactional, bool) {
+	if !s.handler.IsValid() {
+		return nil, false
+	}
+	t, ok := s.handler.Interface().(Transactional)
+	return t, ok
+}
+
+// exec runs the queued commands, in one transaction if the handler is
+// Transactional. It replies a nil multi bulk if the transaction was aborted.
+func (srv *Server) exec(r *Request) ReplyWriter {
+	s := r.session
+	queued, dirty := s.queued, s.dirty
+	s.reset()
+
+	t, ok := s.transactional()
+	if dirty {
+		if ok {
+			t.Discard()
+		}
+		return ErrExecAbort
+	}
+
+	var replies []interface{}
+	run := func() error {
+		replies = make([]interface{}, len(queued))
+		for i, q := range queued {
+			reply, ok := srv.applyServer(q, strings.ToLower(q.Name))
+			if !ok {
+				var err error
+				if reply, err = srv.call(q); err != nil {
+					reply = errorReply(q, err)
+				}
+			}
+			replies[i] = reply
+		}
+		return nil
+	}
+	if !ok {
+		run()
+		return &MultiBulkReply{values: replies}
+	}
+
+	committed, err := t.Exec(run)
+	if err != nil {
+		return errorReply(r, err)
+	}
+	if !committed {
+		return srv.createValueReply(r, []interface{}(nil))
+	}
+	return &MultiBulkReply{values: replies}
+}
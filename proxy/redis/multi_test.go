@@ -0,0 +1,35 @@
+package redis
+
+import (
+	"testing"
+)
+
+func TestMultiQueuesServerCommands(t *testing.T) {
+	client, _ := newTestClient(t)
+	defer client.Close()
+
+	steps := []struct {
+		cmd   string
+		reply string
+	}{
+		{command("MULTI"), "+OK\r\n"},
+		{command("CLIENT", "SETNAME", "discarded"), "+QUEUED\r\n"},
+		{command("DISCARD"), "+OK\r\n"},
+		// The discarded transaction did not name the connection.
+		{command("CLIENT", "GETNAME"), "$-1\r\n"},
+		{command("MULTI"), "+OK\r\n"},
+		{command("CLIENT", "SETNAME", "conn"), "+QUEUED\r\n"},
+		{command("CLIENT", "GETNAME"), "+QUEUED\r\n"},
+		{command("ECHO", "a"), "+QUEUED\r\n"},
+		{command("EXEC"), "*3\r\n+OK\r\n" + bulk("conn") + bulk("a")},
+		{command("CLIENT", "GETNAME"), bulk("conn")},
+	}
+	for _, step := range steps {
+		if _, err := client.Write([]byte(step.cmd)); err != nil {
+			t.Fatal(err)
+		}
+		if got := readReplies(t, client, len(step.reply)); got != step.reply {
+			t.Fatalf("%q replied %q, want %q", step.cmd, got, step.reply)
+		}
+	}
+}
@@ -6,24 +6,42 @@ import (
 	"io"
 	"io/ioutil"
 	"strings"
+
+	"github.com/Mansfield6/tikv-proxy-demo/proxy/config"
 )
 
-func parseRequest(conn io.ReadCloser) (*Request, error) {
-	r := bufio.NewReader(conn)
+// parseRequest reads the next request of conn from r. The same reader must
+// be used for the whole connection, it may have buffered the requests that
+// follow when the client pipelines. Empty requests are skipped as redis does.
+func parseRequest(conn io.ReadCloser, r *bufio.Reader) (*Request, error) {
 	// first line of redis request should be:
 	// *<number of arguments>CRLF
-	line, err := r.ReadString('\n')
-	if err != nil {
-		return nil, err
-	}
-	// note that this line also protects us from negative integers
+	var line string
 	var argsCount int
-
-	// Multiline request:
-	if line[0] == '*' {
+	for {
+		var err error
+		if line, err = readLine(r); err != nil {
+			return nil, err
+		}
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		if line[0] != '*' {
+			break
+		}
 		if _, err := fmt.Sscanf(line, "*%d\r", &argsCount); err != nil {
 			return nil, malformed("*<numberOfArguments>", line)
 		}
+		if argsCount > config.ProtoMaxMultibulkLen.Get() {
+			return nil, ErrInvalidMultibulkLen
+		}
+		if argsCount > 0 {
+			break
+		}
+	}
+
+	// Multiline request:
+	if line[0] == '*' {
 		// All next lines are pairs of:
 		//$<number of bytes of argument 1> CR LF
 		//<argument data> CR LF
@@ -33,11 +51,19 @@ func parseRequest(conn io.ReadCloser) (*Request, error) {
 			return nil, err
 		}
 
-		args := make([][]byte, argsCount-1)
+		// The arguments are not all allocated up front, a client can claim
+		// many more than it sends.
+		capacity := argsCount - 1
+		if capacity > 1024 {
+			capacity = 1024
+		}
+		args := make([][]byte, 0, capacity)
 		for i := 0; i < argsCount-1; i += 1 {
-			if args[i], err = readArgument(r); err != nil {
+			arg, err := readArgument(r)
+			if err != nil {
 				return nil, err
 			}
+			args = append(args, arg)
 		}
 
 		return &Request{
@@ -66,7 +92,10 @@ func parseRequest(conn io.ReadCloser) (*Request, error) {
 
 func readArgument(r *bufio.Reader) ([]byte, error) {
 
-	line, err := r.ReadString('\n')
+	line, err := readLine(r)
+	if err == ErrInlineTooBig {
+		return nil, err
+	}
 	if err != nil {
 		return nil, malformed("$<argumentLength>", line)
 	}
@@ -74,6 +103,9 @@ func readArgument(r *bufio.Reader) ([]byte, error) {
 	if _, err := fmt.Sscanf(line, "$%d\r", &argSize); err != nil {
 		return nil, malformed("$<argumentSize>", line)
 	}
+	if argSize < 0 || argSize > config.ProtoMaxBulkLen.Get() {
+		return nil, ErrInvalidBulkLen
+	}
 
 	// I think int is safe here as the max length of request
 	// should be less then max int value?
@@ -0,0 +1,422 @@
+package redis
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Mansfield6/tikv-proxy-demo/proxy/config"
+	"github.com/Mansfield6/tikv-proxy-demo/proxy/util"
+	"github.com/ngaut/log"
+)
+
+const (
+	// pubsubReadBatch is the number of messages read from the log at once.
+	pubsubReadBatch = 1000
+	// pubsubQueueSize is the number of messages waiting to be written to a
+	// subscriber before the server gives up on it and disconnects it.
+	pubsubQueueSize = 1024
+)
+
+// PubSubMessage is a message of the Pub/Sub log, the log numbers the
+// messages it gives a server from 1 on.
+type PubSubMessage struct {
+	Seq     uint64
+	Channel []byte
+	Message []byte
+}
+
+// PubSubLog carries the messages published on a server to the subscribers
+// of every server sharing the log. It only keeps the latest messages, a
+// server lagging further behind misses the older ones.
+type PubSubLog interface {
+	// Publish appends a message to the log.
+	Publish(channel []byte, message []byte) error
+	// Last gets the number of the latest message, 0 if there is none.
+	Last() (uint64, error)
+	// Read gets at most limit messages published after the message after,
+	// in order.
+	Read(after uint64, limit int) ([]PubSubMessage, error)
+}
+
+// subscriptionCommands change the subscriptions of a client, they are not
+// allowed inside MULTI.
+var subscriptionCommands = map[string]bool{
+	"subscribe": true, "psubscribe": true, "unsubscribe": true, "punsubscribe": true,
+}
+
+// subscribedCommands are the commands besides subscriptionCommands a RESP2
+// client may send while it has subscriptions.
+var subscribedCommands = map[string]bool{
+	"ping": true, "quit": true, "reset": true,
+}
+
+// connWriter is the writer of a connection, replies and the messages of the
+// subscribed channels are written to it from different goroutines.
+type connWriter struct {
+	mu   sync.Mutex
+	conn net.Conn
+	w    *bufio.Writer
+}
+
+// subscriber holds the subscriptions of a session.
+type subscriber struct {
+	channels map[string]bool
+	patterns map[string]bool
+	// pushes queues the messages for the connection, it is closed with the
+	// connection.
+	pushes chan Push
+}
+
+func (s *subscriber) count() int {
+	if s == nil {
+		return 0
+	}
+	return len(s.channels) + len(s.patterns)
+}
+
+// pubsub delivers the messages read from the log to the subscribers of the
+// server.
+type pubsub struct {
+	log PubSubLog
+
+	mu       sync.Mutex
+	channels map[string]map[*session]bool
+	patterns map[string]map[*session]bool
+	// cursor is the number of the last message read, it is valid while
+	// started is set, which is while there are subscribers.
+	cursor  uint64
+	started bool
+}
+
+func newPubSub(l PubSubLog) *pubsub {
+	return &pubsub{
+		log:      l,
+		channels: make(map[string]map[*session]bool),
+		patterns: make(map[string]map[*session]bool),
+	}
+}
+
+func (p *pubsub) run(quit <-chan struct{}) {
+	for {
+		select {
+		case <-quit:
+			return
+		case <-time.After(config.PubSubPollInterval.Get()):
+		}
+		p.mu.Lock()
+		if err := p.poll(); err != nil {
+			log.Errorf("read pub/sub log failed - %s", err)
+		}
+		p.mu.Unlock()
+	}
+}
+
+func (p *pubsub) poll() error {
+	if len(p.channels) == 0 && len(p.patterns) == 0 {
+		p.started = false
+		return nil
+	}
+	if err := p.start(); err != nil {
+		return err
+	}
+	for {
+		msgs, err := p.log.Read(p.cursor, pubsubReadBatch)
+		if err != nil {
+			return err
+		}
+		for _, m := range msgs {
+			p.cursor = m.Seq
+			p.deliver(m)
+		}
+		if len(msgs) < pubsubReadBatch {
+			return nil
+		}
+	}
+}
+
+// start makes the server receive the messages published from now on.
+func (p *pubsub) start() error {
+	if p.started {
+		return nil
+	}
+	last, err := p.log.Last()
+	if err != nil {
+		return err
+	}
+	p.cursor, p.started = last, true
+	return nil
+}
+
+func (p *pubsub) deliver(m PubSubMessage) {
+	for s := range p.channels[string(m.Channel)] {
+		s.push(Push{[]byte("message"), m.Channel, m.Message})
+	}
+	for pattern, sessions := range p.patterns {
+		if !util.GlobMatch([]byte(pattern), m.Channel) {
+			continue
+		}
+		for s := range sessions {
+			s.push(Push{[]byte("pmessage"), []byte(pattern), m.Channel, m.Message})
+		}
+	}
+}
+
+// receivers counts the subscriptions of the server a message on channel
+// goes to.
+func (p *pubsub) receivers(channel []byte) int {
+	n := len(p.channels[string(channel)])
+	for pattern, sessions := range p.patterns {
+		if util.GlobMatch([]byte(pattern), channel) {
+			n += len(sessions)
+		}
+	}
+	return n
+}
+
+func (p *pubsub) targets(pattern bool) map[string]map[*session]bool {
+	if pattern {
+		return p.patterns
+	}
+	return p.channels
+}
+
+// remove drops the subscriptions of a closed session.
+func (p *pubsub) remove(s *session) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if s.sub == nil {
+		return
+	}
+	for name := range s.sub.channels {
+		removeSubscription(p.channels, name, s)
+	}
+	for name := range s.sub.patterns {
+		removeSubscription(p.patterns, name, s)
+	}
+	close(s.sub.pushes)
+	s.sub = nil
+}
+
+func removeSubscription(m map[string]map[*session]bool, name string, s *session) {
+	delete(m[name], s)
+	if len(m[name]) == 0 {
+		delete(m, name)
+	}
+}
+
+// push queues a message for the session, a session that does not keep up is
+// disconnected.
+func (s *session) push(p Push) {
+	select {
+	case s.sub.pushes <- p:
+	default:
+		log.Warnf("client %d does not keep up with its subscriptions, closing it", s.id)
+		s.out.conn.Close()
+	}
+}
+
+// writePushes writes the queued messages until the queue is closed.
+func (s *session) writePushes(pushes chan Push) {
+	for p := range pushes {
+		s.out.mu.Lock()
+		_, err := writeBytes(toProto(p, s.proto), s.out.w)
+		if err == nil && len(pushes) == 0 {
+			err = s.out.w.Flush()
+		}
+		s.out.mu.Unlock()
+		if err != nil {
+			s.out.conn.Close()
+		}
+	}
+}
+
+func (srv *Server) registerPubSub() {
+	srv.Register("subscribe", func(r *Request) (ReplyWriter, error) {
+		return srv.subscribe(r, false), nil
+	})
+	srv.Register("psubscribe", func(r *Request) (ReplyWriter, error) {
+		return srv.subscribe(r, true), nil
+	})
+	srv.Register("unsubscribe", func(r *Request) (ReplyWriter, error) {
+		return srv.unsubscribe(r, false), nil
+	})
+	srv.Register("punsubscribe", func(r *Request) (ReplyWriter, error) {
+		return srv.unsubscribe(r, true), nil
+	})
+	srv.Register("publish", func(r *Request) (ReplyWriter, error) {
+		return srv.publish(r), nil
+	})
+	srv.Register("pubsub", func(r *Request) (ReplyWriter, error) {
+		return srv.pubsubCommand(r), nil
+	})
+}
+
+// subscribe handles SUBSCRIBE and PSUBSCRIBE. The confirmations are written
+// right away, before any message of the new subscriptions can be.
+func (srv *Server) subscribe(r *Request, pattern bool) ReplyWriter {
+	s := r.session
+	if len(r.Args) == 0 {
+		return wrongArgs(r)
+	}
+	if s == nil || s.out == nil {
+		return ErrNoConnection
+	}
+
+	p := srv.pubsub
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.start(); err != nil {
+		return errorReply(r, err)
+	}
+
+	s.out.mu.Lock()
+	defer s.out.mu.Unlock()
+	if s.sub == nil {
+		s.sub = &subscriber{
+			channels: make(map[string]bool),
+			patterns: make(map[string]bool),
+			pushes:   make(chan Push, pubsubQueueSize),
+		}
+		go s.writePushes(s.sub.pushes)
+	}
+
+	kind, mine, targets := "subscribe", s.sub.channels, p.channels
+	if pattern {
+		kind, mine, targets = "psubscribe", s.sub.patterns, p.patterns
+	}
+	for _, arg := range r.Args {
+		name := string(arg)
+		mine[name] = true
+		if targets[name] == nil {
+			targets[name] = make(map[*session]bool)
+		}
+		targets[name][s] = true
+		writeBytes(toProto(Push{[]byte(kind), arg, s.sub.count()}, s.proto), s.out.w)
+	}
+	return noReply{}
+}
+
+// unsubscribe handles UNSUBSCRIBE and PUNSUBSCRIBE, without arguments they
+// drop every subscription of their kind.
+func (srv *Server) unsubscribe(r *Request, pattern bool) ReplyWriter {
+	s := r.session
+	if s == nil || s.out == nil {
+		return ErrNoConnection
+	}
+
+	p := srv.pubsub
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s.out.mu.Lock()
+	defer s.out.mu.Unlock()
+
+	kind := "unsubscribe"
+	if pattern {
+		kind = "punsubscribe"
+	}
+	var mine map[string]bool
+	if s.sub != nil {
+		mine = s.sub.channels
+		if pattern {
+			mine = s.sub.patterns
+		}
+	}
+
+	names := r.Args
+	if len(names) == 0 {
+		for name := range mine {
+			names = append(names, []byte(name))
+		}
+		if len(names) == 0 {
+			writeBytes(toProto(Push{[]byte(kind), nil, s.sub.count()}, s.proto), s.out.w)
+			return noReply{}
+		}
+	}
+	for _, name := range names {
+		if mine[string(name)] {
+			delete(mine, string(name))
+			removeSubscription(p.targets(pattern), string(name), s)
+		}
+		writeBytes(toProto(Push{[]byte(kind), name, s.sub.count()}, s.proto), s.out.w)
+	}
+	return noReply{}
+}
+
+// publish appends the message to the log. Like a node of a redis cluster,
+// it replies with the number of subscriptions on this server the message
+// goes to.
+func (srv *Server) publish(r *Request) ReplyWriter {
+	if len(r.Args) != 2 {
+		return wrongArgs(r)
+	}
+	if err := srv.pubsub.log.Publish(r.Args[0], r.Args[1]); err != nil {
+		return errorReply(r, err)
+	}
+	p := srv.pubsub
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return &IntegerReply{number: p.receivers(r.Args[0])}
+}
+
+// pubsubCommand handles PUBSUB, which tells about the subscriptions of this
+// server only.
+func (srv *Server) pubsubCommand(r *Request) ReplyWriter {
+	if len(r.Args) == 0 {
+		return wrongArgs(r)
+	}
+	p := srv.pubsub
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	sub := strings.ToLower(string(r.Args[0]))
+	args := r.Args[1:]
+	switch {
+	case sub == "channels" && len(args) <= 1:
+		var names []string
+		for name := range p.channels {
+			if len(args) == 0 || util.GlobMatch(args[0], []byte(name)) {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		channels := []interface{}{}
+		for _, name := range names {
+			channels = append(channels, []byte(name))
+		}
+		return srv.createValueReply(r, channels)
+	case sub == "numsub":
+		counts := Map{}
+		for _, name := range args {
+			counts = append(counts, name, len(p.channels[string(name)]))
+		}
+		return srv.createValueReply(r, counts)
+	case sub == "numpat" && len(args) == 0:
+		return &IntegerReply{number: len(p.patterns)}
+	}
+	return NewError("Unknown subcommand or wrong number of arguments for '" + string(r.Args[0]) + "'. Try PUBSUB HELP.")
+}
+
+// subscribedPing replies to PING the way redis does for a RESP2 client with
+// subscriptions.
+func subscribedPing(r *Request) ReplyWriter {
+	if len(r.Args) > 1 {
+		return wrongArgs(r)
+	}
+	msg := []byte{}
+	if len(r.Args) == 1 {
+		msg = r.Args[0]
+	}
+	return &MultiBulkReply{values: []interface{}{[]byte("pong"), msg}}
+}
+
+// noReply is returned by the commands that write their replies themselves.
+type noReply struct{}
+
+func (noReply) WriteTo(w io.Writer) (int64, error) {
+	return 0, nil
+}
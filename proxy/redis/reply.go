@@ -6,6 +6,8 @@ import (
 	"io"
 	"reflect"
 	"strconv"
+
+	"github.com/Mansfield6/tikv-proxy-demo/proxy/util"
 )
 
 type ReplyWriter io.WriterTo
@@ -14,6 +16,9 @@ type StatusReply struct {
 	code string
 }
 
+// StatusOK is the +OK reply.
+var StatusOK = &StatusReply{code: "OK"}
+
 func (r *StatusReply) WriteTo(w io.Writer) (int64, error) {
 	n, err := w.Write([]byte("+" + r.code + "\r\n"))
 	return int64(n), err
@@ -40,10 +45,6 @@ func writeBytes(value interface{}, w io.Writer) (int64, error) {
 	}
 	switch v := value.(type) {
 	case string:
-		if len(v) == 0 {
-			n, err := w.Write([]byte("$-1\r\n"))
-			return int64(n), err
-		}
 		wrote, err := w.Write([]byte("$" + strconv.Itoa(len(v)) + "\r\n"))
 		if err != nil {
 			return int64(wrote), err
@@ -55,7 +56,7 @@ func writeBytes(value interface{}, w io.Writer) (int64, error) {
 		wroteCrLf, err := w.Write([]byte("\r\n"))
 		return int64(wrote + wroteBytes + wroteCrLf), err
 	case []byte:
-		if len(v) == 0 {
+		if v == nil {
 			n, err := w.Write([]byte("$-1\r\n"))
 			return int64(n), err
 		}
@@ -75,6 +76,41 @@ func writeBytes(value interface{}, w io.Writer) (int64, error) {
 			return int64(wrote), err
 		}
 		return int64(wrote), err
+	case []interface{}:
+		return writeMultiBytes(v, w)
+	case [][]byte:
+		m := make([]interface{}, len(v))
+		for i, elem := range v {
+			m[i] = elem
+		}
+		return writeMultiBytes(m, w)
+	case Map:
+		return writeAggregate('%', len(v)/2, v, w)
+	case Set:
+		return writeAggregate('~', len(v), v, w)
+	case Push:
+		return writeAggregate('>', len(v), v, w)
+	case Double:
+		n, err := w.Write([]byte("," + string(util.FormatFloat(float64(v), false)) + "\r\n"))
+		return int64(n), err
+	case bool:
+		s := "#f\r\n"
+		if v {
+			s = "#t\r\n"
+		}
+		n, err := w.Write([]byte(s))
+		return int64(n), err
+	case BigNumber:
+		n, err := w.Write([]byte("(" + string(v) + "\r\n"))
+		return int64(n), err
+	case *Verbatim:
+		n, err := w.Write([]byte("=" + strconv.Itoa(len(v.Text)+4) + "\r\n" + v.Format + ":" + string(v.Text) + "\r\n"))
+		return int64(n), err
+	case null:
+		n, err := w.Write([]byte("_\r\n"))
+		return int64(n), err
+	case ReplyWriter:
+		return v.WriteTo(w)
 	}
 
 	Debugf("Invalid type sent to writeBytes: %v", reflect.TypeOf(value).Name())
@@ -105,6 +141,7 @@ func (r *MonitorReply) WriteTo(w io.Writer) (int64, error) {
 }
 
 //for nil reply in multi bulk just set []byte as nil
+//a nil values is the nil multi bulk reply
 type MultiBulkReply struct {
 	values []interface{}
 }
@@ -122,7 +159,8 @@ func MultiBulkFromMap(m map[string]interface{}) *MultiBulkReply {
 
 func writeMultiBytes(values []interface{}, w io.Writer) (int64, error) {
 	if values == nil {
-		return 0, errors.New("Nil in multi bulk replies are not ok")
+		n, err := w.Write([]byte("*-1\r\n"))
+		return int64(n), err
 	}
 	wrote, err := w.Write([]byte("*" + strconv.Itoa(len(values)) + "\r\n"))
 	if err != nil {
@@ -209,3 +247,118 @@ func (c *ChannelWriter) WriteTo(w io.Writer) (int64, error) {
 	}
 	return totalBytes, nil
 }
+
+// Values of the types below are replied with the RESP3 type of the same
+// name, or as the closest RESP2 type to clients that did not switch to RESP3
+// with HELLO.
+type (
+	// Map holds the keys and the values of a map one after the other.
+	Map []interface{}
+	Set []interface{}
+	// Push is an out of band reply, like a message of a subscribed channel.
+	Push      []interface{}
+	Double    float64
+	BigNumber string
+)
+
+// Verbatim is a string with a three letter format like "txt" or "mkd".
+type Verbatim struct {
+	Format string
+	Text   []byte
+}
+
+// null is the RESP3 null, which replaces the RESP2 nil bulk and nil multi
+// bulk.
+type null struct{}
+
+// valueReply writes any value supported by writeBytes.
+type valueReply struct {
+	value interface{}
+}
+
+func (r *valueReply) WriteTo(w io.Writer) (int64, error) {
+	return writeBytes(r.value, w)
+}
+
+func writeAggregate(kind byte, n int, values []interface{}, w io.Writer) (int64, error) {
+	wrote, err := w.Write([]byte(string(kind) + strconv.Itoa(n) + "\r\n"))
+	if err != nil {
+		return int64(wrote), err
+	}
+	wrote64 := int64(wrote)
+	for _, v := range values {
+		wroteBytes, err := writeBytes(v, w)
+		wrote64 += wroteBytes
+		if err != nil {
+			return wrote64, err
+		}
+	}
+	return wrote64, nil
+}
+
+// toProto converts value to the types of the protocol version proto: the
+// RESP3 types are turned into RESP2 ones for version 2, and nils into the
+// RESP3 null for version 3.
+func toProto(value interface{}, proto int) interface{} {
+	switch v := value.(type) {
+	case nil:
+		if proto == 3 {
+			return null{}
+		}
+		return nil
+	case []byte:
+		if v == nil && proto == 3 {
+			return null{}
+		}
+		return v
+	case []interface{}:
+		if v == nil && proto == 3 {
+			return null{}
+		}
+		return convertValues(v, proto)
+	case Map:
+		if proto == 2 {
+			return convertValues(v, proto)
+		}
+		return Map(convertValues(v, proto))
+	case Set:
+		if proto == 2 {
+			return convertValues(v, proto)
+		}
+		return Set(convertValues(v, proto))
+	case Push:
+		if proto == 2 {
+			return convertValues(v, proto)
+		}
+		return Push(convertValues(v, proto))
+	}
+
+	if proto == 3 {
+		return value
+	}
+	switch v := value.(type) {
+	case Double:
+		return util.FormatFloat(float64(v), false)
+	case bool:
+		if v {
+			return 1
+		}
+		return 0
+	case BigNumber:
+		return []byte(v)
+	case *Verbatim:
+		return v.Text
+	}
+	return value
+}
+
+func convertValues(values []interface{}, proto int) []interface{} {
+	if values == nil {
+		return nil
+	}
+	converted := make([]interface{}, len(values))
+	for i, v := range values {
+		converted[i] = toProto(v, proto)
+	}
+	return converted
+}
@@ -11,6 +11,11 @@ type Request struct {
 	Host       string
 	ClientChan chan struct{}
 	Body       io.ReadCloser
+
+	session *session
+	// closed is closed once the client disconnects, it is only watched for
+	// the commands that block.
+	closed <-chan struct{}
 }
 
 func (r *Request) HasArgument(index int) bool {
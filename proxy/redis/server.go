@@ -5,48 +5,116 @@
 package redis
 
 import (
+	"bufio"
 	"fmt"
+	"github.com/Mansfield6/tikv-proxy-demo/proxy/config"
 	"github.com/ngaut/log"
 	"io"
 	"io/ioutil"
 	"net"
 	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type Server struct {
 	Proto        string
 	Addr         string // TCP address to listen on, ":6389" if empty
+	TLSAddr      string // TCP address to listen on with TLS, none if empty
 	MonitorChans []chan string
 	methods      map[string]HandlerFn
+	handler      interface{}
+	acl          *acl
+	tls          *serverTLS
+	pubsub       *pubsub
+	stats        *stats
+	started      time.Time
+
+	// mu guards the listeners and the sessions, Shutdown closes them.
+	mu        sync.Mutex
+	listeners map[net.Listener]bool
+	sessions  map[*session]bool
+	shutdown  bool
+	// quit is closed by Shutdown, the background loops return then.
+	quit  chan struct{}
+	loops sync.WaitGroup
 }
 
+// ListenAndServe listens on Addr and on TLSAddr if TLS is enabled, a server
+// with TLS and an empty Addr only serves TLS. It returns once one of the
+// listeners fails, or ErrServerClosed after Shutdown.
 func (srv *Server) ListenAndServe() error {
-	addr := srv.Addr
-	if srv.Proto == "" {
-		srv.Proto = "tcp"
+	var listeners []net.Listener
+	defer func() {
+		for _, l := range listeners {
+			l.Close()
+		}
+	}()
+
+	if srv.TLSAddr != "" {
+		if srv.tls == nil {
+			return fmt.Errorf("tls address %s given without a tls config", srv.TLSAddr)
+		}
+		log.Info("tls", srv.TLSAddr)
+		l, err := srv.tls.listen(srv.TLSAddr)
+		if err != nil {
+			return err
+		}
+		listeners = append(listeners, l)
 	}
-	if srv.Proto == "unix" && addr == "" {
-		addr = "/tmp/redis.sock"
-	} else if addr == "" {
-		addr = ":6389"
+
+	if srv.Addr != "" || srv.TLSAddr == "" {
+		addr := srv.Addr
+		if srv.Proto == "" {
+			srv.Proto = "tcp"
+		}
+		if srv.Proto == "unix" && addr == "" {
+			addr = "/tmp/redis.sock"
+		} else if addr == "" {
+			addr = ":6389"
+		}
+		log.Info(srv.Proto, addr)
+		l, err := net.Listen(srv.Proto, addr)
+		if err != nil {
+			return err
+		}
+		listeners = append(listeners, l)
 	}
-	log.Info(srv.Proto, addr)
-	l, e := net.Listen(srv.Proto, addr)
-	if e != nil {
-		return e
+
+	srv.MonitorChans = []chan string{}
+	errc := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go func(l net.Listener) {
+			errc <- srv.serve(l)
+		}(l)
 	}
-	return srv.Serve(l)
+	return <-errc
 }
 
 // Serve accepts incoming connections on the Listener l, creating a
 // new service goroutine for each.  The service goroutines read requests and
 // then call srv.Handler to reply to them.
 func (srv *Server) Serve(l net.Listener) error {
-	defer l.Close()
 	srv.MonitorChans = []chan string{}
+	return srv.serve(l)
+}
+
+func (srv *Server) serve(l net.Listener) error {
+	defer l.Close()
+	if !srv.trackListener(l) {
+		return ErrServerClosed
+	}
+	defer srv.untrackListener(l)
 	for {
 		rw, err := l.Accept()
 		if err != nil {
+			select {
+			case <-srv.quit:
+				return ErrServerClosed
+			default:
+			}
 			return err
 		}
 		go srv.ServeClient(rw)
@@ -64,10 +132,37 @@ func (srv *Server) ServeClient(conn net.Conn) (err error) {
 		}
 	}()
 
+	connGauge.Inc()
+	defer connGauge.Dec()
+	atomic.AddInt64(&srv.stats.connections, 1)
+
+	cc := meteredConn{Conn: conn, stats: srv.stats}
+	r := bufio.NewReader(cc)
+	w := bufio.NewWriter(cc)
+	session := srv.newSession()
+	session.out = &connWriter{conn: conn, w: w}
+	session.addr, session.laddr = conn.RemoteAddr().String(), conn.LocalAddr().String()
+	session.info = clientInfo{user: session.user, proto: session.proto, multi: -1, cmd: "NULL", last: session.created}
+	if err := srv.trackSession(session); err != nil {
+		if reply, ok := err.(*ErrorReply); ok {
+			reply.WriteTo(conn)
+		}
+		conn.Close()
+		return err
+	}
+	defer srv.untrackSession(session)
 	defer func() {
-		if err != nil {
-			fmt.Fprintf(conn, "-%s\n", err)
+		if srv.pubsub != nil {
+			srv.pubsub.remove(session)
+		}
+		session.out.mu.Lock()
+		if reply, ok := err.(*ErrorReply); ok {
+			reply.WriteTo(w)
+		} else if err != nil {
+			fmt.Fprintf(w, "-%s\n", err)
 		}
+		w.Flush()
+		session.out.mu.Unlock()
 		conn.Close()
 	}()
 
@@ -96,20 +191,112 @@ func (srv *Server) ServeClient(conn net.Conn) (err error) {
 		clientAddr = co.RemoteAddr().String()
 	}
 
+	var deadline bool
 	for {
-		request, err := parseRequest(conn)
+		// The requests the client pipelined are served before the connection
+		// is closed by a shutdown.
+		if r.Buffered() == 0 && !srv.idle(session) {
+			return nil
+		}
+		setIdleDeadline(conn, session, &deadline)
+		request, err := parseRequest(cc, r)
+		if ne, ok := err.(net.Error); ok && ne.Timeout() && deadline {
+			log.Infof("client %d closed after being idle for %d seconds", session.id, config.Timeout.Get())
+			return nil
+		}
 		if err != nil {
 			return err
 		}
+		if !srv.busy(session) {
+			return nil
+		}
+		if deadline {
+			// A command that blocks reads ahead while it runs.
+			conn.SetReadDeadline(time.Time{})
+			deadline = false
+		}
 		request.Host = clientAddr
 		request.ClientChan = clientChan
-		reply, err := srv.Apply(request)
+		request.session = session
+
+		// A command that blocks is unblocked by a shutdown. Unless the
+		// client pipelined more requests, it is also watched for a
+		// disconnect by reading ahead, up to the next request.
+		var peeked, done chan struct{}
+		if s := commandSpecs[strings.ToLower(request.Name)]; s != nil && s.inCategory("blocking") {
+			closed := make(chan struct{})
+			done = make(chan struct{})
+			request.closed = closed
+			var once sync.Once
+			unblock := func() { once.Do(func() { close(closed) }) }
+			if r.Buffered() == 0 {
+				peeked = make(chan struct{})
+				go func() {
+					defer close(peeked)
+					if _, err := r.Peek(1); err != nil {
+						unblock()
+					}
+				}()
+			}
+			go func() {
+				select {
+				case <-srv.quit:
+					unblock()
+				case <-done:
+				}
+			}()
+		}
+
+		name := srv.metricsName(strings.ToLower(request.Name))
+		cmd := commandName(request)
+		srv.publishInfo(session, cmd, done != nil)
+		start := time.Now()
+		var reply ReplyWriter
+		if reply = checkArgs(request); reply == nil {
+			reply, err = srv.Apply(request)
+		} else if session.multi {
+			session.dirty = true
+		}
+		if done != nil {
+			close(done)
+		}
+		srv.publishInfo(session, cmd, false)
+		_, failed := reply.(*ErrorReply)
+		srv.observeCommand(name, time.Since(start), failed || err != nil)
 		if err != nil {
 			return err
 		}
-		if _, err = reply.WriteTo(conn); err != nil {
+
+		switch reply.(type) {
+		case *MonitorReply, *ChannelWriter, *MultiChannelWriter:
+			// These keep writing for as long as the client listens, so they
+			// bypass the buffer.
+			if err = w.Flush(); err != nil {
+				return err
+			}
+			_, err = reply.WriteTo(cc)
+		default:
+			session.out.mu.Lock()
+			_, err = reply.WriteTo(w)
+			// Flush once the requests the client pipelined are all served.
+			if err == nil && (peeked != nil || r.Buffered() == 0) {
+				err = w.Flush()
+			}
+			session.out.mu.Unlock()
+		}
+		if err != nil {
 			return err
 		}
+		if srv.killed(session) {
+			return nil
+		}
+		if peeked != nil {
+			select {
+			case <-peeked:
+			case <-srv.quit:
+				return nil
+			}
+		}
 	}
 	return nil
 }
@@ -119,24 +306,52 @@ func NewServer(c *Config) (*Server, error) {
 		Proto:        c.proto,
 		MonitorChans: []chan string{},
 		methods:      make(map[string]HandlerFn),
+		stats:        newStats(),
+		started:      time.Now(),
+		listeners:    make(map[net.Listener]bool),
+		sessions:     make(map[*session]bool),
+		quit:         make(chan struct{}),
 	}
 
 	if srv.Proto == "unix" {
 		srv.Addr = c.host
-	} else {
+	} else if c.port != 0 || c.tlsPort == 0 {
 		srv.Addr = fmt.Sprintf(":%d", c.port)
 	}
+	if c.tlsPort != 0 {
+		t, err := newServerTLS(c.tls)
+		if err != nil {
+			return nil, err
+		}
+		srv.tls = t
+		srv.TLSAddr = fmt.Sprintf(":%d", c.tlsPort)
+	}
 
 	if c.handler == nil {
 		c.handler = NewDefaultHandler()
 	}
 
+	srv.handler = c.handler
+	aclStore := c.acl
+	if aclStore == nil {
+		aclStore = newMemoryACLStore()
+	}
+	srv.acl = newACL(aclStore)
+	if err := srv.acl.reload(); err != nil {
+		return nil, err
+	}
+	if c.acl != nil {
+		srv.goLoop(srv.acl.reloadLoop)
+	}
 	rh := reflect.TypeOf(c.handler)
 	for i := 0; i < rh.NumMethod(); i++ {
 		method := rh.Method(i)
 		if method.Name[0] > 'a' && method.Name[0] < 'z' {
 			continue
 		}
+		if isHook(c.handler, method.Name) {
+			continue
+		}
 		log.Info("Listening method:", method.Name)
 		handlerFn, err := srv.createHandlerFn(c.handler, &method.Func)
 		if err != nil {
@@ -144,5 +359,11 @@ func NewServer(c *Config) (*Server, error) {
 		}
 		srv.Register(method.Name, handlerFn)
 	}
+	if c.pubsub != nil {
+		srv.pubsub = newPubSub(c.pubsub)
+		srv.registerPubSub()
+		srv.goLoop(srv.pubsub.run)
+	}
+	srv.goLoop(srv.stats.sampleOps)
 	return srv, nil
 }
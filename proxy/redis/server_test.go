@@ -0,0 +1,179 @@
+package redis
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type echoHandler struct{}
+
+func (h *echoHandler) ECHO(arg []byte) ([]byte, error) {
+	return arg, nil
+}
+
+func (h *echoHandler) LEN(args [][]byte) (int, error) {
+	return len(args), nil
+}
+
+// GET gets the key itself.
+func (h *echoHandler) GET(key []byte) ([]byte, error) {
+	return key, nil
+}
+
+// BLPOP blocks until closed is closed, it fails if there is no channel.
+func (h *echoHandler) BLPOP(closed <-chan struct{}, args [][]byte) ([]byte, error) {
+	if closed == nil {
+		return nil, errors.New("no channel to block on")
+	}
+	<-closed
+	return nil, nil
+}
+
+// countingConn counts the writes that reach the connection.
+type countingConn struct {
+	net.Conn
+	writes int32
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	atomic.AddInt32(&c.writes, 1)
+	return c.Conn.Write(b)
+}
+
+func newTestClient(t *testing.T) (net.Conn, *countingConn) {
+	srv, err := NewServer(DefaultConfig().Handler(&echoHandler{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, server := net.Pipe()
+	conn := &countingConn{Conn: server}
+	go srv.ServeClient(conn)
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	return client, conn
+}
+
+func command(args ...string) string {
+	s := fmt.Sprintf("*%d\r\n", len(args))
+	for _, arg := range args {
+		s += fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg)
+	}
+	return s
+}
+
+func bulk(s string) string {
+	return fmt.Sprintf("$%d\r\n%s\r\n", len(s), s)
+}
+
+func readReplies(t *testing.T, r io.Reader, n int) string {
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		t.Fatalf("read %d bytes of replies: %s", n, err)
+	}
+	return string(b)
+}
+
+func TestPipelineInOneWrite(t *testing.T) {
+	client, conn := newTestClient(t)
+	defer client.Close()
+
+	var req, want bytes.Buffer
+	for i := 0; i < 100; i++ {
+		v := fmt.Sprint(i)
+		req.WriteString(command("ECHO", v))
+		want.WriteString(bulk(v))
+	}
+	req.WriteString(command("LEN", "a", "b", "c"))
+	want.WriteString(":3\r\n")
+
+	go client.Write(req.Bytes())
+	if got := readReplies(t, client, want.Len()); got != want.String() {
+		t.Fatalf("got %q, want %q", got, want.String())
+	}
+	if n := atomic.LoadInt32(&conn.writes); n != 1 {
+		t.Fatalf("replies of one batch took %d writes, want 1", n)
+	}
+}
+
+func TestPipelineLargeBatch(t *testing.T) {
+	client, _ := newTestClient(t)
+	defer client.Close()
+
+	// Larger than the buffers of the reader and the writer, with arguments
+	// crossing their boundaries.
+	var req, want bytes.Buffer
+	for i := 0; i < 2000; i++ {
+		v := strings.Repeat(fmt.Sprint(i%10), i%300+1)
+		req.WriteString(command("ECHO", v))
+		want.WriteString(bulk(v))
+	}
+
+	go client.Write(req.Bytes())
+	if got := readReplies(t, client, want.Len()); got != want.String() {
+		t.Fatal("replies of a large batch do not match")
+	}
+}
+
+func TestPipelineSplitRequest(t *testing.T) {
+	client, _ := newTestClient(t)
+	defer client.Close()
+
+	req := command("ECHO", "first") + command("ECHO", "second")
+	cut := len(command("ECHO", "first")) + 5
+	go func() {
+		client.Write([]byte(req[:cut]))
+		time.Sleep(10 * time.Millisecond)
+		client.Write([]byte(req[cut:]))
+	}()
+
+	r := bufio.NewReader(client)
+	want := bulk("first") + bulk("second")
+	if got := readReplies(t, r, len(want)); got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestPipelineInline(t *testing.T) {
+	client, _ := newTestClient(t)
+	defer client.Close()
+
+	go client.Write([]byte("ECHO a\r\nLEN x y\r\nECHO b\r\n"))
+	want := bulk("a") + ":2\r\n" + bulk("b")
+	if got := readReplies(t, client, len(want)); got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestPipelinedBlockingShutdown(t *testing.T) {
+	srv, err := NewServer(DefaultConfig().Handler(&echoHandler{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, server := net.Pipe()
+	defer client.Close()
+	go srv.ServeClient(server)
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// Pipelined behind the blocking command, ECHO keeps it from reading
+	// ahead, the shutdown must unblock it still.
+	go client.Write([]byte(command("BLPOP", "q", "0") + command("ECHO", "a")))
+	time.Sleep(10 * time.Millisecond)
+	shutdown := make(chan error)
+	go func() { shutdown <- srv.Shutdown(context.Background()) }()
+
+	want := "$-1\r\n" + bulk("a")
+	if got := readReplies(t, client, len(want)); got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	if err = <-shutdown; err != nil {
+		t.Fatal(err)
+	}
+}
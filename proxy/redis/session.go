@@ -0,0 +1,187 @@
+package redis
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// ServerVersion is the version of redis the server claims to be.
+const ServerVersion = "6.2.0"
+
+var lastSessionID int64
+
+// session is the state of a client connection.
+type session struct {
+	id int64
+	// addr and laddr are the addresses of the client and of the server end
+	// of the connection.
+	addr, laddr string
+	created     time.Time
+	// db is the database chosen by the last SELECT that succeeded.
+	db int
+	// proto is the protocol version negotiated with HELLO.
+	proto int
+	// name is set by HELLO SETNAME and CLIENT SETNAME.
+	name string
+	// user is the ACL user the commands run as, authenticated is cleared
+	// until the client logs in if the default user has a password.
+	user          string
+	authenticated bool
+
+	// handler is the copy of the handler for the connection, it is invalid
+	// if the handler is not Transactional.
+	handler reflect.Value
+	// multi is set between MULTI and EXEC or DISCARD.
+	multi  bool
+	queued []*Request
+	// dirty is set if a command could not be queued, EXEC fails then.
+	dirty bool
+
+	// out is the writer of the connection, nil for a request that did not
+	// come from a connection.
+	out *connWriter
+	// sub is set once the client subscribes to a channel or a pattern.
+	sub *subscriber
+
+	// busy is set while the connection serves a request and closed once
+	// Shutdown closed it, kill once CLIENT KILL killed the client itself.
+	// They and info are guarded by the mutex of the server.
+	busy   bool
+	closed bool
+	kill   bool
+	info   clientInfo
+}
+
+func (srv *Server) newSession() *session {
+	s := &session{
+		id:      atomic.AddInt64(&lastSessionID, 1),
+		created: time.Now(),
+		proto:   2,
+		user:    "default",
+	}
+	if u := srv.acl.user("default"); u != nil && u.enabled && u.nopass {
+		s.authenticated = true
+	}
+	if _, ok := srv.handler.(Transactional); ok {
+		v := reflect.ValueOf(srv.handler)
+		s.handler = reflect.New(v.Type().Elem())
+		s.handler.Elem().Set(v.Elem())
+	}
+	return s
+}
+
+// applySession handles the commands that change the state of the
+// connection. It returns false if r is to be run as usual.
+func (srv *Server) applySession(r *Request, name string) (ReplyWriter, bool) {
+	s := r.session
+	switch name {
+	case "hello":
+		return srv.hello(r), true
+	case "auth":
+		return srv.authCommand(r), true
+	}
+	if srv.pubsub != nil && s.sub.count() > 0 && s.proto == 2 {
+		if name == "ping" {
+			return subscribedPing(r), true
+		}
+		if !subscriptionCommands[name] && !subscribedCommands[name] {
+			return NewError("Can't execute '" + name + "': only (P|S)SUBSCRIBE / (P|S)UNSUBSCRIBE / PING / QUIT / RESET are allowed in this context"), true
+		}
+	}
+	if reply, ok := srv.applyMulti(r, name); ok {
+		return reply, true
+	}
+	return srv.applyServer(r, name)
+}
+
+// serverCommands are the commands the server runs itself rather than the
+// handler. Inside MULTI they are queued like the others.
+var serverCommands = map[string]bool{
+	"acl":    true,
+	"config": true,
+	"client": true,
+	"info":   true,
+}
+
+// applyServer runs the commands of serverCommands. It returns false if r is
+// to be run by the handler.
+func (srv *Server) applyServer(r *Request, name string) (ReplyWriter, bool) {
+	switch name {
+	case "acl":
+		return srv.aclCommand(r), true
+	case "config":
+		return srv.configCommand(r), true
+	case "client":
+		return srv.clientCommand(r), true
+	case "info":
+		return srv.info(r), true
+	}
+	return nil, false
+}
+
+// hello negotiates the protocol version with HELLO [protover [AUTH username
+// password] [SETNAME clientname]] and replies with the server properties.
+func (srv *Server) hello(r *Request) ReplyWriter {
+	s := r.session
+	proto := s.proto
+	if len(r.Args) > 0 {
+		v, err := strconv.Atoi(string(r.Args[0]))
+		if err != nil {
+			return ErrProtoVersion
+		}
+		if v != 2 && v != 3 {
+			return ErrNoProto
+		}
+		proto = v
+	}
+
+	var name []byte
+	for i := 1; i < len(r.Args); i++ {
+		switch strings.ToLower(string(r.Args[i])) {
+		case "auth":
+			if i+2 >= len(r.Args) {
+				return NewError("Syntax error in HELLO option 'auth'")
+			}
+			if reply := srv.auth(s, r.Args[i+1], r.Args[i+2]); reply != nil {
+				return reply
+			}
+			i += 2
+		case "setname":
+			if i+1 >= len(r.Args) {
+				return NewError("Syntax error in HELLO option 'setname'")
+			}
+			name = r.Args[i+1]
+			i++
+		default:
+			return NewError("Syntax error in HELLO option '" + string(r.Args[i]) + "'")
+		}
+	}
+
+	if !s.authenticated {
+		return ErrHelloNoAuth
+	}
+	// The messages of the subscriptions are written in the protocol of the
+	// session as well.
+	if s.out != nil {
+		s.out.mu.Lock()
+		s.proto = proto
+		s.out.mu.Unlock()
+	} else {
+		s.proto = proto
+	}
+	if name != nil {
+		s.name = string(name)
+	}
+	return srv.createValueReply(r, Map{
+		[]byte("server"), []byte("redis"),
+		[]byte("version"), []byte(ServerVersion),
+		[]byte("proto"), proto,
+		[]byte("id"), int(s.id),
+		[]byte("mode"), []byte("standalone"),
+		[]byte("role"), []byte("master"),
+		[]byte("modules"), []interface{}{},
+	})
+}
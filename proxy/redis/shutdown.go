@@ -0,0 +1,160 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/Mansfield6/tikv-proxy-demo/proxy/config"
+	"github.com/ngaut/log"
+)
+
+// ErrServerClosed is returned by ListenAndServe and Serve after Shutdown.
+var ErrServerClosed = errors.New("redis: Server closed")
+
+// shutdownPollInterval is how often Shutdown checks whether the connections
+// are all closed.
+const shutdownPollInterval = 10 * time.Millisecond
+
+// Closer is implemented by handlers that have background work of their own,
+// Shutdown closes them once the connections are closed. Close is not
+// registered as a command.
+type Closer interface {
+	Close() error
+}
+
+// trackListener adds l to the listeners Shutdown closes, it reports false if
+// the server is already shutting down.
+func (srv *Server) trackListener(l net.Listener) bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.shutdown {
+		return false
+	}
+	srv.listeners[l] = true
+	return true
+}
+
+func (srv *Server) untrackListener(l net.Listener) {
+	srv.mu.Lock()
+	delete(srv.listeners, l)
+	srv.mu.Unlock()
+}
+
+// trackSession adds the session of a new connection. It fails if the server
+// is shutting down or already has config.MaxClients connections.
+func (srv *Server) trackSession(s *session) error {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.shutdown {
+		return ErrServerClosed
+	}
+	if len(srv.sessions) >= config.MaxClients.Get() {
+		atomic.AddInt64(&srv.stats.rejected, 1)
+		return ErrMaxClients
+	}
+	srv.sessions[s] = true
+	return nil
+}
+
+func (srv *Server) untrackSession(s *session) {
+	srv.mu.Lock()
+	delete(srv.sessions, s)
+	srv.mu.Unlock()
+}
+
+// idle marks s as waiting for its next request. It reports false once the
+// server is shutting down, the connection is closed instead then.
+func (srv *Server) idle(s *session) bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.shutdown {
+		return false
+	}
+	s.busy = false
+	return true
+}
+
+// busy marks s as serving a request. It reports false if Shutdown closed
+// the connection while it was idle, the request is not served then.
+func (srv *Server) busy(s *session) bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	s.busy = true
+	return true
+}
+
+// goLoop runs a background loop of the server until Shutdown.
+func (srv *Server) goLoop(loop func(quit <-chan struct{})) {
+	srv.loops.Add(1)
+	go func() {
+		defer srv.loops.Done()
+		loop(srv.quit)
+	}()
+}
+
+// Shutdown stops the server without cutting off the commands it is running.
+// It closes the listeners and the idle connections, then waits for the
+// connections serving requests to send their replies and close, which they
+// do once the requests they already read are served. The clients blocked
+// by a command are replied as if it timed out. The connections still open
+// once ctx is done are closed anyway and ctx.Err() is returned. The handler
+// is closed last if it is a Closer.
+func (srv *Server) Shutdown(ctx context.Context) error {
+	srv.mu.Lock()
+	if srv.shutdown {
+		srv.mu.Unlock()
+		return ErrServerClosed
+	}
+	srv.shutdown = true
+	close(srv.quit)
+	for l := range srv.listeners {
+		l.Close()
+	}
+	idle := 0
+	for s := range srv.sessions {
+		if !s.busy {
+			s.closed = true
+			s.out.conn.Close()
+			idle++
+		}
+	}
+	log.Infof("shutting down, closed %d idle connections of %d", idle, len(srv.sessions))
+	srv.mu.Unlock()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	var err error
+	for err == nil && srv.openSessions() > 0 {
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+			srv.mu.Lock()
+			log.Warnf("shutdown deadline passed, closing %d connections", len(srv.sessions))
+			for s := range srv.sessions {
+				s.out.conn.Close()
+			}
+			srv.mu.Unlock()
+		case <-ticker.C:
+		}
+	}
+
+	srv.loops.Wait()
+	if c, ok := srv.handler.(Closer); ok {
+		if cerr := c.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+func (srv *Server) openSessions() int {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return len(srv.sessions)
+}
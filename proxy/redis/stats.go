@@ -0,0 +1,107 @@
+package redis
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// opsSamples samples of the commands processed, one every
+	// opsSampleInterval, are averaged for instantaneous_ops_per_sec.
+	opsSamples        = 16
+	opsSampleInterval = 100 * time.Millisecond
+)
+
+// commandStats are the counters of a command.
+type commandStats struct {
+	calls  int64
+	failed int64
+	usec   int64
+}
+
+// stats are the counters of a server, unlike the metrics CONFIG RESETSTAT
+// sets them back to zero.
+type stats struct {
+	mu       sync.Mutex
+	commands map[string]*commandStats
+
+	connections  int64
+	rejected     int64
+	readBytes    int64
+	writtenBytes int64
+	processed    int64
+
+	// ops are the last samples of the command rate per second, guarded by
+	// mu like lastProcessed, the number processed at the last sample.
+	ops           [opsSamples]int64
+	opsIndex      int
+	lastProcessed int64
+}
+
+func newStats() *stats {
+	return &stats{commands: make(map[string]*commandStats)}
+}
+
+func (s *stats) command(name string, d time.Duration, failed bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := s.commands[name]
+	if c == nil {
+		c = &commandStats{}
+		s.commands[name] = c
+	}
+	atomic.AddInt64(&s.processed, 1)
+	c.calls++
+	c.usec += int64(d / time.Microsecond)
+	if failed {
+		c.failed++
+	}
+}
+
+// sampleOps samples the command rate until quit is closed.
+func (s *stats) sampleOps(quit <-chan struct{}) {
+	ticker := time.NewTicker(opsSampleInterval)
+	defer ticker.Stop()
+	last := time.Now()
+	for {
+		select {
+		case <-quit:
+			return
+		case now := <-ticker.C:
+			s.mu.Lock()
+			processed := atomic.LoadInt64(&s.processed)
+			if elapsed := now.Sub(last); elapsed > 0 {
+				s.ops[s.opsIndex] = (processed - s.lastProcessed) * int64(time.Second) / int64(elapsed)
+				s.opsIndex = (s.opsIndex + 1) % opsSamples
+			}
+			s.lastProcessed = processed
+			s.mu.Unlock()
+			last = now
+		}
+	}
+}
+
+// opsPerSec gets the average of the samples of the command rate.
+func (s *stats) opsPerSec() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var sum int64
+	for _, ops := range s.ops {
+		sum += ops
+	}
+	return sum / opsSamples
+}
+
+func (s *stats) reset() {
+	s.mu.Lock()
+	s.commands = make(map[string]*commandStats)
+	s.ops = [opsSamples]int64{}
+	s.lastProcessed = 0
+	atomic.StoreInt64(&s.processed, 0)
+	s.mu.Unlock()
+	atomic.StoreInt64(&s.connections, 0)
+	atomic.StoreInt64(&s.rejected, 0)
+	atomic.StoreInt64(&s.readBytes, 0)
+	atomic.StoreInt64(&s.writtenBytes, 0)
+}
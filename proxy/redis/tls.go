@@ -0,0 +1,112 @@
+package redis
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sync"
+)
+
+// tlsFiles are the TLS settings of a Config, the files are read again on
+// every reload.
+type tlsFiles struct {
+	certFile string
+	keyFile  string
+	caFile   string
+	// authClients requires the clients to present a certificate signed by
+	// the CA, otherwise one is only verified if it is given.
+	authClients bool
+	minVersion  string
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// serverTLS holds the TLS configuration of a server, which ReloadTLS swaps
+// without touching the connections already established.
+type serverTLS struct {
+	files tlsFiles
+
+	mu     sync.RWMutex
+	config *tls.Config
+}
+
+func newServerTLS(files tlsFiles) (*serverTLS, error) {
+	t := &serverTLS{files: files}
+	if err := t.reload(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *serverTLS) reload() error {
+	f := t.files
+	if f.certFile == "" || f.keyFile == "" {
+		return fmt.Errorf("tls needs both a certificate and a key file")
+	}
+	minVersion, ok := tlsVersions[f.minVersion]
+	if !ok {
+		return fmt.Errorf("unsupported tls min version %q", f.minVersion)
+	}
+	cert, err := tls.LoadX509KeyPair(f.certFile, f.keyFile)
+	if err != nil {
+		return fmt.Errorf("load tls certificate: %s", err)
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   minVersion,
+		ClientAuth:   tls.NoClientCert,
+	}
+	if f.caFile != "" {
+		pem, err := ioutil.ReadFile(f.caFile)
+		if err != nil {
+			return fmt.Errorf("load tls ca bundle: %s", err)
+		}
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificate found in tls ca bundle %s", f.caFile)
+		}
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	if f.authClients {
+		if config.ClientCAs == nil {
+			return fmt.Errorf("tls client authentication needs a ca bundle")
+		}
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	t.mu.Lock()
+	t.config = config
+	t.mu.Unlock()
+	return nil
+}
+
+func (t *serverTLS) configForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.config, nil
+}
+
+func (t *serverTLS) listen(addr string) (net.Listener, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return tls.NewListener(l, &tls.Config{GetConfigForClient: t.configForClient}), nil
+}
+
+// ReloadTLS reads the certificate, key and CA files again, new connections
+// use them from then on. The current files stay in use if they fail to load.
+func (srv *Server) ReloadTLS() error {
+	if srv.tls == nil {
+		return fmt.Errorf("tls is not enabled")
+	}
+	return srv.tls.reload()
+}
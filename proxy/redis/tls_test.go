@@ -0,0 +1,242 @@
+package redis
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testPKI is a CA generated for a test, with a certificate it signed for
+// the server and one for a client, all kept in files under dir.
+type testPKI struct {
+	dir               string
+	caFile            string
+	certFile, keyFile string
+	client            tls.Certificate
+	otherCAFile       string
+	pool              *x509.CertPool
+}
+
+func newTestPKI(t *testing.T) *testPKI {
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &testPKI{dir: dir, pool: x509.NewCertPool()}
+
+	caKey, caDER := newTestCert(t, "ca", nil, nil)
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.pool.AddCert(ca)
+	p.caFile = p.writePEM(t, "ca.pem", "CERTIFICATE", caDER)
+
+	key, der := newTestCert(t, "server", ca, caKey)
+	p.certFile = p.writePEM(t, "server.pem", "CERTIFICATE", der)
+	p.keyFile = p.writeKey(t, "server-key.pem", key)
+
+	key, der = newTestCert(t, "client", ca, caKey)
+	p.client, err = tls.X509KeyPair(
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: marshalKey(t, key)}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, otherDER := newTestCert(t, "other ca", nil, nil)
+	p.otherCAFile = p.writePEM(t, "other-ca.pem", "CERTIFICATE", otherDER)
+	return p
+}
+
+// newTestCert creates a key and a certificate for it signed by parent, a
+// self signed CA if parent is nil.
+func newTestCert(t *testing.T, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*ecdsa.PrivateKey, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage |= x509.KeyUsageCertSign
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, der
+}
+
+func marshalKey(t *testing.T, key *ecdsa.PrivateKey) []byte {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+func (p *testPKI) writeKey(t *testing.T, name string, key *ecdsa.PrivateKey) string {
+	return p.writePEM(t, name, "EC PRIVATE KEY", marshalKey(t, key))
+}
+
+func (p *testPKI) writePEM(t *testing.T, name string, typ string, der []byte) string {
+	file := filepath.Join(p.dir, name)
+	if err := ioutil.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func (p *testPKI) files() tlsFiles {
+	return tlsFiles{certFile: p.certFile, keyFile: p.keyFile, caFile: p.caFile, authClients: true, minVersion: "1.2"}
+}
+
+func TestTLSReloadErrors(t *testing.T) {
+	p := newTestPKI(t)
+	defer os.RemoveAll(p.dir)
+
+	tests := []struct {
+		name  string
+		files func(f *tlsFiles)
+	}{
+		{"no key", func(f *tlsFiles) { f.keyFile = "" }},
+		{"missing cert", func(f *tlsFiles) { f.certFile = filepath.Join(p.dir, "missing.pem") }},
+		{"key of another cert", func(f *tlsFiles) { f.certFile = p.caFile }},
+		{"bad min version", func(f *tlsFiles) { f.minVersion = "1.4" }},
+		{"missing ca", func(f *tlsFiles) { f.caFile = filepath.Join(p.dir, "missing.pem") }},
+		{"no ca with auth clients", func(f *tlsFiles) { f.caFile = "" }},
+		{"ca without certificates", func(f *tlsFiles) { f.caFile = p.keyFile }},
+	}
+	for _, tt := range tests {
+		f := p.files()
+		tt.files(&f)
+		if _, err := newServerTLS(f); err == nil {
+			t.Errorf("%s: no error", tt.name)
+		}
+	}
+
+	// Without client authentication the CA is optional.
+	f := p.files()
+	f.caFile, f.authClients = "", false
+	if _, err := newServerTLS(f); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTLSReloadKeepsConfig(t *testing.T) {
+	p := newTestPKI(t)
+	defer os.RemoveAll(p.dir)
+
+	s, err := newServerTLS(p.files())
+	if err != nil {
+		t.Fatal(err)
+	}
+	old, _ := s.configForClient(nil)
+
+	os.Remove(p.certFile)
+	if err = s.reload(); err == nil {
+		t.Fatal("reload without the certificate succeeded")
+	}
+	if config, _ := s.configForClient(nil); config != old {
+		t.Fatal("a failed reload replaced the config")
+	}
+
+	// A reload that succeeds is used by the new connections.
+	key, der := newTestCert(t, "server", nil, nil)
+	p.writePEM(t, "server.pem", "CERTIFICATE", der)
+	p.writeKey(t, "server-key.pem", key)
+	if err = s.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if config, _ := s.configForClient(nil); config == old {
+		t.Fatal("the reload kept the old config")
+	}
+}
+
+func TestTLSHandshake(t *testing.T) {
+	p := newTestPKI(t)
+	defer os.RemoveAll(p.dir)
+
+	tests := []struct {
+		name string
+		// authClients and caFile set up the server, other the client.
+		authClients bool
+		caFile      string
+		withCert    bool
+		ok          bool
+	}{
+		{"mutual", true, p.caFile, true, true},
+		{"no client cert", true, p.caFile, false, false},
+		{"client cert of another ca", true, p.otherCAFile, true, false},
+		{"optional client cert given", false, p.caFile, true, true},
+		{"optional client cert missing", false, p.caFile, false, true},
+		{"optional client cert of another ca", false, p.otherCAFile, true, false},
+	}
+	for _, tt := range tests {
+		f := p.files()
+		f.authClients, f.caFile = tt.authClients, tt.caFile
+		s, err := newServerTLS(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l, err := s.listen("127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The server tells whether the handshake succeeded, with TLS 1.3 the
+		// client only learns that its certificate was rejected later.
+		handshake := make(chan error, 1)
+		go func() {
+			conn, err := l.Accept()
+			if err != nil {
+				handshake <- err
+				return
+			}
+			defer conn.Close()
+			handshake <- conn.(*tls.Conn).Handshake()
+		}()
+
+		config := &tls.Config{RootCAs: p.pool}
+		if tt.withCert {
+			// Given even when the server asks for another CA.
+			config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+				return &p.client, nil
+			}
+		}
+		conn, err := tls.Dial("tcp", l.Addr().String(), config)
+		if err == nil {
+			conn.Close()
+		}
+		if err = <-handshake; (err == nil) != tt.ok {
+			t.Errorf("%s: handshake error %v, want ok %v", tt.name, err, tt.ok)
+		}
+		l.Close()
+	}
+}
@@ -0,0 +1,58 @@
+package structure
+
+import (
+	"github.com/juju/errors"
+	"github.com/pingcap/tidb/kv"
+	"github.com/pingcap/tidb/terror"
+)
+
+// aclPrefix leads the ACL users, one key per user name holding its rules.
+// Every proxy on the cluster reads its users from there.
+var aclPrefix = []byte{SystemPrefix, 'a'}
+
+func encodeACLUserKey(name string) kv.Key {
+	return append(append([]byte{}, aclPrefix...), name...)
+}
+
+// LoadACLUsers gets the rules of every ACL user by user name.
+func LoadACLUsers(r kv.Retriever) (map[string]string, error) {
+	it, err := r.Seek(aclPrefix)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer it.Close()
+
+	users := make(map[string]string)
+	for it.Valid() && it.Key().HasPrefix(aclPrefix) {
+		users[string(it.Key()[len(aclPrefix):])] = string(it.Value())
+		if err = it.Next(); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+	return users, nil
+}
+
+// GetACLUser gets the rules of an ACL user, they are empty if the user does
+// not exist.
+func GetACLUser(r kv.Retriever, name string) (string, error) {
+	v, err := r.Get(encodeACLUserKey(name))
+	if terror.ErrorEqual(err, kv.ErrNotExist) {
+		err = nil
+	}
+	return string(v), errors.Trace(err)
+}
+
+// SetACLUser sets the rules of an ACL user, rules are never empty as they at
+// least tell whether the user is enabled.
+func SetACLUser(rm kv.RetrieverMutator, name string, rules string) error {
+	return errors.Trace(rm.Set(encodeACLUserKey(name), []byte(rules)))
+}
+
+// DeleteACLUser deletes an ACL user, it returns false if it did not exist.
+func DeleteACLUser(rm kv.RetrieverMutator, name string) (bool, error) {
+	rules, err := GetACLUser(rm, name)
+	if err != nil || rules == "" {
+		return false, errors.Trace(err)
+	}
+	return true, errors.Trace(rm.Delete(encodeACLUserKey(name)))
+}
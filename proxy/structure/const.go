@@ -1,5 +1,14 @@
 package structure
 
 const (
-	SeekThreshold int = 10
+	// ScanBatch is the number of keys a full walk of the keyspace visits in
+	// every round.
+	ScanBatch int = 1000
+	// SystemPrefix leads the key ranges the proxy keeps for its own bookkeeping,
+	// it sorts after every user key prefix.
+	SystemPrefix byte = 0xfe
+	// BitmapChunkSize is the number of bytes in every chunk key of a bitmap.
+	BitmapChunkSize int64 = 4096
+	// Databases is the number of logical databases SELECT can switch to.
+	Databases int = 16
 )
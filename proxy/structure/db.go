@@ -0,0 +1,396 @@
+package structure
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/fnv"
+	"sync"
+
+	"github.com/juju/errors"
+	"github.com/pingcap/tidb/kv"
+	"github.com/pingcap/tidb/terror"
+	"github.com/pingcap/tidb/util/codec"
+)
+
+var (
+	// dbMapKey holds the key prefix of every logical database followed by a
+	// version, SWAPDB swaps two of the prefixes and bumps the version.
+	// Database n uses the prefix n until it is swapped.
+	dbMapKey = []byte{SystemPrefix, 'd'}
+	// dbSizePrefix leads the key counters of every key prefix, they are
+	// sharded so that writers creating different keys rarely conflict.
+	dbSizePrefix = []byte{SystemPrefix, 'n'}
+)
+
+// dbSizeShards is the number of counters of a key prefix. DBSIZE reads them
+// all, every writer creating or deleting a key writes one of them.
+const dbSizeShards = 1024
+
+// ErrDBIndex is returned for a database index out of [0, Databases).
+var ErrDBIndex = errors.New("DB index is out of range")
+
+// errDBMapChanged fails a transaction that used a database map SWAPDB has
+// changed since, it is retried with the new map.
+var errDBMapChanged = kv.ErrRetryable.Gen("database map changed by SWAPDB, try again later")
+
+// loadDBMap gets the prefixes of the databases and the version of the map,
+// a map written before it had a version is version 0.
+func loadDBMap(r kv.Retriever) ([]byte, uint64, error) {
+	v, err := r.Get(dbMapKey)
+	if terror.ErrorEqual(err, kv.ErrNotExist) {
+		m := make([]byte, Databases)
+		for i := range m {
+			m[i] = byte(i)
+		}
+		return m, 0, nil
+	}
+	if err != nil {
+		return nil, 0, errors.Trace(err)
+	}
+	switch len(v) {
+	case Databases:
+		return v, 0, nil
+	case Databases + 8:
+		return v[:Databases], binary.BigEndian.Uint64(v[Databases:]), nil
+	}
+	return nil, 0, errors.Errorf("invalid database map of %d bytes", len(v))
+}
+
+// DBMap caches the database map for the transactions of a proxy, so that
+// a command does not read it from the store. The map is checked against the
+// store before the first write of a transaction. A read may use a map
+// another proxy has swapped until this proxy writes.
+type DBMap struct {
+	mu       sync.RWMutex
+	prefixes []byte
+	version  uint64
+}
+
+// NewDBMap creates an empty DBMap, the map is loaded by its first user.
+func NewDBMap() *DBMap {
+	return &DBMap{}
+}
+
+// Structure creates a TxStructure on txn for the logical database db with
+// the cached map. A write through it fails with a retryable error if the
+// map was swapped since it was cached.
+func (m *DBMap) Structure(txn kv.RetrieverMutator, db int) (*TxStructure, error) {
+	prefixes, version, err := m.get(txn, db)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	rm := &dbMapChecker{RetrieverMutator: txn, m: m, version: version}
+	return NewStructure(txn, rm, []byte{prefixes[db]}), nil
+}
+
+// Reader creates a TxStructure that only reads from r, for the logical
+// database db with the cached map.
+func (m *DBMap) Reader(r kv.Retriever, db int) (*TxStructure, error) {
+	prefixes, _, err := m.get(r, db)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return NewStructure(r, nil, []byte{prefixes[db]}), nil
+}
+
+// get gets the cached map, it is loaded from r if there is none.
+func (m *DBMap) get(r kv.Retriever, db int) ([]byte, uint64, error) {
+	if db < 0 || db >= Databases {
+		return nil, 0, errors.Trace(ErrDBIndex)
+	}
+	m.mu.RLock()
+	prefixes, version := m.prefixes, m.version
+	m.mu.RUnlock()
+	if prefixes == nil {
+		var err error
+		if prefixes, version, err = loadDBMap(r); err != nil {
+			return nil, 0, errors.Trace(err)
+		}
+		m.set(prefixes, version)
+	}
+	return prefixes, version, nil
+}
+
+// Invalidate drops the cached map, the next transaction loads it again.
+// It is called after SWAPDB.
+func (m *DBMap) Invalidate() {
+	m.set(nil, 0)
+}
+
+func (m *DBMap) set(prefixes []byte, version uint64) {
+	m.mu.Lock()
+	m.prefixes, m.version = prefixes, version
+	m.mu.Unlock()
+}
+
+// dbMapChecker reads the version of the database map before the first
+// write through it. A version other than the one the transaction started
+// with is replaced in the cache and fails the write.
+type dbMapChecker struct {
+	kv.RetrieverMutator
+	m       *DBMap
+	version uint64
+	checked bool
+}
+
+// StartTS gets the start timestamp of the transaction under c, 0 if it is
+// not a transaction.
+func (c *dbMapChecker) StartTS() uint64 {
+	if s, ok := c.RetrieverMutator.(stamper); ok {
+		return s.StartTS()
+	}
+	return 0
+}
+
+func (c *dbMapChecker) check() error {
+	if c.checked {
+		return nil
+	}
+	prefixes, version, err := loadDBMap(c.RetrieverMutator)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if version != c.version {
+		c.m.set(prefixes, version)
+		return errors.Trace(errDBMapChanged)
+	}
+	c.checked = true
+	return nil
+}
+
+func (c *dbMapChecker) Set(k kv.Key, v []byte) error {
+	if err := c.check(); err != nil {
+		return errors.Trace(err)
+	}
+	return c.RetrieverMutator.Set(k, v)
+}
+
+func (c *dbMapChecker) Delete(k kv.Key) error {
+	if err := c.check(); err != nil {
+		return errors.Trace(err)
+	}
+	return c.RetrieverMutator.Delete(k)
+}
+
+// NewDBStructure creates a TxStructure on txn for the logical database db.
+func NewDBStructure(txn kv.RetrieverMutator, db int) (*TxStructure, error) {
+	if db < 0 || db >= Databases {
+		return nil, errors.Trace(ErrDBIndex)
+	}
+	m, _, err := loadDBMap(txn)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return NewStructure(txn, txn, []byte{m[db]}), nil
+}
+
+// DB creates a TxStructure for the logical database db on the transaction
+// of t.
+func (t *TxStructure) DB(db int) (*TxStructure, error) {
+	if t.readWriter == nil {
+		return nil, errWriteOnSnapshot
+	}
+	return NewDBStructure(t.rawMutator(), db)
+}
+
+// SwapDB swaps the data of two logical databases, the clients connected to
+// one of them see the data of the other at once. The proxies notice the new
+// version of the map before their next write.
+func (t *TxStructure) SwapDB(a int, b int) error {
+	if t.readWriter == nil {
+		return errWriteOnSnapshot
+	}
+	if a < 0 || a >= Databases || b < 0 || b >= Databases {
+		return errors.Trace(ErrDBIndex)
+	}
+	rm := t.rawMutator()
+	prefixes, version, err := loadDBMap(rm)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	v := make([]byte, Databases+8)
+	copy(v, prefixes)
+	v[a], v[b] = v[b], v[a]
+	binary.BigEndian.PutUint64(v[Databases:], version+1)
+	return errors.Trace(rm.Set(dbMapKey, v))
+}
+
+// countingMutator keeps the key counter of a key prefix up to date as meta
+// keys are created and deleted through it. It also stamps the meta of every
+// key written through it, see stampMeta.
+type countingMutator struct {
+	kv.RetrieverMutator
+	prefix []byte
+	stamp  uint64
+	// stamped holds the meta keys stamped already.
+	stamped map[string]bool
+}
+
+func (c *countingMutator) Set(k kv.Key, v []byte) error {
+	if !isMetaKey(c.prefix, k) {
+		if err := c.touch(k); err != nil {
+			return errors.Trace(err)
+		}
+		return c.RetrieverMutator.Set(k, v)
+	}
+
+	if _, err := c.RetrieverMutator.Get(k); terror.ErrorEqual(err, kv.ErrNotExist) {
+		if err = addDBSize(c.RetrieverMutator, c.prefix, k, 1); err != nil {
+			return errors.Trace(err)
+		}
+	} else if err != nil {
+		return errors.Trace(err)
+	}
+	c.markStamped(k)
+	return c.RetrieverMutator.Set(k, stampMeta(v, c.stamp))
+}
+
+func (c *countingMutator) Delete(k kv.Key) error {
+	if !isMetaKey(c.prefix, k) {
+		if err := c.touch(k); err != nil {
+			return errors.Trace(err)
+		}
+		return c.RetrieverMutator.Delete(k)
+	}
+
+	_, err := c.RetrieverMutator.Get(k)
+	if err == nil {
+		err = addDBSize(c.RetrieverMutator, c.prefix, k, -1)
+	}
+	if err != nil && !terror.ErrorEqual(err, kv.ErrNotExist) {
+		return errors.Trace(err)
+	}
+	delete(c.stamped, string(k))
+	return c.RetrieverMutator.Delete(k)
+}
+
+// touch stamps the meta of the key the data key k belongs to, once in the
+// transaction. A key without a meta yet is stamped when its meta is set.
+func (c *countingMutator) touch(k kv.Key) error {
+	if c.stamp == 0 {
+		return nil
+	}
+	mk := metaKeyOf(c.prefix, k)
+	if mk == nil || c.stamped[string(mk)] {
+		return nil
+	}
+	v, err := c.RetrieverMutator.Get(mk)
+	if terror.ErrorEqual(err, kv.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return errors.Trace(err)
+	}
+	c.markStamped(mk)
+	return errors.Trace(c.RetrieverMutator.Set(mk, stampMeta(v, c.stamp)))
+}
+
+func (c *countingMutator) markStamped(mk kv.Key) {
+	if c.stamped == nil {
+		c.stamped = make(map[string]bool)
+	}
+	c.stamped[string(mk)] = true
+}
+
+// isMetaKey reports whether ek is the meta key of a user key under prefix.
+func isMetaKey(prefix []byte, ek kv.Key) bool {
+	if !ek.HasPrefix(prefix) {
+		return false
+	}
+	rest, _, err := codec.DecodeBytes(ek[len(prefix):])
+	return err == nil && bytes.Equal(rest, codec.EncodeUint(nil, uint64(MetaCode)))
+}
+
+func dbSizeKeyPrefix(prefix []byte) kv.Key {
+	return codec.EncodeBytes(append([]byte{}, dbSizePrefix...), prefix)
+}
+
+func addDBSize(rm kv.RetrieverMutator, prefix []byte, metaKey kv.Key, delta int64) error {
+	h := fnv.New32a()
+	h.Write(metaKey)
+	shard := h.Sum32() % dbSizeShards
+	ck := append(dbSizeKeyPrefix(prefix), byte(shard>>8), byte(shard))
+	var n int64
+	v, err := rm.Get(ck)
+	if err == nil && len(v) == 8 {
+		n = int64(binary.BigEndian.Uint64(v))
+	} else if err != nil && !terror.ErrorEqual(err, kv.ErrNotExist) {
+		return errors.Trace(err)
+	}
+
+	n += delta
+	if n == 0 {
+		return errors.Trace(rm.Delete(ck))
+	}
+	v = make([]byte, 8)
+	binary.BigEndian.PutUint64(v, uint64(n))
+	return errors.Trace(rm.Set(ck, v))
+}
+
+// rawMutator gets the readWriter of t without the key counting.
+func (t *TxStructure) rawMutator() kv.RetrieverMutator {
+	if c, ok := t.readWriter.(*countingMutator); ok {
+		return c.RetrieverMutator
+	}
+	return t.readWriter
+}
+
+// DBSize gets the number of keys in the database of t, expired keys not
+// reaped yet included. It sums every counter under the prefix, the ones of
+// proxies that used fewer shards as well.
+func (t *TxStructure) DBSize() (int64, error) {
+	start := dbSizeKeyPrefix(t.prefix)
+	it, err := t.reader.Seek(start)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	defer it.Close()
+
+	var n int64
+	for it.Valid() && it.Key().HasPrefix(start) {
+		if v := it.Value(); len(v) == 8 {
+			n += int64(binary.BigEndian.Uint64(v))
+		}
+		if err = it.Next(); err != nil {
+			return 0, errors.Trace(err)
+		}
+	}
+	return n, nil
+}
+
+// FlushDB deletes at most limit encoded keys of the database of t, it
+// returns the number deleted, which is below limit once the database is
+// empty. The entries left in the expire index are dropped by the reaper as
+// it finds the keys gone.
+func (t *TxStructure) FlushDB(limit int) (int, error) {
+	if t.readWriter == nil {
+		return 0, errWriteOnSnapshot
+	}
+	rm := t.rawMutator()
+	it, err := rm.Seek(t.prefix)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	var keys []kv.Key
+	for it.Valid() && it.Key().HasPrefix(t.prefix) && len(keys) < limit {
+		keys = append(keys, append(kv.Key{}, it.Key()...))
+		if err = it.Next(); err != nil {
+			it.Close()
+			return 0, errors.Trace(err)
+		}
+	}
+	it.Close()
+
+	for _, k := range keys {
+		if isMetaKey(t.prefix, k) {
+			if err = addDBSize(rm, t.prefix, k, -1); err != nil {
+				return 0, errors.Trace(err)
+			}
+		}
+		if err = rm.Delete(k); err != nil {
+			return 0, errors.Trace(err)
+		}
+	}
+	return len(keys), nil
+}
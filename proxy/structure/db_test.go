@@ -0,0 +1,167 @@
+package structure
+
+import (
+	"fmt"
+
+	"github.com/juju/errors"
+	. "github.com/pingcap/check"
+	"github.com/pingcap/tidb/kv"
+	"github.com/pingcap/tidb/util/testleak"
+)
+
+func (s *testTxStructureSuite) TestDBMap(c *C) {
+	defer testleak.AfterTest(c)()
+	m := NewDBMap()
+	err := kv.RunInNewTxn(s.store, false, func(txn kv.Transaction) error {
+		tx, err := m.Structure(txn, 0)
+		c.Assert(err, IsNil)
+		_, err = tx.Set([]byte("a"), []byte("0"))
+		return err
+	})
+	c.Assert(err, IsNil)
+
+	// Another proxy swaps the databases.
+	err = kv.RunInNewTxn(s.store, false, func(txn kv.Transaction) error {
+		tx, err := NewDBStructure(txn, 0)
+		c.Assert(err, IsNil)
+		return tx.SwapDB(0, 1)
+	})
+	c.Assert(err, IsNil)
+
+	txn, err := s.store.Begin()
+	c.Assert(err, IsNil)
+	tx, err := m.Structure(txn, 1)
+	c.Assert(err, IsNil)
+	// A read uses the cached map, a write notices the swap.
+	v, err := tx.Get([]byte("a"))
+	c.Assert(err, IsNil)
+	c.Assert(v, IsNil)
+	_, err = tx.Set([]byte("b"), []byte("1"))
+	c.Assert(kv.IsRetryableError(err), IsTrue)
+	txn.Rollback()
+
+	err = kv.RunInNewTxn(s.store, false, func(txn kv.Transaction) error {
+		tx, err := m.Structure(txn, 1)
+		c.Assert(err, IsNil)
+		v, err := tx.Get([]byte("a"))
+		c.Assert(err, IsNil)
+		c.Assert(v, DeepEquals, []byte("0"))
+		_, err = tx.Set([]byte("b"), []byte("1"))
+		c.Assert(err, IsNil)
+		// SWAPDB through the cached map does not fail on its own write.
+		return tx.SwapDB(0, 1)
+	})
+	c.Assert(err, IsNil)
+	m.Invalidate()
+
+	err = kv.RunInNewTxn(s.store, false, func(txn kv.Transaction) error {
+		tx, err := m.Structure(txn, 0)
+		c.Assert(err, IsNil)
+		n, err := tx.DBSize()
+		c.Assert(err, IsNil)
+		c.Assert(n, Equals, int64(2))
+		_, err = tx.Set([]byte("c"), []byte("2"))
+		return err
+	})
+	c.Assert(err, IsNil)
+}
+
+func (s *testTxStructureSuite) TestDBSizeShards(c *C) {
+	defer testleak.AfterTest(c)()
+	txn, err := s.store.Begin()
+	c.Assert(err, IsNil)
+	defer txn.Rollback()
+
+	tx := NewStructure(txn, txn, []byte{0x00})
+	for i := 0; i < 100; i++ {
+		_, err = tx.Set([]byte(fmt.Sprintf("k%d", i)), []byte("v"))
+		c.Assert(err, IsNil)
+	}
+	// A counter left by a proxy with one byte shards is summed as well.
+	err = txn.Set(append(dbSizeKeyPrefix([]byte{0x00}), 7), []byte{0, 0, 0, 0, 0, 0, 0, 3})
+	c.Assert(err, IsNil)
+	n, err := tx.DBSize()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, int64(103))
+	c.Assert(countKeys(c, txn, dbSizeKeyPrefix([]byte{0x00})) > 90, IsTrue)
+
+	for i := 0; i < 100; i++ {
+		_, err = tx.DEL([][]byte{[]byte(fmt.Sprintf("k%d", i))})
+		c.Assert(err, IsNil)
+	}
+	n, err = tx.DBSize()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, int64(3))
+	c.Assert(countKeys(c, txn, dbSizeKeyPrefix([]byte{0x00})), Equals, 1)
+}
+
+func (s *testTxStructureSuite) TestSwapDBMoveFlushDB(c *C) {
+	defer testleak.AfterTest(c)()
+	txn, err := s.store.Begin()
+	c.Assert(err, IsNil)
+	defer txn.Rollback()
+
+	db := func(i int) *TxStructure {
+		tx, err := NewDBStructure(txn, i)
+		c.Assert(err, IsNil)
+		return tx
+	}
+	get := func(tx *TxStructure, key string) string {
+		v, err := tx.Get([]byte(key))
+		c.Assert(err, IsNil)
+		return string(v)
+	}
+	_, err = db(0).Set([]byte("a"), []byte("0"))
+	c.Assert(err, IsNil)
+	_, err = db(1).Set([]byte("a"), []byte("1"))
+	c.Assert(err, IsNil)
+	_, err = db(1).Set([]byte("b"), []byte("1"))
+	c.Assert(err, IsNil)
+
+	c.Assert(db(0).SwapDB(0, 1), IsNil)
+	c.Assert(get(db(0), "a"), Equals, "1")
+	c.Assert(get(db(1), "a"), Equals, "0")
+	n, err := db(0).DBSize()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, int64(2))
+	c.Assert(errors.Cause(db(0).SwapDB(0, Databases)), Equals, ErrDBIndex)
+
+	// MOVE does nothing if the key exists in the other database.
+	ok, err := db(0).Move([]byte("a"), db(1))
+	c.Assert(err, IsNil)
+	c.Assert(ok, IsFalse)
+	ok, err = db(0).Move([]byte("b"), db(1))
+	c.Assert(err, IsNil)
+	c.Assert(ok, IsTrue)
+	c.Assert(get(db(0), "b"), Equals, "")
+	c.Assert(get(db(1), "b"), Equals, "1")
+	ok, err = db(0).Move([]byte("missing"), db(1))
+	c.Assert(err, IsNil)
+	c.Assert(ok, IsFalse)
+	_, err = db(0).Move([]byte("a"), db(0))
+	c.Assert(errors.Cause(err), Equals, ErrSameObject)
+
+	// FLUSHDB deletes in batches and leaves the other databases alone.
+	for i := 0; i < 10; i++ {
+		_, err = db(1).HSet([]byte("h"), []byte(fmt.Sprintf("f%d", i)), []byte("v"))
+		c.Assert(err, IsNil)
+	}
+	rounds := 0
+	for {
+		deleted, err := db(1).FlushDB(4)
+		c.Assert(err, IsNil)
+		rounds++
+		if deleted < 4 {
+			break
+		}
+	}
+	c.Assert(rounds > 1, IsTrue)
+	n, err = db(1).DBSize()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, int64(0))
+	c.Assert(countKeys(c, txn, kv.Key(db(1).prefix)), Equals, 0)
+	n, err = db(0).DBSize()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, int64(1))
+	c.Assert(get(db(0), "a"), Equals, "1")
+}
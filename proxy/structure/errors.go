@@ -1,7 +1,28 @@
 package structure
 
-import "github.com/juju/errors"
+import (
+	"github.com/juju/errors"
+	"github.com/pingcap/tidb/terror"
+)
 
 var (
-	ErrSetType = errors.New("invalid set type")
+	ErrSetType         = errors.New("invalid set type")
+	ErrNoSuchKey       = errors.New("no such key")
+	ErrIndexOutOfRange = errors.New("index out of range")
+	ErrNotInteger      = errors.New("value is not an integer or out of range")
+	ErrNotFloat        = errors.New("value is not a valid float")
+	ErrOverflow        = errors.New("increment or decrement would overflow")
+	ErrNaNOrInf        = errors.New("increment would produce NaN or Infinity")
+	ErrHashNotInteger  = errors.New("hash value is not an integer")
+	ErrHashNotFloat    = errors.New("hash value is not a float")
+	ErrStringTooLong   = errors.New("string exceeds maximum allowed size (proto-max-bulk-len)")
+	ErrSameObject      = errors.New("source and destination objects are the same")
 )
+
+// IsWrongType reports whether err is returned because a command was run
+// against a key holding another type of value.
+func IsWrongType(err error) bool {
+	cause := errors.Cause(err)
+	// errInvalidHashMeta shares the code of errInvalidHashKeyFlag.
+	return cause == ErrSetType || terror.ErrorEqual(cause, errInvalidHashKeyFlag)
+}
@@ -0,0 +1,353 @@
+package structure
+
+import (
+	"bytes"
+	"encoding/binary"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/pingcap/tidb/kv"
+	"github.com/pingcap/tidb/terror"
+	"github.com/pingcap/tidb/util/codec"
+)
+
+// expireIndexPrefix leads the expire index. Index keys are ordered by expire
+// time first, so the reaper only has to look at the head of the range.
+var expireIndexPrefix = []byte{SystemPrefix, 'e'}
+
+func nowMs() int64 {
+	return time.Now().UnixNano() / int64(time.Millisecond)
+}
+
+func isExpired(expireAt int64) bool {
+	return expireAt > 0 && expireAt <= nowMs()
+}
+
+func (t *TxStructure) encodeExpireIndexKey(key []byte, expireAt int64) kv.Key {
+	ek := make([]byte, 0, len(expireIndexPrefix)+len(t.prefix)+len(key)+40)
+	ek = append(ek, expireIndexPrefix...)
+	ek = codec.EncodeInt(ek, expireAt)
+	ek = codec.EncodeBytes(ek, t.prefix)
+	return codec.EncodeBytes(ek, key)
+}
+
+func decodeExpireIndexKey(ek kv.Key) (int64, []byte, []byte, error) {
+	if !bytes.HasPrefix(ek, expireIndexPrefix) {
+		return 0, nil, nil, errors.New("invalid encoded expire index key prefix")
+	}
+	b := ek[len(expireIndexPrefix):]
+
+	b, expireAt, err := codec.DecodeInt(b)
+	if err != nil {
+		return 0, nil, nil, errors.Trace(err)
+	}
+	b, prefix, err := codec.DecodeBytes(b)
+	if err != nil {
+		return 0, nil, nil, errors.Trace(err)
+	}
+	_, key, err := codec.DecodeBytes(b)
+	return expireAt, prefix, key, errors.Trace(err)
+}
+
+// loadMeta gets the meta value of key, it returns nil if the key does not
+// exist or its ttl has passed.
+func (t *TxStructure) loadMeta(key []byte) ([]byte, error) {
+	mv, err := t.reader.Get(t.EncodeMetaKey(key))
+	if terror.ErrorEqual(err, kv.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if _, expireAt, _ := DecodeMetaValue(mv); isExpired(expireAt) {
+		return nil, nil
+	}
+	return mv, nil
+}
+
+// expireIfNeeded physically removes key if its ttl has passed, so writers
+// always start from an empty value.
+func (t *TxStructure) expireIfNeeded(key []byte) error {
+	mv, err := t.reader.Get(t.EncodeMetaKey(key))
+	if terror.ErrorEqual(err, kv.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	flag, expireAt, _ := DecodeMetaValue(mv)
+	if !isExpired(expireAt) {
+		return nil
+	}
+	return errors.Trace(t.clearKey(key, flag))
+}
+
+// setExpire rewrites the expire field of the meta value mv and keeps the
+// expire index in step with it. An expireAt of 0 removes the ttl.
+func (t *TxStructure) setExpire(key []byte, mv []byte, expireAt int64) error {
+	_, oldExpireAt, _ := DecodeMetaValue(mv)
+	if oldExpireAt == expireAt {
+		return nil
+	}
+
+	if oldExpireAt > 0 {
+		if err := t.readWriter.Delete(t.encodeExpireIndexKey(key, oldExpireAt)); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	if expireAt > 0 {
+		if err := t.readWriter.Set(t.encodeExpireIndexKey(key, expireAt), mv[0:1]); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	return errors.Trace(t.readWriter.Set(t.EncodeMetaKey(key), setMetaExpire(mv, expireAt)))
+}
+
+// clearExpire removes the expire index entry of key, it must be called
+// before the meta key of key is deleted.
+func (t *TxStructure) clearExpire(key []byte) error {
+	mv, err := t.reader.Get(t.EncodeMetaKey(key))
+	if terror.ErrorEqual(err, kv.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	_, expireAt, _ := DecodeMetaValue(mv)
+	if expireAt == 0 {
+		return nil
+	}
+	err = t.readWriter.Delete(t.encodeExpireIndexKey(key, expireAt))
+	if terror.ErrorEqual(err, kv.ErrNotExist) {
+		err = nil
+	}
+	return errors.Trace(err)
+}
+
+// ExpireAt sets the expire time of key as a unix timestamp in milliseconds.
+// It returns 1 if the timeout was set and 0 if the key does not exist. A time
+// in the past deletes the key at once.
+func (t *TxStructure) ExpireAt(key []byte, expireAt int64) (int, error) {
+	if t.readWriter == nil {
+		return 0, errWriteOnSnapshot
+	}
+	if err := t.expireIfNeeded(key); err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	mv, err := t.loadMeta(key)
+	if err != nil || mv == nil {
+		return 0, errors.Trace(err)
+	}
+
+	if expireAt <= nowMs() {
+		flag, _, _ := DecodeMetaValue(mv)
+		return 1, errors.Trace(t.clearKey(key, flag))
+	}
+	return 1, errors.Trace(t.setExpire(key, mv, expireAt))
+}
+
+// Persist removes the ttl of key. It returns 1 if the ttl was removed and 0
+// if the key does not exist or has no ttl.
+func (t *TxStructure) Persist(key []byte) (int, error) {
+	if t.readWriter == nil {
+		return 0, errWriteOnSnapshot
+	}
+
+	mv, err := t.loadMeta(key)
+	if err != nil || mv == nil {
+		return 0, errors.Trace(err)
+	}
+
+	_, expireAt, _ := DecodeMetaValue(mv)
+	if expireAt == 0 {
+		return 0, nil
+	}
+	return 1, errors.Trace(t.setExpire(key, mv, 0))
+}
+
+// PTTL gets the remaining time to live of key in milliseconds. It returns -2
+// if the key does not exist and -1 if the key has no ttl.
+func (t *TxStructure) PTTL(key []byte) (int64, error) {
+	mv, err := t.loadMeta(key)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	if mv == nil {
+		return -2, nil
+	}
+
+	_, expireAt, _ := DecodeMetaValue(mv)
+	if expireAt == 0 {
+		return -1, nil
+	}
+
+	ttl := expireAt - nowMs()
+	if ttl < 0 {
+		ttl = 0
+	}
+	return ttl, nil
+}
+
+type expireEntry struct {
+	expireAt int64
+	prefix   []byte
+	key      []byte
+}
+
+// ReapExpired deletes the keys whose ttl has passed before now in the order
+// of the expire index, deleting at most limit raw keys so that a round stays
+// one small transaction however large the keys are. The data keys of a key
+// go first, across several rounds if they do not fit in one, then its meta
+// and last its index entry; the key reads as missing meanwhile. It returns
+// the number of keys reaped and whether the round ran out of limit before
+// the expired keys did. Callers run it in a fresh transaction.
+func ReapExpired(rm kv.RetrieverMutator, now int64, limit int) (int, bool, error) {
+	it, err := rm.Seek(expireIndexPrefix)
+	if err != nil {
+		return 0, false, errors.Trace(err)
+	}
+
+	var entries []expireEntry
+	for it.Valid() && len(entries) < limit {
+		if !it.Key().HasPrefix(expireIndexPrefix) {
+			break
+		}
+
+		expireAt, prefix, key, err := decodeExpireIndexKey(it.Key())
+		if err != nil {
+			it.Close()
+			return 0, false, errors.Trace(err)
+		}
+		if expireAt > now {
+			break
+		}
+		entries = append(entries, expireEntry{expireAt: expireAt, prefix: prefix, key: key})
+
+		if err = it.Next(); err != nil {
+			it.Close()
+			return 0, false, errors.Trace(err)
+		}
+	}
+	it.Close()
+
+	deleted, reaped := 0, 0
+	for _, e := range entries {
+		if deleted >= limit {
+			return reaped, true, nil
+		}
+		t := NewStructure(rm, rm, e.prefix)
+		mk := t.EncodeMetaKey(e.key)
+		mv, err := rm.Get(mk)
+		if terror.ErrorEqual(err, kv.ErrNotExist) {
+			err = nil
+		}
+		if err != nil {
+			return 0, false, errors.Trace(err)
+		}
+
+		if mv != nil {
+			if _, expireAt, _ := DecodeMetaValue(mv); expireAt == e.expireAt {
+				n, cleared, err := t.clearKeyData(e.key, limit-deleted)
+				if err != nil {
+					return 0, false, errors.Trace(err)
+				}
+				deleted += n
+				if !cleared || deleted >= limit {
+					return reaped, true, nil
+				}
+				if err = t.readWriter.Delete(mk); err != nil {
+					return 0, false, errors.Trace(err)
+				}
+				deleted++
+				reaped++
+				if deleted >= limit {
+					// The entry is stale now, the next round drops it.
+					return reaped, true, nil
+				}
+			}
+		}
+
+		// The key was deleted or got a new ttl, the entry is stale.
+		err = rm.Delete(t.encodeExpireIndexKey(e.key, e.expireAt))
+		if err != nil && !terror.ErrorEqual(err, kv.ErrNotExist) {
+			return 0, false, errors.Trace(err)
+		}
+		deleted++
+	}
+
+	return reaped, len(entries) == limit, nil
+}
+
+// clearKeyData deletes at most limit data keys of key, leaving its meta. It
+// returns the number deleted and whether none is left.
+func (t *TxStructure) clearKeyData(key []byte, limit int) (int, bool, error) {
+	prefix := t.keyPrefix(key)
+	mk := t.EncodeMetaKey(key)
+	rm := t.rawMutator()
+	it, err := rm.Seek(prefix)
+	if err != nil {
+		return 0, false, errors.Trace(err)
+	}
+
+	var keys []kv.Key
+	cleared := true
+	for it.Valid() && it.Key().HasPrefix(prefix) {
+		if !bytes.Equal(it.Key(), mk) {
+			if len(keys) == limit {
+				cleared = false
+				break
+			}
+			keys = append(keys, it.Key().Clone())
+		}
+		if err = it.Next(); err != nil {
+			it.Close()
+			return 0, false, errors.Trace(err)
+		}
+	}
+	it.Close()
+
+	for _, k := range keys {
+		if err = rm.Delete(k); err != nil {
+			return 0, false, errors.Trace(err)
+		}
+	}
+	return len(keys), cleared, nil
+}
+
+// reaperLeaseKey holds the proxy that reaps the expired keys and until when.
+// The proxies of a cluster would all clear the same head of the index and
+// conflict, only the holder of the lease reaps.
+var reaperLeaseKey = []byte{SystemPrefix, 'r'}
+
+// HoldReaperLease reports whether owner holds the reaper lease at now. A
+// lease that is free or has run out is taken for ttl milliseconds, and the
+// holder renews it once half of ttl is gone.
+func HoldReaperLease(rm kv.RetrieverMutator, owner []byte, now int64, ttl int64) (bool, error) {
+	v, err := rm.Get(reaperLeaseKey)
+	if terror.ErrorEqual(err, kv.ErrNotExist) {
+		err = nil
+	}
+	if err != nil {
+		return false, errors.Trace(err)
+	}
+	if len(v) >= 8 {
+		until := int64(binary.BigEndian.Uint64(v))
+		mine := bytes.Equal(v[8:], owner)
+		if !mine && until > now {
+			return false, nil
+		}
+		if mine && until-now > ttl/2 {
+			return true, nil
+		}
+	}
+
+	v = make([]byte, 8, 8+len(owner))
+	binary.BigEndian.PutUint64(v, uint64(now+ttl))
+	v = append(v, owner...)
+	return true, errors.Trace(rm.Set(reaperLeaseKey, v))
+}
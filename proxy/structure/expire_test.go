@@ -0,0 +1,107 @@
+package structure
+
+import (
+	"fmt"
+	"time"
+
+	. "github.com/pingcap/check"
+	"github.com/pingcap/tidb/kv"
+	"github.com/pingcap/tidb/util/testleak"
+)
+
+// countKeys counts the raw keys under prefix.
+func countKeys(c *C, r kv.Retriever, prefix kv.Key) int {
+	it, err := r.Seek(prefix)
+	c.Assert(err, IsNil)
+	defer it.Close()
+	n := 0
+	for it.Valid() && it.Key().HasPrefix(prefix) {
+		n++
+		c.Assert(it.Next(), IsNil)
+	}
+	return n
+}
+
+func (s *testTxStructureSuite) TestReapExpiredBounded(c *C) {
+	defer testleak.AfterTest(c)()
+	prefix := []byte{0x00}
+	key := []byte("big")
+	var expireAt int64
+	err := kv.RunInNewTxn(s.store, false, func(txn kv.Transaction) error {
+		tx := NewStructure(txn, txn, prefix)
+		var members [][]byte
+		for i := 0; i < 25; i++ {
+			members = append(members, []byte(fmt.Sprintf("m%02d", i)))
+		}
+		_, err := tx.SAdd(key, members)
+		c.Assert(err, IsNil)
+		_, err = tx.SAdd([]byte("small"), members[:1])
+		c.Assert(err, IsNil)
+		expireAt = nowMs() + 50
+		_, err = tx.ExpireAt(key, expireAt)
+		c.Assert(err, IsNil)
+		_, err = tx.ExpireAt([]byte("small"), expireAt+1)
+		return err
+	})
+	c.Assert(err, IsNil)
+	time.Sleep(60 * time.Millisecond)
+
+	// 30 raw keys: the meta and 25 members of big, 2 of small and 2 index
+	// entries, 10 per round.
+	rounds := 0
+	for more := true; more; rounds++ {
+		err = kv.RunInNewTxn(s.store, false, func(txn kv.Transaction) error {
+			before := countKeys(c, txn, kv.Key(prefix)) + countKeys(c, txn, expireIndexPrefix)
+			var err error
+			_, more, err = ReapExpired(txn, nowMs(), 10)
+			c.Assert(err, IsNil)
+			after := countKeys(c, txn, kv.Key(prefix)) + countKeys(c, txn, expireIndexPrefix)
+			c.Assert(before-after <= 10, IsTrue)
+
+			// The key reads as missing while it is cleared.
+			tx := NewStructure(txn, txn, prefix)
+			n, err := tx.SCard(key)
+			c.Assert(err, IsNil)
+			c.Assert(n, Equals, int64(0))
+			return nil
+		})
+		c.Assert(err, IsNil)
+		c.Assert(rounds < 10, IsTrue)
+	}
+	c.Assert(rounds, Equals, 3)
+
+	snap, err := s.store.GetSnapshot(kv.MaxVersion)
+	c.Assert(err, IsNil)
+	c.Assert(countKeys(c, snap, kv.Key(prefix)), Equals, 0)
+	c.Assert(countKeys(c, snap, expireIndexPrefix), Equals, 0)
+	n, err := NewStructure(snap, nil, prefix).DBSize()
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, int64(0))
+}
+
+func (s *testTxStructureSuite) TestReaperLease(c *C) {
+	defer testleak.AfterTest(c)()
+	txn, err := s.store.Begin()
+	c.Assert(err, IsNil)
+	defer txn.Rollback()
+
+	held, err := HoldReaperLease(txn, []byte("a"), 1000, 100)
+	c.Assert(err, IsNil)
+	c.Assert(held, IsTrue)
+	held, err = HoldReaperLease(txn, []byte("b"), 1050, 100)
+	c.Assert(err, IsNil)
+	c.Assert(held, IsFalse)
+	// a renews it past half of the ttl, b takes it once it ran out.
+	held, err = HoldReaperLease(txn, []byte("a"), 1060, 100)
+	c.Assert(err, IsNil)
+	c.Assert(held, IsTrue)
+	held, err = HoldReaperLease(txn, []byte("b"), 1150, 100)
+	c.Assert(err, IsNil)
+	c.Assert(held, IsFalse)
+	held, err = HoldReaperLease(txn, []byte("b"), 1161, 100)
+	c.Assert(err, IsNil)
+	c.Assert(held, IsTrue)
+	held, err = HoldReaperLease(txn, []byte("a"), 1170, 100)
+	c.Assert(err, IsNil)
+	c.Assert(held, IsFalse)
+}
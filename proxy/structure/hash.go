@@ -15,8 +15,10 @@ package structure
 
 import (
 	"bytes"
+	"math"
 	"strconv"
 
+	"github.com/Mansfield6/tikv-proxy-demo/proxy/config"
 	"github.com/Mansfield6/tikv-proxy-demo/proxy/util"
 	"github.com/juju/errors"
 	"github.com/pingcap/tidb/kv"
@@ -57,9 +59,12 @@ func (t *TxStructure) HSet(key []byte, field []byte, value []byte) (int, error)
 }
 
 func (t *TxStructure) HMSet(key []byte, elements []*HashPair) ([]byte, error) {
+	if err := t.expireIfNeeded(key); err != nil {
+		return nil, errors.Trace(err)
+	}
 
 	ms := &util.MarkSet{}
-	if len(elements) > SeekThreshold {
+	if len(elements) > config.SeekThreshold.Get() {
 
 		omap := make(map[string][]byte)
 		err := t.iterateHash(key, func(field []byte, value []byte) error {
@@ -119,6 +124,9 @@ func (t *TxStructure) HMSet(key []byte, elements []*HashPair) ([]byte, error) {
 
 // HGet gets the value of a hash field.
 func (t *TxStructure) HGet(key []byte, field []byte) ([]byte, error) {
+	if mv, err := t.loadMeta(key); err != nil || mv == nil {
+		return nil, errors.Trace(err)
+	}
 	dataKey := t.encodeHashDataKey(key, field)
 	value, err := t.reader.Get(dataKey)
 	if terror.ErrorEqual(err, kv.ErrNotExist) {
@@ -139,9 +147,12 @@ func (t *TxStructure) HInc(key []byte, field []byte, step int64) (int64, error)
 			var err error
 			base, err = strconv.ParseInt(string(oldValue), 10, 64)
 			if err != nil {
-				return nil, errors.Trace(err)
+				return nil, errors.Trace(ErrHashNotInteger)
 			}
 		}
+		if (step > 0 && base > math.MaxInt64-step) || (step < 0 && base < math.MinInt64-step) {
+			return nil, errors.Trace(ErrOverflow)
+		}
 		base += step
 		return []byte(strconv.FormatInt(base, 10)), nil
 	})
@@ -162,6 +173,9 @@ func (t *TxStructure) HGetInt64(key []byte, field []byte) (int64, error) {
 }
 
 func (t *TxStructure) updateHash(key []byte, field []byte, fn func(oldValue []byte) ([]byte, error)) (int, error) {
+	if err := t.expireIfNeeded(key); err != nil {
+		return 0, errors.Trace(err)
+	}
 	dataKey := t.encodeHashDataKey(key, field)
 	oldValue, err := t.loadHashValue(dataKey)
 	res := 0
@@ -203,6 +217,9 @@ func (t *TxStructure) updateHash(key []byte, field []byte, fn func(oldValue []by
 
 // HLen gets the number of fields in a hash.
 func (t *TxStructure) HLen(key []byte) (int, error) {
+	if mv, err := t.loadMeta(key); err != nil || mv == nil {
+		return 0, errors.Trace(err)
+	}
 	metaKey := t.EncodeMetaKey(key)
 	meta, err := t.loadHashMeta(metaKey)
 	if err != nil {
@@ -216,6 +233,9 @@ func (t *TxStructure) HDel(key []byte, fields [][]byte) (int, error) {
 	if t.readWriter == nil {
 		return 0, errWriteOnSnapshot
 	}
+	if err := t.expireIfNeeded(key); err != nil {
+		return 0, errors.Trace(err)
+	}
 	metaKey := t.EncodeMetaKey(key)
 	meta, err := t.loadHashMeta(metaKey)
 	if err != nil || meta.IsEmpty() {
@@ -243,6 +263,9 @@ func (t *TxStructure) HDel(key []byte, fields [][]byte) (int, error) {
 	}
 
 	if meta.IsEmpty() {
+		if err = t.clearExpire(key); err != nil {
+			return 0, errors.Trace(err)
+		}
 		err = t.readWriter.Delete(metaKey)
 	} else {
 		err = t.readWriter.Set(metaKey, meta.Value())
@@ -253,6 +276,9 @@ func (t *TxStructure) HDel(key []byte, fields [][]byte) (int, error) {
 
 // HKeys gets all the fields in a hash.
 func (t *TxStructure) HKeys(key []byte) ([][]byte, error) {
+	if mv, err := t.loadMeta(key); err != nil || mv == nil {
+		return nil, errors.Trace(err)
+	}
 	var keys [][]byte
 	err := t.iterateHash(key, func(field []byte, value []byte) error {
 		keys = append(keys, append([]byte{}, field...))
@@ -264,6 +290,9 @@ func (t *TxStructure) HKeys(key []byte) ([][]byte, error) {
 
 // HGetAll gets all the fields and values in a hash.
 func (t *TxStructure) HGetAll(key []byte) ([][]byte, error) {
+	if mv, err := t.loadMeta(key); err != nil || mv == nil {
+		return nil, errors.Trace(err)
+	}
 	var res []HashPair
 	err := t.iterateHash(key, func(field []byte, value []byte) error {
 		pair := HashPair{
@@ -299,6 +328,9 @@ func (t *TxStructure) HClear(key []byte) error {
 		return errors.Trace(err)
 	}
 
+	if err = t.clearExpire(key); err != nil {
+		return errors.Trace(err)
+	}
 	return errors.Trace(t.readWriter.Delete(metaKey))
 }
 
@@ -0,0 +1,310 @@
+package structure
+
+import (
+	"encoding/binary"
+	"math"
+
+	"github.com/juju/errors"
+	"github.com/pingcap/tidb/kv"
+	"github.com/pingcap/tidb/terror"
+)
+
+func init() {
+	registerType(HLLData, &keyType{
+		clear: (*TxStructure).PFClear,
+		copy:  (*TxStructure).copyKeyData,
+	})
+}
+
+// The estimator follows the one of redis: 2^hllP registers of hllBits bits
+// each, indexed by the low hllP bits of a 64 bit murmur hash.
+const (
+	hllP         = 14
+	hllQ         = 64 - hllP
+	hllRegisters = 1 << hllP
+	hllBits      = 6
+	hllMax       = 1<<hllBits - 1
+	// hllDenseSize is the size of the dense register encoding in bytes.
+	hllDenseSize = (hllRegisters*hllBits + 7) / 8
+	hllAlphaInf  = 0.721347520444481703680
+)
+
+// hllRegs is the dense encoding of hyperloglog registers, packed hllBits
+// bits per register, least significant bit first.
+type hllRegs []byte
+
+func newHLLRegs() hllRegs {
+	return make(hllRegs, hllDenseSize)
+}
+
+func (r hllRegs) get(i int) uint8 {
+	b := i * hllBits / 8
+	fb := uint(i * hllBits & 7)
+	v := uint(r[b]) >> fb
+	if b+1 < len(r) {
+		v |= uint(r[b+1]) << (8 - fb)
+	}
+	return uint8(v & hllMax)
+}
+
+func (r hllRegs) set(i int, v uint8) {
+	b := i * hllBits / 8
+	fb := uint(i * hllBits & 7)
+	r[b] &^= byte(hllMax << fb)
+	r[b] |= byte(uint(v) << fb)
+	if b+1 < len(r) {
+		r[b+1] &^= byte(hllMax >> (8 - fb))
+		r[b+1] |= byte(uint(v) >> (8 - fb))
+	}
+}
+
+// add sets the register of element, it returns true if the register changed.
+func (r hllRegs) add(element []byte) bool {
+	hash := murmurHash64A(element, 0xadc83b19)
+	index := int(hash & (hllRegisters - 1))
+	hash >>= hllP
+	hash |= 1 << hllQ
+
+	count := uint8(1)
+	for bit := uint64(1); hash&bit == 0; bit <<= 1 {
+		count++
+	}
+
+	if r.get(index) >= count {
+		return false
+	}
+	r.set(index, count)
+	return true
+}
+
+// merge sets every register of r to the max of itself and the one of o.
+func (r hllRegs) merge(o hllRegs) {
+	for i := 0; i < hllRegisters; i++ {
+		if v := o.get(i); v > r.get(i) {
+			r.set(i, v)
+		}
+	}
+}
+
+func (r hllRegs) count() int64 {
+	var histo [hllQ + 2]int
+	for i := 0; i < hllRegisters; i++ {
+		histo[r.get(i)]++
+	}
+
+	m := float64(hllRegisters)
+	z := m * hllTau((m-float64(histo[hllQ+1]))/m)
+	for j := hllQ; j >= 1; j-- {
+		z += float64(histo[j])
+		z *= 0.5
+	}
+	z += m * hllSigma(float64(histo[0])/m)
+	return int64(math.Floor(hllAlphaInf*m*m/z + 0.5))
+}
+
+func hllSigma(x float64) float64 {
+	if x == 1 {
+		return math.Inf(1)
+	}
+	y, z := 1.0, x
+	for {
+		x *= x
+		zPrime := z
+		z += x * y
+		y += y
+		if zPrime == z {
+			return z
+		}
+	}
+}
+
+func hllTau(x float64) float64 {
+	if x == 0 || x == 1 {
+		return 0
+	}
+	y, z := 1.0, 1-x
+	for {
+		x = math.Sqrt(x)
+		zPrime := z
+		y *= 0.5
+		z -= math.Pow(1-x, 2) * y
+		if zPrime == z {
+			return z / 3
+		}
+	}
+}
+
+// murmurHash64A is the 64 bit murmur hash redis uses for hyperloglogs.
+func murmurHash64A(data []byte, seed uint64) uint64 {
+	const m = 0xc6a4a7935bd1e995
+	const r = 47
+
+	h := seed ^ uint64(len(data))*m
+	n := len(data) / 8 * 8
+	for i := 0; i < n; i += 8 {
+		k := binary.LittleEndian.Uint64(data[i:])
+		k *= m
+		k ^= k >> r
+		k *= m
+		h ^= k
+		h *= m
+	}
+
+	tail := data[n:]
+	switch len(tail) {
+	case 7:
+		h ^= uint64(tail[6]) << 48
+		fallthrough
+	case 6:
+		h ^= uint64(tail[5]) << 40
+		fallthrough
+	case 5:
+		h ^= uint64(tail[4]) << 32
+		fallthrough
+	case 4:
+		h ^= uint64(tail[3]) << 24
+		fallthrough
+	case 3:
+		h ^= uint64(tail[2]) << 16
+		fallthrough
+	case 2:
+		h ^= uint64(tail[1]) << 8
+		fallthrough
+	case 1:
+		h ^= uint64(tail[0])
+		h *= m
+	}
+
+	h ^= h >> r
+	h *= m
+	h ^= h >> r
+	return h
+}
+
+// PFAdd adds elements to a hyperloglog, it returns 1 if the estimate may
+// have changed, which includes creating the key, and 0 otherwise.
+func (t *TxStructure) PFAdd(key []byte, elements [][]byte) (int, error) {
+	if t.readWriter == nil {
+		return 0, errWriteOnSnapshot
+	}
+	if err := t.expireIfNeeded(key); err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	mv, regs, err := t.loadHLL(key)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	changed := mv == nil
+	for _, e := range elements {
+		if regs.add(e) {
+			changed = true
+		}
+	}
+	if !changed {
+		return 0, nil
+	}
+	return 1, errors.Trace(t.saveHLL(key, mv, regs))
+}
+
+// PFCount estimates the number of distinct elements in the union of the
+// hyperloglogs of keys, missing keys count as empty.
+func (t *TxStructure) PFCount(keys [][]byte) (int64, error) {
+	regs, err := t.mergeHLLs(keys)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	return regs.count(), nil
+}
+
+// PFMerge merges the hyperloglogs of keys into the one of dest, creating it
+// if needed. The ttl of dest is kept.
+func (t *TxStructure) PFMerge(dest []byte, keys [][]byte) error {
+	if t.readWriter == nil {
+		return errWriteOnSnapshot
+	}
+	if err := t.expireIfNeeded(dest); err != nil {
+		return errors.Trace(err)
+	}
+
+	mv, regs, err := t.loadHLL(dest)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	merged, err := t.mergeHLLs(keys)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	regs.merge(merged)
+	return errors.Trace(t.saveHLL(dest, mv, regs))
+}
+
+// PFClear removes the hyperloglog of the key.
+func (t *TxStructure) PFClear(key []byte) error {
+	if t.readWriter == nil {
+		return errWriteOnSnapshot
+	}
+	if err := t.clearExpire(key); err != nil {
+		return errors.Trace(err)
+	}
+	if err := t.readWriter.Delete(t.encodeHLLDataKey(key)); err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(t.readWriter.Delete(t.EncodeMetaKey(key)))
+}
+
+func (t *TxStructure) mergeHLLs(keys [][]byte) (hllRegs, error) {
+	merged := newHLLRegs()
+	for _, key := range keys {
+		mv, regs, err := t.loadHLL(key)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		if mv == nil {
+			continue
+		}
+		if len(keys) == 1 {
+			return regs, nil
+		}
+		merged.merge(regs)
+	}
+	return merged, nil
+}
+
+// loadHLL gets the meta value and the registers of a hyperloglog, the meta
+// value is nil and the registers are empty if the key does not exist.
+func (t *TxStructure) loadHLL(key []byte) ([]byte, hllRegs, error) {
+	mv, err := t.loadMeta(key)
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+	if mv == nil {
+		return nil, newHLLRegs(), nil
+	}
+	if flag, _, _ := DecodeMetaValue(mv); flag != HLLData {
+		return nil, nil, errors.Trace(ErrSetType)
+	}
+
+	v, err := t.reader.Get(t.encodeHLLDataKey(key))
+	if terror.ErrorEqual(err, kv.ErrNotExist) {
+		err = nil
+	}
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+	if len(v) != hllDenseSize {
+		return nil, nil, errors.Trace(errInvalidHLLData)
+	}
+	return mv, hllRegs(append([]byte{}, v...)), nil
+}
+
+func (t *TxStructure) saveHLL(key []byte, mv []byte, regs hllRegs) error {
+	if mv == nil {
+		mv = EncodeHLLMetaValue(0)
+		if err := t.readWriter.Set(t.EncodeMetaKey(key), mv); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return errors.Trace(t.readWriter.Set(t.encodeHLLDataKey(key), regs))
+}
@@ -0,0 +1,99 @@
+package structure
+
+import (
+	"fmt"
+
+	. "github.com/pingcap/check"
+	"github.com/pingcap/tidb/terror"
+	"github.com/pingcap/tidb/util/testleak"
+)
+
+// elements gets n distinct elements starting with prefix.
+func elements(prefix string, n int) [][]byte {
+	res := make([][]byte, n)
+	for i := range res {
+		res[i] = []byte(fmt.Sprintf("%s%d", prefix, i))
+	}
+	return res
+}
+
+// assertEstimate checks that an estimate is within 3% of n.
+func assertEstimate(c *C, got int64, n int) {
+	diff := got - int64(n)
+	if diff < 0 {
+		diff = -diff
+	}
+	c.Assert(diff*100 <= int64(n)*3, IsTrue, Commentf("estimate %d of %d", got, n))
+}
+
+func (s *testTxStructureSuite) TestHyperLogLog(c *C) {
+	defer testleak.AfterTest(c)()
+	txn, err := s.store.Begin()
+	c.Assert(err, IsNil)
+	defer txn.Rollback()
+
+	tx := NewStructure(txn, txn, []byte{0x00})
+	// Creating the key counts as a change, even without elements.
+	changed, err := tx.PFAdd([]byte("e"), nil)
+	c.Assert(err, IsNil)
+	c.Assert(changed, Equals, 1)
+	changed, err = tx.PFAdd([]byte("e"), nil)
+	c.Assert(err, IsNil)
+	c.Assert(changed, Equals, 0)
+	n, err := tx.PFCount(bytesOf("e", "missing"))
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, int64(0))
+
+	changed, err = tx.PFAdd([]byte("a"), bytesOf("x", "y", "z"))
+	c.Assert(err, IsNil)
+	c.Assert(changed, Equals, 1)
+	changed, err = tx.PFAdd([]byte("a"), bytesOf("x", "y"))
+	c.Assert(err, IsNil)
+	c.Assert(changed, Equals, 0)
+	n, err = tx.PFCount(bytesOf("a"))
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, int64(3))
+
+	_, err = tx.PFAdd([]byte("b"), elements("m", 5000))
+	c.Assert(err, IsNil)
+	_, err = tx.PFAdd([]byte("c"), elements("m", 10000)[2500:])
+	c.Assert(err, IsNil)
+	n, err = tx.PFCount(bytesOf("b"))
+	c.Assert(err, IsNil)
+	assertEstimate(c, n, 5000)
+	// Counting several keys counts their union.
+	n, err = tx.PFCount(bytesOf("b", "c"))
+	c.Assert(err, IsNil)
+	assertEstimate(c, n, 10000)
+
+	// PFMERGE keeps what dest had.
+	c.Assert(tx.PFMerge([]byte("a"), bytesOf("b", "c")), IsNil)
+	n, err = tx.PFCount(bytesOf("a"))
+	c.Assert(err, IsNil)
+	assertEstimate(c, n, 10003)
+	c.Assert(tx.PFMerge([]byte("d"), nil), IsNil)
+	typ, err := tx.Type([]byte("d"))
+	c.Assert(err, IsNil)
+	c.Assert(typ, Equals, "hyperloglog")
+	// The string commands do not read the registers.
+	_, err = tx.Get([]byte("d"))
+	c.Assert(terror.ErrorEqual(err, ErrSetType), IsTrue)
+	_, err = tx.StrLen([]byte("d"))
+	c.Assert(terror.ErrorEqual(err, ErrSetType), IsTrue)
+
+	// A hyperloglog is a string to the generic commands.
+	ok, err := tx.Copy([]byte("a"), []byte("a2"), false)
+	c.Assert(err, IsNil)
+	c.Assert(ok, IsTrue)
+	n, err = tx.PFCount(bytesOf("a2"))
+	c.Assert(err, IsNil)
+	assertEstimate(c, n, 10003)
+
+	_, err = tx.Set([]byte("s"), []byte("v"))
+	c.Assert(err, IsNil)
+	_, err = tx.PFAdd([]byte("s"), bytesOf("x"))
+	c.Assert(IsWrongType(err), IsTrue)
+	_, err = tx.PFCount(bytesOf("a", "s"))
+	c.Assert(IsWrongType(err), IsTrue)
+	c.Assert(IsWrongType(tx.PFMerge([]byte("s"), bytesOf("a"))), IsTrue)
+}
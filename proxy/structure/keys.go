@@ -1,8 +1,12 @@
 package structure
 
 import (
+	"bytes"
+
+	"github.com/Mansfield6/tikv-proxy-demo/proxy/config"
 	"github.com/Mansfield6/tikv-proxy-demo/proxy/util"
 	"github.com/juju/errors"
+	"github.com/pingcap/tidb/kv"
 )
 
 var (
@@ -18,28 +22,17 @@ func (t *TxStructure) DEL(keys [][]byte) (int, error) {
 	var intererr error
 	for _, key := range keys {
 		if !ms.Has(key) {
+			if err := t.expireIfNeeded(key); err != nil {
+				return 0, errors.Trace(err)
+			}
 			mk := t.EncodeMetaKey(key)
 			mv, _ := t.reader.Get(mk)
 			if mv != nil {
 				flag, _, _ := DecodeMetaValue(mv)
-				switch flag {
-				case StringData:
-					err := t.Clear(key)
-					if err != nil {
-						return 0, err
-					}
-					ms.Set(key)
-				case HashData:
-					//err := t.HClear(key)
-					err := t.MergedHClear(key)
-					if err != nil {
-						return 0, err
-					}
-					ms.Set(key)
-				default:
-					return 0, InvalidFlag
+				if err := t.clearKey(key, flag); err != nil {
+					return 0, err
 				}
-
+				ms.Set(key)
 			}
 
 		}
@@ -48,3 +41,285 @@ func (t *TxStructure) DEL(keys [][]byte) (int, error) {
 	return int(ms.Len()), intererr
 
 }
+
+// keyType tells the generic key commands how to handle one type of value.
+type keyType struct {
+	// clear removes the meta and all the data keys of key.
+	clear func(t *TxStructure, key []byte) error
+	// copy copies the meta and all the data keys of src to dst in the
+	// database of dt, dst must not exist.
+	copy func(t *TxStructure, src []byte, dt *TxStructure, dst []byte) error
+}
+
+var keyTypes = make(map[TypeFlag]*keyType)
+
+// registerType makes a type known to DEL, RENAME, COPY and the expire
+// reaper, every type registers itself in the init of its file.
+func registerType(flag TypeFlag, kt *keyType) {
+	if _, ok := keyTypes[flag]; ok {
+		panic("structure: type registered twice: " + string(flag))
+	}
+	keyTypes[flag] = kt
+}
+
+// clearKey removes the meta and all data of key according to its type flag.
+func (t *TxStructure) clearKey(key []byte, flag TypeFlag) error {
+	kt, ok := keyTypes[flag]
+	if !ok {
+		return InvalidFlag
+	}
+	return kt.clear(t, key)
+}
+
+// Type gets the type name of key, "none" if it does not exist.
+func (t *TxStructure) Type(key []byte) (string, error) {
+	mv, err := t.loadMeta(key)
+	if err != nil || mv == nil {
+		return "none", errors.Trace(err)
+	}
+	flag, _, _ := DecodeMetaValue(mv)
+	return TypeName(flag), nil
+}
+
+// Exists counts the keys that exist, a key given twice counts twice.
+func (t *TxStructure) Exists(keys [][]byte) (int, error) {
+	n := 0
+	for _, key := range keys {
+		mv, err := t.loadMeta(key)
+		if err != nil {
+			return 0, errors.Trace(err)
+		}
+		if mv != nil {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// Rename moves the value of src to dst together with its ttl. With nx it
+// does nothing if dst exists and returns false. It fails with ErrNoSuchKey if
+// src does not exist.
+func (t *TxStructure) Rename(src []byte, dst []byte, nx bool) (bool, error) {
+	if t.readWriter == nil {
+		return false, errWriteOnSnapshot
+	}
+	if err := t.expireIfNeeded(src); err != nil {
+		return false, errors.Trace(err)
+	}
+	mv, err := t.loadMeta(src)
+	if err != nil {
+		return false, errors.Trace(err)
+	}
+	if mv == nil {
+		return false, errors.Trace(ErrNoSuchKey)
+	}
+	if bytes.Equal(src, dst) {
+		return !nx, nil
+	}
+
+	ok, err := t.Copy(src, dst, !nx)
+	if err != nil || !ok {
+		return false, errors.Trace(err)
+	}
+	flag, _, _ := DecodeMetaValue(mv)
+	return true, errors.Trace(t.clearKey(src, flag))
+}
+
+// Copy copies the value of src to dst together with its ttl. It returns
+// false if src does not exist, or if dst exists and replace is false.
+func (t *TxStructure) Copy(src []byte, dst []byte, replace bool) (bool, error) {
+	return t.CopyTo(src, t, dst, replace)
+}
+
+// CopyTo is Copy with dst in the database of dt, which must be on the same
+// transaction as t.
+func (t *TxStructure) CopyTo(src []byte, dt *TxStructure, dst []byte, replace bool) (bool, error) {
+	if t.readWriter == nil || dt.readWriter == nil {
+		return false, errWriteOnSnapshot
+	}
+	if bytes.Equal(t.prefix, dt.prefix) && bytes.Equal(src, dst) {
+		return false, errors.Trace(ErrSameObject)
+	}
+	mv, err := t.loadMeta(src)
+	if err != nil || mv == nil {
+		return false, errors.Trace(err)
+	}
+
+	if err = dt.expireIfNeeded(dst); err != nil {
+		return false, errors.Trace(err)
+	}
+	dmv, err := dt.loadMeta(dst)
+	if err != nil {
+		return false, errors.Trace(err)
+	}
+	if dmv != nil {
+		if !replace {
+			return false, nil
+		}
+		flag, _, _ := DecodeMetaValue(dmv)
+		if err = dt.clearKey(dst, flag); err != nil {
+			return false, errors.Trace(err)
+		}
+	}
+
+	flag, _, _ := DecodeMetaValue(mv)
+	kt, ok := keyTypes[flag]
+	if !ok {
+		return false, InvalidFlag
+	}
+	return true, errors.Trace(kt.copy(t, src, dt, dst))
+}
+
+// Move moves key to the database of dt, it returns false if key does not
+// exist or if it already exists in dt.
+func (t *TxStructure) Move(key []byte, dt *TxStructure) (bool, error) {
+	if bytes.Equal(t.prefix, dt.prefix) {
+		return false, errors.Trace(ErrSameObject)
+	}
+	if err := t.expireIfNeeded(key); err != nil {
+		return false, errors.Trace(err)
+	}
+	mv, err := t.loadMeta(key)
+	if err != nil || mv == nil {
+		return false, errors.Trace(err)
+	}
+	ok, err := t.CopyTo(key, dt, key, false)
+	if err != nil || !ok {
+		return false, errors.Trace(err)
+	}
+	flag, _, _ := DecodeMetaValue(mv)
+	return true, errors.Trace(t.clearKey(key, flag))
+}
+
+// copyKeyData copies the meta and the data keys of src to dst in the
+// database of dt as they are, which works for every type whose data keys
+// only embed the user key in the common key prefix. The expire index of dst
+// is set up as well.
+func (t *TxStructure) copyKeyData(src []byte, dt *TxStructure, dst []byte) error {
+	prefix := t.keyPrefix(src)
+	it, err := t.reader.Seek(prefix)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	var suffixes, values [][]byte
+	for it.Valid() && it.Key().HasPrefix(prefix) {
+		suffixes = append(suffixes, append([]byte{}, it.Key()[len(prefix):]...))
+		values = append(values, append([]byte{}, it.Value()...))
+		if err = it.Next(); err != nil {
+			it.Close()
+			return errors.Trace(err)
+		}
+	}
+	it.Close()
+
+	dstPrefix := dt.keyPrefix(dst)
+	for i, suffix := range suffixes {
+		ek := append(append([]byte{}, dstPrefix...), suffix...)
+		if err = dt.readWriter.Set(ek, values[i]); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	mv, err := dt.reader.Get(dt.EncodeMetaKey(dst))
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if _, expireAt, _ := DecodeMetaValue(mv); expireAt > 0 {
+		return errors.Trace(dt.readWriter.Set(dt.encodeExpireIndexKey(dst, expireAt), mv[0:1]))
+	}
+	return nil
+}
+
+// KeyVersion gets the meta value of key with its stamp, which changes
+// whenever the key is written. The version of a missing key is nil. A
+// transaction that locks the meta key fails to commit if the key is written
+// meanwhile.
+func (t *TxStructure) KeyVersion(key []byte) ([]byte, error) {
+	if mv, err := t.loadMeta(key); err != nil || mv == nil {
+		return nil, errors.Trace(err)
+	}
+	r := t.reader
+	if mr, ok := r.(*metaReader); ok {
+		r = mr.Retriever
+	}
+	v, err := r.Get(t.EncodeMetaKey(key))
+	return v, errors.Trace(err)
+}
+
+// Scan walks the keys in order from the one after cursor on, a nil cursor
+// starts from the first key. At most count keys are visited, the ones that
+// pass match are returned with the last key visited, which is nil once the
+// whole keyspace was walked. Expired keys are skipped.
+func (t *TxStructure) Scan(cursor []byte, count int, match func(key []byte, flag TypeFlag) bool) ([][]byte, []byte, error) {
+	seekKey := kv.Key(t.prefix)
+	if cursor != nil {
+		seekKey = t.keyPrefix(cursor).PrefixNext()
+	}
+	it, err := t.reader.Seek(seekKey)
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+	defer func() {
+		it.Close()
+	}()
+
+	var keys [][]byte
+	var last []byte
+	for visited := 0; visited < count; {
+		if !it.Valid() || !it.Key().HasPrefix(t.prefix) {
+			return keys, nil, nil
+		}
+
+		key, code, err := t.decodeKey(it.Key())
+		if err != nil {
+			return nil, nil, errors.Trace(err)
+		}
+		if code == MetaCode {
+			visited++
+			last = key
+			flag, expireAt, _ := DecodeMetaValue(it.Value())
+			if !isExpired(expireAt) && match(key, flag) {
+				keys = append(keys, key)
+			}
+		}
+
+		// Step over the data keys of key, seek past them if there are many.
+		prefix := t.keyPrefix(key)
+		steps := 0
+		for it.Valid() && it.Key().HasPrefix(prefix) && steps < config.SeekThreshold.Get() {
+			if err = it.Next(); err != nil {
+				return nil, nil, errors.Trace(err)
+			}
+			steps++
+		}
+		if it.Valid() && it.Key().HasPrefix(prefix) {
+			it.Close()
+			if it, err = t.reader.Seek(prefix.PrefixNext()); err != nil {
+				return nil, nil, errors.Trace(err)
+			}
+		}
+	}
+
+	if !it.Valid() || !it.Key().HasPrefix(t.prefix) {
+		last = nil
+	}
+	return keys, last, nil
+}
+
+// Keys gets all the keys that pass match.
+func (t *TxStructure) Keys(match func(key []byte, flag TypeFlag) bool) ([][]byte, error) {
+	var keys [][]byte
+	var cursor []byte
+	for {
+		res, next, err := t.Scan(cursor, ScanBatch, match)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		keys = append(keys, res...)
+		if next == nil {
+			return keys, nil
+		}
+		cursor = next
+	}
+}
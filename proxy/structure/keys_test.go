@@ -0,0 +1,159 @@
+package structure
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/juju/errors"
+	. "github.com/pingcap/check"
+	"github.com/pingcap/tidb/util/testleak"
+)
+
+func (s *testTxStructureSuite) TestScan(c *C) {
+	defer testleak.AfterTest(c)()
+	txn, err := s.store.Begin()
+	c.Assert(err, IsNil)
+	defer txn.Rollback()
+
+	tx := NewStructure(txn, txn, []byte{0x00})
+	var want []string
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("k%02d", i)
+		_, err = tx.Set([]byte(key), []byte("v"))
+		c.Assert(err, IsNil)
+		want = append(want, key)
+	}
+	// A hash with more fields than the seek threshold is skipped by a seek.
+	for i := 0; i < 50; i++ {
+		_, err = tx.HSet([]byte("h"), []byte(fmt.Sprintf("f%d", i)), []byte("v"))
+		c.Assert(err, IsNil)
+	}
+	c.Assert(tx.RPush([]byte("l"), bytesOf("a", "b", "c")...), IsNil)
+	_, err = tx.SAdd([]byte("s"), bytesOf("a", "b"))
+	c.Assert(err, IsNil)
+	want = append(want, "h", "l", "s")
+	sort.Strings(want)
+	// Keys of another database are not walked.
+	_, err = NewStructure(txn, txn, []byte{0x01}).Set([]byte("other"), []byte("v"))
+	c.Assert(err, IsNil)
+
+	all := func(key []byte, flag TypeFlag) bool { return true }
+	var got []string
+	var cursor []byte
+	for rounds := 0; ; rounds++ {
+		c.Assert(rounds < len(want), IsTrue)
+		keys, next, err := tx.Scan(cursor, 3, all)
+		c.Assert(err, IsNil)
+		c.Assert(len(keys) <= 3, IsTrue)
+		got = append(got, byteStrings(keys, false)...)
+		if next == nil {
+			break
+		}
+		cursor = next
+	}
+	c.Assert(got, DeepEquals, want)
+
+	// The walk goes on from a cursor whose key was deleted meanwhile.
+	keys, next, err := tx.Scan(nil, 2, all)
+	c.Assert(err, IsNil)
+	c.Assert(byteStrings(keys, false), DeepEquals, []string{"h", "k00"})
+	_, err = tx.DEL([][]byte{next})
+	c.Assert(err, IsNil)
+	keys, _, err = tx.Scan(next, 2, all)
+	c.Assert(err, IsNil)
+	c.Assert(byteStrings(keys, false), DeepEquals, []string{"k01", "k02"})
+
+	// Keys that do not match still count against count.
+	lists := func(key []byte, flag TypeFlag) bool { return flag == ListData }
+	keys, next, err = tx.Scan(nil, 5, lists)
+	c.Assert(err, IsNil)
+	c.Assert(keys, HasLen, 0)
+	c.Assert(string(next), Equals, "k04")
+	keys, err = tx.Keys(lists)
+	c.Assert(err, IsNil)
+	c.Assert(byteStrings(keys, false), DeepEquals, []string{"l"})
+}
+
+func (s *testTxStructureSuite) TestRenameCopy(c *C) {
+	defer testleak.AfterTest(c)()
+	txn, err := s.store.Begin()
+	c.Assert(err, IsNil)
+	defer txn.Rollback()
+
+	tx := NewStructure(txn, txn, []byte{0x00})
+	_, err = tx.HSet([]byte("h"), []byte("f"), []byte("1"))
+	c.Assert(err, IsNil)
+	_, err = tx.HSet([]byte("h"), []byte("g"), []byte("2"))
+	c.Assert(err, IsNil)
+	_, err = tx.ExpireAt([]byte("h"), nowMs()+100000)
+	c.Assert(err, IsNil)
+	_, err = tx.MergedHSet([]byte("m"), []byte("f"), []byte("1"))
+	c.Assert(err, IsNil)
+	_, err = tx.Set([]byte("s"), []byte("v"))
+	c.Assert(err, IsNil)
+
+	// RENAME carries the data and the ttl.
+	ok, err := tx.Rename([]byte("h"), []byte("h2"), false)
+	c.Assert(err, IsNil)
+	c.Assert(ok, IsTrue)
+	n, err := tx.Exists(bytesOf("h", "h2", "h2"))
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 2)
+	v, err := tx.HGet([]byte("h2"), []byte("g"))
+	c.Assert(err, IsNil)
+	c.Assert(string(v), Equals, "2")
+	ttl, err := tx.PTTL([]byte("h2"))
+	c.Assert(err, IsNil)
+	c.Assert(ttl > 0, IsTrue)
+
+	// RENAMENX leaves an existing destination alone, RENAME replaces it.
+	ok, err = tx.Rename([]byte("m"), []byte("s"), true)
+	c.Assert(err, IsNil)
+	c.Assert(ok, IsFalse)
+	ok, err = tx.Rename([]byte("m"), []byte("s"), false)
+	c.Assert(err, IsNil)
+	c.Assert(ok, IsTrue)
+	v, err = tx.MergedHGet([]byte("s"), []byte("f"))
+	c.Assert(err, IsNil)
+	c.Assert(string(v), Equals, "1")
+	typ, err := tx.Type([]byte("m"))
+	c.Assert(err, IsNil)
+	c.Assert(typ, Equals, "none")
+
+	ok, err = tx.Rename([]byte("s"), []byte("s"), false)
+	c.Assert(err, IsNil)
+	c.Assert(ok, IsTrue)
+	ok, err = tx.Rename([]byte("s"), []byte("s"), true)
+	c.Assert(err, IsNil)
+	c.Assert(ok, IsFalse)
+	_, err = tx.Rename([]byte("missing"), []byte("x"), false)
+	c.Assert(errors.Cause(err), Equals, ErrNoSuchKey)
+
+	// COPY leaves the source and only replaces when asked to.
+	ok, err = tx.Copy([]byte("h2"), []byte("s"), false)
+	c.Assert(err, IsNil)
+	c.Assert(ok, IsFalse)
+	ok, err = tx.Copy([]byte("h2"), []byte("s"), true)
+	c.Assert(err, IsNil)
+	c.Assert(ok, IsTrue)
+	for _, key := range []string{"h2", "s"} {
+		n, err := tx.HLen([]byte(key))
+		c.Assert(err, IsNil)
+		c.Assert(n, Equals, 2)
+	}
+	ok, err = tx.Copy([]byte("missing"), []byte("x"), true)
+	c.Assert(err, IsNil)
+	c.Assert(ok, IsFalse)
+	_, err = tx.Copy([]byte("s"), []byte("s"), true)
+	c.Assert(errors.Cause(err), Equals, ErrSameObject)
+
+	// The copy is a key of its own.
+	_, err = tx.HDel([]byte("s"), bytesOf("f"))
+	c.Assert(err, IsNil)
+	n, err = tx.HLen([]byte("h2"))
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 2)
+	size, err := tx.DBSize()
+	c.Assert(err, IsNil)
+	c.Assert(size, Equals, int64(2))
+}
@@ -21,16 +21,21 @@ import (
 	"github.com/pingcap/tidb/terror"
 )
 
+func init() {
+	registerType(ListData, &keyType{
+		clear: (*TxStructure).LClear,
+		copy:  (*TxStructure).copyKeyData,
+	})
+}
+
 type listMeta struct {
-	LIndex int64
-	RIndex int64
+	ExpireAt int64
+	LIndex   int64
+	RIndex   int64
 }
 
 func (meta listMeta) Value() []byte {
-	buf := make([]byte, 16)
-	binary.BigEndian.PutUint64(buf[0:8], uint64(meta.LIndex))
-	binary.BigEndian.PutUint64(buf[8:16], uint64(meta.RIndex))
-	return buf
+	return EncodeListMetaValue(meta.ExpireAt, meta.LIndex, meta.RIndex)
 }
 
 func (meta listMeta) IsEmpty() bool {
@@ -54,8 +59,11 @@ func (t *TxStructure) listPush(key []byte, left bool, values ...[]byte) error {
 	if len(values) == 0 {
 		return nil
 	}
+	if err := t.expireIfNeeded(key); err != nil {
+		return errors.Trace(err)
+	}
 
-	metaKey := t.encodeListMetaKey(key)
+	metaKey := t.EncodeMetaKey(key)
 	meta, err := t.loadListMeta(metaKey)
 	if err != nil {
 		return errors.Trace(err)
@@ -72,7 +80,7 @@ func (t *TxStructure) listPush(key []byte, left bool, values ...[]byte) error {
 		}
 
 		dataKey := t.encodeListDataKey(key, index)
-		if err = t.readWriter.Set(dataKey, v); err != nil {
+		if err = t.readWriter.Set(dataKey, encodeListValue(v)); err != nil {
 			return errors.Trace(err)
 		}
 	}
@@ -94,7 +102,10 @@ func (t *TxStructure) listPop(key []byte, left bool) ([]byte, error) {
 	if t.readWriter == nil {
 		return nil, errWriteOnSnapshot
 	}
-	metaKey := t.encodeListMetaKey(key)
+	if err := t.expireIfNeeded(key); err != nil {
+		return nil, errors.Trace(err)
+	}
+	metaKey := t.EncodeMetaKey(key)
 	meta, err := t.loadListMeta(metaKey)
 	if err != nil || meta.IsEmpty() {
 		return nil, errors.Trace(err)
@@ -121,25 +132,46 @@ func (t *TxStructure) listPop(key []byte, left bool) ([]byte, error) {
 		return nil, errors.Trace(err)
 	}
 
-	if !meta.IsEmpty() {
-		err = t.readWriter.Set(metaKey, meta.Value())
-	} else {
-		err = t.readWriter.Delete(metaKey)
+	return decodeListValue(data), errors.Trace(t.listUpdateMeta(key, meta))
+}
+
+// LMove pops an element from one end of src and pushes it to one end of dst,
+// it returns nil if src is empty. The element is not popped if dst holds
+// another type.
+func (t *TxStructure) LMove(src []byte, dst []byte, srcLeft bool, dstLeft bool) ([]byte, error) {
+	if t.readWriter == nil {
+		return nil, errWriteOnSnapshot
+	}
+	if err := t.expireIfNeeded(dst); err != nil {
+		return nil, errors.Trace(err)
+	}
+	if _, err := t.loadListMeta(t.EncodeMetaKey(dst)); err != nil {
+		return nil, errors.Trace(err)
 	}
 
-	return data, errors.Trace(err)
+	v, err := t.listPop(src, srcLeft)
+	if err != nil || v == nil {
+		return nil, errors.Trace(err)
+	}
+	return v, errors.Trace(t.listPush(dst, dstLeft, v))
 }
 
 // LLen gets the length of a list.
 func (t *TxStructure) LLen(key []byte) (int64, error) {
-	metaKey := t.encodeListMetaKey(key)
+	if mv, err := t.loadMeta(key); err != nil || mv == nil {
+		return 0, errors.Trace(err)
+	}
+	metaKey := t.EncodeMetaKey(key)
 	meta, err := t.loadListMeta(metaKey)
 	return meta.RIndex - meta.LIndex, errors.Trace(err)
 }
 
 // LIndex gets an element from a list by its index.
 func (t *TxStructure) LIndex(key []byte, index int64) ([]byte, error) {
-	metaKey := t.encodeListMetaKey(key)
+	if mv, err := t.loadMeta(key); err != nil || mv == nil {
+		return nil, errors.Trace(err)
+	}
+	metaKey := t.EncodeMetaKey(key)
 	meta, err := t.loadListMeta(metaKey)
 	if err != nil || meta.IsEmpty() {
 		return nil, errors.Trace(err)
@@ -148,7 +180,8 @@ func (t *TxStructure) LIndex(key []byte, index int64) ([]byte, error) {
 	index = adjustIndex(index, meta.LIndex, meta.RIndex)
 
 	if index >= meta.LIndex && index < meta.RIndex {
-		return t.reader.Get(t.encodeListDataKey(key, index))
+		v, err := t.reader.Get(t.encodeListDataKey(key, index))
+		return decodeListValue(v), errors.Trace(err)
 	}
 	return nil, nil
 }
@@ -158,18 +191,113 @@ func (t *TxStructure) LSet(key []byte, index int64, value []byte) error {
 	if t.readWriter == nil {
 		return errWriteOnSnapshot
 	}
-	metaKey := t.encodeListMetaKey(key)
+	if err := t.expireIfNeeded(key); err != nil {
+		return errors.Trace(err)
+	}
+	metaKey := t.EncodeMetaKey(key)
 	meta, err := t.loadListMeta(metaKey)
-	if err != nil || meta.IsEmpty() {
+	if err != nil {
 		return errors.Trace(err)
 	}
+	if meta.IsEmpty() {
+		return errors.Trace(ErrNoSuchKey)
+	}
 
 	index = adjustIndex(index, meta.LIndex, meta.RIndex)
 
 	if index >= meta.LIndex && index < meta.RIndex {
-		return t.readWriter.Set(t.encodeListDataKey(key, index), value)
+		return t.readWriter.Set(t.encodeListDataKey(key, index), encodeListValue(value))
+	}
+	return errors.Trace(ErrIndexOutOfRange)
+}
+
+// LRange gets the elements from start to stop, both inclusive, negative
+// positions count from the tail.
+func (t *TxStructure) LRange(key []byte, start int64, stop int64) ([][]byte, error) {
+	if mv, err := t.loadMeta(key); err != nil || mv == nil {
+		return nil, errors.Trace(err)
+	}
+	meta, err := t.loadListMeta(t.EncodeMetaKey(key))
+	if err != nil || meta.IsEmpty() {
+		return nil, errors.Trace(err)
 	}
-	return errInvalidListIndex.Gen("invalid list index %d", index)
+
+	start, stop, ok := listRange(start, stop, meta)
+	if !ok {
+		return nil, nil
+	}
+
+	it, err := t.reader.Seek(t.encodeListDataKey(key, start))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer it.Close()
+
+	prefix := t.listDataKeyPrefix(key)
+	values := make([][]byte, 0, stop-start+1)
+	for it.Valid() && it.Key().HasPrefix(prefix) && int64(len(values)) <= stop-start {
+		values = append(values, decodeListValue(it.Value()))
+		if err = it.Next(); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+	return values, nil
+}
+
+// LTrim trims the list so that it only holds the elements from start to
+// stop, both inclusive.
+func (t *TxStructure) LTrim(key []byte, start int64, stop int64) error {
+	if t.readWriter == nil {
+		return errWriteOnSnapshot
+	}
+	if err := t.expireIfNeeded(key); err != nil {
+		return errors.Trace(err)
+	}
+	meta, err := t.loadListMeta(t.EncodeMetaKey(key))
+	if err != nil || meta.IsEmpty() {
+		return errors.Trace(err)
+	}
+
+	start, stop, ok := listRange(start, stop, meta)
+	if !ok {
+		return errors.Trace(t.LClear(key))
+	}
+
+	for index := meta.LIndex; index < start; index++ {
+		if err = t.readWriter.Delete(t.encodeListDataKey(key, index)); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	for index := stop + 1; index < meta.RIndex; index++ {
+		if err = t.readWriter.Delete(t.encodeListDataKey(key, index)); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	meta.LIndex, meta.RIndex = start, stop+1
+	return errors.Trace(t.listUpdateMeta(key, meta))
+}
+
+// listRange converts the user positions start and stop into data indexes of
+// meta, ok is false if the range holds no element.
+func listRange(start int64, stop int64, meta listMeta) (int64, int64, bool) {
+	length := meta.RIndex - meta.LIndex
+	if start < 0 {
+		start += length
+	}
+	if stop < 0 {
+		stop += length
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= length {
+		stop = length - 1
+	}
+	if start > stop {
+		return 0, 0, false
+	}
+	return start + meta.LIndex, stop + meta.LIndex, true
 }
 
 // LClear removes the list of the key.
@@ -177,12 +305,15 @@ func (t *TxStructure) LClear(key []byte) error {
 	if t.readWriter == nil {
 		return errWriteOnSnapshot
 	}
-	metaKey := t.encodeListMetaKey(key)
+	metaKey := t.EncodeMetaKey(key)
 	meta, err := t.loadListMeta(metaKey)
 	if err != nil || meta.IsEmpty() {
 		return errors.Trace(err)
 	}
 
+	if err = t.clearExpire(key); err != nil {
+		return errors.Trace(err)
+	}
 	for index := meta.LIndex; index < meta.RIndex; index++ {
 		dataKey := t.encodeListDataKey(key, index)
 		if err = t.readWriter.Delete(dataKey); err != nil {
@@ -193,6 +324,27 @@ func (t *TxStructure) LClear(key []byte) error {
 	return t.readWriter.Delete(metaKey)
 }
 
+// encodeListValue escapes a list element for the store, which can not hold
+// empty values: an element that is empty or starts with 0x00 gets a 0x00
+// prefix.
+func encodeListValue(v []byte) []byte {
+	if len(v) > 0 && v[0] != 0x00 {
+		return v
+	}
+	return append([]byte{0x00}, v...)
+}
+
+// decodeListValue undoes encodeListValue, the result is a copy of v.
+func decodeListValue(v []byte) []byte {
+	if v == nil {
+		return nil
+	}
+	if len(v) > 0 && v[0] == 0x00 {
+		v = v[1:]
+	}
+	return append([]byte{}, v...)
+}
+
 func (t *TxStructure) loadListMeta(metaKey []byte) (listMeta, error) {
 	v, err := t.reader.Get(metaKey)
 	if terror.ErrorEqual(err, kv.ErrNotExist) {
@@ -201,20 +353,37 @@ func (t *TxStructure) loadListMeta(metaKey []byte) (listMeta, error) {
 		return listMeta{}, errors.Trace(err)
 	}
 
-	meta := listMeta{0, 0}
+	meta := listMeta{0, 0, 0}
 	if v == nil {
 		return meta, nil
 	}
 
-	if len(v) != 16 {
+	if TypeFlag(v[0]) != ListData {
+		return meta, errors.Trace(ErrSetType)
+	}
+	if len(v) != 25 {
 		return meta, errInvalidListMetaData
 	}
 
-	meta.LIndex = int64(binary.BigEndian.Uint64(v[0:8]))
-	meta.RIndex = int64(binary.BigEndian.Uint64(v[8:16]))
+	meta.ExpireAt = int64(binary.BigEndian.Uint64(v[1:9]))
+	meta.LIndex = int64(binary.BigEndian.Uint64(v[9:17]))
+	meta.RIndex = int64(binary.BigEndian.Uint64(v[17:25]))
 	return meta, nil
 }
 
+// listUpdateMeta writes meta back, removing the list once it is empty.
+func (t *TxStructure) listUpdateMeta(key []byte, meta listMeta) error {
+	metaKey := t.EncodeMetaKey(key)
+	if !meta.IsEmpty() {
+		return errors.Trace(t.readWriter.Set(metaKey, meta.Value()))
+	}
+
+	if err := t.clearExpire(key); err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(t.readWriter.Delete(metaKey))
+}
+
 func adjustIndex(index int64, min, max int64) int64 {
 	if index >= 0 {
 		return index + min
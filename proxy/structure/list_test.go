@@ -0,0 +1,132 @@
+package structure
+
+import (
+	"github.com/juju/errors"
+	. "github.com/pingcap/check"
+	"github.com/pingcap/tidb/util/testleak"
+)
+
+func (s *testTxStructureSuite) TestListRange(c *C) {
+	defer testleak.AfterTest(c)()
+	txn, err := s.store.Begin()
+	c.Assert(err, IsNil)
+	defer txn.Rollback()
+
+	tx := NewStructure(txn, txn, []byte{0x00})
+	key := []byte("l")
+	// LPUSH prepends its values one by one, so they end up reversed.
+	c.Assert(tx.LPush(key, bytesOf("c", "b", "a")...), IsNil)
+	c.Assert(tx.RPush(key, bytesOf("d", "e")...), IsNil)
+
+	tbl := []struct {
+		start, stop int64
+		res         []string
+	}{
+		{0, -1, []string{"a", "b", "c", "d", "e"}},
+		{1, 2, []string{"b", "c"}},
+		{-2, -1, []string{"d", "e"}},
+		{-100, 0, []string{"a"}},
+		{3, 100, []string{"d", "e"}},
+		{3, 1, nil},
+		{5, 10, nil},
+	}
+	for _, t := range tbl {
+		values, err := tx.LRange(key, t.start, t.stop)
+		c.Assert(err, IsNil)
+		if t.res == nil {
+			c.Assert(values, HasLen, 0, Commentf("%d %d", t.start, t.stop))
+			continue
+		}
+		c.Assert(byteStrings(values, false), DeepEquals, t.res, Commentf("%d %d", t.start, t.stop))
+	}
+
+	for index, want := range map[int64]string{0: "a", 4: "e", -1: "e", -5: "a"} {
+		v, err := tx.LIndex(key, index)
+		c.Assert(err, IsNil)
+		c.Assert(string(v), Equals, want)
+	}
+	v, err := tx.LIndex(key, 5)
+	c.Assert(err, IsNil)
+	c.Assert(v, IsNil)
+
+	c.Assert(tx.LSet(key, -1, []byte("E")), IsNil)
+	err = tx.LSet(key, 5, []byte("x"))
+	c.Assert(errors.Cause(err), Equals, ErrIndexOutOfRange)
+	err = tx.LSet([]byte("missing"), 0, []byte("x"))
+	c.Assert(errors.Cause(err), Equals, ErrNoSuchKey)
+
+	c.Assert(tx.LTrim(key, 1, -2), IsNil)
+	values, err := tx.LRange(key, 0, -1)
+	c.Assert(err, IsNil)
+	c.Assert(byteStrings(values, false), DeepEquals, []string{"b", "c", "d"})
+	n, err := tx.LLen(key)
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, int64(3))
+
+	// A trim to nothing deletes the key.
+	c.Assert(tx.LTrim(key, 2, 1), IsNil)
+	typ, err := tx.Type(key)
+	c.Assert(err, IsNil)
+	c.Assert(typ, Equals, "none")
+}
+
+func (s *testTxStructureSuite) TestListPopMove(c *C) {
+	defer testleak.AfterTest(c)()
+	txn, err := s.store.Begin()
+	c.Assert(err, IsNil)
+	defer txn.Rollback()
+
+	tx := NewStructure(txn, txn, []byte{0x00})
+	src, dst := []byte("src"), []byte("dst")
+	c.Assert(tx.RPush(src, bytesOf("a", "b", "c")...), IsNil)
+
+	v, err := tx.LMove(src, dst, true, false)
+	c.Assert(err, IsNil)
+	c.Assert(string(v), Equals, "a")
+	v, err = tx.LMove(src, dst, false, true)
+	c.Assert(err, IsNil)
+	c.Assert(string(v), Equals, "c")
+	values, err := tx.LRange(dst, 0, -1)
+	c.Assert(err, IsNil)
+	c.Assert(byteStrings(values, false), DeepEquals, []string{"c", "a"})
+
+	// Moving within one list rotates it.
+	v, err = tx.LMove(dst, dst, true, false)
+	c.Assert(err, IsNil)
+	c.Assert(string(v), Equals, "c")
+	values, err = tx.LRange(dst, 0, -1)
+	c.Assert(err, IsNil)
+	c.Assert(byteStrings(values, false), DeepEquals, []string{"a", "c"})
+
+	v, err = tx.RPop(src)
+	c.Assert(err, IsNil)
+	c.Assert(string(v), Equals, "b")
+	v, err = tx.LPop(src)
+	c.Assert(err, IsNil)
+	c.Assert(v, IsNil)
+	n, err := tx.LLen(src)
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, int64(0))
+	v, err = tx.LMove(src, dst, true, true)
+	c.Assert(err, IsNil)
+	c.Assert(v, IsNil)
+
+	// Nothing is popped when dst holds another type.
+	_, err = tx.Set([]byte("str"), []byte("v"))
+	c.Assert(err, IsNil)
+	_, err = tx.LMove(dst, []byte("str"), true, true)
+	c.Assert(IsWrongType(err), IsTrue)
+	n, err = tx.LLen(dst)
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, int64(2))
+
+	for _, fn := range []func() error{
+		func() error { return tx.RPush([]byte("str"), []byte("x")) },
+		func() error { _, err := tx.LPop([]byte("str")); return err },
+		func() error { _, err := tx.LLen([]byte("str")); return err },
+		func() error { _, err := tx.LRange([]byte("str"), 0, -1); return err },
+		func() error { return tx.LTrim([]byte("str"), 0, -1) },
+	} {
+		c.Assert(IsWrongType(fn()), IsTrue)
+	}
+}
@@ -15,17 +15,36 @@ package structure
 
 import (
 	"bytes"
+	"math"
+	"strconv"
 
 	"encoding/json"
 	"github.com/Mansfield6/tikv-proxy-demo/proxy/util"
 	"github.com/juju/errors"
+	"github.com/pingcap/tidb/terror"
 )
 
+func init() {
+	registerType(HashData, &keyType{
+		clear: func(t *TxStructure, key []byte) error {
+			// A hash may hold fields written by HSet besides the merged blob.
+			if err := t.HClear(key); err != nil {
+				return errors.Trace(err)
+			}
+			return t.MergedHClear(key)
+		},
+		copy: (*TxStructure).copyKeyData,
+	})
+}
+
 // HSet sets the string value of a hash field.
 func (t *TxStructure) MergedHSet(key []byte, field []byte, value []byte) (int, error) {
 	if t.readWriter == nil {
 		return 0, errWriteOnSnapshot
 	}
+	if err := t.expireIfNeeded(key); err != nil {
+		return 0, errors.Trace(err)
+	}
 	metaKey := t.EncodeMetaKey(key)
 	meta, err := t.loadHashMeta(metaKey)
 	if err != nil {
@@ -52,7 +71,7 @@ func (t *TxStructure) MergedHSet(key []byte, field []byte, value []byte) (int, e
 		res = 1
 	}
 
-	if !bytes.Equal(ov, value) {
+	if !has || !bytes.Equal(ov, value) {
 		oldMap[fkey] = value
 		newJsonData, err := json.Marshal(oldMap)
 		if err != nil {
@@ -70,7 +89,98 @@ func (t *TxStructure) MergedHSet(key []byte, field []byte, value []byte) (int, e
 	return res, errors.Trace(err)
 }
 
+// MergedHInc increments the integer value of a hash field by step, returns
+// the value after the increment.
+func (t *TxStructure) MergedHInc(key []byte, field []byte, step int64) (int64, error) {
+	var n int64
+	err := t.mergedUpdateHash(key, field, func(oldValue []byte) ([]byte, error) {
+		if oldValue != nil {
+			var err error
+			if n, err = strconv.ParseInt(string(oldValue), 10, 64); err != nil {
+				return nil, errors.Trace(ErrHashNotInteger)
+			}
+		}
+		if (step > 0 && n > math.MaxInt64-step) || (step < 0 && n < math.MinInt64-step) {
+			return nil, errors.Trace(ErrOverflow)
+		}
+		n += step
+		return []byte(strconv.FormatInt(n, 10)), nil
+	})
+	return n, errors.Trace(err)
+}
+
+// MergedHIncByFloat increments the float value of a hash field by step,
+// returns the value after the increment as it is stored.
+func (t *TxStructure) MergedHIncByFloat(key []byte, field []byte, step float64) ([]byte, error) {
+	var value []byte
+	err := t.mergedUpdateHash(key, field, func(oldValue []byte) ([]byte, error) {
+		f, err := incFloat(oldValue, step)
+		if terror.ErrorEqual(err, ErrNotFloat) {
+			return nil, errors.Trace(ErrHashNotFloat)
+		}
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		value = util.FormatFloat(f, true)
+		return value, nil
+	})
+	return value, errors.Trace(err)
+}
+
+// mergedUpdateHash replaces the value of a hash field with the result of fn,
+// which gets nil if the field does not exist.
+func (t *TxStructure) mergedUpdateHash(key []byte, field []byte, fn func(oldValue []byte) ([]byte, error)) error {
+	if t.readWriter == nil {
+		return errWriteOnSnapshot
+	}
+	if err := t.expireIfNeeded(key); err != nil {
+		return errors.Trace(err)
+	}
+	metaKey := t.EncodeMetaKey(key)
+	meta, err := t.loadHashMeta(metaKey)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	dataKey := t.encodeMergedHashDataKey(key)
+	jsonData, err := t.loadHashValue(dataKey)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	oldMap := make(map[string][]byte)
+	if len(jsonData) > 0 {
+		if err = json.Unmarshal(jsonData, &oldMap); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	fkey := string(field)
+	oldValue, has := oldMap[fkey]
+	newValue, err := fn(oldValue)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if !has {
+		meta.FieldCount++
+	}
+	oldMap[fkey] = newValue
+
+	newJsonData, err := json.Marshal(oldMap)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if err = t.readWriter.Set(dataKey, newJsonData); err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(t.readWriter.Set(metaKey, EncodeHashMetaValue(meta.ExpireAt, meta.FieldCount)))
+}
+
 func (t *TxStructure) MergedHGet(key []byte, field []byte) ([]byte, error) {
+	if mv, err := t.loadHashMetaValue(key); err != nil || mv == nil {
+		return nil, errors.Trace(err)
+	}
+
 	dataKey := t.encodeMergedHashDataKey(key)
 	jsonData, err := t.loadHashValue(dataKey)
 	if err != nil || len(jsonData) ==0{
@@ -90,6 +200,9 @@ func (t *TxStructure) MergedHMSet(key []byte, elements []*HashPair) ([]byte, err
 		return nil, errWriteOnSnapshot
 	}
 
+	if err := t.expireIfNeeded(key); err != nil {
+		return nil, errors.Trace(err)
+	}
 	metaKey := t.EncodeMetaKey(key)
 	meta, err := t.loadHashMeta(metaKey)
 	if err != nil {
@@ -134,6 +247,10 @@ func (t *TxStructure) MergedHMSet(key []byte, elements []*HashPair) ([]byte, err
 }
 
 func (t *TxStructure) MergedHGetAll(key []byte) ([][]byte, error) {
+	if mv, err := t.loadHashMetaValue(key); err != nil || mv == nil {
+		return nil, errors.Trace(err)
+	}
+
 	dataKey := t.encodeMergedHashDataKey(key)
 	jsonData, err := t.loadHashValue(dataKey)
 	if err != nil || len(jsonData)==0 {
@@ -161,6 +278,9 @@ func (t *TxStructure) MergedHDel(key []byte, fields [][]byte) (int, error) {
 	if t.readWriter == nil {
 		return 0, errWriteOnSnapshot
 	}
+	if err := t.expireIfNeeded(key); err != nil {
+		return 0, errors.Trace(err)
+	}
 	metaKey := t.EncodeMetaKey(key)
 	meta, err := t.loadHashMeta(metaKey)
 	if err != nil || meta.IsEmpty() {
@@ -192,6 +312,10 @@ func (t *TxStructure) MergedHDel(key []byte, fields [][]byte) (int, error) {
 		return res, errors.Trace(err)
 	}
 
+	if meta.IsEmpty() {
+		return res, errors.Trace(t.MergedHClear(key))
+	}
+
 	newJsonData, err := json.Marshal(oldMap)
 	if err != nil {
 		return 0, errors.Trace(err)
@@ -206,25 +330,41 @@ func (t *TxStructure) MergedHDel(key []byte, fields [][]byte) (int, error) {
 	return res, errors.Trace(err)
 }
 
+// loadHashMetaValue gets the meta value of key, which is nil if key does not
+// exist. It fails with ErrSetType if key holds another type.
+func (t *TxStructure) loadHashMetaValue(key []byte) ([]byte, error) {
+	mv, err := t.loadMeta(key)
+	if err != nil || mv == nil {
+		return nil, errors.Trace(err)
+	}
+	if flag, _, _ := DecodeMetaValue(mv); flag != HashData {
+		return nil, errors.Trace(ErrSetType)
+	}
+	return mv, nil
+}
+
 func (t *TxStructure) MergedHClear(key []byte) error {
-	metaKey := t.EncodeMetaKey(key)
-	meta, err := t.loadHashMeta(metaKey)
-	if err != nil || meta.IsEmpty() {
+	if err := t.clearExpire(key); err != nil {
 		return errors.Trace(err)
 	}
 
-	if err = t.readWriter.Delete(metaKey);err != nil {
+	metaKey := t.EncodeMetaKey(key)
+	if err := t.readWriter.Delete(metaKey); err != nil {
 		return errors.Trace(err)
 	}
 
 	dataKey := t.encodeMergedHashDataKey(key)
-	err = t.readWriter.Delete(dataKey)
+	err := t.readWriter.Delete(dataKey)
 
 	return errors.Trace(err)
 }
 
 func (t *TxStructure) MergedHKeys(key []byte) ([][]byte, error) {
 	var keys [][]byte
+	if mv, err := t.loadHashMetaValue(key); err != nil || mv == nil {
+		return nil, errors.Trace(err)
+	}
+
 	dataKey := t.encodeMergedHashDataKey(key)
 	jsonData, err := t.loadHashValue(dataKey)
 	if err != nil||len(jsonData)==0 {
@@ -0,0 +1,98 @@
+package structure
+
+import (
+	"github.com/juju/errors"
+	"github.com/pingcap/tidb/kv"
+	"github.com/pingcap/tidb/util/codec"
+)
+
+// pubsubPrefix leads the Pub/Sub log. A message is kept under pubsubPrefix,
+// the start timestamp of the transaction that published it and the id of
+// the publishing proxy. Publishers never write the same key, so they do not
+// conflict, and the log reads in the order of the timestamps.
+var pubsubPrefix = []byte{SystemPrefix, 'p'}
+
+// PubSubMessage is a message of the Pub/Sub log.
+type PubSubMessage struct {
+	TS        uint64
+	Publisher []byte
+	Channel   []byte
+	Message   []byte
+}
+
+func encodePubSubKey(ts uint64) kv.Key {
+	return codec.EncodeUint(append([]byte{}, pubsubPrefix...), ts)
+}
+
+// PublishMessage adds a message to the Pub/Sub log, ts is the start
+// timestamp of the transaction of m and publisher the id of the proxy.
+func PublishMessage(m kv.Mutator, ts uint64, publisher []byte, channel []byte, message []byte) error {
+	v := append(codec.EncodeBytes(nil, channel), message...)
+	return errors.Trace(m.Set(append(encodePubSubKey(ts), publisher...), v))
+}
+
+// ReadMessages gets the messages of the Pub/Sub log published by the
+// transactions started after from and up to to, in the order of their start
+// timestamps.
+func ReadMessages(r kv.Retriever, from uint64, to uint64) ([]PubSubMessage, error) {
+	it, err := r.Seek(encodePubSubKey(from + 1))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer it.Close()
+
+	var msgs []PubSubMessage
+	for it.Valid() && it.Key().HasPrefix(pubsubPrefix) {
+		publisher, ts, err := codec.DecodeUint(it.Key()[len(pubsubPrefix):])
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		if ts > to {
+			break
+		}
+		message, channel, err := codec.DecodeBytes(it.Value())
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		msgs = append(msgs, PubSubMessage{
+			TS:        ts,
+			Publisher: append([]byte{}, publisher...),
+			Channel:   channel,
+			Message:   append([]byte{}, message...),
+		})
+		if err = it.Next(); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+	return msgs, nil
+}
+
+// TrimPubSubLog deletes at most limit messages published by transactions
+// started before before, it reports whether there are more to delete.
+func TrimPubSubLog(rm kv.RetrieverMutator, before uint64, limit int) (int, bool, error) {
+	it, err := rm.Seek(pubsubPrefix)
+	if err != nil {
+		return 0, false, errors.Trace(err)
+	}
+	defer it.Close()
+
+	end := encodePubSubKey(before)
+	var keys []kv.Key
+	for it.Valid() && it.Key().HasPrefix(pubsubPrefix) && it.Key().Cmp(end) < 0 {
+		if len(keys) == limit {
+			break
+		}
+		keys = append(keys, it.Key().Clone())
+		if err = it.Next(); err != nil {
+			return 0, false, errors.Trace(err)
+		}
+	}
+	more := len(keys) == limit && it.Valid() && it.Key().HasPrefix(pubsubPrefix) && it.Key().Cmp(end) < 0
+
+	for _, k := range keys {
+		if err = rm.Delete(k); err != nil {
+			return 0, false, errors.Trace(err)
+		}
+	}
+	return len(keys), more, nil
+}
@@ -0,0 +1,49 @@
+package structure
+
+import (
+	. "github.com/pingcap/check"
+	"github.com/pingcap/tidb/kv"
+	"github.com/pingcap/tidb/util/testleak"
+)
+
+func (s *testTxStructureSuite) TestPubSubLog(c *C) {
+	defer testleak.AfterTest(c)()
+	txn, err := s.store.Begin()
+	c.Assert(err, IsNil)
+	defer txn.Rollback()
+
+	// Messages read in the order of their timestamps whoever published them.
+	for _, m := range []struct {
+		ts        uint64
+		publisher string
+	}{{30, "b"}, {10, "a"}, {20, "b"}, {30, "a"}} {
+		err = PublishMessage(txn, m.ts, []byte(m.publisher), []byte("ch"), []byte(m.publisher))
+		c.Assert(err, IsNil)
+	}
+	read := func(from, to uint64) []string {
+		msgs, err := ReadMessages(txn, from, to)
+		c.Assert(err, IsNil)
+		var res []string
+		for _, m := range msgs {
+			c.Assert(m.Channel, DeepEquals, []byte("ch"))
+			c.Assert(m.Message, DeepEquals, m.Publisher)
+			res = append(res, string(m.Publisher))
+		}
+		return res
+	}
+	c.Assert(read(0, 100), DeepEquals, []string{"a", "b", "a", "b"})
+	c.Assert(read(10, 20), DeepEquals, []string{"b"})
+	c.Assert(read(20, 30), DeepEquals, []string{"a", "b"})
+	c.Assert(read(30, 100), IsNil)
+
+	n, more, err := TrimPubSubLog(txn, 30, 1)
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 1)
+	c.Assert(more, IsTrue)
+	n, more, err = TrimPubSubLog(txn, 30, 10)
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 1)
+	c.Assert(more, IsFalse)
+	c.Assert(read(0, 100), DeepEquals, []string{"a", "b"})
+	c.Assert(countKeys(c, txn, kv.Key(pubsubPrefix)), Equals, 2)
+}
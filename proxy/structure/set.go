@@ -0,0 +1,390 @@
+package structure
+
+import (
+	"math/rand"
+
+	"github.com/juju/errors"
+	"github.com/pingcap/tidb/kv"
+	"github.com/pingcap/tidb/terror"
+)
+
+func init() {
+	registerType(SetData, &keyType{
+		clear: (*TxStructure).SClear,
+		copy:  (*TxStructure).copyKeyData,
+	})
+}
+
+type setMeta struct {
+	ExpireAt int64
+	Count    int64
+}
+
+func (meta setMeta) Value() []byte {
+	return EncodeSetMetaValue(meta.ExpireAt, meta.Count)
+}
+
+func (meta setMeta) IsEmpty() bool {
+	return meta.Count <= 0
+}
+
+// SAdd adds members to a set, it returns the number of added members.
+func (t *TxStructure) SAdd(key []byte, members [][]byte) (int, error) {
+	if t.readWriter == nil {
+		return 0, errWriteOnSnapshot
+	}
+	if err := t.expireIfNeeded(key); err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	metaKey := t.EncodeMetaKey(key)
+	meta, err := t.loadSetMeta(metaKey)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	res := 0
+	for _, member := range members {
+		dataKey := t.encodeSetDataKey(key, member)
+		exists, err := t.setHasMember(dataKey)
+		if err != nil {
+			return 0, errors.Trace(err)
+		}
+		if exists {
+			continue
+		}
+
+		if err = t.readWriter.Set(dataKey, []byte{0}); err != nil {
+			return 0, errors.Trace(err)
+		}
+		res++
+		meta.Count++
+	}
+
+	if res == 0 {
+		return 0, nil
+	}
+	return res, errors.Trace(t.readWriter.Set(metaKey, meta.Value()))
+}
+
+// SRem removes members from a set, it returns the number of removed members.
+func (t *TxStructure) SRem(key []byte, members [][]byte) (int, error) {
+	if t.readWriter == nil {
+		return 0, errWriteOnSnapshot
+	}
+	if err := t.expireIfNeeded(key); err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	metaKey := t.EncodeMetaKey(key)
+	meta, err := t.loadSetMeta(metaKey)
+	if err != nil || meta.IsEmpty() {
+		return 0, errors.Trace(err)
+	}
+
+	res := 0
+	for _, member := range members {
+		dataKey := t.encodeSetDataKey(key, member)
+		exists, err := t.setHasMember(dataKey)
+		if err != nil {
+			return 0, errors.Trace(err)
+		}
+		if !exists {
+			continue
+		}
+
+		if err = t.readWriter.Delete(dataKey); err != nil {
+			return 0, errors.Trace(err)
+		}
+		res++
+		meta.Count--
+	}
+
+	if res == 0 {
+		return 0, nil
+	}
+	return res, errors.Trace(t.setUpdateMeta(key, meta))
+}
+
+// SIsMember reports whether member is in the set.
+func (t *TxStructure) SIsMember(key []byte, member []byte) (bool, error) {
+	mv, err := t.loadMeta(key)
+	if err != nil || mv == nil {
+		return false, errors.Trace(err)
+	}
+	if flag, _, _ := DecodeMetaValue(mv); flag != SetData {
+		return false, errors.Trace(ErrSetType)
+	}
+	return t.setHasMember(t.encodeSetDataKey(key, member))
+}
+
+// SCard gets the number of members in a set.
+func (t *TxStructure) SCard(key []byte) (int64, error) {
+	if mv, err := t.loadMeta(key); err != nil || mv == nil {
+		return 0, errors.Trace(err)
+	}
+	meta, err := t.loadSetMeta(t.EncodeMetaKey(key))
+	return meta.Count, errors.Trace(err)
+}
+
+// SMembers gets all the members of a set.
+func (t *TxStructure) SMembers(key []byte) ([][]byte, error) {
+	if count, err := t.SCard(key); err != nil || count == 0 {
+		return nil, errors.Trace(err)
+	}
+
+	var members [][]byte
+	err := t.iterateSet(key, func(member []byte) error {
+		members = append(members, member)
+		return nil
+	})
+	return members, errors.Trace(err)
+}
+
+// SPop removes and returns at most count random members of a set.
+func (t *TxStructure) SPop(key []byte, count int64) ([][]byte, error) {
+	if t.readWriter == nil {
+		return nil, errWriteOnSnapshot
+	}
+	if err := t.expireIfNeeded(key); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	metaKey := t.EncodeMetaKey(key)
+	meta, err := t.loadSetMeta(metaKey)
+	if err != nil || meta.IsEmpty() || count <= 0 {
+		return nil, errors.Trace(err)
+	}
+
+	if count >= meta.Count {
+		members, err := t.SMembers(key)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		return members, errors.Trace(t.SClear(key))
+	}
+
+	// Reservoir sampling keeps the pick uniform in one pass over the set.
+	picked := make([][]byte, 0, count)
+	var seen int64
+	err = t.iterateSet(key, func(member []byte) error {
+		if seen < count {
+			picked = append(picked, member)
+		} else if j := rand.Int63n(seen + 1); j < count {
+			picked[j] = member
+		}
+		seen++
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	for _, member := range picked {
+		if err = t.readWriter.Delete(t.encodeSetDataKey(key, member)); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+	meta.Count -= int64(len(picked))
+	return picked, errors.Trace(t.setUpdateMeta(key, meta))
+}
+
+// SInter gets the members of the intersection of all the given sets.
+func (t *TxStructure) SInter(keys [][]byte) ([][]byte, error) {
+	sets, err := t.loadSets(keys)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	var res [][]byte
+	for _, member := range sets[0].members {
+		in := true
+		for _, s := range sets[1:] {
+			if _, ok := s.index[string(member)]; !ok {
+				in = false
+				break
+			}
+		}
+		if in {
+			res = append(res, member)
+		}
+	}
+	return res, nil
+}
+
+// SUnion gets the members of the union of all the given sets.
+func (t *TxStructure) SUnion(keys [][]byte) ([][]byte, error) {
+	sets, err := t.loadSets(keys)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	var res [][]byte
+	seen := make(map[string]struct{})
+	for _, s := range sets {
+		for _, member := range s.members {
+			if _, ok := seen[string(member)]; ok {
+				continue
+			}
+			seen[string(member)] = struct{}{}
+			res = append(res, member)
+		}
+	}
+	return res, nil
+}
+
+// SDiff gets the members of the first set that are in none of the others.
+func (t *TxStructure) SDiff(keys [][]byte) ([][]byte, error) {
+	sets, err := t.loadSets(keys)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	var res [][]byte
+	for _, member := range sets[0].members {
+		in := false
+		for _, s := range sets[1:] {
+			if _, ok := s.index[string(member)]; ok {
+				in = true
+				break
+			}
+		}
+		if !in {
+			res = append(res, member)
+		}
+	}
+	return res, nil
+}
+
+// SStore replaces whatever is stored at key with a set of members, it
+// returns the size of the new set.
+func (t *TxStructure) SStore(key []byte, members [][]byte) (int, error) {
+	if t.readWriter == nil {
+		return 0, errWriteOnSnapshot
+	}
+	if _, err := t.DEL([][]byte{key}); err != nil {
+		return 0, errors.Trace(err)
+	}
+	return t.SAdd(key, members)
+}
+
+// SClear removes the set of the key.
+func (t *TxStructure) SClear(key []byte) error {
+	if t.readWriter == nil {
+		return errWriteOnSnapshot
+	}
+	if err := t.clearExpire(key); err != nil {
+		return errors.Trace(err)
+	}
+
+	var members [][]byte
+	err := t.iterateSet(key, func(member []byte) error {
+		members = append(members, member)
+		return nil
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	for _, member := range members {
+		if err = t.readWriter.Delete(t.encodeSetDataKey(key, member)); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return errors.Trace(t.readWriter.Delete(t.EncodeMetaKey(key)))
+}
+
+type loadedSet struct {
+	members [][]byte
+	index   map[string]struct{}
+}
+
+// loadSets reads every set of keys from the same transaction snapshot, a
+// missing key is an empty set.
+func (t *TxStructure) loadSets(keys [][]byte) ([]loadedSet, error) {
+	sets := make([]loadedSet, len(keys))
+	for i, key := range keys {
+		members, err := t.SMembers(key)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		index := make(map[string]struct{}, len(members))
+		for _, member := range members {
+			index[string(member)] = struct{}{}
+		}
+		sets[i] = loadedSet{members: members, index: index}
+	}
+	return sets, nil
+}
+
+func (t *TxStructure) iterateSet(key []byte, fn func(member []byte) error) error {
+	prefix := t.setDataKeyPrefix(key)
+	it, err := t.reader.Seek(prefix)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer it.Close()
+
+	for it.Valid() && it.Key().HasPrefix(prefix) {
+		member, err := t.decodeSetDataKey(key, it.Key())
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if err = fn(member); err != nil {
+			return errors.Trace(err)
+		}
+		if err = it.Next(); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
+
+func (t *TxStructure) setHasMember(dataKey kv.Key) (bool, error) {
+	_, err := t.reader.Get(dataKey)
+	if terror.ErrorEqual(err, kv.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, errors.Trace(err)
+}
+
+// setUpdateMeta writes meta back, removing the set once it is empty.
+func (t *TxStructure) setUpdateMeta(key []byte, meta setMeta) error {
+	metaKey := t.EncodeMetaKey(key)
+	if !meta.IsEmpty() {
+		return errors.Trace(t.readWriter.Set(metaKey, meta.Value()))
+	}
+
+	if err := t.clearExpire(key); err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(t.readWriter.Delete(metaKey))
+}
+
+func (t *TxStructure) loadSetMeta(metaKey []byte) (setMeta, error) {
+	v, err := t.reader.Get(metaKey)
+	if terror.ErrorEqual(err, kv.ErrNotExist) {
+		err = nil
+	} else if err != nil {
+		return setMeta{}, errors.Trace(err)
+	}
+
+	meta := setMeta{}
+	if v == nil {
+		return meta, nil
+	}
+
+	if len(v) != 17 {
+		return meta, errInvalidHashMeta
+	}
+
+	flag, expireAt, count := DecodeMetaValue(v)
+	if flag != SetData {
+		return meta, errors.Trace(ErrSetType)
+	}
+	meta.ExpireAt = expireAt
+	meta.Count = count
+
+	return meta, nil
+}
@@ -0,0 +1,165 @@
+package structure
+
+import (
+	"sort"
+
+	. "github.com/pingcap/check"
+	"github.com/pingcap/tidb/util/testleak"
+)
+
+// byteStrings gets values as strings, sorted if sorted is set.
+func byteStrings(values [][]byte, sorted bool) []string {
+	res := make([]string, 0, len(values))
+	for _, v := range values {
+		res = append(res, string(v))
+	}
+	if sorted {
+		sort.Strings(res)
+	}
+	return res
+}
+
+func bytesOf(values ...string) [][]byte {
+	res := make([][]byte, 0, len(values))
+	for _, v := range values {
+		res = append(res, []byte(v))
+	}
+	return res
+}
+
+func (s *testTxStructureSuite) TestSet(c *C) {
+	defer testleak.AfterTest(c)()
+	txn, err := s.store.Begin()
+	c.Assert(err, IsNil)
+	defer txn.Rollback()
+
+	tx := NewStructure(txn, txn, []byte{0x00})
+	key := []byte("s")
+	n, err := tx.SAdd(key, bytesOf("a", "b", "a", "c"))
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 3)
+	n, err = tx.SAdd(key, bytesOf("c", "d"))
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 1)
+
+	card, err := tx.SCard(key)
+	c.Assert(err, IsNil)
+	c.Assert(card, Equals, int64(4))
+	members, err := tx.SMembers(key)
+	c.Assert(err, IsNil)
+	c.Assert(byteStrings(members, true), DeepEquals, []string{"a", "b", "c", "d"})
+	ok, err := tx.SIsMember(key, []byte("b"))
+	c.Assert(err, IsNil)
+	c.Assert(ok, IsTrue)
+	ok, err = tx.SIsMember(key, []byte("x"))
+	c.Assert(err, IsNil)
+	c.Assert(ok, IsFalse)
+
+	n, err = tx.SRem(key, bytesOf("b", "x", "b"))
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 1)
+	card, err = tx.SCard(key)
+	c.Assert(err, IsNil)
+	c.Assert(card, Equals, int64(3))
+
+	// SPOP takes distinct members and drops the key with the last one.
+	popped, err := tx.SPop(key, 2)
+	c.Assert(err, IsNil)
+	c.Assert(popped, HasLen, 2)
+	c.Assert(popped[0], Not(DeepEquals), popped[1])
+	rest, err := tx.SPop(key, 10)
+	c.Assert(err, IsNil)
+	c.Assert(byteStrings(append(popped, rest...), true), DeepEquals, []string{"a", "c", "d"})
+	typ, err := tx.Type(key)
+	c.Assert(err, IsNil)
+	c.Assert(typ, Equals, "none")
+	popped, err = tx.SPop(key, 1)
+	c.Assert(err, IsNil)
+	c.Assert(popped, IsNil)
+
+	n, err = tx.SRem(key, bytesOf("a"))
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 0)
+}
+
+func (s *testTxStructureSuite) TestSetAlgebra(c *C) {
+	defer testleak.AfterTest(c)()
+	txn, err := s.store.Begin()
+	c.Assert(err, IsNil)
+	defer txn.Rollback()
+
+	tx := NewStructure(txn, txn, []byte{0x00})
+	_, err = tx.SAdd([]byte("x"), bytesOf("a", "b", "c", "d"))
+	c.Assert(err, IsNil)
+	_, err = tx.SAdd([]byte("y"), bytesOf("c", "d", "e"))
+	c.Assert(err, IsNil)
+
+	tbl := []struct {
+		op   func([][]byte) ([][]byte, error)
+		keys []string
+		res  []string
+	}{
+		{tx.SInter, []string{"x", "y"}, []string{"c", "d"}},
+		{tx.SInter, []string{"x", "missing"}, []string{}},
+		{tx.SUnion, []string{"x", "y"}, []string{"a", "b", "c", "d", "e"}},
+		{tx.SUnion, []string{"missing", "y"}, []string{"c", "d", "e"}},
+		{tx.SDiff, []string{"x", "y"}, []string{"a", "b"}},
+		{tx.SDiff, []string{"y", "x"}, []string{"e"}},
+		{tx.SDiff, []string{"missing", "x"}, []string{}},
+	}
+	for _, t := range tbl {
+		res, err := t.op(bytesOf(t.keys...))
+		c.Assert(err, IsNil)
+		c.Assert(byteStrings(res, true), DeepEquals, t.res, Commentf("%v", t.keys))
+	}
+
+	// A *STORE replaces the destination, whatever its type.
+	_, err = tx.Set([]byte("dst"), []byte("v"))
+	c.Assert(err, IsNil)
+	res, err := tx.SInter(bytesOf("x", "y"))
+	c.Assert(err, IsNil)
+	n, err := tx.SStore([]byte("dst"), res)
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 2)
+	members, err := tx.SMembers([]byte("dst"))
+	c.Assert(err, IsNil)
+	c.Assert(byteStrings(members, true), DeepEquals, []string{"c", "d"})
+	// An empty result deletes the destination.
+	n, err = tx.SStore([]byte("dst"), nil)
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 0)
+	typ, err := tx.Type([]byte("dst"))
+	c.Assert(err, IsNil)
+	c.Assert(typ, Equals, "none")
+}
+
+func (s *testTxStructureSuite) TestSetWrongType(c *C) {
+	defer testleak.AfterTest(c)()
+	txn, err := s.store.Begin()
+	c.Assert(err, IsNil)
+	defer txn.Rollback()
+
+	tx := NewStructure(txn, txn, []byte{0x00})
+	key := []byte("str")
+	_, err = tx.Set(key, []byte("v"))
+	c.Assert(err, IsNil)
+	_, err = tx.SAdd([]byte("set"), bytesOf("a"))
+	c.Assert(err, IsNil)
+
+	_, err = tx.SAdd(key, bytesOf("a"))
+	c.Assert(IsWrongType(err), IsTrue)
+	_, err = tx.SRem(key, bytesOf("a"))
+	c.Assert(IsWrongType(err), IsTrue)
+	_, err = tx.SIsMember(key, []byte("a"))
+	c.Assert(IsWrongType(err), IsTrue)
+	_, err = tx.SCard(key)
+	c.Assert(IsWrongType(err), IsTrue)
+	_, err = tx.SMembers(key)
+	c.Assert(IsWrongType(err), IsTrue)
+	_, err = tx.SPop(key, 1)
+	c.Assert(IsWrongType(err), IsTrue)
+	_, err = tx.SUnion(bytesOf("set", "str"))
+	c.Assert(IsWrongType(err), IsTrue)
+	_, err = tx.Get([]byte("set"))
+	c.Assert(IsWrongType(err), IsTrue)
+}
@@ -0,0 +1,101 @@
+package structure
+
+import (
+	"encoding/binary"
+
+	"github.com/pingcap/tidb/kv"
+	"github.com/pingcap/tidb/util/codec"
+)
+
+// A meta value may end with a stamp, the start timestamp of the last
+// transaction that wrote the key. Any write to a key writes its meta with a
+// new stamp, so WATCH only has to compare and lock the meta key. The high bit
+// of the flag byte tells a stamped value from the ones written before stamps
+// existed. The stamp is removed before the meta value reaches the code of the
+// types, which sees the value it wrote.
+const metaStamped = 0x80
+
+// stamper is implemented by the transactions a stamp is taken from.
+type stamper interface {
+	StartTS() uint64
+}
+
+// stampMeta sets the stamp of the meta value v.
+func stampMeta(v []byte, stamp uint64) []byte {
+	v = stripMetaStamp(v)
+	if stamp == 0 || len(v) == 0 {
+		return v
+	}
+	buf := make([]byte, len(v)+8)
+	copy(buf, v)
+	buf[0] |= metaStamped
+	binary.BigEndian.PutUint64(buf[len(v):], stamp)
+	return buf
+}
+
+// stripMetaStamp removes the stamp of the meta value v, if it has one.
+func stripMetaStamp(v []byte) []byte {
+	if len(v) <= 8 || v[0]&metaStamped == 0 {
+		return v
+	}
+	buf := append([]byte{}, v[:len(v)-8]...)
+	buf[0] &^= metaStamped
+	return buf
+}
+
+// metaKeyOf gets the meta key of the user key a data key ek under prefix
+// belongs to, it returns nil for keys outside prefix.
+func metaKeyOf(prefix []byte, ek kv.Key) kv.Key {
+	if !ek.HasPrefix(prefix) {
+		return nil
+	}
+	rest, _, err := codec.DecodeBytes(ek[len(prefix):])
+	if err != nil {
+		return nil
+	}
+	mk := append(kv.Key{}, ek[:len(ek)-len(rest)]...)
+	return codec.EncodeUint(mk, uint64(MetaCode))
+}
+
+// metaReader removes the stamps of the meta values read under prefix.
+type metaReader struct {
+	kv.Retriever
+	prefix []byte
+}
+
+func (r *metaReader) Get(k kv.Key) ([]byte, error) {
+	v, err := r.Retriever.Get(k)
+	if err == nil && len(v) > 8 && v[0]&metaStamped != 0 && isMetaKey(r.prefix, k) {
+		v = stripMetaStamp(v)
+	}
+	return v, err
+}
+
+func (r *metaReader) Seek(k kv.Key) (kv.Iterator, error) {
+	it, err := r.Retriever.Seek(k)
+	if err != nil {
+		return nil, err
+	}
+	return &metaIter{Iterator: it, prefix: r.prefix}, nil
+}
+
+func (r *metaReader) SeekReverse(k kv.Key) (kv.Iterator, error) {
+	it, err := r.Retriever.SeekReverse(k)
+	if err != nil {
+		return nil, err
+	}
+	return &metaIter{Iterator: it, prefix: r.prefix}, nil
+}
+
+type metaIter struct {
+	kv.Iterator
+	prefix []byte
+}
+
+func (it *metaIter) Value() []byte {
+	v := it.Iterator.Value()
+	if len(v) > 8 && v[0]&metaStamped != 0 && isMetaKey(it.prefix, it.Iterator.Key()) {
+		v = stripMetaStamp(v)
+	}
+	return v
+}
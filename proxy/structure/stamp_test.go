@@ -0,0 +1,80 @@
+package structure
+
+import (
+	. "github.com/pingcap/check"
+	"github.com/pingcap/tidb/kv"
+	"github.com/pingcap/tidb/util/testleak"
+)
+
+func (s *testTxStructureSuite) TestKeyVersion(c *C) {
+	defer testleak.AfterTest(c)()
+	prefix := []byte{0x00}
+	run := func(fn func(tx *TxStructure) error) {
+		err := kv.RunInNewTxn(s.store, false, func(txn kv.Transaction) error {
+			return fn(NewStructure(txn, txn, prefix))
+		})
+		c.Assert(err, IsNil)
+	}
+	version := func(key string) []byte {
+		var v []byte
+		run(func(tx *TxStructure) error {
+			var err error
+			v, err = tx.KeyVersion([]byte(key))
+			return err
+		})
+		return v
+	}
+
+	run(func(tx *TxStructure) error {
+		if _, err := tx.HSet([]byte("h"), []byte("f"), []byte("1")); err != nil {
+			return err
+		}
+		if err := tx.RPush([]byte("l"), []byte("a"), []byte("b")); err != nil {
+			return err
+		}
+		_, err := tx.ZAdd([]byte("z"), 0, zsetPairs("a", 1.0))
+		return err
+	})
+	c.Assert(version("missing"), IsNil)
+
+	// Writes that leave the meta as it was still change the version.
+	writes := map[string]func(tx *TxStructure) error{
+		"h": func(tx *TxStructure) error {
+			_, err := tx.HSet([]byte("h"), []byte("f"), []byte("2"))
+			return err
+		},
+		"l": func(tx *TxStructure) error {
+			return tx.LSet([]byte("l"), 0, []byte("c"))
+		},
+		"z": func(tx *TxStructure) error {
+			_, err := tx.ZAdd([]byte("z"), 0, zsetPairs("a", 2.0))
+			return err
+		},
+	}
+	for key, write := range writes {
+		v := version(key)
+		c.Assert(v, NotNil)
+		c.Assert(version(key), DeepEquals, v)
+		run(write)
+		c.Assert(version(key), Not(DeepEquals), v, Commentf("%s", key))
+	}
+
+	// The types read their meta without the stamp.
+	run(func(tx *TxStructure) error {
+		for key, typ := range map[string]string{"h": "hash", "l": "list", "z": "zset"} {
+			name, err := tx.Type([]byte(key))
+			c.Assert(err, IsNil)
+			c.Assert(name, Equals, typ)
+		}
+		n, err := tx.HLen([]byte("h"))
+		c.Assert(err, IsNil)
+		c.Assert(n, Equals, 1)
+		values, err := tx.LRange([]byte("l"), 0, -1)
+		c.Assert(err, IsNil)
+		c.Assert(values, DeepEquals, [][]byte{[]byte("c"), []byte("b")})
+		n64, err := tx.DBSize()
+		c.Assert(err, IsNil)
+		c.Assert(n64, Equals, int64(3))
+		return nil
+	})
+}
@@ -14,17 +14,60 @@
 package structure
 
 import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"math/big"
+	"math/bits"
 	"strconv"
 
+	"github.com/Mansfield6/tikv-proxy-demo/proxy/util"
 	"github.com/juju/errors"
 	"github.com/pingcap/tidb/kv"
 	"github.com/pingcap/tidb/terror"
 )
 
+func init() {
+	registerType(StringData, &keyType{
+		clear: func(t *TxStructure, key []byte) error {
+			return t.Clear(key)
+		},
+		copy: (*TxStructure).copyKeyData,
+	})
+}
+
+// Flags of SetString.
+const (
+	// SetIfNotExist only sets the key if it does not exist.
+	SetIfNotExist = 1 << iota
+	// SetIfExist only sets the key if it already exists.
+	SetIfExist
+	// SetKeepTTL retains the ttl of the key.
+	SetKeepTTL
+	// SetGetOld fetches the old value, which must be a string.
+	SetGetOld
+)
+
+// MaxStringLength is the largest string SETRANGE and APPEND may build.
+const MaxStringLength int64 = 512 * 1024 * 1024
+
 // Set sets the string value of the key.
 func (t *TxStructure) Set(key []byte, value []byte) ([]byte, error) {
+	if _, _, err := t.SetString(key, value, 0, 0); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return []byte("OK"), nil
+}
+
+// SetString sets the string value of the key whatever its type was, it
+// expires at expireAt unless expireAt is 0. It returns the old value when
+// SetGetOld is given, and whether the value was set at all.
+func (t *TxStructure) SetString(key []byte, value []byte, expireAt int64, flags int) ([]byte, bool, error) {
 	if t.readWriter == nil {
-		return nil, errWriteOnSnapshot
+		return nil, false, errWriteOnSnapshot
+	}
+	if err := t.expireIfNeeded(key); err != nil {
+		return nil, false, errors.Trace(err)
 	}
 
 	mk := t.EncodeMetaKey(key)
@@ -33,36 +76,208 @@ func (t *TxStructure) Set(key []byte, value []byte) ([]byte, error) {
 		err = nil
 	}
 	if err != nil {
-		return nil, errors.Trace(err)
+		return nil, false, errors.Trace(err)
+	}
+
+	var old []byte
+	if flags&SetGetOld != 0 && mv != nil {
+		if old, _, err = t.getString(key); err != nil {
+			return nil, false, errors.Trace(err)
+		}
+	}
+	if (flags&SetIfNotExist != 0 && mv != nil) || (flags&SetIfExist != 0 && mv == nil) {
+		return old, false, nil
 	}
+
 	if mv != nil {
-		flag, _, _ := DecodeMetaValue(mv)
+		flag, oldExpireAt, _ := DecodeMetaValue(mv)
+		if flags&SetKeepTTL != 0 && expireAt == 0 {
+			expireAt = oldExpireAt
+		}
 		if flag != StringData {
-			return nil, errors.Trace(ErrSetType)
+			if err = t.clearKey(key, flag); err != nil {
+				return nil, false, errors.Trace(err)
+			}
+			mv = nil
 		}
 	}
-	ek := t.encodeStringDataKey(key)
-	verr := t.readWriter.Set(ek, value)
-	if verr != nil {
-		return nil, errors.Trace(err)
+	if mv == nil {
+		mv = EncodeStringMetaValue(0)
+	} else if mv, err = t.unchunkString(key, mv); err != nil {
+		return nil, false, errors.Trace(err)
 	}
-	merr := t.readWriter.Set(mk, EncodeStringMetaValue(0))
-	if merr != nil {
-		return nil, errors.Trace(merr)
+	if err = t.readWriter.Set(mk, mv); err != nil {
+		return nil, false, errors.Trace(err)
 	}
-	return []byte("OK"), nil
+
+	if err = t.setStringValue(key, value); err != nil {
+		return nil, false, errors.Trace(err)
+	}
+	return old, true, errors.Trace(t.setExpire(key, mv, expireAt))
+}
+
+// MSetNX sets the values of all the keys, but only if none of them exists.
+func (t *TxStructure) MSetNX(keys [][]byte, values [][]byte) (bool, error) {
+	for _, key := range keys {
+		mv, err := t.loadMeta(key)
+		if err != nil {
+			return false, errors.Trace(err)
+		}
+		if mv != nil {
+			return false, nil
+		}
+	}
+
+	for i, key := range keys {
+		if _, _, err := t.SetString(key, values[i], 0, 0); err != nil {
+			return false, errors.Trace(err)
+		}
+	}
+	return true, nil
 }
 
 // Get gets the string value of a key.
 func (t *TxStructure) Get(key []byte) ([]byte, error) {
-	ek := t.encodeStringDataKey(key)
-	value, err := t.reader.Get(ek)
-	if terror.ErrorEqual(err, kv.ErrNotExist) {
-		err = nil
+	value, _, err := t.getString(key)
+	return value, errors.Trace(err)
+}
+
+// GetDel gets the string value of a key and deletes the key.
+func (t *TxStructure) GetDel(key []byte) ([]byte, error) {
+	if t.readWriter == nil {
+		return nil, errWriteOnSnapshot
+	}
+	value, mv, err := t.getString(key)
+	if err != nil || mv == nil {
+		return nil, errors.Trace(err)
+	}
+	return value, errors.Trace(t.Clear(key))
+}
+
+// GetEx gets the string value of a key and sets its expire time to expireAt,
+// or removes its ttl if persist is true. An expireAt of 0 leaves the ttl
+// alone.
+func (t *TxStructure) GetEx(key []byte, expireAt int64, persist bool) ([]byte, error) {
+	if t.readWriter == nil {
+		return nil, errWriteOnSnapshot
 	}
+	value, mv, err := t.getString(key)
+	if err != nil || mv == nil {
+		return nil, errors.Trace(err)
+	}
+
+	switch {
+	case persist:
+		err = t.setExpire(key, mv, 0)
+	case expireAt > 0 && expireAt <= nowMs():
+		err = t.Clear(key)
+	case expireAt > 0:
+		err = t.setExpire(key, mv, expireAt)
+	}
+	return value, errors.Trace(err)
+}
+
+// Append appends value to the string value of a key, returns the length of
+// the string after the append.
+func (t *TxStructure) Append(key []byte, value []byte) (int64, error) {
+	var n int64
+	err := t.updateString(key, func(oldValue []byte) ([]byte, error) {
+		n = int64(len(oldValue) + len(value))
+		if n > MaxStringLength {
+			return nil, errors.Trace(ErrStringTooLong)
+		}
+		return append(append([]byte{}, oldValue...), value...), nil
+	})
+	return n, errors.Trace(err)
+}
+
+// StrLen gets the length of the string value of a key.
+func (t *TxStructure) StrLen(key []byte) (int64, error) {
+	sv, err := t.loadStringValue(key)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	return sv.length, nil
+}
+
+// GetRange gets the substring of the string value of a key between start
+// and end, both inclusive, negative offsets count from the end.
+func (t *TxStructure) GetRange(key []byte, start int64, end int64) ([]byte, error) {
+	sv, err := t.loadStringValue(key)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	start, end, ok := normalizeRange(start, end, sv.length)
+	if !ok {
+		return []byte{}, nil
+	}
+	value := make([]byte, 0, end-start+1)
+	err = sv.each(start, end, func(off int64, b []byte) bool {
+		value = append(value, b...)
+		return true
+	})
 	return value, errors.Trace(err)
 }
 
+// SetRange overwrites part of the string value of a key from offset on,
+// padding it with zero bytes if needed. It returns the length of the string
+// after the change.
+func (t *TxStructure) SetRange(key []byte, offset int64, value []byte) (int64, error) {
+	if len(value) == 0 {
+		return t.StrLen(key)
+	}
+	if offset+int64(len(value)) > MaxStringLength {
+		return 0, errors.Trace(ErrStringTooLong)
+	}
+
+	var n int64
+	err := t.updateString(key, func(oldValue []byte) ([]byte, error) {
+		n = offset + int64(len(value))
+		if int64(len(oldValue)) > n {
+			n = int64(len(oldValue))
+		}
+		newValue := make([]byte, n)
+		copy(newValue, oldValue)
+		copy(newValue[offset:], value)
+		return newValue, nil
+	})
+	return n, errors.Trace(err)
+}
+
+// getString gets the string value and the meta value of a key, both are nil
+// if the key does not exist.
+func (t *TxStructure) getString(key []byte) ([]byte, []byte, error) {
+	mv, err := t.loadMeta(key)
+	if err != nil || mv == nil {
+		return nil, nil, errors.Trace(err)
+	}
+	if flag, _, _ := DecodeMetaValue(mv); flag != StringData {
+		return nil, nil, errors.Trace(ErrSetType)
+	}
+	if isBitmapMeta(mv) {
+		value, err := t.loadBitmapValue(key, mv)
+		return value, mv, errors.Trace(err)
+	}
+
+	value, err := t.reader.Get(t.encodeStringDataKey(key))
+	if terror.ErrorEqual(err, kv.ErrNotExist) {
+		// An empty string has no data key, see setStringValue.
+		return []byte{}, mv, nil
+	}
+	return value, mv, errors.Trace(err)
+}
+
+// setStringValue writes the data key of a string. The store can not hold
+// empty values, so an empty string is kept as a meta without a data key.
+func (t *TxStructure) setStringValue(key []byte, value []byte) error {
+	ek := t.encodeStringDataKey(key)
+	if len(value) == 0 {
+		return errors.Trace(t.readWriter.Delete(ek))
+	}
+	return errors.Trace(t.readWriter.Set(ek, value))
+}
+
 // GetInt64 gets the int64 value of a key.
 func (t *TxStructure) GetInt64(key []byte) (int64, error) {
 	v, err := t.Get(key)
@@ -75,18 +290,97 @@ func (t *TxStructure) GetInt64(key []byte) (int64, error) {
 }
 
 // Inc increments the integer value of a key by step, returns
-// the value after the increment.
+// the value after the increment. A missing key counts as 0.
 func (t *TxStructure) Inc(key []byte, step int64) (int64, error) {
+	var n int64
+	err := t.updateString(key, func(oldValue []byte) ([]byte, error) {
+		if oldValue != nil {
+			var err error
+			if n, err = strconv.ParseInt(string(oldValue), 10, 64); err != nil {
+				return nil, errors.Trace(ErrNotInteger)
+			}
+		}
+		if (step > 0 && n > math.MaxInt64-step) || (step < 0 && n < math.MinInt64-step) {
+			return nil, errors.Trace(ErrOverflow)
+		}
+		n += step
+		return []byte(strconv.FormatInt(n, 10)), nil
+	})
+	return n, errors.Trace(err)
+}
+
+// IncByFloat increments the float value of a key by step, returns the value
+// after the increment as it is stored.
+func (t *TxStructure) IncByFloat(key []byte, step float64) ([]byte, error) {
+	var value []byte
+	err := t.updateString(key, func(oldValue []byte) ([]byte, error) {
+		f, err := incFloat(oldValue, step)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		value = util.FormatFloat(f, true)
+		return value, nil
+	})
+	return value, errors.Trace(err)
+}
+
+// updateString replaces the string value of key with the result of fn, which
+// gets nil if the key does not exist. The ttl of the key is kept.
+func (t *TxStructure) updateString(key []byte, fn func(oldValue []byte) ([]byte, error)) error {
 	if t.readWriter == nil {
-		return 0, errWriteOnSnapshot
+		return errWriteOnSnapshot
 	}
-	ek := t.encodeStringDataKey(key)
-	// txn Inc will lock this key, so we don't lock it here.
-	n, err := kv.IncInt64(t.readWriter, ek, step)
+	if err := t.expireIfNeeded(key); err != nil {
+		return errors.Trace(err)
+	}
+
+	mk := t.EncodeMetaKey(key)
+	mv, err := t.reader.Get(mk)
 	if terror.ErrorEqual(err, kv.ErrNotExist) {
 		err = nil
 	}
-	return n, errors.Trace(err)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	var oldValue []byte
+	if mv != nil {
+		if oldValue, _, err = t.getString(key); err != nil {
+			return errors.Trace(err)
+		}
+		if mv, err = t.unchunkString(key, mv); err != nil {
+			return errors.Trace(err)
+		}
+	} else {
+		mv = EncodeStringMetaValue(0)
+	}
+
+	newValue, err := fn(oldValue)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if err = t.setStringValue(key, newValue); err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(t.readWriter.Set(mk, mv))
+}
+
+// incFloat parses value as a float, a nil value counts as 0, and adds step
+// to it.
+func incFloat(value []byte, step float64) (float64, error) {
+	var f float64
+	if value != nil {
+		var err error
+		f, err = strconv.ParseFloat(string(value), 64)
+		if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+			return 0, errors.Trace(ErrNotFloat)
+		}
+	}
+	f += step
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0, errors.Trace(ErrNaNOrInf)
+	}
+	return f, nil
 }
 
 // Clear removes the string value of the key.
@@ -94,8 +388,21 @@ func (t *TxStructure) Clear(key []byte) error {
 	if t.readWriter == nil {
 		return errWriteOnSnapshot
 	}
+	if err := t.clearExpire(key); err != nil {
+		return errors.Trace(err)
+	}
 	mk := t.encodeMetaValue(key)
-	err := t.readWriter.Delete(mk)
+	mv, err := t.reader.Get(mk)
+	if err == nil && isBitmapMeta(mv) {
+		err = t.clearBitmapChunks(key)
+	}
+	if terror.ErrorEqual(err, kv.ErrNotExist) {
+		err = nil
+	}
+	if err != nil {
+		return errors.Trace(err)
+	}
+	err = t.readWriter.Delete(mk)
 	if terror.ErrorEqual(err, kv.ErrNotExist) {
 		err = nil
 	}
@@ -109,3 +416,698 @@ func (t *TxStructure) Clear(key []byte) error {
 	}
 	return errors.Trace(err)
 }
+
+// Operators of BitOp.
+const (
+	BitAnd = iota
+	BitOr
+	BitXor
+	BitNot
+)
+
+// Subcommands of BitField.
+const (
+	BitFieldGet = iota
+	BitFieldSet
+	BitFieldIncrBy
+)
+
+// Overflow behaviors of BitField.
+const (
+	BitFieldWrap = iota
+	BitFieldSat
+	BitFieldFail
+)
+
+// BitFieldOp is one subcommand of BitField on the integer of Bits bits that
+// starts at bit Offset.
+type BitFieldOp struct {
+	Op       int
+	Signed   bool
+	Bits     uint
+	Offset   int64
+	Value    int64
+	Overflow int
+}
+
+// SetBit sets or clears the bit at offset in the string value of a key,
+// returns the original bit.
+func (t *TxStructure) SetBit(key []byte, offset int64, on bool) (int, error) {
+	if t.readWriter == nil {
+		return 0, errWriteOnSnapshot
+	}
+	bm, err := t.loadBitmap(key, true)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	old, err := bm.bit(offset)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	v := 0
+	if on {
+		v = 1
+	}
+	if err = bm.setBit(offset, v); err != nil {
+		return 0, errors.Trace(err)
+	}
+	return old, errors.Trace(bm.flush())
+}
+
+// GetBit gets the bit at offset in the string value of a key.
+func (t *TxStructure) GetBit(key []byte, offset int64) (int, error) {
+	bm, err := t.loadBitmap(key, false)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	return bm.bit(offset)
+}
+
+// BitCount counts the set bits of the string value of a key between start
+// and end, both inclusive. They are byte positions, or bit positions if
+// bitUnit is true, and negative positions count from the end.
+func (t *TxStructure) BitCount(key []byte, start int64, end int64, bitUnit bool) (int64, error) {
+	sv, err := t.loadStringValue(key)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	total := sv.length
+	if bitUnit {
+		total *= 8
+	}
+	start, end, ok := normalizeRange(start, end, total)
+	if !ok {
+		return 0, nil
+	}
+	first, last := start, end
+	if bitUnit {
+		first, last = start>>3, end>>3
+	}
+
+	var n int64
+	err = sv.each(first, last, func(off int64, b []byte) bool {
+		for i, c := range b {
+			if bitUnit {
+				// Mask the bits of the first and the last byte that are
+				// out of the range.
+				pos := off + int64(i)
+				if pos == first {
+					c &= 0xff >> uint(start&7)
+				}
+				if pos == last {
+					c &= 0xff << uint(7-end&7)
+				}
+			}
+			n += int64(bits.OnesCount8(c))
+		}
+		return true
+	})
+	return n, errors.Trace(err)
+}
+
+// BitPos finds the first bit set to bit in the string value of a key
+// between start and end, which are treated as in BitCount. It returns -1 if
+// there is none, except that a string is taken as padded with zeros on the
+// right when clear bits are searched and no end is given.
+func (t *TxStructure) BitPos(key []byte, bit int, start int64, end int64, endGiven bool, bitUnit bool) (int64, error) {
+	sv, err := t.loadStringValue(key)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	if sv.mv == nil {
+		if bit == 1 {
+			return -1, nil
+		}
+		return 0, nil
+	}
+
+	total := sv.length
+	if bitUnit {
+		total *= 8
+	}
+	start, end, ok := normalizeRange(start, end, total)
+	if !ok {
+		return -1, nil
+	}
+	if !bitUnit {
+		start, end = start*8, end*8+7
+	}
+
+	found := int64(-1)
+	err = sv.each(start>>3, end>>3, func(off int64, b []byte) bool {
+		for i := range b {
+			c := b[i]
+			pos := off + int64(i)
+			// Skip whole bytes that cannot hold the bit.
+			if (bit == 1 && c == 0) || (bit == 0 && c == 0xff) {
+				continue
+			}
+			for j := int64(0); j < 8; j++ {
+				if p := pos*8 + j; p >= start && p <= end && bitAt(b[i:i+1], j) == bit {
+					found = p
+					return false
+				}
+			}
+		}
+		return true
+	})
+	if err != nil || found >= 0 {
+		return found, errors.Trace(err)
+	}
+
+	if bit == 0 && !endGiven {
+		return end + 1, nil
+	}
+	return -1, nil
+}
+
+// BitOp stores the result of a bitwise operation between the string values
+// of keys in dest, returns the length of the result. Missing keys count as
+// strings of zeros.
+func (t *TxStructure) BitOp(op int, dest []byte, keys [][]byte) (int64, error) {
+	if t.readWriter == nil {
+		return 0, errWriteOnSnapshot
+	}
+
+	values := make([][]byte, len(keys))
+	maxLen := 0
+	for i, key := range keys {
+		v, err := t.Get(key)
+		if err != nil {
+			return 0, errors.Trace(err)
+		}
+		values[i] = v
+		if len(v) > maxLen {
+			maxLen = len(v)
+		}
+	}
+
+	res := make([]byte, maxLen)
+	for i := range res {
+		c := byteAt(values[0], i)
+		for _, v := range values[1:] {
+			switch op {
+			case BitAnd:
+				c &= byteAt(v, i)
+			case BitOr:
+				c |= byteAt(v, i)
+			case BitXor:
+				c ^= byteAt(v, i)
+			}
+		}
+		if op == BitNot {
+			c = ^c
+		}
+		res[i] = c
+	}
+
+	if len(res) == 0 {
+		_, err := t.DEL([][]byte{dest})
+		return 0, errors.Trace(err)
+	}
+	_, _, err := t.SetString(dest, res, 0, 0)
+	return int64(len(res)), errors.Trace(err)
+}
+
+// BitField runs ops in order against the string value of a key, it returns
+// the result of every op, nil for the ones that failed on overflow. Only ops
+// other than BitFieldGet write to the key.
+func (t *TxStructure) BitField(key []byte, ops []*BitFieldOp) ([]*int64, error) {
+	write := false
+	for _, op := range ops {
+		if op.Op != BitFieldGet {
+			write = true
+		}
+	}
+	if write && t.readWriter == nil {
+		return nil, errWriteOnSnapshot
+	}
+
+	bm, err := t.loadBitmap(key, write)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	res := make([]*int64, 0, len(ops))
+	for _, op := range ops {
+		old, err := bm.bits(op.Offset, op.Bits, op.Signed)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		var v int64
+		ok := true
+		switch op.Op {
+		case BitFieldGet:
+			res = append(res, &old)
+			continue
+		case BitFieldSet:
+			v, ok = bitFieldAdd(op.Value, 0, op.Bits, op.Signed, op.Overflow)
+		case BitFieldIncrBy:
+			v, ok = bitFieldAdd(old, op.Value, op.Bits, op.Signed, op.Overflow)
+		}
+		if !ok {
+			res = append(res, nil)
+			continue
+		}
+
+		if err = bm.setBits(op.Offset, op.Bits, v); err != nil {
+			return nil, errors.Trace(err)
+		}
+		if op.Op == BitFieldSet {
+			res = append(res, &old)
+		} else {
+			res = append(res, &v)
+		}
+	}
+
+	if !write {
+		return res, nil
+	}
+	return res, errors.Trace(bm.flush())
+}
+
+// bitmap gives bit access to a string value through its chunk keys, so a
+// write only touches the chunks it changes.
+type bitmap struct {
+	t      *TxStructure
+	key    []byte
+	mv     []byte
+	length int64
+	chunks map[int64][]byte
+	dirty  map[int64]bool
+	// plain is set while the value still sits in the plain data key, it is
+	// split into chunks on the first flush.
+	plain bool
+}
+
+func (t *TxStructure) loadBitmap(key []byte, write bool) (*bitmap, error) {
+	if write {
+		if err := t.expireIfNeeded(key); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+	mv, err := t.loadMeta(key)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	bm := &bitmap{
+		t:      t,
+		key:    key,
+		mv:     mv,
+		chunks: make(map[int64][]byte),
+		dirty:  make(map[int64]bool),
+	}
+	if mv == nil {
+		return bm, nil
+	}
+	if flag, _, _ := DecodeMetaValue(mv); flag != StringData {
+		return nil, errors.Trace(ErrSetType)
+	}
+	if isBitmapMeta(mv) {
+		bm.length = bitmapLength(mv)
+		return bm, nil
+	}
+
+	value, err := t.reader.Get(t.encodeStringDataKey(key))
+	if terror.ErrorEqual(err, kv.ErrNotExist) {
+		err = nil
+	}
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	bm.plain = true
+	bm.length = int64(len(value))
+	for index := int64(0); index*BitmapChunkSize < bm.length; index++ {
+		c := make([]byte, BitmapChunkSize)
+		copy(c, value[index*BitmapChunkSize:])
+		bm.chunks[index] = c
+	}
+	return bm, nil
+}
+
+func (bm *bitmap) chunk(index int64) ([]byte, error) {
+	if c, ok := bm.chunks[index]; ok {
+		return c, nil
+	}
+
+	c := make([]byte, BitmapChunkSize)
+	if bm.mv != nil && !bm.plain {
+		v, err := bm.t.reader.Get(bm.t.encodeBitmapChunkKey(bm.key, index))
+		if terror.ErrorEqual(err, kv.ErrNotExist) {
+			err = nil
+		}
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		copy(c, v)
+	}
+	bm.chunks[index] = c
+	return c, nil
+}
+
+func (bm *bitmap) bit(offset int64) (int, error) {
+	pos := offset >> 3
+	if pos >= bm.length {
+		return 0, nil
+	}
+	c, err := bm.chunk(pos / BitmapChunkSize)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	return int(c[pos%BitmapChunkSize]>>(7-uint(offset&7))) & 1, nil
+}
+
+func (bm *bitmap) setBit(offset int64, v int) error {
+	pos := offset >> 3
+	index := pos / BitmapChunkSize
+	c, err := bm.chunk(index)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	mask := byte(1) << (7 - uint(offset&7))
+	if v == 1 {
+		c[pos%BitmapChunkSize] |= mask
+	} else {
+		c[pos%BitmapChunkSize] &^= mask
+	}
+	bm.dirty[index] = true
+	if pos >= bm.length {
+		bm.length = pos + 1
+	}
+	return nil
+}
+
+// bits reads n bits from offset on as an integer, most significant bit
+// first.
+func (bm *bitmap) bits(offset int64, n uint, signed bool) (int64, error) {
+	var v uint64
+	for i := uint(0); i < n; i++ {
+		b, err := bm.bit(offset + int64(i))
+		if err != nil {
+			return 0, errors.Trace(err)
+		}
+		v = v<<1 | uint64(b)
+	}
+	if signed && n < 64 && v>>(n-1) == 1 {
+		v |= ^uint64(0) << n
+	}
+	return int64(v), nil
+}
+
+// setBits writes the low n bits of v from offset on, most significant bit
+// first.
+func (bm *bitmap) setBits(offset int64, n uint, v int64) error {
+	for i := uint(0); i < n; i++ {
+		b := int(uint64(v)>>(n-1-i)) & 1
+		if err := bm.setBit(offset+int64(i), b); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
+
+// flush writes the changed chunks and the meta back. Chunks holding only
+// zeros are deleted, a missing chunk reads as zeros.
+func (bm *bitmap) flush() error {
+	if len(bm.dirty) == 0 {
+		return nil
+	}
+
+	t := bm.t
+	if bm.plain {
+		for index := range bm.chunks {
+			bm.dirty[index] = true
+		}
+		err := t.readWriter.Delete(t.encodeStringDataKey(bm.key))
+		if err != nil && !terror.ErrorEqual(err, kv.ErrNotExist) {
+			return errors.Trace(err)
+		}
+	}
+
+	for index := range bm.dirty {
+		c := bm.chunks[index]
+		if n := bm.length - index*BitmapChunkSize; n < int64(len(c)) {
+			c = c[:n]
+		}
+
+		ck := t.encodeBitmapChunkKey(bm.key, index)
+		var err error
+		if allZero(c) {
+			err = t.readWriter.Delete(ck)
+		} else {
+			err = t.readWriter.Set(ck, c)
+		}
+		if err != nil && !terror.ErrorEqual(err, kv.ErrNotExist) {
+			return errors.Trace(err)
+		}
+	}
+
+	var expireAt int64
+	if bm.mv != nil {
+		_, expireAt, _ = DecodeMetaValue(bm.mv)
+	}
+	return errors.Trace(t.readWriter.Set(t.EncodeMetaKey(bm.key), EncodeBitmapMetaValue(expireAt, bm.length)))
+}
+
+// loadBitmapValue reassembles the string value of a key kept in bitmap
+// chunks.
+func (t *TxStructure) loadBitmapValue(key []byte, mv []byte) ([]byte, error) {
+	sv := &stringValue{t: t, key: key, mv: mv, length: bitmapLength(mv)}
+	value := make([]byte, 0, sv.length)
+	if sv.length == 0 {
+		return value, nil
+	}
+	err := sv.each(0, sv.length-1, func(off int64, b []byte) bool {
+		value = append(value, b...)
+		return true
+	})
+	return value, errors.Trace(err)
+}
+
+// stringValue reads parts of the string value of a key. Of a string kept in
+// bitmap chunks only the chunks covering a part are read.
+type stringValue struct {
+	t   *TxStructure
+	key []byte
+	// mv is the meta value, nil if the key does not exist.
+	mv     []byte
+	length int64
+	// plain is the value of a string that is not kept in chunks.
+	plain []byte
+}
+
+// loadStringValue gets the meta of the string value of a key, and the value
+// itself unless it is kept in bitmap chunks.
+func (t *TxStructure) loadStringValue(key []byte) (*stringValue, error) {
+	mv, err := t.loadMeta(key)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	sv := &stringValue{t: t, key: key, mv: mv}
+	if mv == nil {
+		return sv, nil
+	}
+	if flag, _, _ := DecodeMetaValue(mv); flag != StringData {
+		return nil, errors.Trace(ErrSetType)
+	}
+	if isBitmapMeta(mv) {
+		sv.length = bitmapLength(mv)
+		return sv, nil
+	}
+
+	value, err := t.reader.Get(t.encodeStringDataKey(key))
+	if terror.ErrorEqual(err, kv.ErrNotExist) {
+		value, err = []byte{}, nil
+	}
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	sv.plain = value
+	sv.length = int64(len(value))
+	return sv, nil
+}
+
+// each calls fn with the bytes from first to last, both inclusive and within
+// the length, in order and in pieces of at most one chunk, off being the
+// position of the piece. It stops once fn returns false.
+func (sv *stringValue) each(first int64, last int64, fn func(off int64, b []byte) bool) error {
+	if sv.plain != nil || sv.mv == nil {
+		if first <= last && last < int64(len(sv.plain)) {
+			fn(first, sv.plain[first:last+1])
+		}
+		return nil
+	}
+
+	t := sv.t
+	it, err := t.reader.Seek(t.encodeBitmapChunkKey(sv.key, first/BitmapChunkSize))
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer it.Close()
+
+	lastIndex := last / BitmapChunkSize
+	upper := t.encodeBitmapChunkKey(sv.key, lastIndex).PrefixNext()
+	zeros := make([]byte, BitmapChunkSize)
+	for index := first / BitmapChunkSize; index <= lastIndex; index++ {
+		// A missing chunk reads as zeros.
+		c, read := zeros, false
+		if it.Valid() && bytes.Compare(it.Key(), upper) < 0 {
+			ci, err := t.decodeBitmapChunkKey(sv.key, it.Key())
+			if err != nil {
+				return errors.Trace(err)
+			}
+			if ci == index {
+				c = make([]byte, BitmapChunkSize)
+				copy(c, it.Value())
+				read = true
+			}
+		}
+
+		from, to := index*BitmapChunkSize, (index+1)*BitmapChunkSize-1
+		if from < first {
+			from = first
+		}
+		if to > last {
+			to = last
+		}
+		if !fn(from, c[from-index*BitmapChunkSize:to-index*BitmapChunkSize+1]) {
+			return nil
+		}
+		// Step only when more chunks are wanted, the next key may be far
+		// away.
+		if read && index < lastIndex {
+			if err = it.Next(); err != nil {
+				return errors.Trace(err)
+			}
+		}
+	}
+	return nil
+}
+
+// unchunkString drops the chunks of a bitmap string before its value goes
+// back to the plain data key, it returns the meta value to write.
+func (t *TxStructure) unchunkString(key []byte, mv []byte) ([]byte, error) {
+	if !isBitmapMeta(mv) {
+		return mv, nil
+	}
+	if err := t.clearBitmapChunks(key); err != nil {
+		return nil, errors.Trace(err)
+	}
+	_, expireAt, _ := DecodeMetaValue(mv)
+	return EncodeStringMetaValue(expireAt), nil
+}
+
+func (t *TxStructure) clearBitmapChunks(key []byte) error {
+	prefix := t.bitmapChunkKeyPrefix(key)
+	it, err := t.reader.Seek(prefix)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	var keys []kv.Key
+	for it.Valid() && it.Key().HasPrefix(prefix) {
+		keys = append(keys, it.Key().Clone())
+		if err = it.Next(); err != nil {
+			it.Close()
+			return errors.Trace(err)
+		}
+	}
+	it.Close()
+
+	for _, ck := range keys {
+		if err = t.readWriter.Delete(ck); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
+
+func bitmapLength(mv []byte) int64 {
+	return int64(binary.BigEndian.Uint64(mv[9:17]))
+}
+
+// bitFieldAdd adds incr to value as an integer of n bits, handling overflow
+// as told by overflow. It returns false if the result does not fit and
+// overflow is BitFieldFail.
+func bitFieldAdd(value int64, incr int64, n uint, signed bool, overflow int) (int64, bool) {
+	sum := new(big.Int).Add(big.NewInt(value), big.NewInt(incr))
+
+	min, max := new(big.Int), new(big.Int).Lsh(big.NewInt(1), n)
+	max.Sub(max, big.NewInt(1))
+	if signed {
+		min.Lsh(big.NewInt(-1), n-1)
+		max.Rsh(max, 1)
+	}
+	if sum.Cmp(min) >= 0 && sum.Cmp(max) <= 0 {
+		return sum.Int64(), true
+	}
+
+	switch overflow {
+	case BitFieldSat:
+		if sum.Sign() > 0 {
+			return max.Int64(), true
+		}
+		return min.Int64(), true
+	case BitFieldWrap:
+		mod := new(big.Int).Lsh(big.NewInt(1), n)
+		sum.Mod(sum, mod)
+		if signed && sum.Cmp(max) > 0 {
+			sum.Sub(sum, mod)
+		}
+		return sum.Int64(), true
+	}
+	return 0, false
+}
+
+// normalizeRange turns the start and end positions of a range over total
+// items, negative ones counting from the end, into positions within the
+// items. It returns false if the range is empty.
+func normalizeRange(start int64, end int64, total int64) (int64, int64, bool) {
+	if start < 0 && end < 0 && start > end {
+		return 0, 0, false
+	}
+	if start < 0 {
+		start += total
+	}
+	if end < 0 {
+		end += total
+	}
+	if start < 0 {
+		start = 0
+	}
+	if end < 0 {
+		end = 0
+	}
+	if end >= total {
+		end = total - 1
+	}
+	if start > end || total == 0 {
+		return 0, 0, false
+	}
+	return start, end, true
+}
+
+func bitAt(value []byte, offset int64) int {
+	return int(value[offset>>3]>>(7-uint(offset&7))) & 1
+}
+
+func byteAt(value []byte, i int) byte {
+	if i < len(value) {
+		return value[i]
+	}
+	return 0
+}
+
+func allZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
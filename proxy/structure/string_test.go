@@ -0,0 +1,370 @@
+package structure
+
+import (
+	"bytes"
+	"math"
+	"math/bits"
+	"strconv"
+
+	"github.com/juju/errors"
+	. "github.com/pingcap/check"
+	"github.com/pingcap/tidb/kv"
+	"github.com/pingcap/tidb/util/testleak"
+)
+
+// nextCounter counts the steps of the iterators of a retriever.
+type nextCounter struct {
+	kv.Retriever
+	n *int
+}
+
+func (r nextCounter) Seek(k kv.Key) (kv.Iterator, error) {
+	it, err := r.Retriever.Seek(k)
+	return nextCountingIter{it, r.n}, err
+}
+
+type nextCountingIter struct {
+	kv.Iterator
+	n *int
+}
+
+func (it nextCountingIter) Next() error {
+	*it.n++
+	return it.Iterator.Next()
+}
+
+func (s *testTxStructureSuite) TestBitmapChunks(c *C) {
+	defer testleak.AfterTest(c)()
+	txn, err := s.store.Begin()
+	c.Assert(err, IsNil)
+	defer txn.Rollback()
+
+	tx := NewStructure(txn, txn, []byte{0x00})
+	key := []byte("b")
+	// want is the value the key should hold.
+	var want []byte
+	setBit := func(offset int64) {
+		old, err := tx.SetBit(key, offset, true)
+		c.Assert(err, IsNil)
+		c.Assert(old, Equals, 0)
+		for int64(len(want)) <= offset>>3 {
+			want = append(want, 0)
+		}
+		want[offset>>3] |= 0x80 >> uint(offset&7)
+	}
+	check := func() {
+		v, err := tx.Get(key)
+		c.Assert(err, IsNil)
+		c.Assert(v, DeepEquals, want)
+		n, err := tx.StrLen(key)
+		c.Assert(err, IsNil)
+		c.Assert(n, Equals, int64(len(want)))
+
+		ones := 0
+		for _, b := range want {
+			ones += bits.OnesCount8(b)
+		}
+		n, err = tx.BitCount(key, 0, -1, false)
+		c.Assert(err, IsNil)
+		c.Assert(n, Equals, int64(ones))
+	}
+
+	// The last bit of the first chunk and the first bit of the second.
+	setBit(BitmapChunkSize*8 - 1)
+	setBit(BitmapChunkSize * 8)
+	check()
+	tbl := []struct {
+		start, end int64
+		bitUnit    bool
+		count      int64
+	}{
+		{BitmapChunkSize - 1, BitmapChunkSize - 1, false, 1},
+		{BitmapChunkSize, BitmapChunkSize, false, 1},
+		{0, BitmapChunkSize - 2, false, 0},
+		{BitmapChunkSize*8 - 1, BitmapChunkSize * 8, true, 2},
+		{BitmapChunkSize * 8, -1, true, 1},
+		{BitmapChunkSize*8 - 8, BitmapChunkSize*8 - 2, true, 0},
+		{-9, -8, true, 2},
+	}
+	for _, t := range tbl {
+		n, err := tx.BitCount(key, t.start, t.end, t.bitUnit)
+		c.Assert(err, IsNil)
+		c.Assert(n, Equals, t.count, Commentf("%d %d %v", t.start, t.end, t.bitUnit))
+	}
+	pos, err := tx.BitPos(key, 1, 0, -1, false, false)
+	c.Assert(err, IsNil)
+	c.Assert(pos, Equals, int64(BitmapChunkSize*8-1))
+	pos, err = tx.BitPos(key, 1, BitmapChunkSize, -1, false, false)
+	c.Assert(err, IsNil)
+	c.Assert(pos, Equals, int64(BitmapChunkSize*8))
+	pos, err = tx.BitPos(key, 0, BitmapChunkSize*8-1, -1, true, true)
+	c.Assert(err, IsNil)
+	c.Assert(pos, Equals, int64(BitmapChunkSize*8+1))
+	v, err := tx.GetRange(key, BitmapChunkSize-1, BitmapChunkSize)
+	c.Assert(err, IsNil)
+	c.Assert(v, DeepEquals, []byte{0x01, 0x80})
+
+	// SETBIT grows the value over a chunk it never writes, which reads as
+	// zeros.
+	far := int64(BitmapChunkSize*8*3 + 5)
+	setBit(far)
+	check()
+	pos, err = tx.BitPos(key, 1, BitmapChunkSize+1, -1, false, false)
+	c.Assert(err, IsNil)
+	c.Assert(pos, Equals, far)
+	v, err = tx.GetRange(key, BitmapChunkSize*2-1, BitmapChunkSize*2)
+	c.Assert(err, IsNil)
+	c.Assert(v, DeepEquals, []byte{0, 0})
+	v, err = tx.GetRange(key, -1, -1)
+	c.Assert(err, IsNil)
+	c.Assert(v, DeepEquals, []byte{0x04})
+
+	// Only the chunks covering the range are read.
+	var steps int
+	rtx := NewStructure(nextCounter{txn, &steps}, nil, []byte{0x00})
+	n, err := rtx.BitCount(key, 0, 10, false)
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, int64(0))
+	pos, err = rtx.BitPos(key, 1, 0, -1, false, false)
+	c.Assert(err, IsNil)
+	c.Assert(pos, Equals, int64(BitmapChunkSize*8-1))
+	v, err = rtx.GetRange(key, 0, 3)
+	c.Assert(err, IsNil)
+	c.Assert(v, DeepEquals, []byte{0, 0, 0, 0})
+	c.Assert(steps, Equals, 0)
+
+	// APPEND and SETRANGE on a value kept in chunks.
+	n, err = tx.Append(key, []byte("xy"))
+	c.Assert(err, IsNil)
+	want = append(want, "xy"...)
+	c.Assert(n, Equals, int64(len(want)))
+	check()
+	n, err = tx.SetRange(key, BitmapChunkSize-1, []byte("ab"))
+	c.Assert(err, IsNil)
+	copy(want[BitmapChunkSize-1:], "ab")
+	c.Assert(n, Equals, int64(len(want)))
+	check()
+	v, err = tx.GetRange(key, BitmapChunkSize-2, BitmapChunkSize+1)
+	c.Assert(err, IsNil)
+	c.Assert(v, DeepEquals, []byte("\x00ab\x00"))
+	bit, err := tx.GetBit(key, far)
+	c.Assert(err, IsNil)
+	c.Assert(bit, Equals, 1)
+
+	// And SETBIT again on what they left.
+	setBit(int64(len(want))*8 + BitmapChunkSize*8)
+	check()
+	c.Assert(bytes.HasSuffix(want, []byte{0x80}), IsTrue)
+}
+
+func (s *testTxStructureSuite) TestCounters(c *C) {
+	defer testleak.AfterTest(c)()
+	txn, err := s.store.Begin()
+	c.Assert(err, IsNil)
+	defer txn.Rollback()
+
+	tx := NewStructure(txn, txn, []byte{0x00})
+	key := []byte("n")
+	n, err := tx.Inc(key, 5)
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, int64(5))
+	n, err = tx.Inc(key, -7)
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, int64(-2))
+	// The counter is a string key like any other.
+	typ, err := tx.Type(key)
+	c.Assert(err, IsNil)
+	c.Assert(typ, Equals, "string")
+
+	// The ttl is kept.
+	_, err = tx.ExpireAt(key, nowMs()+100000)
+	c.Assert(err, IsNil)
+	_, err = tx.Inc(key, 1)
+	c.Assert(err, IsNil)
+	ttl, err := tx.PTTL(key)
+	c.Assert(err, IsNil)
+	c.Assert(ttl > 0, IsTrue)
+
+	_, err = tx.Set(key, []byte(strconv.FormatInt(math.MaxInt64, 10)))
+	c.Assert(err, IsNil)
+	_, err = tx.Inc(key, 1)
+	c.Assert(errors.Cause(err), Equals, ErrOverflow)
+	_, err = tx.Set(key, []byte("1.5"))
+	c.Assert(err, IsNil)
+	_, err = tx.Inc(key, 1)
+	c.Assert(errors.Cause(err), Equals, ErrNotInteger)
+
+	v, err := tx.IncByFloat(key, 0.25)
+	c.Assert(err, IsNil)
+	c.Assert(string(v), Equals, "1.75")
+	// Large values are formatted without an exponent.
+	v, err = tx.IncByFloat(key, 1e20)
+	c.Assert(err, IsNil)
+	c.Assert(string(v), Equals, "100000000000000000000")
+	_, err = tx.Set(key, []byte("x"))
+	c.Assert(err, IsNil)
+	_, err = tx.IncByFloat(key, 1)
+	c.Assert(errors.Cause(err), Equals, ErrNotFloat)
+	_, err = tx.IncByFloat([]byte("f"), math.Inf(1))
+	c.Assert(errors.Cause(err), Equals, ErrNaNOrInf)
+
+	c.Assert(tx.RPush([]byte("l"), []byte("1")), IsNil)
+	_, err = tx.Inc([]byte("l"), 1)
+	c.Assert(IsWrongType(err), IsTrue)
+	_, err = tx.IncByFloat([]byte("l"), 1)
+	c.Assert(IsWrongType(err), IsTrue)
+}
+
+func (s *testTxStructureSuite) TestHashCounters(c *C) {
+	defer testleak.AfterTest(c)()
+	txn, err := s.store.Begin()
+	c.Assert(err, IsNil)
+	defer txn.Rollback()
+
+	tx := NewStructure(txn, txn, []byte{0x00})
+	field := []byte("f")
+	n, err := tx.HInc([]byte("h"), field, 3)
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, int64(3))
+	n, err = tx.HInc([]byte("h"), field, -4)
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, int64(-1))
+	_, err = tx.HSet([]byte("h"), field, []byte("a"))
+	c.Assert(err, IsNil)
+	_, err = tx.HInc([]byte("h"), field, 1)
+	c.Assert(errors.Cause(err), Equals, ErrHashNotInteger)
+
+	n, err = tx.MergedHInc([]byte("m"), field, 3)
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, int64(3))
+	n, err = tx.MergedHInc([]byte("m"), field, math.MaxInt64-3)
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, int64(math.MaxInt64))
+	_, err = tx.MergedHInc([]byte("m"), field, 1)
+	c.Assert(errors.Cause(err), Equals, ErrOverflow)
+
+	v, err := tx.MergedHIncByFloat([]byte("m"), []byte("g"), 10.5)
+	c.Assert(err, IsNil)
+	c.Assert(string(v), Equals, "10.5")
+	v, err = tx.MergedHIncByFloat([]byte("m"), []byte("g"), -0.5)
+	c.Assert(err, IsNil)
+	c.Assert(string(v), Equals, "10")
+	v, err = tx.MergedHGet([]byte("m"), []byte("g"))
+	c.Assert(err, IsNil)
+	c.Assert(string(v), Equals, "10")
+	_, err = tx.MergedHSet([]byte("m"), []byte("g"), []byte("x"))
+	c.Assert(err, IsNil)
+	_, err = tx.MergedHIncByFloat([]byte("m"), []byte("g"), 1)
+	c.Assert(errors.Cause(err), Equals, ErrHashNotFloat)
+
+	_, err = tx.Set([]byte("s"), []byte("1"))
+	c.Assert(err, IsNil)
+	_, err = tx.HInc([]byte("s"), field, 1)
+	c.Assert(IsWrongType(err), IsTrue)
+	_, err = tx.MergedHInc([]byte("s"), field, 1)
+	c.Assert(IsWrongType(err), IsTrue)
+}
+
+func (s *testTxStructureSuite) TestSetString(c *C) {
+	defer testleak.AfterTest(c)()
+	txn, err := s.store.Begin()
+	c.Assert(err, IsNil)
+	defer txn.Rollback()
+
+	tx := NewStructure(txn, txn, []byte{0x00})
+	key := []byte("k")
+	get := func() string {
+		v, err := tx.Get(key)
+		c.Assert(err, IsNil)
+		return string(v)
+	}
+	pttl := func() int64 {
+		ttl, err := tx.PTTL(key)
+		c.Assert(err, IsNil)
+		return ttl
+	}
+
+	// XX on a missing key and NX on an existing one do nothing.
+	_, ok, err := tx.SetString(key, []byte("a"), 0, SetIfExist)
+	c.Assert(err, IsNil)
+	c.Assert(ok, IsFalse)
+	c.Assert(pttl(), Equals, int64(-2))
+	_, ok, err = tx.SetString(key, []byte("a"), nowMs()+100000, SetIfNotExist)
+	c.Assert(err, IsNil)
+	c.Assert(ok, IsTrue)
+	c.Assert(pttl() > 0, IsTrue)
+	old, ok, err := tx.SetString(key, []byte("b"), 0, SetIfNotExist|SetGetOld)
+	c.Assert(err, IsNil)
+	c.Assert(ok, IsFalse)
+	c.Assert(string(old), Equals, "a")
+	c.Assert(get(), Equals, "a")
+
+	// KEEPTTL keeps the ttl, a plain SET drops it.
+	old, ok, err = tx.SetString(key, []byte("c"), 0, SetIfExist|SetKeepTTL|SetGetOld)
+	c.Assert(err, IsNil)
+	c.Assert(ok, IsTrue)
+	c.Assert(string(old), Equals, "a")
+	c.Assert(get(), Equals, "c")
+	c.Assert(pttl() > 0, IsTrue)
+	_, ok, err = tx.SetString(key, []byte("d"), 0, 0)
+	c.Assert(err, IsNil)
+	c.Assert(ok, IsTrue)
+	c.Assert(pttl(), Equals, int64(-1))
+
+	// A past expire time leaves nothing behind.
+	_, _, err = tx.SetString(key, []byte("e"), nowMs()-1, 0)
+	c.Assert(err, IsNil)
+	c.Assert(pttl(), Equals, int64(-2))
+
+	// SET replaces any type, but GET fails on anything but a string.
+	c.Assert(tx.RPush([]byte("l"), []byte("1")), IsNil)
+	_, _, err = tx.SetString([]byte("l"), []byte("v"), 0, SetGetOld)
+	c.Assert(IsWrongType(err), IsTrue)
+	_, _, err = tx.SetString([]byte("l"), []byte("v"), 0, 0)
+	c.Assert(err, IsNil)
+	v, err := tx.Get([]byte("l"))
+	c.Assert(err, IsNil)
+	c.Assert(string(v), Equals, "v")
+
+	ok, err = tx.MSetNX(bytesOf("x", "l"), bytesOf("1", "2"))
+	c.Assert(err, IsNil)
+	c.Assert(ok, IsFalse)
+	ok, err = tx.MSetNX(bytesOf("x", "y"), bytesOf("1", "2"))
+	c.Assert(err, IsNil)
+	c.Assert(ok, IsTrue)
+
+	v, err = tx.GetDel([]byte("x"))
+	c.Assert(err, IsNil)
+	c.Assert(string(v), Equals, "1")
+	v, err = tx.GetDel([]byte("x"))
+	c.Assert(err, IsNil)
+	c.Assert(v, IsNil)
+	v, err = tx.GetEx([]byte("y"), nowMs()+100000, false)
+	c.Assert(err, IsNil)
+	c.Assert(string(v), Equals, "2")
+	ttl, err := tx.PTTL([]byte("y"))
+	c.Assert(err, IsNil)
+	c.Assert(ttl > 0, IsTrue)
+	_, err = tx.GetEx([]byte("y"), 0, true)
+	c.Assert(err, IsNil)
+	ttl, err = tx.PTTL([]byte("y"))
+	c.Assert(err, IsNil)
+	c.Assert(ttl, Equals, int64(-1))
+
+	// APPEND and SETRANGE pad and grow the value.
+	n, err := tx.Append([]byte("y"), []byte("34"))
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, int64(3))
+	n, err = tx.SetRange([]byte("y"), 5, []byte("x"))
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, int64(6))
+	v, err = tx.Get([]byte("y"))
+	c.Assert(err, IsNil)
+	c.Assert(v, DeepEquals, []byte("234\x00\x00x"))
+	v, err = tx.GetRange([]byte("y"), -3, 100)
+	c.Assert(err, IsNil)
+	c.Assert(v, DeepEquals, []byte("\x00\x00x"))
+	v, err = tx.GetRange([]byte("missing"), 0, -1)
+	c.Assert(err, IsNil)
+	c.Assert(v, DeepEquals, []byte{})
+}
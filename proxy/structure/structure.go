@@ -25,6 +25,7 @@ const (
 	codeInvalidListIndex                    = 3
 	codeInvalidListMetaData                 = 4
 	codeWriteOnSnapshot                     = 5
+	codeInvalidHLLData                      = 6
 )
 
 var (
@@ -34,10 +35,24 @@ var (
 	errInvalidListMetaData  = terror.ClassStructure.New(codeInvalidListMetaData, "invalid list meta data")
 	errWriteOnSnapshot      = terror.ClassStructure.New(codeWriteOnSnapshot, "write on snapshot")
 	errInvalidHashMeta      = terror.ClassStructure.New(codeInvalidHashKeyFlag, "invalid type")
+	errInvalidHLLData       = terror.ClassStructure.New(codeInvalidHLLData, "invalid hyperloglog data")
 )
 
 // NewStructure creates a TxStructure with Retriever, RetrieverMutator and key prefix.
+// The keys created and deleted through readWriter are counted for DBSize, and
+// the keys written through it are stamped with the start timestamp of
+// readWriter when it is a transaction.
 func NewStructure(reader kv.Retriever, readWriter kv.RetrieverMutator, prefix []byte) *TxStructure {
+	if reader != nil {
+		reader = &metaReader{Retriever: reader, prefix: prefix}
+	}
+	if readWriter != nil {
+		c := &countingMutator{RetrieverMutator: readWriter, prefix: prefix}
+		if s, ok := readWriter.(stamper); ok {
+			c.stamp = s.StartTS()
+		}
+		readWriter = c
+	}
 	return &TxStructure{
 		reader:     reader,
 		readWriter: readWriter,
@@ -34,7 +34,9 @@ type testTxStructureSuite struct {
 	store kv.Storage
 }
 
-func (s *testTxStructureSuite) SetUpSuite(c *C) {
+// SetUpTest gives every test a store of its own, the keys a test commits
+// do not leak into the next one.
+func (s *testTxStructureSuite) SetUpTest(c *C) {
 	path := "memory:"
 	d := localstore.Driver{
 		Driver: goleveldb.MemoryDriver{},
@@ -44,7 +46,7 @@ func (s *testTxStructureSuite) SetUpSuite(c *C) {
 	s.store = store
 }
 
-func (s *testTxStructureSuite) TearDownSuite(c *C) {
+func (s *testTxStructureSuite) TearDownTest(c *C) {
 	err := s.store.Close()
 	c.Assert(err, IsNil)
 }
@@ -59,7 +61,7 @@ func (s *testTxStructureSuite) TestString(c *C) {
 
 	key := []byte("a")
 	value := []byte("1")
-	err = tx.Set(key, value)
+	_, err = tx.Set(key, value)
 	c.Assert(err, IsNil)
 
 	v, err := tx.Get(key)
@@ -182,15 +184,15 @@ func (s *testTxStructureSuite) TestHash(c *C) {
 
 	key := []byte("a")
 
-	err = tx.HSet(key, []byte("1"), []byte("1"))
+	_, err = tx.HSet(key, []byte("1"), []byte("1"))
 	c.Assert(err, IsNil)
 
-	err = tx.HSet(key, []byte("2"), []byte("2"))
+	_, err = tx.HSet(key, []byte("2"), []byte("2"))
 	c.Assert(err, IsNil)
 
 	l, err := tx.HLen(key)
 	c.Assert(err, IsNil)
-	c.Assert(l, Equals, int64(2))
+	c.Assert(l, Equals, 2)
 
 	value, err := tx.HGet(key, []byte("1"))
 	c.Assert(err, IsNil)
@@ -206,11 +208,11 @@ func (s *testTxStructureSuite) TestHash(c *C) {
 
 	res, err := tx.HGetAll(key)
 	c.Assert(err, IsNil)
-	c.Assert(res, DeepEquals, []HashPair{
-		{[]byte("1"), []byte("1")},
-		{[]byte("2"), []byte("2")}})
+	c.Assert(res, DeepEquals, [][]byte{
+		[]byte("1"), []byte("1"),
+		[]byte("2"), []byte("2")})
 
-	err = tx.HDel(key, []byte("1"))
+	_, err = tx.HDel(key, [][]byte{[]byte("1")})
 	c.Assert(err, IsNil)
 
 	value, err = tx.HGet(key, []byte("1"))
@@ -219,7 +221,7 @@ func (s *testTxStructureSuite) TestHash(c *C) {
 
 	l, err = tx.HLen(key)
 	c.Assert(err, IsNil)
-	c.Assert(l, Equals, int64(1))
+	c.Assert(l, Equals, 1)
 
 	n, err := tx.HInc(key, []byte("1"), 1)
 	c.Assert(err, IsNil)
@@ -227,14 +229,14 @@ func (s *testTxStructureSuite) TestHash(c *C) {
 
 	l, err = tx.HLen(key)
 	c.Assert(err, IsNil)
-	c.Assert(l, Equals, int64(2))
+	c.Assert(l, Equals, 2)
 
 	// Test set new value which equals to old value.
 	value, err = tx.HGet(key, []byte("1"))
 	c.Assert(err, IsNil)
 	c.Assert(value, DeepEquals, []byte("1"))
 
-	err = tx.HSet(key, []byte("1"), []byte("1"))
+	_, err = tx.HSet(key, []byte("1"), []byte("1"))
 	c.Assert(err, IsNil)
 
 	value, err = tx.HGet(key, []byte("1"))
@@ -243,7 +245,7 @@ func (s *testTxStructureSuite) TestHash(c *C) {
 
 	l, err = tx.HLen(key)
 	c.Assert(err, IsNil)
-	c.Assert(l, Equals, int64(2))
+	c.Assert(l, Equals, 2)
 
 	n, err = tx.HInc(key, []byte("1"), 1)
 	c.Assert(err, IsNil)
@@ -251,7 +253,7 @@ func (s *testTxStructureSuite) TestHash(c *C) {
 
 	l, err = tx.HLen(key)
 	c.Assert(err, IsNil)
-	c.Assert(l, Equals, int64(2))
+	c.Assert(l, Equals, 2)
 
 	n, err = tx.HInc(key, []byte("1"), 1)
 	c.Assert(err, IsNil)
@@ -259,7 +261,7 @@ func (s *testTxStructureSuite) TestHash(c *C) {
 
 	l, err = tx.HLen(key)
 	c.Assert(err, IsNil)
-	c.Assert(l, Equals, int64(2))
+	c.Assert(l, Equals, 2)
 
 	n, err = tx.HGetInt64(key, []byte("1"))
 	c.Assert(err, IsNil)
@@ -267,16 +269,16 @@ func (s *testTxStructureSuite) TestHash(c *C) {
 
 	l, err = tx.HLen(key)
 	c.Assert(err, IsNil)
-	c.Assert(l, Equals, int64(2))
+	c.Assert(l, Equals, 2)
 
 	err = tx.HClear(key)
 	c.Assert(err, IsNil)
 
 	l, err = tx.HLen(key)
 	c.Assert(err, IsNil)
-	c.Assert(l, Equals, int64(0))
+	c.Assert(l, Equals, 0)
 
-	err = tx.HDel(key, []byte("fake_key"))
+	_, err = tx.HDel(key, [][]byte{[]byte("fake_key")})
 	c.Assert(err, IsNil)
 
 	// Test set nil value.
@@ -286,43 +288,43 @@ func (s *testTxStructureSuite) TestHash(c *C) {
 
 	l, err = tx.HLen(key)
 	c.Assert(err, IsNil)
-	c.Assert(l, Equals, int64(0))
+	c.Assert(l, Equals, 0)
 
-	err = tx.HSet(key, []byte("nil_key"), nil)
+	_, err = tx.HSet(key, []byte("nil_key"), nil)
 	c.Assert(err, IsNil)
 
 	l, err = tx.HLen(key)
 	c.Assert(err, IsNil)
-	c.Assert(l, Equals, int64(0))
+	c.Assert(l, Equals, 0)
 
-	err = tx.HSet(key, []byte("nil_key"), []byte("1"))
+	_, err = tx.HSet(key, []byte("nil_key"), []byte("1"))
 	c.Assert(err, IsNil)
 
 	l, err = tx.HLen(key)
 	c.Assert(err, IsNil)
-	c.Assert(l, Equals, int64(1))
+	c.Assert(l, Equals, 1)
 
 	value, err = tx.HGet(key, []byte("nil_key"))
 	c.Assert(err, IsNil)
 	c.Assert(value, DeepEquals, []byte("1"))
 
-	err = tx.HSet(key, []byte("nil_key"), nil)
+	_, err = tx.HSet(key, []byte("nil_key"), nil)
 	c.Assert(err, NotNil)
 
 	l, err = tx.HLen(key)
 	c.Assert(err, IsNil)
-	c.Assert(l, Equals, int64(1))
+	c.Assert(l, Equals, 1)
 
 	value, err = tx.HGet(key, []byte("nil_key"))
 	c.Assert(err, IsNil)
 	c.Assert(value, DeepEquals, []byte("1"))
 
-	err = tx.HSet(key, []byte("nil_key"), []byte("2"))
+	_, err = tx.HSet(key, []byte("nil_key"), []byte("2"))
 	c.Assert(err, IsNil)
 
 	l, err = tx.HLen(key)
 	c.Assert(err, IsNil)
-	c.Assert(l, Equals, int64(1))
+	c.Assert(l, Equals, 1)
 
 	value, err = tx.HGet(key, []byte("nil_key"))
 	c.Assert(err, IsNil)
@@ -333,7 +335,7 @@ func (s *testTxStructureSuite) TestHash(c *C) {
 
 	err = kv.RunInNewTxn(s.store, false, func(txn kv.Transaction) error {
 		t := NewStructure(txn, txn, []byte{0x00})
-		err = t.Set(key, []byte("abc"))
+		_, err = t.Set(key, []byte("abc"))
 		c.Assert(err, IsNil)
 
 		value, err = t.Get(key)
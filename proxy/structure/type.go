@@ -30,6 +30,8 @@ const (
 	DataCode TypeFlag = '&'
 	// for zset
 	indexCode TypeFlag = '+'
+	// for the chunks of a bitmap string
+	chunkCode TypeFlag = '%'
 	// StringMeta is the flag for string meta.
 	//StringMeta TypeFlag = 'S'
 	// StringData is the flag for string data.
@@ -39,9 +41,15 @@ const (
 	// HashData is the flag for hash data.
 	HashData TypeFlag = 'h'
 	// ListMeta is the flag for list meta.
-	ListMeta TypeFlag = 'L'
+	//ListMeta TypeFlag = 'L'
 	// ListData is the flag for list data.
 	ListData TypeFlag = 'l'
+	// ZSetData is the flag for zset member data.
+	ZSetData TypeFlag = 'z'
+	// SetData is the flag for set member data.
+	SetData TypeFlag = 'e'
+	// HLLData is the flag for hyperloglog registers.
+	HLLData TypeFlag = 'p'
 )
 
 type MetaValue struct {
@@ -64,17 +72,95 @@ func  EncodeHashMetaValue(expireAt int64, count int64) []byte {
 	return buf
 }
 
+func EncodeZSetMetaValue(expireAt int64, count int64) []byte {
+	buf := make([]byte, 17)
+	buf[0] = byte(ZSetData)
+	binary.BigEndian.PutUint64(buf[1:9], uint64(expireAt))
+	binary.BigEndian.PutUint64(buf[9:], uint64(count))
+	return buf
+}
+
+func EncodeSetMetaValue(expireAt int64, count int64) []byte {
+	buf := make([]byte, 17)
+	buf[0] = byte(SetData)
+	binary.BigEndian.PutUint64(buf[1:9], uint64(expireAt))
+	binary.BigEndian.PutUint64(buf[9:], uint64(count))
+	return buf
+}
+
+func EncodeListMetaValue(expireAt int64, lIndex int64, rIndex int64) []byte {
+	buf := make([]byte, 25)
+	buf[0] = byte(ListData)
+	binary.BigEndian.PutUint64(buf[1:9], uint64(expireAt))
+	binary.BigEndian.PutUint64(buf[9:17], uint64(lIndex))
+	binary.BigEndian.PutUint64(buf[17:], uint64(rIndex))
+	return buf
+}
+
+func EncodeHLLMetaValue(expireAt int64) []byte {
+	buf := make([]byte, 9)
+	buf[0] = byte(HLLData)
+	binary.BigEndian.PutUint64(buf[1:9], uint64(expireAt))
+	return buf
+}
+
+// TypeName gets the name redis uses for the type of flag. Redis keeps a
+// hyperloglog in a string, here the registers have a type of their own that
+// the string commands reject, so it is named apart.
+func TypeName(flag TypeFlag) string {
+	switch flag {
+	case StringData:
+		return "string"
+	case HLLData:
+		return "hyperloglog"
+	case HashData:
+		return "hash"
+	case ListData:
+		return "list"
+	case SetData:
+		return "set"
+	case ZSetData:
+		return "zset"
+	}
+	return "none"
+}
+
+// EncodeBitmapMetaValue encodes the meta of a string kept in bitmap chunks,
+// length is the length of the string in bytes.
+func EncodeBitmapMetaValue(expireAt int64, length int64) []byte {
+	buf := make([]byte, 17)
+	buf[0] = byte(StringData)
+	binary.BigEndian.PutUint64(buf[1:9], uint64(expireAt))
+	binary.BigEndian.PutUint64(buf[9:], uint64(length))
+	return buf
+}
+
+// isBitmapMeta reports whether the string of the meta value mv is kept in
+// bitmap chunks instead of the plain data key.
+func isBitmapMeta(mv []byte) bool {
+	return len(mv) == 17 && TypeFlag(mv[0]) == StringData
+}
+
 func  DecodeMetaValue(value []byte) (TypeFlag, int64, int64) {
 	flag := TypeFlag(value[0])
 	expire := int64(binary.BigEndian.Uint64(value[1:9]))
 	var len int64
-	if flag == HashData {
+	if flag == HashData || flag == ZSetData || flag == SetData {
 		len = int64(binary.BigEndian.Uint64(value[9:]))
+	} else if flag == ListData {
+		len = int64(binary.BigEndian.Uint64(value[17:25])) - int64(binary.BigEndian.Uint64(value[9:17]))
 	}
 
 	return flag, expire, len
 }
 
+// setMetaExpire returns a copy of the meta value with its expire field replaced.
+func setMetaExpire(value []byte, expireAt int64) []byte {
+	buf := append([]byte{}, value...)
+	binary.BigEndian.PutUint64(buf[1:9], uint64(expireAt))
+	return buf
+}
+
 func (t *TxStructure) encodeStringDataKey(key []byte) kv.Key {
 	// for codec Encode, we may add extra bytes data, so here and following encode
 	// we will use extra length like 4 for a little optimization.
@@ -163,11 +249,18 @@ func (t *TxStructure) hashDataKeyPrefix(key []byte) kv.Key {
 	return codec.EncodeUint(ek, uint64(HashData))
 }
 
-func (t *TxStructure) encodeListMetaKey(key []byte) kv.Key {
+//func (t *TxStructure) encodeListMetaKey(key []byte) kv.Key {
+//	ek := make([]byte, 0, len(t.prefix)+len(key)+24)
+//	ek = append(ek, t.prefix...)
+//	ek = codec.EncodeBytes(ek, key)
+//	return codec.EncodeUint(ek, uint64(ListMeta))
+//}
+
+func (t *TxStructure) listDataKeyPrefix(key []byte) kv.Key {
 	ek := make([]byte, 0, len(t.prefix)+len(key)+24)
 	ek = append(ek, t.prefix...)
 	ek = codec.EncodeBytes(ek, key)
-	return codec.EncodeUint(ek, uint64(ListMeta))
+	return codec.EncodeUint(ek, uint64(ListData))
 }
 
 func (t *TxStructure) encodeListDataKey(key []byte, index int64) kv.Key {
@@ -177,3 +270,150 @@ func (t *TxStructure) encodeListDataKey(key []byte, index int64) kv.Key {
 	ek = codec.EncodeUint(ek, uint64(ListData))
 	return codec.EncodeInt(ek, index)
 }
+
+func (t *TxStructure) setDataKeyPrefix(key []byte) kv.Key {
+	ek := make([]byte, 0, len(t.prefix)+len(key)+24)
+	ek = append(ek, t.prefix...)
+	ek = codec.EncodeBytes(ek, key)
+	return codec.EncodeUint(ek, uint64(SetData))
+}
+
+func (t *TxStructure) encodeSetDataKey(key []byte, member []byte) kv.Key {
+	ek := make([]byte, 0, len(t.prefix)+len(key)+len(member)+30)
+	ek = append(ek, t.prefix...)
+	ek = codec.EncodeBytes(ek, key)
+	ek = codec.EncodeUint(ek, uint64(SetData))
+	return codec.EncodeBytes(ek, member)
+}
+
+func (t *TxStructure) decodeSetDataKey(key []byte, ek kv.Key) ([]byte, error) {
+	prefix := t.setDataKeyPrefix(key)
+	if !ek.HasPrefix(prefix) {
+		return nil, errors.New("invalid encoded set data key prefix")
+	}
+
+	_, member, err := codec.DecodeBytes(ek[len(prefix):])
+	return member, errors.Trace(err)
+}
+
+func (t *TxStructure) zsetDataKeyPrefix(key []byte) kv.Key {
+	ek := make([]byte, 0, len(t.prefix)+len(key)+24)
+	ek = append(ek, t.prefix...)
+	ek = codec.EncodeBytes(ek, key)
+	return codec.EncodeUint(ek, uint64(ZSetData))
+}
+
+func (t *TxStructure) encodeZSetDataKey(key []byte, member []byte) kv.Key {
+	ek := make([]byte, 0, len(t.prefix)+len(key)+len(member)+30)
+	ek = append(ek, t.prefix...)
+	ek = codec.EncodeBytes(ek, key)
+	ek = codec.EncodeUint(ek, uint64(ZSetData))
+	return codec.EncodeBytes(ek, member)
+}
+
+func (t *TxStructure) decodeZSetDataKey(ek kv.Key) ([]byte, error) {
+	prefix := t.prefix
+	if !bytes.HasPrefix(ek, prefix) {
+		return nil, errors.New("invalid encoded zset data key prefix")
+	}
+
+	ek, _, err := codec.DecodeBytes(ek[len(prefix):])
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	ek, tp, err := codec.DecodeUint(ek)
+	if err != nil {
+		return nil, errors.Trace(err)
+	} else if TypeFlag(tp) != ZSetData {
+		return nil, errInvalidHashKeyFlag.Gen("invalid encoded zset data key flag %c", byte(tp))
+	}
+
+	_, member, err := codec.DecodeBytes(ek)
+	return member, errors.Trace(err)
+}
+
+func (t *TxStructure) zsetIndexKeyPrefix(key []byte) kv.Key {
+	ek := make([]byte, 0, len(t.prefix)+len(key)+24)
+	ek = append(ek, t.prefix...)
+	ek = codec.EncodeBytes(ek, key)
+	return codec.EncodeUint(ek, uint64(indexCode))
+}
+
+func (t *TxStructure) encodeZSetScoreKey(key []byte, score float64) kv.Key {
+	return codec.EncodeFloat(t.zsetIndexKeyPrefix(key), score)
+}
+
+func (t *TxStructure) encodeZSetIndexKey(key []byte, score float64, member []byte) kv.Key {
+	return codec.EncodeBytes(t.encodeZSetScoreKey(key, score), member)
+}
+
+func (t *TxStructure) decodeZSetIndexKey(key []byte, ek kv.Key) (float64, []byte, error) {
+	prefix := t.zsetIndexKeyPrefix(key)
+	if !ek.HasPrefix(prefix) {
+		return 0, nil, errors.New("invalid encoded zset index key prefix")
+	}
+
+	ek, score, err := codec.DecodeFloat(ek[len(prefix):])
+	if err != nil {
+		return 0, nil, errors.Trace(err)
+	}
+
+	_, member, err := codec.DecodeBytes(ek)
+	return score, member, errors.Trace(err)
+}
+
+func (t *TxStructure) bitmapChunkKeyPrefix(key []byte) kv.Key {
+	ek := make([]byte, 0, len(t.prefix)+len(key)+24)
+	ek = append(ek, t.prefix...)
+	ek = codec.EncodeBytes(ek, key)
+	return codec.EncodeUint(ek, uint64(chunkCode))
+}
+
+func (t *TxStructure) encodeBitmapChunkKey(key []byte, index int64) kv.Key {
+	ek := make([]byte, 0, len(t.prefix)+len(key)+36)
+	ek = append(ek, t.prefix...)
+	ek = codec.EncodeBytes(ek, key)
+	ek = codec.EncodeUint(ek, uint64(chunkCode))
+	return codec.EncodeInt(ek, index)
+}
+
+func (t *TxStructure) decodeBitmapChunkKey(key []byte, ek kv.Key) (int64, error) {
+	prefix := t.bitmapChunkKeyPrefix(key)
+	if !ek.HasPrefix(prefix) {
+		return 0, errors.New("invalid encoded bitmap chunk key prefix")
+	}
+
+	_, index, err := codec.DecodeInt(ek[len(prefix):])
+	return index, errors.Trace(err)
+}
+
+func (t *TxStructure) encodeHLLDataKey(key []byte) kv.Key {
+	ek := make([]byte, 0, len(t.prefix)+len(key)+24)
+	ek = append(ek, t.prefix...)
+	ek = codec.EncodeBytes(ek, key)
+	return codec.EncodeUint(ek, uint64(HLLData))
+}
+
+// keyPrefix is the common prefix of the meta key and all the data keys of
+// key.
+func (t *TxStructure) keyPrefix(key []byte) kv.Key {
+	ek := make([]byte, 0, len(t.prefix)+len(key)+16)
+	ek = append(ek, t.prefix...)
+	return codec.EncodeBytes(ek, key)
+}
+
+// decodeKey gets the user key and the type code of an encoded meta or data
+// key.
+func (t *TxStructure) decodeKey(ek kv.Key) ([]byte, TypeFlag, error) {
+	if !ek.HasPrefix(t.prefix) {
+		return nil, 0, errors.New("invalid encoded key prefix")
+	}
+
+	ek, key, err := codec.DecodeBytes(ek[len(t.prefix):])
+	if err != nil {
+		return nil, 0, errors.Trace(err)
+	}
+	_, code, err := codec.DecodeUint(ek)
+	return key, TypeFlag(code), errors.Trace(err)
+}
@@ -0,0 +1,140 @@
+package structure
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"github.com/juju/errors"
+	"github.com/pingcap/tidb/kv"
+	"github.com/pingcap/tidb/util/codec"
+)
+
+// waiterPrefix leads the queues of the clients blocked on a list, one queue
+// per key shared by all the proxies. An entry is waiterPrefix, keyPrefix(key),
+// seq and the id of the client, its value the unix time in milliseconds its
+// lease runs out. seq is the start timestamp of the transaction that queued
+// the client, so a queue is in the order the clients came in on every proxy.
+var waiterPrefix = []byte{SystemPrefix, 'b'}
+
+// WaiterIDLen is the length of the id of a queued client.
+const WaiterIDLen = 24
+
+var errWaiterSeq = errors.New("waiter queued outside a transaction")
+
+func (t *TxStructure) waiterQueuePrefix(key []byte) kv.Key {
+	return append(append(kv.Key{}, waiterPrefix...), t.keyPrefix(key)...)
+}
+
+func (t *TxStructure) waiterKey(key []byte, seq uint64, id []byte) kv.Key {
+	return append(codec.EncodeUint(t.waiterQueuePrefix(key), seq), id...)
+}
+
+// startTS gets the start timestamp of the transaction of t, 0 if t does not
+// write to a transaction.
+func (t *TxStructure) startTS() uint64 {
+	if c, ok := t.readWriter.(*countingMutator); ok {
+		return c.stamp
+	}
+	return 0
+}
+
+// EnqueueWaiter queues the client id at the end of the queues of keys, with
+// a lease that runs out at until. It returns the seq of the entries, which
+// is needed to renew and remove them.
+func (t *TxStructure) EnqueueWaiter(keys [][]byte, id []byte, until int64) (uint64, error) {
+	if t.readWriter == nil {
+		return 0, errWriteOnSnapshot
+	}
+	seq := t.startTS()
+	if seq == 0 {
+		return 0, errors.Trace(errWaiterSeq)
+	}
+	return seq, errors.Trace(t.RenewWaiter(keys, seq, id, until))
+}
+
+// RenewWaiter moves the end of the lease of the entries of a client to until.
+func (t *TxStructure) RenewWaiter(keys [][]byte, seq uint64, id []byte, until int64) error {
+	if t.readWriter == nil {
+		return errWriteOnSnapshot
+	}
+	v := make([]byte, 8)
+	binary.BigEndian.PutUint64(v, uint64(until))
+	rm := t.rawMutator()
+	for _, key := range keys {
+		if err := rm.Set(t.waiterKey(key, seq, id), v); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
+
+// DequeueWaiter removes a client from the queues of keys.
+func (t *TxStructure) DequeueWaiter(keys [][]byte, seq uint64, id []byte) error {
+	if t.readWriter == nil {
+		return errWriteOnSnapshot
+	}
+	rm := t.rawMutator()
+	for _, key := range keys {
+		if err := rm.Delete(t.waiterKey(key, seq, id)); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
+
+// WaiterHead gets the id of the first client in the queue of key whose lease
+// has not run out at now, nil if there is none. With a readWriter the
+// entries of the clients whose lease ran out are dropped on the way.
+func (t *TxStructure) WaiterHead(key []byte, now int64) ([]byte, error) {
+	prefix := t.waiterQueuePrefix(key)
+	it, err := t.reader.Seek(prefix)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer it.Close()
+
+	var stale []kv.Key
+	var head []byte
+	for it.Valid() && it.Key().HasPrefix(prefix) {
+		ek, v := it.Key(), it.Value()
+		if len(ek) == len(prefix)+8+WaiterIDLen && len(v) == 8 && int64(binary.BigEndian.Uint64(v)) > now {
+			head = append([]byte{}, ek[len(prefix)+8:]...)
+			break
+		}
+		stale = append(stale, ek.Clone())
+		if err = it.Next(); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+
+	if t.readWriter != nil {
+		rm := t.rawMutator()
+		for _, ek := range stale {
+			if err = rm.Delete(ek); err != nil {
+				return nil, errors.Trace(err)
+			}
+		}
+	}
+	return head, nil
+}
+
+// IsWaiterHead reports whether id may pop from key at now, which it may if
+// it is the first client in the queue of key or the queue is empty.
+func (t *TxStructure) IsWaiterHead(key []byte, id []byte, now int64) (bool, error) {
+	head, err := t.WaiterHead(key, now)
+	if err != nil {
+		return false, errors.Trace(err)
+	}
+	return head == nil || bytes.Equal(head, id), nil
+}
+
+// IsListMeta reports whether the meta value mv, as read from the store,
+// holds a list with elements that has not expired.
+func IsListMeta(mv []byte) bool {
+	mv = stripMetaStamp(mv)
+	if len(mv) != 25 {
+		return false
+	}
+	flag, expireAt, n := DecodeMetaValue(mv)
+	return flag == ListData && n > 0 && !isExpired(expireAt)
+}
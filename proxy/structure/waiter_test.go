@@ -0,0 +1,106 @@
+package structure
+
+import (
+	"bytes"
+
+	. "github.com/pingcap/check"
+	"github.com/pingcap/tidb/kv"
+	"github.com/pingcap/tidb/util/testleak"
+)
+
+func (s *testTxStructureSuite) TestWaiterQueue(c *C) {
+	defer testleak.AfterTest(c)()
+	prefix := []byte{0x00}
+	a := bytes.Repeat([]byte{'a'}, WaiterIDLen)
+	b := bytes.Repeat([]byte{'b'}, WaiterIDLen)
+	keys := [][]byte{[]byte("q"), []byte("r")}
+	run := func(fn func(tx *TxStructure) error) {
+		err := kv.RunInNewTxn(s.store, false, func(txn kv.Transaction) error {
+			return fn(NewStructure(txn, txn, prefix))
+		})
+		c.Assert(err, IsNil)
+	}
+	head := func(key string, now int64) []byte {
+		snap, err := s.store.GetSnapshot(kv.MaxVersion)
+		c.Assert(err, IsNil)
+		h, err := NewStructure(snap, nil, prefix).WaiterHead([]byte(key), now)
+		c.Assert(err, IsNil)
+		return h
+	}
+
+	c.Assert(head("q", 0), IsNil)
+	var seqA, seqB uint64
+	run(func(tx *TxStructure) error {
+		var err error
+		seqA, err = tx.EnqueueWaiter(keys, a, 1000)
+		return err
+	})
+	// b comes later on q only, with a longer lease.
+	run(func(tx *TxStructure) error {
+		var err error
+		seqB, err = tx.EnqueueWaiter(keys[:1], b, 2000)
+		return err
+	})
+	c.Assert(seqB > seqA, IsTrue)
+	c.Assert(head("q", 500), DeepEquals, a)
+	c.Assert(head("r", 500), DeepEquals, a)
+	run(func(tx *TxStructure) error {
+		ok, err := tx.IsWaiterHead([]byte("q"), b, 500)
+		c.Assert(ok, IsFalse)
+		return err
+	})
+
+	// a stops renewing its lease, b gets its turn and the entries of a are
+	// dropped by the next writer that reads the queue.
+	c.Assert(head("q", 1500), DeepEquals, b)
+	c.Assert(head("r", 1500), IsNil)
+	run(func(tx *TxStructure) error {
+		ok, err := tx.IsWaiterHead([]byte("q"), b, 1500)
+		c.Assert(ok, IsTrue)
+		return err
+	})
+	c.Assert(head("q", 500), DeepEquals, b)
+
+	run(func(tx *TxStructure) error {
+		if err := tx.RenewWaiter(keys[:1], seqB, b, 3000); err != nil {
+			return err
+		}
+		return tx.DequeueWaiter(keys[1:], seqA, a)
+	})
+	c.Assert(head("q", 2500), DeepEquals, b)
+	c.Assert(head("r", 0), IsNil)
+	run(func(tx *TxStructure) error {
+		return tx.DequeueWaiter(keys[:1], seqB, b)
+	})
+	c.Assert(head("q", 0), IsNil)
+
+	snap, err := s.store.GetSnapshot(kv.MaxVersion)
+	c.Assert(err, IsNil)
+	c.Assert(countKeys(c, snap, waiterPrefix), Equals, 0)
+}
+
+func (s *testTxStructureSuite) TestIsListMeta(c *C) {
+	defer testleak.AfterTest(c)()
+	txn, err := s.store.Begin()
+	c.Assert(err, IsNil)
+	defer txn.Rollback()
+
+	tx := NewStructure(txn, txn, []byte{0x00})
+	c.Assert(tx.RPush([]byte("l"), []byte("a")), IsNil)
+	_, err = tx.Set([]byte("s"), []byte("v"))
+	c.Assert(err, IsNil)
+
+	snap, err := s.store.GetSnapshot(kv.MaxVersion)
+	c.Assert(err, IsNil)
+	metas, err := snap.BatchGet([]kv.Key{tx.EncodeMetaKey([]byte("l"))})
+	c.Assert(err, IsNil)
+	c.Assert(metas, HasLen, 0)
+	// The meta read back from the transaction carries its stamp.
+	mv, err := txn.Get(tx.EncodeMetaKey([]byte("l")))
+	c.Assert(err, IsNil)
+	c.Assert(IsListMeta(mv), IsTrue)
+	mv, err = txn.Get(tx.EncodeMetaKey([]byte("s")))
+	c.Assert(err, IsNil)
+	c.Assert(IsListMeta(mv), IsFalse)
+	c.Assert(IsListMeta(nil), IsFalse)
+}
@@ -0,0 +1,567 @@
+package structure
+
+import (
+	"bytes"
+	"math"
+
+	"github.com/juju/errors"
+	"github.com/pingcap/tidb/kv"
+	"github.com/pingcap/tidb/terror"
+	"github.com/pingcap/tidb/util/codec"
+)
+
+func init() {
+	registerType(ZSetData, &keyType{
+		clear: (*TxStructure).ZClear,
+		copy:  (*TxStructure).copyKeyData,
+	})
+}
+
+// ZSetPair is the pair for (member, score) in a zset.
+type ZSetPair struct {
+	Member []byte
+	Score  float64
+}
+
+// ZScoreBound is one end of a score range, the infinities are plain
+// math.Inf values.
+type ZScoreBound struct {
+	Score     float64
+	Exclusive bool
+}
+
+// flags for ZAdd.
+const (
+	// ZAddNX only adds new members.
+	ZAddNX = 1 << iota
+	// ZAddXX only updates existing members.
+	ZAddXX
+	// ZAddGT only updates a member when the new score is greater.
+	ZAddGT
+	// ZAddLT only updates a member when the new score is less.
+	ZAddLT
+	// ZAddCH counts changed members as well as added ones.
+	ZAddCH
+)
+
+var errZSetNaN = errors.New("resulting score is not a number (NaN)")
+
+type zsetMeta struct {
+	ExpireAt int64
+	Count    int64
+}
+
+func (meta zsetMeta) Value() []byte {
+	return EncodeZSetMetaValue(meta.ExpireAt, meta.Count)
+}
+
+func (meta zsetMeta) IsEmpty() bool {
+	return meta.Count <= 0
+}
+
+// ZAdd adds members to a zset or updates their scores, flags is a mask of
+// the ZAdd* flags. It returns the number of added members, or of added and
+// changed members with ZAddCH.
+func (t *TxStructure) ZAdd(key []byte, flags int, pairs []*ZSetPair) (int, error) {
+	if t.readWriter == nil {
+		return 0, errWriteOnSnapshot
+	}
+	if err := t.expireIfNeeded(key); err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	metaKey := t.EncodeMetaKey(key)
+	meta, err := t.loadZSetMeta(metaKey)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	added, changed := 0, 0
+	for _, p := range pairs {
+		if math.IsNaN(p.Score) {
+			return 0, errors.Trace(errZSetNaN)
+		}
+
+		old, exists, err := t.zsetScore(key, p.Member)
+		if err != nil {
+			return 0, errors.Trace(err)
+		}
+
+		if exists {
+			if flags&ZAddNX != 0 || old == p.Score ||
+				(flags&ZAddGT != 0 && p.Score <= old) ||
+				(flags&ZAddLT != 0 && p.Score >= old) {
+				continue
+			}
+			if err = t.zsetSetScore(key, p.Member, &old, p.Score); err != nil {
+				return 0, errors.Trace(err)
+			}
+			changed++
+			continue
+		}
+
+		if flags&ZAddXX != 0 {
+			continue
+		}
+		if err = t.zsetSetScore(key, p.Member, nil, p.Score); err != nil {
+			return 0, errors.Trace(err)
+		}
+		added++
+	}
+
+	if added > 0 {
+		meta.Count += int64(added)
+		if err = t.readWriter.Set(metaKey, meta.Value()); err != nil {
+			return 0, errors.Trace(err)
+		}
+	}
+
+	if flags&ZAddCH != 0 {
+		return added + changed, nil
+	}
+	return added, nil
+}
+
+// ZIncrBy increments the score of member by delta, a missing member is added
+// with delta as its score. It returns the new score.
+func (t *TxStructure) ZIncrBy(key []byte, member []byte, delta float64) (float64, error) {
+	if t.readWriter == nil {
+		return 0, errWriteOnSnapshot
+	}
+	if err := t.expireIfNeeded(key); err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	metaKey := t.EncodeMetaKey(key)
+	meta, err := t.loadZSetMeta(metaKey)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	old, exists, err := t.zsetScore(key, member)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	score := old + delta
+	if math.IsNaN(score) {
+		return 0, errors.Trace(errZSetNaN)
+	}
+
+	if exists {
+		return score, errors.Trace(t.zsetSetScore(key, member, &old, score))
+	}
+
+	if err = t.zsetSetScore(key, member, nil, score); err != nil {
+		return 0, errors.Trace(err)
+	}
+	meta.Count++
+	return score, errors.Trace(t.readWriter.Set(metaKey, meta.Value()))
+}
+
+// ZRem removes members from a zset, it returns the number of removed members.
+func (t *TxStructure) ZRem(key []byte, members [][]byte) (int, error) {
+	if t.readWriter == nil {
+		return 0, errWriteOnSnapshot
+	}
+	if err := t.expireIfNeeded(key); err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	metaKey := t.EncodeMetaKey(key)
+	meta, err := t.loadZSetMeta(metaKey)
+	if err != nil || meta.IsEmpty() {
+		return 0, errors.Trace(err)
+	}
+
+	res := 0
+	for _, member := range members {
+		score, exists, err := t.zsetScore(key, member)
+		if err != nil {
+			return 0, errors.Trace(err)
+		}
+		if !exists {
+			continue
+		}
+
+		if err = t.readWriter.Delete(t.encodeZSetDataKey(key, member)); err != nil {
+			return 0, errors.Trace(err)
+		}
+		if err = t.readWriter.Delete(t.encodeZSetIndexKey(key, score, member)); err != nil {
+			return 0, errors.Trace(err)
+		}
+		res++
+		meta.Count--
+	}
+
+	if res == 0 {
+		return 0, nil
+	}
+
+	if meta.IsEmpty() {
+		if err = t.clearExpire(key); err != nil {
+			return 0, errors.Trace(err)
+		}
+		err = t.readWriter.Delete(metaKey)
+	} else {
+		err = t.readWriter.Set(metaKey, meta.Value())
+	}
+	return res, errors.Trace(err)
+}
+
+// ZScore gets the score of member, the bool result reports whether the
+// member exists.
+func (t *TxStructure) ZScore(key []byte, member []byte) (float64, bool, error) {
+	if exists, err := t.zsetExists(key); err != nil || !exists {
+		return 0, false, errors.Trace(err)
+	}
+	return t.zsetScore(key, member)
+}
+
+// ZCard gets the number of members in a zset.
+func (t *TxStructure) ZCard(key []byte) (int64, error) {
+	if mv, err := t.loadMeta(key); err != nil || mv == nil {
+		return 0, errors.Trace(err)
+	}
+	meta, err := t.loadZSetMeta(t.EncodeMetaKey(key))
+	return meta.Count, errors.Trace(err)
+}
+
+// ZRank gets the rank of member ordered by score, from the highest score if
+// reverse is set. It returns -1 if the member does not exist.
+func (t *TxStructure) ZRank(key []byte, member []byte, reverse bool) (int64, error) {
+	score, exists, err := t.ZScore(key, member)
+	if err != nil || !exists {
+		return -1, errors.Trace(err)
+	}
+	card, err := t.ZCard(key)
+	if err != nil {
+		return -1, errors.Trace(err)
+	}
+
+	rank, err := t.zsetIndexRank(t.zsetIndexKeyPrefix(key), t.encodeZSetIndexKey(key, score, member), card)
+	if err != nil {
+		return -1, errors.Trace(err)
+	}
+	if reverse {
+		rank = card - 1 - rank
+	}
+	return rank, nil
+}
+
+// ZRange gets the members ranked from start to stop, both inclusive, negative
+// positions count from the end. reverse orders the zset from the highest score.
+func (t *TxStructure) ZRange(key []byte, start int64, stop int64, reverse bool) ([]ZSetPair, error) {
+	count, err := t.ZCard(key)
+	if err != nil || count == 0 {
+		return nil, errors.Trace(err)
+	}
+
+	if start < 0 {
+		start += count
+	}
+	if stop < 0 {
+		stop += count
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= count {
+		stop = count - 1
+	}
+	if start > stop {
+		return nil, nil
+	}
+	if reverse {
+		// The ranks from the highest score are the ranks from the lowest one
+		// counted from the end, read them forward and turn the result over.
+		start, stop = count-1-stop, count-1-start
+	}
+
+	prefix := t.zsetIndexKeyPrefix(key)
+	res, err := t.zsetCollect(key, prefix, prefix.PrefixNext(), false, start, stop-start+1)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if reverse {
+		for i, j := 0, len(res)-1; i < j; i, j = i+1, j-1 {
+			res[i], res[j] = res[j], res[i]
+		}
+	}
+	return res, nil
+}
+
+// ZRangeByScore gets the members whose score is between min and max. It skips
+// the first offset members and returns at most count of them, a negative
+// count means no limit.
+func (t *TxStructure) ZRangeByScore(key []byte, min ZScoreBound, max ZScoreBound, reverse bool, offset int64, count int64) ([]ZSetPair, error) {
+	if exists, err := t.zsetExists(key); err != nil || !exists {
+		return nil, errors.Trace(err)
+	}
+
+	lower := t.encodeZSetScoreKey(key, min.Score)
+	if min.Exclusive {
+		lower = lower.PrefixNext()
+	}
+	upper := t.encodeZSetScoreKey(key, max.Score)
+	if !max.Exclusive {
+		upper = upper.PrefixNext()
+	}
+	if bytes.Compare(lower, upper) >= 0 {
+		return nil, nil
+	}
+
+	return t.zsetCollect(key, lower, upper, reverse, offset, count)
+}
+
+// ZClear removes the zset of the key.
+func (t *TxStructure) ZClear(key []byte) error {
+	if t.readWriter == nil {
+		return errWriteOnSnapshot
+	}
+	if err := t.clearExpire(key); err != nil {
+		return errors.Trace(err)
+	}
+
+	var keys []kv.Key
+	for _, prefix := range []kv.Key{t.zsetDataKeyPrefix(key), t.zsetIndexKeyPrefix(key)} {
+		it, err := t.reader.Seek(prefix)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		for it.Valid() && it.Key().HasPrefix(prefix) {
+			keys = append(keys, it.Key().Clone())
+			if err = it.Next(); err != nil {
+				it.Close()
+				return errors.Trace(err)
+			}
+		}
+		it.Close()
+	}
+
+	for _, k := range keys {
+		if err := t.readWriter.Delete(k); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return errors.Trace(t.readWriter.Delete(t.EncodeMetaKey(key)))
+}
+
+// zsetCollect gets the members whose index keys are in [lower, upper), it
+// skips offset members and returns at most count of them.
+func (t *TxStructure) zsetCollect(key []byte, lower kv.Key, upper kv.Key, reverse bool, offset int64, count int64) ([]ZSetPair, error) {
+	if count == 0 {
+		return nil, nil
+	}
+	// Only the first offset+count keys of the range are read, the buffer of
+	// a reverse iteration needs no more than that.
+	limit := int64(-1)
+	if count > 0 && offset <= math.MaxInt64-count {
+		limit = offset + count
+	}
+
+	var res []ZSetPair
+	err := t.iterateZSetIndex(lower, upper, reverse, limit, func(ek kv.Key) (bool, error) {
+		if count >= 0 && int64(len(res)) >= count {
+			return false, nil
+		}
+		if offset > 0 {
+			offset--
+			return true, nil
+		}
+
+		score, member, err := t.decodeZSetIndexKey(key, ek)
+		if err != nil {
+			return false, errors.Trace(err)
+		}
+		res = append(res, ZSetPair{Member: member, Score: score})
+		return true, nil
+	})
+	return res, errors.Trace(err)
+}
+
+// zsetIndexRank counts the index keys under prefix before target, card is the
+// number of members. It walks forward from the first key to target and from
+// target to the last key by turns, so it reads only the shorter side.
+func (t *TxStructure) zsetIndexRank(prefix kv.Key, target kv.Key, card int64) (int64, error) {
+	before, err := t.reader.Seek(prefix)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	defer before.Close()
+	after, err := t.reader.Seek(target.Next())
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	defer after.Close()
+
+	upper := prefix.PrefixNext()
+	var lower, higher int64
+	for {
+		if !before.Valid() || bytes.Compare(before.Key(), target) >= 0 {
+			return lower, nil
+		}
+		lower++
+		if err = before.Next(); err != nil {
+			return 0, errors.Trace(err)
+		}
+
+		if !after.Valid() || bytes.Compare(after.Key(), upper) >= 0 {
+			return card - 1 - higher, nil
+		}
+		higher++
+		if err = after.Next(); err != nil {
+			return 0, errors.Trace(err)
+		}
+	}
+}
+
+// iterateZSetIndex calls fn with the index keys in [lower, upper) in score
+// order, or in reverse order, until fn returns false. limit is the most keys
+// fn asks for, a negative limit means all of them.
+func (t *TxStructure) iterateZSetIndex(lower kv.Key, upper kv.Key, reverse bool, limit int64, fn func(ek kv.Key) (bool, error)) error {
+	if !reverse {
+		it, err := t.reader.Seek(lower)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		defer it.Close()
+
+		for it.Valid() && bytes.Compare(it.Key(), upper) < 0 {
+			more, err := fn(it.Key())
+			if err != nil || !more {
+				return errors.Trace(err)
+			}
+			if err = it.Next(); err != nil {
+				return errors.Trace(err)
+			}
+		}
+		return nil
+	}
+
+	it, err := t.reader.SeekReverse(upper)
+	if terror.ErrorEqual(err, kv.ErrNotImplemented) {
+		// Some snapshots can not iterate backwards, buffer the range instead.
+		return errors.Trace(t.iterateZSetIndexBuffered(lower, upper, limit, fn))
+	}
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer it.Close()
+
+	for it.Valid() && bytes.Compare(it.Key(), lower) >= 0 {
+		more, err := fn(it.Key())
+		if err != nil || !more {
+			return errors.Trace(err)
+		}
+		if err = it.Next(); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
+
+// iterateZSetIndexBuffered reads the range forward and calls fn with the keys
+// in reverse order. With a limit it keeps only the last limit keys, in a ring.
+func (t *TxStructure) iterateZSetIndexBuffered(lower kv.Key, upper kv.Key, limit int64, fn func(ek kv.Key) (bool, error)) error {
+	if limit == 0 {
+		return nil
+	}
+	it, err := t.reader.Seek(lower)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	var keys []kv.Key
+	next := 0
+	for it.Valid() && bytes.Compare(it.Key(), upper) < 0 {
+		if limit < 0 || int64(len(keys)) < limit {
+			keys = append(keys, it.Key().Clone())
+		} else {
+			keys[next] = it.Key().Clone()
+			next = (next + 1) % len(keys)
+		}
+		if err = it.Next(); err != nil {
+			it.Close()
+			return errors.Trace(err)
+		}
+	}
+	it.Close()
+
+	// The newest key is the one before next.
+	for i := 1; i <= len(keys); i++ {
+		more, err := fn(keys[(next-i+len(keys))%len(keys)])
+		if err != nil || !more {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
+
+// zsetExists reports whether the key holds a zset that has not expired, a key
+// of another type is an error.
+func (t *TxStructure) zsetExists(key []byte) (bool, error) {
+	mv, err := t.loadMeta(key)
+	if err != nil || mv == nil {
+		return false, errors.Trace(err)
+	}
+	if flag, _, _ := DecodeMetaValue(mv); flag != ZSetData {
+		return false, errors.Trace(ErrSetType)
+	}
+	return true, nil
+}
+
+func (t *TxStructure) zsetScore(key []byte, member []byte) (float64, bool, error) {
+	v, err := t.reader.Get(t.encodeZSetDataKey(key, member))
+	if terror.ErrorEqual(err, kv.ErrNotExist) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, errors.Trace(err)
+	}
+
+	_, score, err := codec.DecodeFloat(v)
+	return score, true, errors.Trace(err)
+}
+
+// zsetSetScore writes the score of member, old is the current score of an
+// existing member whose index key must be replaced.
+func (t *TxStructure) zsetSetScore(key []byte, member []byte, old *float64, score float64) error {
+	if old != nil {
+		if err := t.readWriter.Delete(t.encodeZSetIndexKey(key, *old, member)); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	if err := t.readWriter.Set(t.encodeZSetDataKey(key, member), codec.EncodeFloat(nil, score)); err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(t.readWriter.Set(t.encodeZSetIndexKey(key, score, member), []byte{0}))
+}
+
+func (t *TxStructure) loadZSetMeta(metaKey []byte) (zsetMeta, error) {
+	v, err := t.reader.Get(metaKey)
+	if terror.ErrorEqual(err, kv.ErrNotExist) {
+		err = nil
+	} else if err != nil {
+		return zsetMeta{}, errors.Trace(err)
+	}
+
+	meta := zsetMeta{}
+	if v == nil {
+		return meta, nil
+	}
+
+	if len(v) != 17 {
+		return meta, errInvalidHashMeta
+	}
+
+	flag, expireAt, count := DecodeMetaValue(v)
+	if flag != ZSetData {
+		return meta, errors.Trace(ErrSetType)
+	}
+	meta.ExpireAt = expireAt
+	meta.Count = count
+
+	return meta, nil
+}
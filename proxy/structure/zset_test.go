@@ -0,0 +1,251 @@
+package structure
+
+import (
+	"math"
+
+	. "github.com/pingcap/check"
+	"github.com/pingcap/tidb/kv"
+	"github.com/pingcap/tidb/util/testleak"
+)
+
+// forwardOnly hides the reverse iteration of a retriever, as the snapshots
+// of tikv do.
+type forwardOnly struct {
+	kv.Retriever
+}
+
+func (r forwardOnly) SeekReverse(k kv.Key) (kv.Iterator, error) {
+	return nil, kv.ErrNotImplemented
+}
+
+func zsetMembers(pairs []ZSetPair) []string {
+	res := make([]string, 0, len(pairs))
+	for _, p := range pairs {
+		res = append(res, string(p.Member))
+	}
+	return res
+}
+
+func zsetPairs(args ...interface{}) []*ZSetPair {
+	var pairs []*ZSetPair
+	for i := 0; i < len(args); i += 2 {
+		pairs = append(pairs, &ZSetPair{Member: []byte(args[i].(string)), Score: args[i+1].(float64)})
+	}
+	return pairs
+}
+
+func (s *testTxStructureSuite) TestZSetScore(c *C) {
+	defer testleak.AfterTest(c)()
+	txn, err := s.store.Begin()
+	c.Assert(err, IsNil)
+	defer txn.Rollback()
+
+	tx := NewStructure(txn, txn, []byte{0x00})
+	key := []byte("z")
+	n, err := tx.ZAdd(key, 0, zsetPairs("a", 1.0, "b", 2.0, "c", 3.0))
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 3)
+
+	// A new score moves the index key with the data key.
+	n, err = tx.ZAdd(key, 0, zsetPairs("a", 4.0))
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 0)
+	score, ok, err := tx.ZScore(key, []byte("a"))
+	c.Assert(err, IsNil)
+	c.Assert(ok, IsTrue)
+	c.Assert(score, Equals, 4.0)
+	_, err = tx.ZIncrBy(key, []byte("b"), 10)
+	c.Assert(err, IsNil)
+	c.Assert(countKeys(c, txn, tx.zsetIndexKeyPrefix(key)), Equals, 3)
+	res, err := tx.ZRange(key, 0, -1, false)
+	c.Assert(err, IsNil)
+	c.Assert(res, DeepEquals, []ZSetPair{
+		{Member: []byte("c"), Score: 3},
+		{Member: []byte("a"), Score: 4},
+		{Member: []byte("b"), Score: 12},
+	})
+
+	_, ok, err = tx.ZScore(key, []byte("x"))
+	c.Assert(err, IsNil)
+	c.Assert(ok, IsFalse)
+
+	n, err = tx.ZRem(key, [][]byte{[]byte("a"), []byte("x")})
+	c.Assert(err, IsNil)
+	c.Assert(n, Equals, 1)
+	c.Assert(countKeys(c, txn, tx.zsetIndexKeyPrefix(key)), Equals, 2)
+	card, err := tx.ZCard(key)
+	c.Assert(err, IsNil)
+	c.Assert(card, Equals, int64(2))
+
+	_, err = tx.ZAdd(key, 0, zsetPairs("a", math.NaN()))
+	c.Assert(err, NotNil)
+}
+
+func (s *testTxStructureSuite) TestZSetAddFlags(c *C) {
+	defer testleak.AfterTest(c)()
+	txn, err := s.store.Begin()
+	c.Assert(err, IsNil)
+	defer txn.Rollback()
+
+	tx := NewStructure(txn, txn, []byte{0x00})
+	key := []byte("z")
+	_, err = tx.ZAdd(key, 0, zsetPairs("a", 1.0, "b", 2.0))
+	c.Assert(err, IsNil)
+
+	tbl := []struct {
+		flags int
+		pairs []*ZSetPair
+		res   int
+		a, b  float64
+	}{
+		{ZAddNX, zsetPairs("a", 5.0, "c", 3.0), 1, 1, 2},
+		{ZAddXX, zsetPairs("a", 5.0, "d", 3.0), 0, 5, 2},
+		{ZAddXX | ZAddCH, zsetPairs("a", 6.0, "b", 2.0), 1, 6, 2},
+		{ZAddGT | ZAddCH, zsetPairs("a", 1.0, "b", 7.0), 1, 6, 7},
+		{ZAddLT | ZAddCH, zsetPairs("a", 0.0, "b", 8.0, "e", 1.0), 2, 0, 7},
+	}
+	for _, t := range tbl {
+		n, err := tx.ZAdd(key, t.flags, t.pairs)
+		c.Assert(err, IsNil)
+		c.Assert(n, Equals, t.res)
+		a, _, err := tx.ZScore(key, []byte("a"))
+		c.Assert(err, IsNil)
+		c.Assert(a, Equals, t.a)
+		b, _, err := tx.ZScore(key, []byte("b"))
+		c.Assert(err, IsNil)
+		c.Assert(b, Equals, t.b)
+	}
+
+	res, err := tx.ZRange(key, 0, -1, false)
+	c.Assert(err, IsNil)
+	c.Assert(zsetMembers(res), DeepEquals, []string{"a", "e", "c", "b"})
+}
+
+func (s *testTxStructureSuite) TestZSetRange(c *C) {
+	defer testleak.AfterTest(c)()
+	txn, err := s.store.Begin()
+	c.Assert(err, IsNil)
+	defer txn.Rollback()
+
+	tx := NewStructure(txn, txn, []byte{0x00})
+	key := []byte("z")
+	_, err = tx.ZAdd(key, 0, zsetPairs("a", 1.0, "b", 2.0, "c", 3.0, "d", 4.0, "e", 5.0, "f", -1.0))
+	c.Assert(err, IsNil)
+
+	tbl := []struct {
+		start, stop int64
+		reverse     bool
+		res         []string
+	}{
+		{0, -1, false, []string{"f", "a", "b", "c", "d", "e"}},
+		{0, -1, true, []string{"e", "d", "c", "b", "a", "f"}},
+		{1, 2, false, []string{"a", "b"}},
+		{1, 2, true, []string{"d", "c"}},
+		{-2, -1, false, []string{"d", "e"}},
+		{-2, -1, true, []string{"a", "f"}},
+		{-100, 0, true, []string{"e"}},
+		{4, 100, true, []string{"a", "f"}},
+		{3, 2, false, []string{}},
+		{6, 10, true, []string{}},
+	}
+	for _, t := range tbl {
+		res, err := tx.ZRange(key, t.start, t.stop, t.reverse)
+		c.Assert(err, IsNil)
+		c.Assert(zsetMembers(res), DeepEquals, t.res, Commentf("%d %d %v", t.start, t.stop, t.reverse))
+	}
+
+	for i, m := range []string{"f", "a", "b", "c", "d", "e"} {
+		rank, err := tx.ZRank(key, []byte(m), false)
+		c.Assert(err, IsNil)
+		c.Assert(rank, Equals, int64(i))
+		rank, err = tx.ZRank(key, []byte(m), true)
+		c.Assert(err, IsNil)
+		c.Assert(rank, Equals, int64(5-i))
+	}
+	rank, err := tx.ZRank(key, []byte("x"), false)
+	c.Assert(err, IsNil)
+	c.Assert(rank, Equals, int64(-1))
+	rank, err = tx.ZRank([]byte("missing"), []byte("a"), true)
+	c.Assert(err, IsNil)
+	c.Assert(rank, Equals, int64(-1))
+}
+
+func (s *testTxStructureSuite) TestZSetRangeByScore(c *C) {
+	defer testleak.AfterTest(c)()
+	txn, err := s.store.Begin()
+	c.Assert(err, IsNil)
+	defer txn.Rollback()
+
+	key := []byte("z")
+	tx := NewStructure(txn, txn, []byte{0x00})
+	_, err = tx.ZAdd(key, 0, zsetPairs("a", 1.0, "b", 2.0, "c", 2.0, "d", 3.0, "e", 4.0))
+	c.Assert(err, IsNil)
+
+	inf := math.Inf(1)
+	tbl := []struct {
+		min, max      ZScoreBound
+		reverse       bool
+		offset, count int64
+		res           []string
+	}{
+		{ZScoreBound{Score: -inf}, ZScoreBound{Score: inf}, false, 0, -1, []string{"a", "b", "c", "d", "e"}},
+		{ZScoreBound{Score: -inf}, ZScoreBound{Score: inf}, true, 0, -1, []string{"e", "d", "c", "b", "a"}},
+		{ZScoreBound{Score: 2}, ZScoreBound{Score: 3}, false, 0, -1, []string{"b", "c", "d"}},
+		{ZScoreBound{Score: 2, Exclusive: true}, ZScoreBound{Score: 4}, false, 0, -1, []string{"d", "e"}},
+		{ZScoreBound{Score: 1}, ZScoreBound{Score: 3, Exclusive: true}, true, 0, -1, []string{"c", "b", "a"}},
+		{ZScoreBound{Score: 2, Exclusive: true}, ZScoreBound{Score: 2, Exclusive: true}, false, 0, -1, []string{}},
+		{ZScoreBound{Score: 3}, ZScoreBound{Score: 1}, false, 0, -1, []string{}},
+		{ZScoreBound{Score: -inf}, ZScoreBound{Score: inf}, false, 1, 2, []string{"b", "c"}},
+		{ZScoreBound{Score: -inf}, ZScoreBound{Score: inf}, true, 1, 2, []string{"d", "c"}},
+		{ZScoreBound{Score: -inf}, ZScoreBound{Score: inf}, true, 3, -1, []string{"b", "a"}},
+		{ZScoreBound{Score: -inf}, ZScoreBound{Score: inf}, true, 4, 10, []string{"a"}},
+		{ZScoreBound{Score: -inf}, ZScoreBound{Score: inf}, true, 5, 10, []string{}},
+		{ZScoreBound{Score: -inf}, ZScoreBound{Score: inf}, true, 0, 0, []string{}},
+		{ZScoreBound{Score: -inf}, ZScoreBound{Score: inf}, true, 1, math.MaxInt64, []string{"d", "c", "b", "a"}},
+	}
+	// The reverse ranges are read backwards from localstore, and buffered
+	// from a retriever that can not iterate backwards.
+	for _, reader := range []kv.Retriever{txn, forwardOnly{txn}} {
+		tx := NewStructure(reader, txn, []byte{0x00})
+		for _, t := range tbl {
+			res, err := tx.ZRangeByScore(key, t.min, t.max, t.reverse, t.offset, t.count)
+			c.Assert(err, IsNil)
+			c.Assert(zsetMembers(res), DeepEquals, t.res, Commentf("%v %v %v %d %d", t.min, t.max, t.reverse, t.offset, t.count))
+		}
+	}
+}
+
+func (s *testTxStructureSuite) TestZSetWrongType(c *C) {
+	defer testleak.AfterTest(c)()
+	txn, err := s.store.Begin()
+	c.Assert(err, IsNil)
+	defer txn.Rollback()
+
+	tx := NewStructure(txn, txn, []byte{0x00})
+	key := []byte("s")
+	_, err = tx.Set(key, []byte("v"))
+	c.Assert(err, IsNil)
+	hash := []byte("h")
+	_, err = tx.HSet(hash, []byte("f"), []byte("v"))
+	c.Assert(err, IsNil)
+
+	all := ZScoreBound{Score: math.Inf(1)}
+	for _, k := range [][]byte{key, hash} {
+		_, err = tx.ZAdd(k, 0, zsetPairs("a", 1.0))
+		c.Assert(IsWrongType(err), IsTrue)
+		_, _, err = tx.ZScore(k, []byte("a"))
+		c.Assert(IsWrongType(err), IsTrue)
+		_, err = tx.ZCard(k)
+		c.Assert(IsWrongType(err), IsTrue)
+		_, err = tx.ZRank(k, []byte("a"), false)
+		c.Assert(IsWrongType(err), IsTrue)
+		_, err = tx.ZRank(k, []byte("a"), true)
+		c.Assert(IsWrongType(err), IsTrue)
+		_, err = tx.ZRange(k, 0, -1, true)
+		c.Assert(IsWrongType(err), IsTrue)
+		_, err = tx.ZRangeByScore(k, ZScoreBound{Score: math.Inf(-1)}, all, false, 0, -1)
+		c.Assert(IsWrongType(err), IsTrue)
+		_, err = tx.ZRem(k, [][]byte{[]byte("a")})
+		c.Assert(IsWrongType(err), IsTrue)
+	}
+}
@@ -0,0 +1,33 @@
+package util
+
+import (
+	"math"
+	"strconv"
+	"strings"
+)
+
+// FormatFloat formats f the way redis does. Replies hold the shortest form
+// that reads back as f, like "%.17g": plain notation while f has at most 17
+// integral digits, so 1000000 and millisecond timestamps keep all their
+// digits, and exponent notation beyond. The values INCRBYFLOAT stores are in
+// plain notation whatever their size, which plain asks for.
+func FormatFloat(f float64, plain bool) []byte {
+	switch {
+	case math.IsInf(f, 1):
+		return []byte("inf")
+	case math.IsInf(f, -1):
+		return []byte("-inf")
+	case math.IsNaN(f):
+		return []byte("nan")
+	}
+	if plain {
+		return []byte(strconv.FormatFloat(f, 'f', -1, 64))
+	}
+
+	e := strconv.FormatFloat(f, 'e', -1, 64)
+	exp, _ := strconv.Atoi(e[strings.LastIndexByte(e, 'e')+1:])
+	if exp < -4 || exp >= 17 {
+		return []byte(e)
+	}
+	return []byte(strconv.FormatFloat(f, 'f', -1, 64))
+}
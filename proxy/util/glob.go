@@ -0,0 +1,91 @@
+package util
+
+// GlobMatch reports whether s matches the redis style glob pattern, which
+// supports '*', '?', character classes like [a-z] or [^abc], and '\' to
+// escape the next character.
+func GlobMatch(pattern []byte, s []byte) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 1 && pattern[1] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 1 {
+				return true
+			}
+			for i := 0; i <= len(s); i++ {
+				if GlobMatch(pattern[1:], s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+			s = s[1:]
+		case '[':
+			if len(s) == 0 {
+				return false
+			}
+			var ok bool
+			if pattern, ok = matchClass(pattern[1:], s[0]); !ok {
+				return false
+			}
+			s = s[1:]
+			continue
+		case '\\':
+			if len(pattern) >= 2 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if len(s) == 0 || pattern[0] != s[0] {
+				return false
+			}
+			s = s[1:]
+		}
+		pattern = pattern[1:]
+	}
+	return len(s) == 0
+}
+
+// matchClass matches c against the character class at the head of pattern,
+// right after its '['. It returns the pattern left after the class.
+func matchClass(pattern []byte, c byte) ([]byte, bool) {
+	not := len(pattern) > 0 && pattern[0] == '^'
+	if not {
+		pattern = pattern[1:]
+	}
+
+	match := false
+	for len(pattern) > 0 && pattern[0] != ']' {
+		switch {
+		case pattern[0] == '\\' && len(pattern) >= 2:
+			pattern = pattern[1:]
+			if pattern[0] == c {
+				match = true
+			}
+		case len(pattern) >= 3 && pattern[1] == '-':
+			start, end := pattern[0], pattern[2]
+			if start > end {
+				start, end = end, start
+			}
+			if c >= start && c <= end {
+				match = true
+			}
+			pattern = pattern[2:]
+		default:
+			if pattern[0] == c {
+				match = true
+			}
+		}
+		pattern = pattern[1:]
+	}
+	if len(pattern) > 0 {
+		// skip the closing ']'
+		pattern = pattern[1:]
+	}
+
+	return pattern, match != not
+}